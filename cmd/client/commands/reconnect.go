@@ -0,0 +1,273 @@
+package commands
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+
+	prot "github.com/dylanmccormick/ws-chat/internal/protocol"
+	"github.com/gorilla/websocket"
+)
+
+// Backoff is how long to wait between reconnect attempts. Each wait doubles up to Max, and a random part of it is
+// taken off so clients that dropped together don't all come back at once
+type Backoff struct {
+	Min time.Duration
+	Max time.Duration
+
+	attempt int
+}
+
+// Next is the wait before the next attempt
+func (b *Backoff) Next() time.Duration {
+	d := b.Min << b.attempt
+	if d <= 0 || d > b.Max {
+		d = b.Max
+	} else {
+		b.attempt++
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+// Reset starts the waits from Min again once a connection works
+func (b *Backoff) Reset() {
+	b.attempt = 0
+}
+
+// maxReconnectAttempts is how many times Conn tries to get back before it gives up
+const maxReconnectAttempts = 10
+
+// Conn is a connection that reconnects when it drops and resumes the session it had. Reads and writes can come from
+// different goroutines as long as there is only one of each, like a plain websocket
+type Conn struct {
+	opts    LoginOptions
+	Backoff Backoff
+	Notify  func(string) // told when the connection drops. Coming back shows up as a welcome from ReadMessage
+
+	mu           sync.Mutex
+	changed      *sync.Cond // broadcast when a reconnect finishes or the connection is closed
+	reconnecting bool
+	done         chan struct{} // closed by Close to stop a reconnect waiting for its next try
+	conn         *websocket.Conn
+	gen          int // bumped on every reconnect so a second caller with the same error doesn't reconnect again
+	err          error
+	username     string
+	session      string
+	lastSeq      map[string]uint64
+	welcome      []byte // the welcome from the last reconnect, for the reader to hand on
+}
+
+// NewConn wraps a connection that has already been through the handshake
+func NewConn(c *websocket.Conn, opts LoginOptions, welcome prot.WelcomeMessage) *Conn {
+	conn := &Conn{
+		opts:     opts,
+		Backoff:  Backoff{Min: 500 * time.Millisecond, Max: 30 * time.Second},
+		Notify:   func(string) {},
+		done:     make(chan struct{}),
+		conn:     c,
+		username: welcome.Username,
+		session:  welcome.Session,
+		lastSeq:  map[string]uint64{},
+	}
+	conn.changed = sync.NewCond(&conn.mu)
+	return conn
+}
+
+func (c *Conn) current() (*websocket.Conn, int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn, c.gen, c.err
+}
+
+// ReadMessage reads the next message. After a reconnect the next message is the new welcome
+func (c *Conn) ReadMessage() (int, []byte, error) {
+	for {
+		c.mu.Lock()
+		welcome := c.welcome
+		c.welcome = nil
+		c.mu.Unlock()
+		if welcome != nil {
+			return websocket.TextMessage, welcome, nil
+		}
+		conn, gen, err := c.current()
+		if err != nil {
+			return 0, nil, err
+		}
+		typ, data, err := conn.ReadMessage()
+		if err == nil {
+			c.track(data)
+			return typ, data, nil
+		}
+		if err := c.reconnect(gen, err); err != nil {
+			return 0, nil, err
+		}
+	}
+}
+
+// WriteMessage writes data, reconnecting and trying once more if the connection is gone
+func (c *Conn) WriteMessage(typ int, data []byte) error {
+	conn, gen, err := c.current()
+	if err != nil {
+		return err
+	}
+	if err := conn.WriteMessage(typ, data); err == nil {
+		return nil
+	} else if err := c.reconnect(gen, err); err != nil {
+		return err
+	}
+	conn, _, err = c.current()
+	if err != nil {
+		return err
+	}
+	return conn.WriteMessage(typ, data)
+}
+
+// Close closes the connection for good
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		c.err = net.ErrClosed
+		close(c.done)
+		c.changed.Broadcast()
+	}
+	return c.conn.Close()
+}
+
+// track keeps the newest seq seen in each room and the username after a rename so a reconnect can ask for the rest
+func (c *Conn) track(data []byte) {
+	var msg prot.Message
+	if err := msg.UnmarshalJSON(data); err != nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch body := msg.Body.(type) {
+	case prot.ChatMessage:
+		c.seen(body.Target, msg.Seq)
+	case prot.AnnouncementMessage:
+		c.seen(body.Target, msg.Seq)
+	case prot.MembershipMessage:
+		if body.Event == prot.MembershipRenamed && body.OldUsername == c.username {
+			c.username = body.Username
+		}
+	case prot.CommandMessage:
+		if body.Action != "History" {
+			return
+		}
+		messages := []prot.Message{}
+		if err := json.Unmarshal(body.Data, &messages); err != nil {
+			return
+		}
+		for _, m := range messages {
+			c.seen(body.Target, m.Seq)
+		}
+	}
+}
+
+func (c *Conn) seen(room string, seq uint64) {
+	if seq > 0 {
+		c.lastSeq[room] = max(c.lastSeq[room], seq)
+	}
+}
+
+// reconnect dials until the server takes the session back or a new one, backing off between tries. A connection the
+// server closed on purpose stays closed. gen is the
+// connection cause came from. If someone else has already replaced it there is nothing to do, and if someone else is
+// replacing it this waits for them. The lock is only held to look at and swap the connection, never while sleeping,
+// dialing or notifying, so Close and whoever is behind Notify are never stuck behind a reconnect
+func (c *Conn) reconnect(gen int, cause error) error {
+	c.mu.Lock()
+	for c.reconnecting && c.err == nil && gen == c.gen {
+		c.changed.Wait()
+	}
+	if c.err != nil || gen != c.gen {
+		defer c.mu.Unlock()
+		return c.err
+	}
+	if serverClosed(cause) {
+		defer c.mu.Unlock()
+		c.conn.Close()
+		c.err = cause
+		return c.err
+	}
+	c.reconnecting = true
+	c.conn.Close()
+	hello := prot.HelloMessage{
+		Username: c.username,
+		Password: c.opts.Password,
+		Session:  c.session,
+		LastSeq:  maps.Clone(c.lastSeq),
+	}
+	c.mu.Unlock()
+
+	c.Notify(fmt.Sprintf("Connection lost: %s. Reconnecting...", cause))
+	conn, welcome, err := c.redial(hello, cause)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reconnecting = false
+	c.changed.Broadcast()
+	if c.err != nil {
+		// closed while we were out
+		if conn != nil {
+			conn.Close()
+		}
+		return c.err
+	}
+	if err != nil {
+		c.err = err
+		return c.err
+	}
+	c.Backoff.Reset()
+	c.conn = conn
+	c.gen++
+	c.username = welcome.Username
+	c.session = welcome.Session
+	c.welcome, _ = MarshalJson(&prot.Message{Typ: "welcome", Body: welcome})
+	return nil
+}
+
+// serverClosed is whether the server ended the connection on purpose with a close frame, like when it shuts down or
+// disconnects us with a reason, rather than the network dropping it. Coming back would only undo what it did
+func serverClosed(err error) bool {
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) {
+		return closeErr.Code != websocket.CloseAbnormalClosure
+	}
+	// a write after the server's close frame was answered
+	return errors.Is(err, websocket.ErrCloseSent)
+}
+
+// redial makes up to maxReconnectAttempts tries at getting back in. Only the goroutine that is reconnecting calls it
+// so it has Backoff to itself
+func (c *Conn) redial(hello prot.HelloMessage, cause error) (*websocket.Conn, prot.WelcomeMessage, error) {
+	for range maxReconnectAttempts {
+		select {
+		case <-time.After(c.Backoff.Next()):
+		case <-c.done:
+			return nil, prot.WelcomeMessage{}, net.ErrClosed
+		}
+		conn, err := CreateConnection(c.opts)
+		if err != nil {
+			continue
+		}
+		welcome, err := Handshake(conn, hello)
+		var hsErr *prot.HandshakeError
+		if errors.As(err, &hsErr) && hsErr.Code != prot.ErrHandshakeTimeout {
+			conn.Close()
+			return nil, prot.WelcomeMessage{}, fmt.Errorf("unable to log back in: %w", err)
+		}
+		if err != nil {
+			conn.Close()
+			continue
+		}
+		return conn, welcome, nil
+	}
+	return nil, prot.WelcomeMessage{}, fmt.Errorf("unable to reconnect after %d attempts: %w", maxReconnectAttempts, cause)
+}
@@ -0,0 +1,186 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	prot "github.com/dylanmccormick/ws-chat/internal/protocol"
+	"github.com/dylanmccormick/ws-chat/pkg/chatserver"
+	"github.com/gorilla/websocket"
+)
+
+func TestBackoff(t *testing.T) {
+	b := Backoff{Min: 100 * time.Millisecond, Max: time.Second}
+	tests := []time.Duration{100, 200, 400, 800, 1000, 1000}
+	for i, want := range tests {
+		want *= time.Millisecond
+		if got := b.Next(); got < want/2 || got > want {
+			t.Errorf("tests[%d] - Expected a wait between %s and %s. got=%s", i, want/2, want, got)
+		}
+	}
+	b.Reset()
+	if got := b.Next(); got > b.Min {
+		t.Errorf("Expected the wait to start from Min again. got=%s", got)
+	}
+}
+
+// dialTestConn logs in to a fresh server and wraps the connection
+func dialTestConn(t *testing.T, username string) *Conn {
+	t.Helper()
+	c, _ := dialTestServer(t, username)
+	return c
+}
+
+// dialTestServer is dialTestConn that also returns a func to shut the server down
+func dialTestServer(t *testing.T, username string) (*Conn, context.CancelFunc) {
+	t.Helper()
+	s, err := chatserver.New()
+	if err != nil {
+		t.Fatalf("Unable to create server: %s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go s.Run(ctx)
+	ts := httptest.NewServer(s.Handler())
+	t.Cleanup(ts.Close)
+
+	opts := LoginOptions{Username: username, Server: "ws" + strings.TrimPrefix(ts.URL, "http")}
+	conn, err := CreateConnection(opts)
+	if err != nil {
+		t.Fatalf("Unable to connect: %s", err)
+	}
+	welcome, err := Handshake(conn, prot.HelloMessage{Username: username})
+	if err != nil {
+		t.Fatalf("Unable to log in: %s", err)
+	}
+	c := NewConn(conn, opts, welcome)
+	c.Backoff = Backoff{Min: 50 * time.Millisecond, Max: 100 * time.Millisecond}
+	t.Cleanup(func() { c.Close() })
+	return c, cancel
+}
+
+// readTestUntil reads from c until a message matches
+func readTestUntil(t *testing.T, c *Conn, match func(prot.Message) bool) prot.Message {
+	t.Helper()
+	for {
+		_, data, err := c.ReadMessage()
+		if err != nil {
+			t.Fatalf("Unable to read: %s", err)
+		}
+		var msg prot.Message
+		if err := msg.UnmarshalJSON(data); err == nil && match(msg) {
+			return msg
+		}
+	}
+}
+
+// drop closes the websocket under c the way a lost network would
+func drop(c *Conn) {
+	conn, _, _ := c.current()
+	conn.Close()
+}
+
+func TestConnResumes(t *testing.T) {
+	c := dialTestConn(t, "alice")
+	notices := make(chan string, 1)
+	c.Notify = func(text string) { notices <- text }
+	c.WriteMessage(websocket.TextMessage, CreateCreateRoomMessage("games", prot.CreateRoomRequest{}))
+	readTestUntil(t, c, func(m prot.Message) bool {
+		body, ok := m.Body.(prot.MembershipMessage)
+		return ok && body.Room == "games"
+	})
+
+	drop(c)
+	msg := readTestUntil(t, c, func(m prot.Message) bool {
+		_, ok := m.Body.(prot.WelcomeMessage)
+		return ok
+	})
+	welcome := msg.Body.(prot.WelcomeMessage)
+	slices.Sort(welcome.Rooms)
+	if !welcome.Resumed || welcome.Username != "alice" || !slices.Equal(welcome.Rooms, []string{"games", "lobby"}) {
+		t.Errorf("Expected the session to be resumed with its rooms. got=%+v", welcome)
+	}
+	if text := <-notices; !strings.Contains(text, "Reconnecting") {
+		t.Errorf("Expected to be told about the drop. got=%q", text)
+	}
+
+	// writes go out on the new connection
+	if err := c.WriteMessage(websocket.TextMessage, CreateChatMessage("back", "games")); err != nil {
+		t.Fatalf("Unable to write after reconnecting: %s", err)
+	}
+	readTestUntil(t, c, func(m prot.Message) bool {
+		body, ok := m.Body.(prot.ChatMessage)
+		return ok && body.Message == "back"
+	})
+}
+
+func TestConnCloseDuringReconnect(t *testing.T) {
+	c := dialTestConn(t, "alice")
+	notified, release := make(chan struct{}), make(chan struct{})
+	c.Notify = func(string) {
+		close(notified)
+		// like a tui that is too busy to take the notice
+		<-release
+	}
+	defer close(release)
+
+	drop(c)
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			if _, _, err := c.ReadMessage(); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+	select {
+	case <-notified:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the drop to be noticed")
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		c.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatalf("Close was stuck behind the reconnect")
+	}
+	release <- struct{}{}
+	if err := <-errs; !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Expected the reader to see the close. got=%v", err)
+	}
+}
+
+func TestConnStaysClosedWhenServerCloses(t *testing.T) {
+	c, shutdown := dialTestServer(t, "alice")
+	notices := make(chan string, 1)
+	c.Notify = func(text string) { notices <- text }
+
+	shutdown()
+	var err error
+	for err == nil {
+		_, _, err = c.ReadMessage()
+	}
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("Expected the server's close to be returned. got=%v", err)
+	}
+	select {
+	case text := <-notices:
+		t.Errorf("Expected no reconnect after the server closed the connection. got=%q", text)
+	default:
+	}
+	if err := c.WriteMessage(websocket.TextMessage, CreateListRoomMessage()); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("Expected writes to fail once the server closed the connection. got=%v", err)
+	}
+}
@@ -4,36 +4,49 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"math/rand/v2"
+	"io"
+	"net/http"
 	"net/url"
 	"os"
 	"strings"
+	"sync"
+	"time"
 
 	prot "github.com/dylanmccormick/ws-chat/internal/protocol"
 	"github.com/gorilla/websocket"
+	"golang.org/x/term"
 )
 
-func Execute() {
-	c := CreateConnection()
-	defer c.Close()
+func Execute(opts LoginOptions) {
+	conn, err := CreateConnection(opts)
+	if err != nil {
+		fmt.Printf("Unable to connect: %s\n", err)
+		return
+	}
 	scanner := bufio.NewScanner(os.Stdin)
-	bchan := make(chan []byte)
-	currentRoom := "lobby"
-	go readAndPrint(c, bchan)
-	for {
-		for {
-			b := false
-			select {
-			case message := <-bchan:
-				fmt.Println(string(message))
-			default:
-				b = true
-			}
-			if b {
-				break
-			}
+	welcome, err := Login(conn, &opts, scanner, os.Stdout)
+	if err != nil {
+		conn.Close()
+		fmt.Printf("Unable to log in: %s\n", err)
+		return
+	}
+	fmt.Println(welcome.Message)
+	c := NewConn(conn, opts, welcome)
+	c.Notify = func(text string) {
+		fmt.Printf("\n* %s\n", text)
+	}
+	defer c.Close()
+	currentRoom := &replRoom{name: welcome.Room, home: welcome.Room}
+	go readAndPrint(c, currentRoom)
+	// a failed write is reported and the prompt carries on. Conn has already tried to reconnect
+	send := func(msg []byte) {
+		if err := c.WriteMessage(websocket.TextMessage, msg); err != nil {
+			fmt.Printf("Unable to send: %s\n", err)
 		}
+	}
+	for {
 		fmt.Print("> ")
 		if !scanner.Scan() {
 			break
@@ -45,31 +58,99 @@ func Execute() {
 			case "/quit":
 				break
 			case "/create":
-				msg := CreateCreateRoomMessage(tokens[1])
-				err := c.WriteMessage(websocket.TextMessage, msg)
-				if err != nil {
-					fmt.Printf("We got an error writing: %s", err)
-					panic(err)
+				name, req, ok := ParseCreateRoom(tokens)
+				if !ok {
+					fmt.Println("usage: /create <room> [public|unlisted|invite|password <password>]")
+					continue
 				}
+				msg := CreateCreateRoomMessage(name, req)
+				send(msg)
 				continue
 			case "/join":
-				msg := CreateJoinRoomMessage(tokens[1])
-				err := c.WriteMessage(websocket.TextMessage, msg)
-				if err != nil {
-					fmt.Printf("We got an error writing: %s", err)
-					panic(err)
+				if len(tokens) < 2 {
+					fmt.Println("usage: /join <room> [password]")
+					continue
+				}
+				password := ""
+				if len(tokens) > 2 {
+					password = tokens[2]
+				}
+				msg := CreateJoinRoomMessage(tokens[1], password)
+				send(msg)
+				continue
+			case "/kick", "/ban", "/unban", "/mute", "/unmute", "/op", "/deop":
+				msg, ok := CreateModerationMessage(tokens, currentRoom.get())
+				if !ok {
+					fmt.Printf("usage: %s <user> [reason]\n", tokens[0])
+					continue
+				}
+				send(msg)
+				continue
+			case "/invite", "/rooms":
+				msg := CreateListAllRoomsMessage()
+				if tokens[0] == "/invite" {
+					if len(tokens) < 2 {
+						fmt.Println("usage: /invite <user>")
+						continue
+					}
+					msg = CreateInviteMessage(currentRoom.get(), tokens[1])
+				}
+				send(msg)
+				continue
+			case "/leave", "/delete":
+				// leaving defaults to the current room but deleting one has to be asked for by name. The reader moves
+				// the prompt out of the room once the server says it is gone
+				room := currentRoom.get()
+				if len(tokens) > 1 {
+					room = tokens[1]
+				} else if tokens[0] == "/delete" {
+					fmt.Println("usage: /delete <room>")
+					continue
+				}
+				msg := CreateLeaveRoomMessage(room)
+				if tokens[0] == "/delete" {
+					msg = CreateDeleteRoomMessage(room)
 				}
+				send(msg)
+				continue
+			case "/status":
+				msg := CreateSetStatusMessage(strings.Join(tokens[1:], " "))
+				send(msg)
+				continue
+			case "/topic":
+				msg := CreateSetTopicMessage(currentRoom.get(), strings.Join(tokens[1:], " "))
+				send(msg)
+				continue
+			case "/receipts":
+				if len(tokens) < 2 {
+					fmt.Println("usage: /receipts on|off")
+					continue
+				}
+				msg := CreateSetReadReceiptsMessage(currentRoom.get(), tokens[1] == "on")
+				send(msg)
 				continue
 			case "/switch":
-				currentRoom = tokens[1]
+				if len(tokens) < 2 {
+					fmt.Println("usage: /switch <room>")
+					continue
+				}
+				currentRoom.set(tokens[1])
+				continue
+			case "/msg":
+				if len(tokens) < 3 {
+					fmt.Println("usage: /msg <user> <message>")
+					continue
+				}
+				msg := CreateDirectMessage(tokens[1], strings.Join(tokens[2:], " "))
+				send(msg)
+				continue
+			case "/history":
+				msg := CreateHistoryMessage(currentRoom.get(), prot.HistoryRequest{})
+				send(msg)
 				continue
 			case "/list":
 				msg := CreateListRoomMessage()
-				err := c.WriteMessage(websocket.TextMessage, msg)
-				if err != nil {
-					fmt.Printf("We got an error writing: %s", err)
-					panic(err)
-				}
+				send(msg)
 			}
 		}
 		if input == "/quit" {
@@ -80,43 +161,350 @@ func Execute() {
 			continue
 		}
 
-		chat := CreateChatMessage(input, currentRoom)
-		err := c.WriteMessage(websocket.TextMessage, chat)
-		if err != nil {
-			fmt.Printf("We got an error writing: %s", err)
-			panic(err)
+		chat := CreateChatMessage(input, currentRoom.get())
+		send(chat)
+	}
+}
+
+// formatMessage prints chat and announcements with the local time they were sent. lastSeq is the last seq seen
+// in each room so a jump can be pointed out. Anything else is printed as it came, except typing which there is no
+// good place for between lines of output
+func formatMessage(data []byte, lastSeq map[string]uint64) string {
+	var msg prot.Message
+	if err := msg.UnmarshalJSON(data); err != nil {
+		return string(data)
+	}
+	return formatEnvelope(msg, string(data), lastSeq)
+}
+
+func formatEnvelope(msg prot.Message, raw string, lastSeq map[string]uint64) string {
+	var room, line string
+	switch body := msg.Body.(type) {
+	case prot.ChatMessage:
+		room, line = body.Target, fmt.Sprintf("%s: %s", body.UserName, body.Message)
+		if body.Deleted {
+			line = fmt.Sprintf("%s: (message deleted)", body.UserName)
+		} else if !body.Edited.IsZero() {
+			line += " (edited)"
+		}
+		if body.Parent != "" {
+			line = "↳ " + line
+		}
+	case prot.AnnouncementMessage:
+		room, line = body.Target, fmt.Sprintf("* %s", body.Message)
+	case prot.DirectMessage:
+		return fmt.Sprintf("[%s] %s -> %s: %s", msg.Time.Local().Format("15:04:05"), body.From, body.To, body.Message)
+	case prot.MembershipMessage:
+		if body.Event == prot.MembershipRenamed {
+			return fmt.Sprintf("* %s is now known as %s in #%s", body.OldUsername, body.Username, body.Room)
+		}
+		return fmt.Sprintf("* %s %s #%s", body.Username, body.Event, body.Room)
+	case prot.PresenceMessage:
+		line = fmt.Sprintf("* %s is %s", body.Username, body.Status)
+		if body.Text != "" {
+			line += fmt.Sprintf(" (%s)", body.Text)
+		}
+		return line
+	case prot.EditedMessage:
+		return fmt.Sprintf("* %s edited a message by %s in #%s: %s", body.By, body.UserName, body.Target, body.Message)
+	case prot.DeletedMessage:
+		return fmt.Sprintf("* %s deleted a message in #%s", body.By, body.Target)
+	case prot.ReactionMessage:
+		if !body.Added {
+			return fmt.Sprintf("* %s removed %s from a message in #%s", body.User, body.Emoji, body.Target)
+		}
+		return fmt.Sprintf("* %s reacted %s to a message in #%s", body.User, body.Emoji, body.Target)
+	case prot.RepliesMessage:
+		// the reply itself is printed when it comes in
+		return ""
+	case prot.NotificationMessage:
+		return fmt.Sprintf("* %s mentioned you in #%s: %s", body.From, body.Room, body.Message)
+	case prot.TypingMessage, prot.UnreadMessage, prot.ReadReceiptMessage:
+		// the repl prints everything as it comes so it has nothing to mark read
+		return ""
+	case prot.WelcomeMessage:
+		// only a reconnect gets here. The first welcome is printed by Execute
+		if !body.Resumed {
+			return fmt.Sprintf("* reconnected as a new session in #%s. Rooms you were in need joining again", body.Room)
 		}
+		return fmt.Sprintf("* reconnected to #%s", strings.Join(body.Rooms, ", #"))
+	case prot.CommandMessage:
+		if body.Action == "History" {
+			return formatHistory(body, raw, lastSeq)
+		}
+		return formatCommandResponse(body, raw)
+	default:
+		return raw
+	}
+	out := fmt.Sprintf("[%s] #%s %s", msg.Time.Local().Format("15:04:05"), room, line)
+	if msg.Seq == 0 {
+		return out
+	}
+	if last := lastSeq[room]; last != 0 && msg.Seq > last+1 {
+		out = fmt.Sprintf("-- missed %d messages in #%s. /history shows the latest --\n%s", msg.Seq-last-1, room, out)
+	}
+	lastSeq[room] = max(lastSeq[room], msg.Seq)
+	return out
+}
+
+// formatHistory prints a page of history, or what was missed while disconnected, a line per message
+func formatHistory(body prot.CommandMessage, raw string, lastSeq map[string]uint64) string {
+	messages := []prot.Message{}
+	if err := json.Unmarshal(body.Data, &messages); err != nil {
+		return raw
+	}
+	if len(messages) == 0 {
+		return fmt.Sprintf("* nothing to show in #%s", body.Target)
+	}
+	lines := []string{}
+	for _, m := range messages {
+		if line := formatEnvelope(m, "", lastSeq); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// formatCommandResponse prints the responses that are meant to be read. Anything else is printed as raw
+func formatCommandResponse(body prot.CommandMessage, raw string) string {
+	switch body.Action {
+	case "ListAllRooms":
+		rooms := []prot.RoomInfo{}
+		if err := json.Unmarshal(body.Data, &rooms); err != nil {
+			return raw
+		}
+		lines := []string{"Rooms:"}
+		for _, room := range rooms {
+			line := fmt.Sprintf("  #%s (%d members)", room.Name, room.Members)
+			if room.Topic != "" {
+				line += " - " + room.Topic
+			}
+			lines = append(lines, line)
+		}
+		return strings.Join(lines, "\n")
+	case "SetTopic":
+		var topic prot.TopicRequest
+		if err := json.Unmarshal(body.Data, &topic); err != nil {
+			return raw
+		}
+		return fmt.Sprintf("* topic for #%s: %s", body.Target, topic.Topic)
+	case "SetReadReceipts":
+		var receipts prot.ReadReceiptsRequest
+		if err := json.Unmarshal(body.Data, &receipts); err != nil {
+			return raw
+		}
+		state := "off"
+		if receipts.Enabled {
+			state = "on"
+		}
+		return fmt.Sprintf("* read receipts for #%s are %s", body.Target, state)
+	}
+	return raw
+}
+
+// replRoom is the room the prompt sends to. The prompt switches it and the reader sends it home when the server
+// confirms the user is out of it
+type replRoom struct {
+	mu   sync.Mutex
+	name string
+	home string
+}
+
+func (r *replRoom) get() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.name
+}
+
+func (r *replRoom) set(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.name = name
+}
+
+// left moves back to the home room if the room that was left is the current one
+func (r *replRoom) left(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.name == name {
+		r.name = r.home
 	}
 }
 
-func readAndPrint(c *websocket.Conn, bchan chan []byte) {
+// readAndPrint prints everything the server sends as it comes. It never waits on the prompt, since pings are only
+// answered while reading and a reader stuck behind someone typing gets the connection timed out. The connection
+// only fails once reconnecting has given up, and the prompt is waiting on stdin, so that ends the repl here
+func readAndPrint(c *Conn, room *replRoom) {
+	lastSeq := map[string]uint64{}
 	for {
 		_, data, err := c.ReadMessage()
 		if err != nil {
-			panic(err)
+			fmt.Printf("\nDisconnected: %s\n", err)
+			os.Exit(1)
 		}
 		data = bytes.TrimSpace(bytes.ReplaceAll(data, []byte("\n"), []byte(" ")))
-		bchan <- data
+		var msg prot.Message
+		if err := msg.UnmarshalJSON(data); err == nil {
+			// leaving, deleting and being kicked are all confirmed this way
+			if body, ok := msg.Body.(prot.CommandMessage); ok && (body.Action == "LeaveRoom" || body.Action == "DeleteRoom") {
+				room.left(body.Target)
+			}
+		}
+		if line := formatMessage(data, lastSeq); line != "" {
+			fmt.Println(line)
+		}
 	}
 }
 
-func CreateConnection() *websocket.Conn {
-	u := url.URL{Scheme: "ws", Host: "localhost:8080", Path: "/ws"}
-	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+// LoginOptions are the credentials to try first. Anything missing or rejected is asked for on the terminal
+type LoginOptions struct {
+	Username string
+	Password string
+	Token    string // sent as a bearer token on the upgrade request
+	Server   string // websocket url of the server. Empty connects to DefaultServerURL
+}
+
+// DefaultServerURL is where the clients connect when no server is given, a server started with the default config
+const DefaultServerURL = "ws://localhost:8080/ws"
+
+func CreateConnection(opts LoginOptions) (*websocket.Conn, error) {
+	server := opts.Server
+	if server == "" {
+		server = DefaultServerURL
+	}
+	u, err := url.Parse(server)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server url %q: %w", server, err)
+	}
+	header := http.Header{}
+	if opts.Token != "" {
+		header.Set("Authorization", "Bearer "+opts.Token)
+	}
+	c, _, err := websocket.DefaultDialer.Dial(u.String(), header)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Handshake sends a hello and waits for the server to welcome or reject it.
+// A rejection comes back as a *protocol.HandshakeError
+func Handshake(c *websocket.Conn, hello prot.HelloMessage) (prot.WelcomeMessage, error) {
+	err := c.WriteMessage(websocket.TextMessage, CreateHelloMessage(hello))
+	if err != nil {
+		return prot.WelcomeMessage{}, err
+	}
+	_, data, err := c.ReadMessage()
+	if err != nil {
+		return prot.WelcomeMessage{}, err
+	}
+	var msg prot.Message
+	if err := msg.UnmarshalJSON(data); err != nil {
+		return prot.WelcomeMessage{}, err
+	}
+	switch body := msg.Body.(type) {
+	case prot.WelcomeMessage:
+		return body, nil
+	case prot.ErrorMessage:
+		return prot.WelcomeMessage{}, &prot.HandshakeError{Code: body.Type, Reason: body.Message}
+	default:
+		return prot.WelcomeMessage{}, fmt.Errorf("unexpected %s message during handshake", msg.Typ)
+	}
+}
+
+// Login keeps trying until the server accepts the hello. It asks for a username when there isn't one
+// or it was rejected, and for a password when the server says the credentials are wrong. The password that
+// worked is kept in opts so a reconnect can log in again
+func Login(c *websocket.Conn, opts *LoginOptions, in *bufio.Scanner, out io.Writer) (prot.WelcomeMessage, error) {
+	username := opts.Username
+	password := opts.Password
+	for {
+		// token logins can leave the username empty and get their account name
+		if username == "" && opts.Token == "" {
+			fmt.Fprint(out, "Username: ")
+			if !in.Scan() {
+				return prot.WelcomeMessage{}, fmt.Errorf("no username given")
+			}
+			username = strings.TrimSpace(in.Text())
+		}
+		welcome, err := Handshake(c, prot.HelloMessage{Username: username, Password: password})
+		var hsErr *prot.HandshakeError
+		if !errors.As(err, &hsErr) {
+			opts.Password = password
+			return welcome, err
+		}
+		switch hsErr.Code {
+		case prot.ErrHandshakeTimeout, prot.ErrTooManyAttempts:
+			return welcome, err
+		case prot.ErrUnauthorized:
+			if opts.Token != "" {
+				return welcome, err
+			}
+			fmt.Fprintf(out, "%s\n", hsErr.Reason)
+			password, err = readSecret(in, out)
+			if err != nil {
+				return welcome, err
+			}
+		default:
+			fmt.Fprintf(out, "%s\n", hsErr.Reason)
+			username = ""
+		}
+	}
+}
+
+// readSecret reads a password from stdin without echoing it when stdin is a terminal
+func readSecret(in *bufio.Scanner, out io.Writer) (string, error) {
+	fmt.Fprint(out, "Password: ")
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		password, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(out)
+		return string(password), err
+	}
+	if !in.Scan() {
+		return "", fmt.Errorf("no password given")
+	}
+	return in.Text(), nil
+}
+
+// ReadPassword reads a single password from in
+func ReadPassword(in *os.File, out io.Writer) (string, error) {
+	if term.IsTerminal(int(in.Fd())) {
+		fmt.Fprint(out, "Password: ")
+		password, err := term.ReadPassword(int(in.Fd()))
+		fmt.Fprintln(out)
+		return string(password), err
+	}
+	scanner := bufio.NewScanner(in)
+	if !scanner.Scan() {
+		return "", fmt.Errorf("no password given")
+	}
+	return scanner.Text(), nil
+}
+
+func CreateHelloMessage(hello prot.HelloMessage) []byte {
+	message := &prot.Message{
+		Typ:  "hello",
+		Body: hello,
+	}
+	msg, err := MarshalJson(message)
 	if err != nil {
 		panic(err)
 	}
-	userNumber := fmt.Sprintf("%6d", rand.IntN(999999))
-	c.WriteMessage(websocket.TextMessage, []byte("TestUser"+userNumber))
-	return c
+	return msg
 }
 
-func CreateJoinRoomMessage(name string) []byte {
+// CreateJoinRoomMessage joins a room. password is only needed for password rooms
+func CreateJoinRoomMessage(name, password string) []byte {
+	var data json.RawMessage
+	if password != "" {
+		data = mustMarshal(prot.JoinRoomRequest{Password: password})
+	}
 	message := &prot.Message{
 		Typ: "command",
 		Body: prot.CommandMessage{
 			Action: "JoinRoom",
 			Target: name,
+			Data:   data,
 		},
 	}
 	msg, err := MarshalJson(message)
@@ -126,6 +514,264 @@ func CreateJoinRoomMessage(name string) []byte {
 	return msg
 }
 
+// CreateInviteMessage invites a user to a room
+func CreateInviteMessage(room, user string) []byte {
+	message := &prot.Message{
+		Typ: "command",
+		Body: prot.CommandMessage{
+			Action: "Invite",
+			Target: room,
+			Data:   mustMarshal(prot.InviteRequest{User: user}),
+		},
+	}
+	msg, err := MarshalJson(message)
+	if err != nil {
+		panic(err)
+	}
+	return msg
+}
+
+func CreateListAllRoomsMessage() []byte {
+	return createRoomCommand("ListAllRooms", "")
+}
+
+// CreateClearMentionsMessage marks your mentions in a room as read
+func CreateClearMentionsMessage(room string) []byte {
+	return createRoomCommand("ClearMentions", room)
+}
+
+// CreateMarkReadMessage marks a room read up to seq. 0 marks everything in it read
+func CreateMarkReadMessage(room string, seq uint64) []byte {
+	message := &prot.Message{
+		Typ: "command",
+		Body: prot.CommandMessage{
+			Action: "MarkRead",
+			Target: room,
+			Data:   mustMarshal(prot.MarkReadRequest{Seq: seq}),
+		},
+	}
+	msg, err := MarshalJson(message)
+	if err != nil {
+		panic(err)
+	}
+	return msg
+}
+
+// CreateSetReadReceiptsMessage turns read receipts on or off for a room
+func CreateSetReadReceiptsMessage(room string, enabled bool) []byte {
+	message := &prot.Message{
+		Typ: "command",
+		Body: prot.CommandMessage{
+			Action: "SetReadReceipts",
+			Target: room,
+			Data:   mustMarshal(prot.ReadReceiptsRequest{Enabled: enabled}),
+		},
+	}
+	msg, err := MarshalJson(message)
+	if err != nil {
+		panic(err)
+	}
+	return msg
+}
+
+// CreateSetStatusMessage sets the status text shown next to your name. An empty text clears it
+func CreateSetStatusMessage(text string) []byte {
+	message := &prot.Message{
+		Typ: "command",
+		Body: prot.CommandMessage{
+			Action: "SetStatus",
+			Data:   mustMarshal(prot.StatusRequest{Text: text}),
+		},
+	}
+	msg, err := MarshalJson(message)
+	if err != nil {
+		panic(err)
+	}
+	return msg
+}
+
+// CreateEditMessage replaces the text of a message in a room
+func CreateEditMessage(room, id, text string) []byte {
+	message := &prot.Message{
+		Typ: "command",
+		Body: prot.CommandMessage{
+			Action: "EditMessage",
+			Target: room,
+			Data:   mustMarshal(prot.EditMessageRequest{ID: id, Message: text}),
+		},
+	}
+	msg, err := MarshalJson(message)
+	if err != nil {
+		panic(err)
+	}
+	return msg
+}
+
+// CreateDeleteMessage deletes a message in a room
+func CreateDeleteMessage(room, id string) []byte {
+	message := &prot.Message{
+		Typ: "command",
+		Body: prot.CommandMessage{
+			Action: "DeleteMessage",
+			Target: room,
+			Data:   mustMarshal(prot.DeleteMessageRequest{ID: id}),
+		},
+	}
+	msg, err := MarshalJson(message)
+	if err != nil {
+		panic(err)
+	}
+	return msg
+}
+
+// CreateReactMessage adds or removes an emoji on a message in a room
+func CreateReactMessage(room, id, emoji string, remove bool) []byte {
+	message := &prot.Message{
+		Typ: "command",
+		Body: prot.CommandMessage{
+			Action: "React",
+			Target: room,
+			Data:   mustMarshal(prot.ReactRequest{ID: id, Emoji: emoji, Remove: remove}),
+		},
+	}
+	msg, err := MarshalJson(message)
+	if err != nil {
+		panic(err)
+	}
+	return msg
+}
+
+// CreateSetTopicMessage sets the topic of a room. An empty topic clears it
+func CreateSetTopicMessage(room, topic string) []byte {
+	message := &prot.Message{
+		Typ: "command",
+		Body: prot.CommandMessage{
+			Action: "SetTopic",
+			Target: room,
+			Data:   mustMarshal(prot.TopicRequest{Topic: topic}),
+		},
+	}
+	msg, err := MarshalJson(message)
+	if err != nil {
+		panic(err)
+	}
+	return msg
+}
+
+// ParseCreateRoom reads `/create <room> [public|unlisted|invite|password <password>]`. It returns false when there is
+// no room name
+func ParseCreateRoom(tokens []string) (string, prot.CreateRoomRequest, bool) {
+	req := prot.CreateRoomRequest{}
+	if len(tokens) < 2 {
+		return "", req, false
+	}
+	if len(tokens) > 2 {
+		req.Visibility = tokens[2]
+	}
+	if len(tokens) > 3 {
+		req.Password = tokens[3]
+	}
+	return tokens[1], req, true
+}
+
+func mustMarshal(v any) json.RawMessage {
+	data, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+// CreateHistoryMessage asks for messages in a room. An empty request gets the newest ones
+func CreateHistoryMessage(room string, req prot.HistoryRequest) []byte {
+	data, err := json.Marshal(req)
+	if err != nil {
+		panic(err)
+	}
+	message := &prot.Message{
+		Typ: "command",
+		Body: prot.CommandMessage{
+			Action: "History",
+			Target: room,
+			Data:   data,
+		},
+	}
+	msg, err := MarshalJson(message)
+	if err != nil {
+		panic(err)
+	}
+	return msg
+}
+
+func CreateLeaveRoomMessage(name string) []byte {
+	return createRoomCommand("LeaveRoom", name)
+}
+
+func CreateDeleteRoomMessage(name string) []byte {
+	return createRoomCommand("DeleteRoom", name)
+}
+
+func createRoomCommand(action, room string) []byte {
+	message := &prot.Message{
+		Typ: "command",
+		Body: prot.CommandMessage{
+			Action: action,
+			Target: room,
+		},
+	}
+	msg, err := MarshalJson(message)
+	if err != nil {
+		panic(err)
+	}
+	return msg
+}
+
+// moderationActions maps the slash commands to their command actions
+var moderationActions = map[string]string{
+	"/kick":   "Kick",
+	"/ban":    "Ban",
+	"/unban":  "Unban",
+	"/mute":   "Mute",
+	"/unmute": "Unmute",
+	"/op":     "Op",
+	"/deop":   "Deop",
+}
+
+// CreateModerationMessage turns `/ban <user> [duration] [reason...]` and friends into a command for room.
+// It returns false if tokens aren't a moderation command
+func CreateModerationMessage(tokens []string, room string) ([]byte, bool) {
+	action, ok := moderationActions[tokens[0]]
+	if !ok || len(tokens) < 2 {
+		return nil, false
+	}
+	req := prot.ModerationRequest{User: tokens[1]}
+	rest := tokens[2:]
+	if len(rest) > 0 && (action == "Ban" || action == "Mute") {
+		if _, err := time.ParseDuration(rest[0]); err == nil {
+			req.Duration = rest[0]
+			rest = rest[1:]
+		}
+	}
+	req.Reason = strings.Join(rest, " ")
+	data, err := json.Marshal(req)
+	if err != nil {
+		panic(err)
+	}
+	message := &prot.Message{
+		Typ: "command",
+		Body: prot.CommandMessage{
+			Action: action,
+			Target: room,
+			Data:   data,
+		},
+	}
+	msg, err := MarshalJson(message)
+	if err != nil {
+		panic(err)
+	}
+	return msg, true
+}
+
 func CreateGetUsersMessage(room string) []byte {
 	message := &prot.Message{
 		Typ: "command",
@@ -170,12 +816,78 @@ func CreateListRoomMessage() []byte {
 	return msg
 }
 
-func CreateCreateRoomMessage(name string) []byte {
+func CreateCreateRoomMessage(name string, req prot.CreateRoomRequest) []byte {
 	message := &prot.Message{
 		Typ: "command",
 		Body: prot.CommandMessage{
 			Action: "CreateRoom",
 			Target: name,
+			Data:   mustMarshal(req),
+		},
+	}
+	msg, err := MarshalJson(message)
+	if err != nil {
+		panic(err)
+	}
+	return msg
+}
+
+func CreateDirectMessage(to, input string) []byte {
+	message := &prot.Message{
+		Typ: "dm",
+		Body: prot.DirectMessage{
+			Message: input,
+			To:      to,
+		},
+	}
+	msg, err := MarshalJson(message)
+	if err != nil {
+		panic(err)
+	}
+	return msg
+}
+
+// CreateTypingMessage tells the room the user started or stopped typing
+func CreateTypingMessage(room string, typing bool) []byte {
+	message := &prot.Message{
+		Typ: "typing",
+		Body: prot.TypingMessage{
+			Target: room,
+			Typing: typing,
+		},
+	}
+	msg, err := MarshalJson(message)
+	if err != nil {
+		panic(err)
+	}
+	return msg
+}
+
+// CreateReplyMessage sends a chat message into the thread of parent
+func CreateReplyMessage(input, room, parent string) []byte {
+	message := &prot.Message{
+		Typ: "chat",
+		Body: prot.ChatMessage{
+			Message: input,
+			Target:  room,
+			Parent:  parent,
+		},
+	}
+	msg, err := MarshalJson(message)
+	if err != nil {
+		panic(err)
+	}
+	return msg
+}
+
+// CreateGetThreadMessage asks for a message and its replies
+func CreateGetThreadMessage(room, id string) []byte {
+	message := &prot.Message{
+		Typ: "command",
+		Body: prot.CommandMessage{
+			Action: "GetThread",
+			Target: room,
+			Data:   mustMarshal(prot.ThreadRequest{ID: id}),
 		},
 	}
 	msg, err := MarshalJson(message)
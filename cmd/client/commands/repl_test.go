@@ -0,0 +1,27 @@
+package commands
+
+import (
+	"testing"
+
+	prot "github.com/dylanmccormick/ws-chat/internal/protocol"
+)
+
+func TestParseCreateRoom(t *testing.T) {
+	tests := []struct {
+		tokens []string
+		name   string
+		req    prot.CreateRoomRequest
+		ok     bool
+	}{
+		{tokens: []string{"/create"}, ok: false},
+		{tokens: []string{"/create", "games"}, name: "games", ok: true},
+		{tokens: []string{"/create", "club", "invite"}, name: "club", req: prot.CreateRoomRequest{Visibility: "invite"}, ok: true},
+		{tokens: []string{"/create", "vault", "password", "s3cret"}, name: "vault", req: prot.CreateRoomRequest{Visibility: "password", Password: "s3cret"}, ok: true},
+	}
+	for _, tt := range tests {
+		name, req, ok := ParseCreateRoom(tt.tokens)
+		if name != tt.name || req != tt.req || ok != tt.ok {
+			t.Errorf("%v: expected %q %+v %v. got=%q %+v %v", tt.tokens, tt.name, tt.req, tt.ok, name, req, ok)
+		}
+	}
+}
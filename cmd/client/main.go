@@ -1,14 +1,23 @@
 package client
 
 import (
+	"io"
+	"os"
+
 	"github.com/dylanmccormick/ws-chat/cmd/client/commands"
 	"github.com/dylanmccormick/ws-chat/cmd/client/tui"
 )
 
-func StartREPL() {
-	commands.Execute()
+func StartREPL(opts commands.LoginOptions) {
+	commands.Execute(opts)
+}
+
+// StartTUI starts the tui
+func StartTUI(opts commands.LoginOptions, options tui.Options) {
+	tui.Start(opts, options)
 }
 
-func StartTUI() {
-	tui.Start()
+// ReadPassword reads a password without echoing it when in is a terminal
+func ReadPassword(in *os.File, out io.Writer) (string, error) {
+	return commands.ReadPassword(in, out)
 }
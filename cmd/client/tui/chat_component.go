@@ -1,51 +1,199 @@
 package tui
 
 import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
 	"github.com/charmbracelet/bubbles/textinput"
 	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/dylanmccormick/ws-chat/internal/protocol"
 )
 
 type SendChatMessage struct {
 	Message string
+	Parent  string // the thread it is a reply in, if any
+}
+
+// OpenThreadMessage opens the thread pane for the message with ID
+type OpenThreadMessage struct {
+	ID string
+}
+
+// ReactMessage toggles our Emoji reaction on the message with ID
+type ReactMessage struct {
+	ID    string
+	Emoji string
+}
+
+// defaultReaction is what the react key toggles. Anything else can be sent with /react
+const defaultReaction = "👍"
+
+// SendTypingMessage is sent when the user starts typing, again every protocol.TypingInterval while they keep at it
+// and when they clear the input
+type SendTypingMessage struct {
+	Typing bool
 }
 
 type ChatComponent struct {
 	focused bool
 	input   textinput.Model
+
+	now        func() time.Time
+	typing     bool      // whether the room was last told we are typing
+	lastTyping time.Time // when it was last told
+
+	selected string         // id of the message picked with up and down, if any
+	username string         // messages that mention this user are highlighted
+	mentions *regexp.Regexp // finds them. Built once for each username rather than for every message
 }
 
-func (cc *ChatComponent) ViewRoom(room *Room) string {
-	return cc.ViewMessages(room.RenderedMessages)
+var mentionStyle = lipgloss.NewStyle().Bold(true).Foreground(lipgloss.Color("214"))
+
+// mentionPattern matches @username or @room with the name characters the server allows. Like the server, full stops
+// after the name end it so @bob. mentions bob but @bob.smith doesn't
+func mentionPattern(username string) *regexp.Regexp {
+	return regexp.MustCompile(`(?:^|[^\w@])@(?:` + regexp.QuoteMeta(username) + `|room)\.*(?:[^\w.-]|$)`)
 }
 
-func (cc *ChatComponent) ViewMessages(messages []string) string {
+// newMessagesDivider goes above the first message that was unread when the room was opened
+const newMessagesDivider = "── new messages ──"
+
+// ViewRoom lists the messages on show in the room with the reactions on each one and who has read up to it underneath
+func (cc *ChatComponent) ViewRoom(room *Room) string {
 	str := ""
-	for _, msg := range messages {
+	divided := room.divider == 0
+	seen := room.SeenBy()
+	for i, raw := range room.RawMessages {
+		if !room.Shows(raw) {
+			continue
+		}
+		if !divided && raw.Seq > room.divider {
+			str += newMessagesDivider + "\n"
+			divided = true
+		}
+		msg := room.RenderedMessages[i]
+		chat, isChat := raw.Body.(protocol.ChatMessage)
+		if isChat && cc.username != "" && chat.UserName != cc.username && cc.mentions.MatchString(chat.Message) {
+			msg = mentionStyle.Render(msg)
+		}
+		if raw.ID != "" && raw.ID == cc.selected {
+			msg = "> " + msg
+		}
 		str += msg + "\n"
+		if isChat && len(chat.Reactions) > 0 {
+			str += renderReactions(chat.Reactions) + "\n"
+		}
+		if names := seen[raw.ID]; len(names) > 0 {
+			str += "    seen by " + strings.Join(names, ", ") + "\n"
+		}
 	}
 	return str
 }
 
+func renderReactions(reactions []protocol.Reaction) string {
+	parts := make([]string, 0, len(reactions))
+	for _, r := range reactions {
+		parts = append(parts, fmt.Sprintf("%s %d", r.Emoji, r.Count))
+	}
+	return "    " + strings.Join(parts, "  ")
+}
+
+// Selected is the id of the selected message if it is in room
+func (cc *ChatComponent) Selected(room *Room) string {
+	if slices.Contains(room.chatIDs(), cc.selected) {
+		return cc.selected
+	}
+	return ""
+}
+
+// moveSelection steps through the room's messages. Going up with nothing selected starts at the newest and going
+// down past the newest clears the selection
+func (cc *ChatComponent) moveSelection(room *Room, step int) {
+	ids := room.chatIDs()
+	i := slices.Index(ids, cc.selected)
+	switch {
+	case len(ids) == 0:
+		cc.selected = ""
+	case i < 0 && step < 0:
+		cc.selected = ids[len(ids)-1]
+	case i < 0:
+	case i+step >= len(ids):
+		cc.selected = ""
+	default:
+		cc.selected = ids[max(i+step, 0)]
+	}
+}
+
 func (cc ChatComponent) View() string {
 	str := ""
 	return str
 }
 
-func (cc *ChatComponent) Update(msg tea.Msg, room string) (ChatComponent, tea.Cmd) {
+func (cc *ChatComponent) Update(msg tea.Msg, room *Room) (ChatComponent, tea.Cmd) {
 	switch msg := msg.(type) {
 	case tea.KeyMsg:
 		switch msg.String() {
+		case "up":
+			cc.moveSelection(room, -1)
+			return *cc, nil
+		case "down":
+			cc.moveSelection(room, 1)
+			return *cc, nil
+		case "esc":
+			cc.selected = ""
+			return *cc, nil
+		case "ctrl+e":
+			id := cc.Selected(room)
+			if id == "" {
+				return *cc, nil
+			}
+			return *cc, func() tea.Msg {
+				return ReactMessage{ID: id, Emoji: defaultReaction}
+			}
+		case "ctrl+t":
+			id := cc.Selected(room)
+			if id == "" || room.Thread != "" {
+				return *cc, nil
+			}
+			return *cc, func() tea.Msg {
+				return OpenThreadMessage{ID: id}
+			}
 		case "enter":
 			text := cc.input.Value()
 			cc.input.SetValue("")
+			// the chat itself clears the indicator for everyone else so there is no need to send a stop
+			cc.typing = false
 			return *cc, func() tea.Msg {
-				return SendChatMessage{Message: text}
+				return SendChatMessage{Message: text, Parent: room.Thread}
 			}
 		}
 	}
 	var cmd tea.Cmd
 	cc.input, cmd = cc.input.Update(msg)
-	return *cc, cmd
+	return *cc, tea.Batch(cmd, cc.typingUpdate())
+}
+
+// typingUpdate decides whether the room needs to hear about typing after the input changed. Commands aren't
+// something the room will see so they don't count
+func (cc *ChatComponent) typingUpdate() tea.Cmd {
+	value := cc.input.Value()
+	typing := value != "" && !strings.HasPrefix(value, "/")
+	now := cc.now()
+	switch {
+	case typing && (!cc.typing || now.Sub(cc.lastTyping) >= protocol.TypingInterval):
+		cc.lastTyping = now
+	case !typing && cc.typing:
+	default:
+		return nil
+	}
+	cc.typing = typing
+	return func() tea.Msg {
+		return SendTypingMessage{Typing: typing}
+	}
 }
 
 func (cc *ChatComponent) Init() tea.Cmd {
@@ -59,6 +207,7 @@ func NewChatComponent() *ChatComponent {
 	return &ChatComponent{
 		focused: true,
 		input:   ti,
+		now:     time.Now,
 	}
 }
 
@@ -1,6 +1,7 @@
 package tui
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"fmt"
@@ -21,24 +22,44 @@ type RootModel struct {
 	width  int
 	height int
 
+	username    string
+	defaultRoom string
+
 	roomsMap    map[string]*Room
+	dmsMap      map[string]*Room // dm conversations by the other user's name
 	CurrentRoom *Room
 
 	ChatComponent *ChatComponent
 	RoomComponent *RoomComponent
 	UserComponent *UserComponent
+	RoomPicker    *RoomPickerComponent
+
+	// the open thread pane. It reuses ChatComponent with the thread as its room
+	Thread          *Room
+	ThreadComponent *ChatComponent
 
-	Conn *websocket.Conn
-	sub  chan protocol.Message
+	Conn     *commands.Conn
+	sub      chan protocol.Message
+	outgoing chan []byte // everything sent to the server goes through here to the one writer goroutine
+
+	pollEvery time.Duration // how often to ask for rooms and users as well as the pushed updates. 0 never does
+	bell      bool          // ring the terminal bell on mentions
 
 	MessageCount int
 	ChatsSent    int
+
+	lost error // why the connection is gone for good once reconnecting gives up
 }
 
 type SwitchedRoomsMessage struct {
 	Room string
 }
 
+// OpenedConversationMessage switches to the dm conversation with Peer, creating it if needed
+type OpenedConversationMessage struct {
+	Peer string
+}
+
 type Component interface {
 	Update(msg tea.Msg) (Component, tea.Cmd)
 	View() string
@@ -48,37 +69,99 @@ type Component interface {
 
 type TickMsg time.Time
 
-func Start() {
-	conn := commands.CreateConnection()
-	rm := NewRootModel(conn)
+// MarkReadDueMessage is when Room can be marked read again
+type MarkReadDueMessage struct {
+	Room *Room
+}
+
+// ConnectionLostMessage ends the tui once the connection can't be got back
+type ConnectionLostMessage struct {
+	Err error
+}
+
+// TypingExpiredMessage redraws the typing line once someone's indicator may have run out
+type TypingExpiredMessage struct{}
+
+// Options change how the tui behaves once it is logged in
+type Options struct {
+	PollEvery time.Duration // how often to also ask for the room and user lists. 0 relies on the pushed updates
+	Bell      bool          // ring the terminal bell when someone mentions you
+}
+
+func Start(opts commands.LoginOptions, options Options) {
+	conn, err := commands.CreateConnection(opts)
+	if err != nil {
+		fmt.Printf("Unable to connect: %v\n", err)
+		os.Exit(1)
+	}
+	// log in before bubbletea takes over the terminal
+	welcome, err := commands.Login(conn, &opts, bufio.NewScanner(os.Stdin), os.Stdout)
+	if err != nil {
+		fmt.Printf("Unable to log in: %v\n", err)
+		os.Exit(1)
+	}
+	c := commands.NewConn(conn, opts, welcome)
+	defer c.Close()
+	rm := NewRootModel(c, welcome)
+	rm.pollEvery = options.PollEvery
+	rm.bell = options.Bell
+	c.Notify = func(text string) {
+		rm.sub <- protocol.Message{Typ: "error", Time: time.Now(), Body: protocol.ErrorMessage{Message: text}}
+	}
 	p := tea.NewProgram(rm)
-	if _, err := p.Run(); err != nil {
+	final, err := p.Run()
+	if err != nil {
 		fmt.Printf("Alas, there has been an error: %v", err)
 		os.Exit(1)
 	}
+	if lost := final.(RootModel).lost; lost != nil {
+		fmt.Printf("Disconnected: %v\n", lost)
+		os.Exit(1)
+	}
 }
 
-func NewRootModel(conn *websocket.Conn) RootModel {
-	lobby := NewRoom("lobby")
-	return RootModel{
-		CurrentRoom:   lobby,
-		roomsMap:      map[string]*Room{"lobby": lobby},
-		ChatComponent: NewChatComponent(),
-		RoomComponent: NewRoomComponent(),
-		UserComponent: NewUserComponent(),
-		Conn:          conn,
-		sub:           make(chan protocol.Message, 10),
-		MessageCount:  0,
-		ChatsSent:     0,
+func NewRootModel(conn *commands.Conn, welcome protocol.WelcomeMessage) RootModel {
+	lobby := NewRoom(welcome.Room)
+	chat, thread := NewChatComponent(), NewChatComponent()
+	rm := RootModel{
+		defaultRoom:     welcome.Room,
+		CurrentRoom:     lobby,
+		roomsMap:        map[string]*Room{welcome.Room: lobby},
+		dmsMap:          map[string]*Room{},
+		ChatComponent:   chat,
+		RoomComponent:   &RoomComponent{rooms: []string{welcome.Room}, mentions: map[string]int{}, unread: map[string]int{}},
+		UserComponent:   NewUserComponent(),
+		RoomPicker:      NewRoomPickerComponent(),
+		ThreadComponent: thread,
+		Conn:            conn,
+		sub:             make(chan protocol.Message, 10),
+		outgoing:        make(chan []byte, 16),
+		MessageCount:    0,
+		ChatsSent:       0,
+	}
+	rm.setUsername(welcome.Username)
+	return rm
+}
+
+// setUsername changes who we are, which is also whose mentions the chat panes highlight
+func (rm *RootModel) setUsername(username string) {
+	rm.username = username
+	pattern := mentionPattern(username)
+	for _, cc := range []*ChatComponent{rm.ChatComponent, rm.ThreadComponent} {
+		cc.username, cc.mentions = username, pattern
 	}
 }
 
 func (rm RootModel) Init() tea.Cmd {
-	return tea.Batch(
+	cmds := []tea.Cmd{
 		ListenForMessages(rm.Conn, rm.sub),
+		WriteMessages(rm.Conn, rm.outgoing),
 		ReceiveMessage(rm.sub),
-		doTick(),
-	)
+	}
+	if rm.pollEvery > 0 {
+		cmds = append(cmds, doTick(rm.pollEvery))
+	}
+	return tea.Batch(cmds...)
 }
 
 func (rm RootModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
@@ -90,6 +173,15 @@ func (rm RootModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		switch msg.String() {
 		case "ctrl+c":
 			return rm, tea.Quit
+		case "ctrl+r":
+			return rm, rm.SendChatMessage(SendChatMessage{Message: "/rooms"})
+		}
+		if rm.RoomPicker.IsOpen() {
+			return rm, rm.RoomPicker.Update(msg)
+		}
+		if msg.String() == "ctrl+t" && rm.threadOpen() {
+			rm.Thread = nil
+			return rm, nil
 		}
 	case protocol.Message:
 		var cmd tea.Cmd
@@ -98,21 +190,139 @@ func (rm RootModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	case SendChatMessage:
 		rm.ChatsSent++
 		return rm, rm.SendChatMessage(msg)
+	case SendTypingMessage:
+		return rm, rm.SendTypingMessage(msg)
+	case ReactMessage:
+		return rm, rm.react(msg.ID, msg.Emoji)
+	case OpenThreadMessage:
+		return rm, rm.openThread(msg.ID)
+	case TypingExpiredMessage:
+		return rm, nil
+	case ConnectionLostMessage:
+		rm.lost = msg.Err
+		return rm, tea.Quit
+	case MarkReadDueMessage:
+		msg.Room.markReadDue = false
+		if msg.Room != rm.CurrentRoom {
+			return rm, nil
+		}
+		return rm, rm.markRead()
 	case SwitchedRoomsMessage:
-		rm.CurrentRoom = rm.roomsMap[msg.Room]
+		if room, ok := rm.roomsMap[msg.Room]; ok {
+			return rm, rm.enterRoom(room)
+		}
+		if room, ok := rm.dmsMap[strings.TrimPrefix(msg.Room, "@")]; ok {
+			rm.CurrentRoom = room
+			return rm, nil
+		}
+		rm.CurrentRoom.Notice(fmt.Sprintf("You are not in %s", msg.Room))
 		return rm, nil
+	case OpenedConversationMessage:
+		rm.CurrentRoom = rm.conversation(msg.Peer)
+		return rm, nil
+	case PickedRoomMessage:
+		if room, ok := rm.roomsMap[msg.Room]; ok {
+			return rm, rm.enterRoom(room)
+		}
+		return rm, rm.joinRoom(msg.Room, "")
 	case TickMsg:
-		return rm, tea.Batch(doTick(), rm.UpdateUsersAndRooms())
+		return rm, tea.Batch(doTick(rm.pollEvery), rm.UpdateUsersAndRooms())
 	}
 
 	var cmd tea.Cmd
-	*rm.ChatComponent, cmd = rm.ChatComponent.Update(msg, rm.CurrentRoom.Name)
+	if rm.threadOpen() {
+		*rm.ThreadComponent, cmd = rm.ThreadComponent.Update(msg, rm.Thread)
+		return rm, cmd
+	}
+	*rm.ChatComponent, cmd = rm.ChatComponent.Update(msg, rm.CurrentRoom)
 
 	return rm, cmd
 }
 
-func doTick() tea.Cmd {
-	return tea.Tick(5*time.Second, func(t time.Time) tea.Msg {
+// enterRoom makes room the current room. Anything unread in it gets the new messages divider above it and is marked read
+func (rm *RootModel) enterRoom(room *Room) tea.Cmd {
+	room.divider = 0
+	if room.Unread > 0 {
+		room.divider = room.LastRead
+	}
+	rm.CurrentRoom = room
+	return rm.markRead()
+}
+
+// markReadInterval is the least time between MarkRead commands for a room, so a busy room doesn't use up the
+// command rate limit
+const markReadInterval = time.Second
+
+// markRead tells the server we have seen everything in the current room, which also clears our mentions in it.
+// If it was told too recently another try is scheduled instead
+func (rm *RootModel) markRead() tea.Cmd {
+	room := rm.CurrentRoom
+	if room == nil || room.Direct || (room.Unread == 0 && rm.RoomComponent.mentions[room.Name] == 0) {
+		return nil
+	}
+	now := time.Now()
+	if wait := room.markedRead.Add(markReadInterval).Sub(now); wait > 0 {
+		if room.markReadDue {
+			return nil
+		}
+		room.markReadDue = true
+		return tea.Tick(wait, func(time.Time) tea.Msg {
+			return MarkReadDueMessage{Room: room}
+		})
+	}
+	room.markedRead = now
+	seq := room.lastSeq
+	return func() tea.Msg {
+		rm.write(commands.CreateMarkReadMessage(room.Name, seq))
+		return nil
+	}
+}
+
+// ringBell rings the terminal bell if the user asked for it
+func (rm *RootModel) ringBell() tea.Cmd {
+	if !rm.bell {
+		return nil
+	}
+	return func() tea.Msg {
+		fmt.Fprint(os.Stdout, "\a")
+		return nil
+	}
+}
+
+// threadOpen is whether the thread pane is showing. It stays open but hidden while another room is current
+func (rm RootModel) threadOpen() bool {
+	return rm.Thread != nil && !rm.CurrentRoom.Direct && rm.Thread.Name == rm.CurrentRoom.Name
+}
+
+// openThread shows the replies to a message in the current room. What we already have is shown straight away
+// and the rest comes with the GetThread response
+func (rm *RootModel) openThread(id string) tea.Cmd {
+	room := rm.CurrentRoom.Name
+	rm.Thread = NewThread(room, id)
+	rm.Thread.MergeHistory(slices.DeleteFunc(slices.Clone(rm.CurrentRoom.RawMessages), func(msg protocol.Message) bool {
+		chat, ok := msg.Body.(protocol.ChatMessage)
+		return !ok || (msg.ID != id && chat.Parent != id)
+	}))
+	return func() tea.Msg {
+		rm.write(commands.CreateGetThreadMessage(room, id))
+		return nil
+	}
+}
+
+// roomsFor is the room and the open thread pane, if it is in that room, for events that change a message
+func (rm *RootModel) roomsFor(name string) []*Room {
+	rooms := []*Room{}
+	if room, ok := rm.roomsMap[name]; ok {
+		rooms = append(rooms, room)
+	}
+	if rm.Thread != nil && rm.Thread.Name == name {
+		rooms = append(rooms, rm.Thread)
+	}
+	return rooms
+}
+
+func doTick(every time.Duration) tea.Cmd {
+	return tea.Tick(every, func(t time.Time) tea.Msg {
 		return TickMsg(t)
 	})
 }
@@ -141,7 +351,25 @@ func (rm RootModel) RenderFooter(width, height int) string {
 
 func (rm RootModel) RenderChat(width, height int) string {
 	messages := rm.ChatComponent.ViewRoom(rm.CurrentRoom)
-	input := rm.ChatComponent.input.View()
+	if rm.RoomPicker.IsOpen() {
+		messages = rm.RoomPicker.View()
+	} else if rm.CurrentRoom.Topic != "" {
+		messages = fmt.Sprintf("Topic: %s\n\n%s", rm.CurrentRoom.Topic, messages)
+	}
+	typing := rm.CurrentRoom.TypingText(time.Now())
+	if !rm.threadOpen() || rm.RoomPicker.IsOpen() {
+		return renderChatPane(messages, typing, rm.ChatComponent, width, height)
+	}
+	thread := "Thread (ctrl+t to close)\n\n" + rm.ThreadComponent.ViewRoom(rm.Thread)
+	return lipgloss.JoinHorizontal(lipgloss.Top,
+		renderChatPane(messages, typing, rm.ChatComponent, width/2, height),
+		renderChatPane(thread, "", rm.ThreadComponent, width-width/2, height),
+	)
+}
+
+// renderChatPane draws messages in a box with the component's input under it
+func renderChatPane(messages, typing string, cc *ChatComponent, width, height int) string {
+	input := fmt.Sprintf("%s\n%s", typing, cc.input.View())
 
 	chatStyle := lipgloss.NewStyle().
 		Width(width - 2).
@@ -169,7 +397,7 @@ func (rm RootModel) RenderRooms(width, height int) string {
 }
 
 func (rm RootModel) RenderUsers(width, height int) string {
-	content := rm.UserComponent.View()
+	content := rm.UserComponent.ViewRoom(rm.CurrentRoom)
 	headerStyle := lipgloss.NewStyle().
 		Width(width - 2).
 		Height(height - 2).
@@ -179,13 +407,15 @@ func (rm RootModel) RenderUsers(width, height int) string {
 	return headerStyle.Render(content)
 }
 
-func ListenForMessages(c *websocket.Conn, sub chan protocol.Message) tea.Cmd {
+// ListenForMessages hands everything the server sends to sub. The connection reconnects by itself so an error
+// means it has given up
+func ListenForMessages(c *commands.Conn, sub chan protocol.Message) tea.Cmd {
 	translator := commands.Translator{}
 	return func() tea.Msg {
 		for {
 			_, data, err := c.ReadMessage()
 			if err != nil {
-				panic(err)
+				return ConnectionLostMessage{Err: err}
 			}
 			data = bytes.TrimSpace(bytes.ReplaceAll(data, []byte("\n"), []byte(" ")))
 			msg, err := translator.BytesToMessage(data)
@@ -198,28 +428,47 @@ func ListenForMessages(c *websocket.Conn, sub chan protocol.Message) tea.Cmd {
 	}
 }
 
-func (rm *RootModel) UpdateUsersAndRooms() tea.Cmd {
+// WriteMessages is the only goroutine that writes to the connection since a websocket can't take concurrent writes
+func WriteMessages(c *commands.Conn, outgoing chan []byte) tea.Cmd {
 	return func() tea.Msg {
-		roomMsg := commands.CreateListRoomMessage()
-		err := rm.Conn.WriteMessage(websocket.TextMessage, roomMsg)
-		if err != nil {
-			fmt.Printf("We got an error writing: %s", err)
-			panic(err)
-		}
-
-		userMsg := commands.CreateGetUsersMessage(rm.CurrentRoom.Name)
-		err = rm.Conn.WriteMessage(websocket.TextMessage, userMsg)
-		if err != nil {
-			fmt.Printf("We got an error writing: %s", err)
-			panic(err)
+		for data := range outgoing {
+			if err := c.WriteMessage(websocket.TextMessage, data); err != nil {
+				return ConnectionLostMessage{Err: err}
+			}
 		}
 		return nil
 	}
 }
 
+// write queues a message for the writer goroutine
+func (rm *RootModel) write(data []byte) {
+	rm.outgoing <- data
+}
+
+// UpdateUsersAndRooms asks for the full room and user lists in case a pushed update was missed
+func (rm *RootModel) UpdateUsersAndRooms() tea.Cmd {
+	if rm.CurrentRoom.Direct {
+		return rm.send(commands.CreateListRoomMessage())
+	}
+	return rm.send(commands.CreateListRoomMessage(), commands.CreateGetUsersMessage(rm.CurrentRoom.Name))
+}
+
 func (rm *RootModel) SendChatMessage(msg SendChatMessage) tea.Cmd {
+	if msg.Parent != "" && !strings.HasPrefix(msg.Message, "/") {
+		return rm.send(commands.CreateReplyMessage(msg.Message, rm.CurrentRoom.Name, msg.Parent))
+	}
+	return rm.handleMessage(msg.Message)
+}
+
+// SendTypingMessage tells the current room about typing. Direct conversations don't show it
+func (rm *RootModel) SendTypingMessage(msg SendTypingMessage) tea.Cmd {
+	if rm.CurrentRoom.Direct {
+		return nil
+	}
+	room := rm.CurrentRoom.Name
 	return func() tea.Msg {
-		return rm.handleMessage(msg.Message)
+		rm.write(commands.CreateTypingMessage(room, msg.Typing))
+		return nil
 	}
 }
 
@@ -233,25 +482,105 @@ func (rm *RootModel) ProcessMessage(msg protocol.Message) (tea.Model, tea.Cmd) {
 	rm.MessageCount++
 	switch body := msg.Body.(type) {
 	case protocol.ChatMessage:
-		roomName := body.Target
-		room, ok := rm.roomsMap[roomName]
+		if rm.Thread != nil && rm.Thread.Name == body.Target && body.Parent == rm.Thread.Thread {
+			rm.Thread.Add(msg)
+		}
+		return rm, rm.addToRoom(body.Target, msg)
+
+	case protocol.AnnouncementMessage:
+		return rm, rm.addToRoom(body.Target, msg)
+
+	case protocol.DirectMessage:
+		peer := body.From
+		if peer == rm.username {
+			peer = body.To
+		}
+		rm.conversation(peer).Add(msg)
+		return rm, nil
+
+	case protocol.ErrorMessage:
+		rm.CurrentRoom.Add(msg)
+		return rm, nil
+
+	case protocol.PresenceMessage:
+		rm.UserComponent.SetPresence(body)
+		return rm, nil
+
+	case protocol.EditedMessage:
+		for _, room := range rm.roomsFor(body.Target) {
+			room.UpdateChat(body.ID, func(chat *protocol.ChatMessage) {
+				chat.Message = body.Message
+				chat.Edited = body.Edited
+			})
+		}
+		return rm, nil
+
+	case protocol.DeletedMessage:
+		for _, room := range rm.roomsFor(body.Target) {
+			room.UpdateChat(body.ID, func(chat *protocol.ChatMessage) {
+				chat.Message = ""
+				chat.Deleted = true
+				chat.Reactions = nil
+			})
+		}
+		return rm, nil
+
+	case protocol.ReactionMessage:
+		for _, room := range rm.roomsFor(body.Target) {
+			room.ApplyReaction(body, rm.username)
+		}
+		return rm, nil
+
+	case protocol.RepliesMessage:
+		for _, room := range rm.roomsFor(body.Target) {
+			room.UpdateChat(body.ID, func(chat *protocol.ChatMessage) {
+				chat.Replies = body.Count
+			})
+		}
+		return rm, nil
+
+	case protocol.NotificationMessage:
+		rm.RoomComponent.mentions[body.Room] = body.Mentions
+		return rm, tea.Batch(rm.ringBell(), rm.markRead())
+
+	case protocol.UnreadMessage:
+		room, ok := rm.roomsMap[body.Room]
 		if !ok {
-			// This might need to be an error but I'm not sure how to show those yet
 			return rm, nil
 		}
-		room.RawMessages = append(room.RawMessages, msg)
-		room.RenderedMessages = append(room.RenderedMessages, renderChat(body))
+		room.Unread, room.LastRead = body.Unread, body.LastRead
+		rm.RoomComponent.unread[body.Room] = body.Unread
+		if room != rm.CurrentRoom {
+			return rm, nil
+		}
+		// whatever came in is already on screen
+		return rm, rm.markRead()
+
+	case protocol.ReadReceiptMessage:
+		if room, ok := rm.roomsMap[body.Room]; ok && body.Username != rm.username {
+			room.SetReceipt(body.Username, body.Seq)
+		}
 		return rm, nil
 
-	case protocol.AnnouncementMessage:
-		roomName := body.Target
-		room, ok := rm.roomsMap[roomName]
-		if !ok {
-			// This might need to be an error but I'm not sure how to show those yet
+	case protocol.TypingMessage:
+		room, ok := rm.roomsMap[body.Target]
+		if !ok || body.UserName == rm.username {
 			return rm, nil
 		}
-		room.RawMessages = append(room.RawMessages, msg)
-		room.RenderedMessages = append(room.RenderedMessages, renderAnnouncement(body))
+		room.SetTyping(body.UserName, body.Typing, time.Now())
+		if !body.Typing {
+			return rm, nil
+		}
+		return rm, tea.Tick(protocol.TypingTimeout, func(time.Time) tea.Msg {
+			return TypingExpiredMessage{}
+		})
+
+	case protocol.MembershipMessage:
+		rm.applyMembership(body)
+		return rm, nil
+
+	case protocol.WelcomeMessage:
+		rm.reconnected(body)
 		return rm, nil
 
 	case protocol.CommandMessage:
@@ -261,6 +590,136 @@ func (rm *RootModel) ProcessMessage(msg protocol.Message) (tea.Model, tea.Cmd) {
 	}
 }
 
+// reconnected catches up with the welcome after the connection came back. A resumed session is back in its rooms and
+// the server sends what was missed in them. Otherwise it starts again in the default room
+func (rm *RootModel) reconnected(welcome protocol.WelcomeMessage) {
+	rm.setUsername(welcome.Username)
+	rooms := welcome.Rooms
+	text := "Reconnected"
+	if !welcome.Resumed {
+		rooms = []string{welcome.Room}
+		text = "Reconnected as a new session. Rooms you were in need joining again"
+	}
+	for name := range rm.roomsMap {
+		if !slices.Contains(rooms, name) {
+			rm.removeRoom(name)
+		}
+	}
+	for _, name := range rooms {
+		rm.ensureRoom(name)
+	}
+	rm.CurrentRoom.Add(protocol.Message{Typ: "error", Time: time.Now(), Body: protocol.ErrorMessage{Message: text}})
+}
+
+// syncRooms updates the sidebar after roomsMap changes
+func (rm *RootModel) syncRooms() {
+	rm.RoomComponent.rooms = slices.Sorted(maps.Keys(rm.roomsMap))
+}
+
+// ensureRoom returns the room, adding it if the server says we are in a room we haven't seen yet
+func (rm *RootModel) ensureRoom(name string) *Room {
+	room, ok := rm.roomsMap[name]
+	if !ok {
+		room = NewRoom(name)
+		rm.roomsMap[name] = room
+		rm.syncRooms()
+	}
+	return room
+}
+
+// applyMembership keeps the room list and each room's members in step with the server.
+// When we join a room the server follows up with its member list so only other people are added here
+func (rm *RootModel) applyMembership(m protocol.MembershipMessage) {
+	if m.Username == rm.username {
+		switch m.Event {
+		case protocol.MembershipJoined:
+			rm.ensureRoom(m.Room)
+			return
+		case protocol.MembershipLeft, protocol.MembershipKicked:
+			rm.removeRoom(m.Room)
+			return
+		}
+	}
+	if m.Event == protocol.MembershipRenamed && m.OldUsername == rm.username {
+		rm.setUsername(m.Username)
+	}
+	room, ok := rm.roomsMap[m.Room]
+	if !ok {
+		return
+	}
+	switch m.Event {
+	case protocol.MembershipJoined:
+		if !slices.Contains(room.Users, m.Username) {
+			room.Users = append(room.Users, m.Username)
+		}
+	case protocol.MembershipLeft, protocol.MembershipKicked:
+		room.Users = slices.DeleteFunc(room.Users, func(u string) bool {
+			return u == m.Username
+		})
+		room.SetTyping(m.Username, false, time.Now())
+	case protocol.MembershipRenamed:
+		if i := slices.Index(room.Users, m.OldUsername); i >= 0 {
+			room.Users[i] = m.Username
+		}
+		if seq, ok := room.receipts[m.OldUsername]; ok {
+			delete(room.receipts, m.OldUsername)
+			room.receipts[m.Username] = seq
+		}
+		rm.UserComponent.Rename(m.OldUsername, m.Username)
+	}
+}
+
+// removeRoom forgets a room the user left or that was deleted. If it was the current room the user goes back to the default room
+func (rm *RootModel) removeRoom(name string) {
+	delete(rm.roomsMap, name)
+	delete(rm.RoomComponent.unread, name)
+	delete(rm.RoomComponent.mentions, name)
+	rm.syncRooms()
+	if rm.CurrentRoom.Name != name || rm.CurrentRoom.Direct {
+		return
+	}
+	if room, ok := rm.roomsMap[rm.defaultRoom]; ok {
+		rm.CurrentRoom = room
+		return
+	}
+	for _, room := range rm.roomsMap {
+		rm.CurrentRoom = room
+		return
+	}
+	// the server won't let the last room go but the tui still needs something to show
+	rm.CurrentRoom = NewRoom(rm.defaultRoom)
+	rm.roomsMap[rm.defaultRoom] = rm.CurrentRoom
+}
+
+// conversation returns the dm conversation with peer, creating it if this is the first message
+func (rm *RootModel) conversation(peer string) *Room {
+	room, ok := rm.dmsMap[peer]
+	if !ok {
+		room = NewDirectConversation(peer)
+		rm.dmsMap[peer] = room
+		rm.RoomComponent.dms = slices.Sorted(maps.Keys(rm.dmsMap))
+	}
+	return room
+}
+
+// addToRoom adds a live message to its room. If the seq shows messages were missed it asks for them
+func (rm *RootModel) addToRoom(roomName string, msg protocol.Message) tea.Cmd {
+	room, ok := rm.roomsMap[roomName]
+	if !ok {
+		// This might need to be an error but I'm not sure how to show those yet
+		return nil
+	}
+	after, gap := room.Add(msg)
+	if !gap {
+		return nil
+	}
+	return func() tea.Msg {
+		req := protocol.HistoryRequest{After: after, Before: msg.Seq, Limit: protocol.MaxHistoryLimit}
+		rm.write(commands.CreateHistoryMessage(roomName, req))
+		return nil
+	}
+}
+
 func (rm *RootModel) handleCommandBody(body protocol.CommandMessage) (tea.Model, tea.Cmd) {
 	switch body.Action {
 	case "ListRoomUsers":
@@ -274,87 +733,234 @@ func (rm *RootModel) handleCommandBody(body protocol.CommandMessage) (tea.Model,
 			return rm, nil
 		}
 		room.Users = *users
-		rm.UserComponent.users = *users
 	case "ListMyRooms":
 		rooms := &[]string{}
 		err := json.Unmarshal(body.Data, rooms)
 		if err != nil {
 			return rm, nil
 		}
-		for _, room := range *rooms {
-			_, ok := rm.roomsMap[room]
-			if !ok {
-				rm.roomsMap[room] = NewRoom(room)
+		// this is the polling fallback so it also drops rooms a missed membership event should have removed
+		for name := range rm.roomsMap {
+			if !slices.Contains(*rooms, name) {
+				rm.removeRoom(name)
 			}
 		}
-		rm.RoomComponent.rooms = slices.Collect(maps.Keys(rm.roomsMap))
+		for _, room := range *rooms {
+			rm.ensureRoom(room)
+		}
+		return rm, nil
+	case "ListAllRooms":
+		rooms := []protocol.RoomInfo{}
+		if err := json.Unmarshal(body.Data, &rooms); err != nil {
+			return rm, nil
+		}
+		rm.RoomPicker.Open(rooms)
+		return rm, nil
+	case "SetTopic":
+		var topic protocol.TopicRequest
+		if err := json.Unmarshal(body.Data, &topic); err != nil {
+			return rm, nil
+		}
+		// only members are sent topics and on a join this comes before the History response that adds the room
+		rm.ensureRoom(body.Target).Topic = topic.Topic
+		return rm, nil
+	case "Invite":
+		var invite protocol.InviteRequest
+		if err := json.Unmarshal(body.Data, &invite); err != nil {
+			return rm, nil
+		}
+		rm.CurrentRoom.Notice(fmt.Sprintf("%s invited you to %s. /join %s to go there", invite.User, body.Target, body.Target))
+		return rm, nil
+	case "LeaveRoom", "DeleteRoom":
+		rm.removeRoom(body.Target)
+		return rm, nil
+	case "SetReadReceipts":
+		var receipts protocol.ReadReceiptsRequest
+		if err := json.Unmarshal(body.Data, &receipts); err != nil {
+			return rm, nil
+		}
+		if room, ok := rm.roomsMap[body.Target]; ok && !receipts.Enabled {
+			room.receipts = nil
+		}
+		return rm, nil
+	case "ClearMentions":
+		delete(rm.RoomComponent.mentions, body.Target)
+		return rm, nil
+	case "GetThread":
+		messages := []protocol.Message{}
+		if err := json.Unmarshal(body.Data, &messages); err != nil || len(messages) == 0 {
+			return rm, nil
+		}
+		if rm.Thread != nil && rm.Thread.Name == body.Target && messages[0].ID == rm.Thread.Thread {
+			rm.Thread.MergeHistory(messages)
+		}
+		return rm, nil
+	case "History":
+		messages := []protocol.Message{}
+		err := json.Unmarshal(body.Data, &messages)
+		if err != nil {
+			return rm, nil
+		}
+		rm.ensureRoom(body.Target).MergeHistory(messages)
 		return rm, nil
 	}
 	return rm, nil
 }
 
 func renderChat(msg protocol.ChatMessage) string {
-	return fmt.Sprintf("%s: %s", msg.UserName, msg.Message)
+	text := fmt.Sprintf("%s: %s", msg.UserName, msg.Message)
+	if msg.Deleted {
+		text = fmt.Sprintf("%s: (message deleted)", msg.UserName)
+	} else if !msg.Edited.IsZero() {
+		text += " (edited)"
+	}
+	switch {
+	case msg.Replies == 1:
+		text += " [1 reply]"
+	case msg.Replies > 1:
+		text += fmt.Sprintf(" [%d replies]", msg.Replies)
+	}
+	return text
 }
 
 func renderAnnouncement(msg protocol.AnnouncementMessage) string {
 	return fmt.Sprintf("%s", msg.Message)
 }
 
-func (rm *RootModel) handleMessage(input string) tea.Msg {
+// react toggles our emoji on a message in the current room
+func (rm *RootModel) react(id, emoji string) tea.Cmd {
+	remove := rm.CurrentRoom.Reacted(id, emoji)
+	return rm.send(commands.CreateReactMessage(rm.CurrentRoom.Name, id, emoji, remove))
+}
+
+// joinRoom asks to join the room and for its recent history
+func (rm *RootModel) joinRoom(name, password string) tea.Cmd {
+	// the server handles commands in order so the history comes back after the join
+	return rm.send(commands.CreateJoinRoomMessage(name, password), commands.CreateHistoryMessage(name, protocol.HistoryRequest{}))
+}
+
+// send writes the messages from a command. They are built before it runs since commands must not read the model
+func (rm *RootModel) send(msgs ...[]byte) tea.Cmd {
+	return func() tea.Msg {
+		for _, msg := range msgs {
+			rm.write(msg)
+		}
+		return nil
+	}
+}
+
+// handleMessage turns what was typed into a command. It runs in Update, so it can read the model, and only the
+// write happens in the command
+func (rm *RootModel) handleMessage(input string) tea.Cmd {
 	if len(input) > 0 && input[0] == '/' {
 		tokens := strings.Split(input, " ")
 		switch tokens[0] {
 		case "/quit":
 			break
 		case "/create":
-			msg := commands.CreateCreateRoomMessage(tokens[1])
-			err := rm.Conn.WriteMessage(websocket.TextMessage, msg)
-			if err != nil {
-				fmt.Printf("We got an error writing: %s", err)
-				panic(err)
+			name, req, ok := commands.ParseCreateRoom(tokens)
+			if !ok {
+				return nil
 			}
-			return nil
+			return rm.send(commands.CreateCreateRoomMessage(name, req))
 		case "/join":
-			msg := commands.CreateJoinRoomMessage(tokens[1])
-			err := rm.Conn.WriteMessage(websocket.TextMessage, msg)
-			if err != nil {
-				fmt.Printf("We got an error writing: %s", err)
-				panic(err)
+			if len(tokens) < 2 {
+				return nil
 			}
-			return nil
-		// TODO: Implement Switch
+			password := ""
+			if len(tokens) > 2 {
+				password = tokens[2]
+			}
+			return rm.joinRoom(tokens[1], password)
+		case "/status":
+			return rm.send(commands.CreateSetStatusMessage(strings.Join(tokens[1:], " ")))
+		case "/edit", "/unsend":
+			// both work on your last message in the room since the tui has no way to pick one yet
+			last, ok := rm.CurrentRoom.LastChatFrom(rm.username)
+			if !ok || rm.CurrentRoom.Direct {
+				return nil
+			}
+			if tokens[0] == "/unsend" {
+				return rm.send(commands.CreateDeleteMessage(rm.CurrentRoom.Name, last.ID))
+			}
+			if len(tokens) < 2 {
+				return nil
+			}
+			return rm.send(commands.CreateEditMessage(rm.CurrentRoom.Name, last.ID, strings.Join(tokens[1:], " ")))
+		case "/react":
+			// the selected message, or the newest one when nothing is selected
+			id := rm.ChatComponent.Selected(rm.CurrentRoom)
+			if ids := rm.CurrentRoom.chatIDs(); id == "" && len(ids) > 0 {
+				id = ids[len(ids)-1]
+			}
+			if len(tokens) < 2 || id == "" || rm.CurrentRoom.Direct {
+				return nil
+			}
+			return rm.react(id, tokens[1])
+		case "/receipts":
+			if len(tokens) < 2 || rm.CurrentRoom.Direct {
+				return nil
+			}
+			return rm.send(commands.CreateSetReadReceiptsMessage(rm.CurrentRoom.Name, tokens[1] == "on"))
+		case "/topic":
+			return rm.send(commands.CreateSetTopicMessage(rm.CurrentRoom.Name, strings.Join(tokens[1:], " ")))
 		case "/switch":
-			if r, ok := rm.roomsMap[tokens[1]]; ok {
-				rm.CurrentRoom = r
-			} else {
-				panic(fmt.Errorf("SOMETHING IS WRONG"))
+			// Update finds the room so the room can be marked read
+			if len(tokens) < 2 {
+				return nil
+			}
+			return func() tea.Msg {
+				return SwitchedRoomsMessage{tokens[1]}
+			}
+		case "/msg":
+			if len(tokens) < 3 {
+				return nil
+			}
+			msg := commands.CreateDirectMessage(tokens[1], strings.Join(tokens[2:], " "))
+			return func() tea.Msg {
+				rm.write(msg)
+				return OpenedConversationMessage{tokens[1]}
 			}
-			return SwitchedRoomsMessage{tokens[1]}
 
-		case "/list":
-			msg := commands.CreateListRoomMessage()
-			err := rm.Conn.WriteMessage(websocket.TextMessage, msg)
-			if err != nil {
-				fmt.Printf("We got an error writing: %s", err)
-				panic(err)
+		case "/kick", "/ban", "/unban", "/mute", "/unmute", "/op", "/deop":
+			msg, ok := commands.CreateModerationMessage(tokens, rm.CurrentRoom.Name)
+			if !ok {
+				return nil
 			}
-			return nil
+			return rm.send(msg)
+		case "/invite":
+			if len(tokens) < 2 {
+				return nil
+			}
+			return rm.send(commands.CreateInviteMessage(rm.CurrentRoom.Name, tokens[1]))
+		case "/rooms":
+			return rm.send(commands.CreateListAllRoomsMessage())
+		case "/leave":
+			room := rm.CurrentRoom.Name
+			if len(tokens) > 1 {
+				room = tokens[1]
+			} else if rm.CurrentRoom.Direct {
+				return nil
+			}
+			return rm.send(commands.CreateLeaveRoomMessage(room))
+		case "/delete":
+			// unlike leaving there is no default. Deleting a room has to name it
+			if len(tokens) < 2 {
+				return nil
+			}
+			return rm.send(commands.CreateDeleteRoomMessage(tokens[1]))
+		case "/list":
+			return rm.send(commands.CreateListRoomMessage())
 		case "/changeUsername":
-			msg := commands.CreateChangeUsernameMessage(tokens[1])
-			err := rm.Conn.WriteMessage(websocket.TextMessage, msg)
-			if err != nil {
-				fmt.Printf("We got an error writing: %s", err)
-				panic(err)
+			if len(tokens) < 2 {
+				return nil
 			}
-			return nil
+			return rm.send(commands.CreateChangeUsernameMessage(tokens[1]))
 		}
 	}
 	chat := commands.CreateChatMessage(input, rm.CurrentRoom.Name)
-	err := rm.Conn.WriteMessage(websocket.TextMessage, chat)
-	if err != nil {
-		fmt.Printf("We got an error writing: %s", err)
-		panic(err)
+	if rm.CurrentRoom.Direct {
+		chat = commands.CreateDirectMessage(rm.CurrentRoom.Name, input)
 	}
-	return nil
+	return rm.send(chat)
 }
@@ -0,0 +1,251 @@
+package tui
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dylanmccormick/ws-chat/internal/protocol"
+)
+
+func TestApplyMembership(t *testing.T) {
+	rm := NewRootModel(nil, protocol.WelcomeMessage{Username: "alice", Room: "lobby"})
+	event := func(room, event, username, old string) {
+		rm.applyMembership(protocol.MembershipMessage{Room: room, Event: event, Username: username, OldUsername: old})
+	}
+
+	event("games", protocol.MembershipJoined, "alice", "")
+	if !slices.Equal(rm.RoomComponent.rooms, []string{"games", "lobby"}) {
+		t.Errorf("Expected joining to add the room. got=%v", rm.RoomComponent.rooms)
+	}
+	games := rm.roomsMap["games"]
+	games.Users = []string{"alice"}
+	event("games", protocol.MembershipJoined, "bob", "")
+	event("games", protocol.MembershipJoined, "bob", "")
+	event("games", protocol.MembershipJoined, "carol", "")
+	event("games", protocol.MembershipLeft, "carol", "")
+	if !slices.Equal(games.Users, []string{"alice", "bob"}) {
+		t.Errorf("Unexpected members after joins and a leave. got=%v", games.Users)
+	}
+
+	event("games", protocol.MembershipRenamed, "alicia", "alice")
+	event("games", protocol.MembershipRenamed, "robert", "bob")
+	if rm.username != "alicia" {
+		t.Errorf("Expected our own rename to change our username. got=%s", rm.username)
+	}
+	if !slices.Equal(games.Users, []string{"alicia", "robert"}) {
+		t.Errorf("Unexpected members after renames. got=%v", games.Users)
+	}
+
+	rm.CurrentRoom = games
+	event("games", protocol.MembershipKicked, "alicia", "")
+	if _, ok := rm.roomsMap["games"]; ok {
+		t.Errorf("Expected being kicked to remove the room")
+	}
+	if rm.CurrentRoom.Name != "lobby" {
+		t.Errorf("Expected to be moved back to the lobby. got=%s", rm.CurrentRoom.Name)
+	}
+}
+
+func TestEditedAndDeletedMessages(t *testing.T) {
+	rm := NewRootModel(nil, protocol.WelcomeMessage{Username: "alice", Room: "lobby"})
+	lobby := rm.roomsMap["lobby"]
+	rm.ProcessMessage(protocol.Message{Typ: "chat", ID: "1", Seq: 1, Body: protocol.ChatMessage{Message: "helo", Target: "lobby", UserName: "alice"}})
+	rm.ProcessMessage(protocol.Message{Typ: "chat", ID: "2", Seq: 2, Body: protocol.ChatMessage{Message: "hi", Target: "lobby", UserName: "bob"}})
+
+	if last, ok := lobby.LastChatFrom("alice"); !ok || last.ID != "1" {
+		t.Errorf("Expected alice's last message to be 1. got=%+v", last)
+	}
+	rm.ProcessMessage(protocol.Message{Typ: "edited", Body: protocol.EditedMessage{ID: "1", Target: "lobby", Message: "hello", UserName: "alice", Edited: time.Now(), By: "alice"}})
+	rm.ProcessMessage(protocol.Message{Typ: "deleted", Body: protocol.DeletedMessage{ID: "2", Target: "lobby", By: "alice"}})
+	want := []string{"alice: hello (edited)", "bob: (message deleted)"}
+	if !slices.Equal(lobby.RenderedMessages, want) {
+		t.Errorf("Unexpected messages after edit and delete.\nexpected=%q\ngot=%q", want, lobby.RenderedMessages)
+	}
+	if _, ok := lobby.LastChatFrom("bob"); ok {
+		t.Errorf("A deleted message shouldn't count as bob's last")
+	}
+}
+
+func TestThreadPane(t *testing.T) {
+	rm := NewRootModel(nil, protocol.WelcomeMessage{Username: "alice", Room: "lobby"})
+	chat := func(id string, seq uint64, user, text, parent string) protocol.Message {
+		return protocol.Message{Typ: "chat", ID: id, Seq: seq, Body: protocol.ChatMessage{Message: text, Target: "lobby", UserName: user, Parent: parent}}
+	}
+	rm.ProcessMessage(chat("1", 1, "alice", "anyone up for a game?", ""))
+	replies := func(count int) protocol.Message {
+		return protocol.Message{Typ: "replies", Body: protocol.RepliesMessage{ID: "1", Target: "lobby", Count: count}}
+	}
+	rm.ProcessMessage(chat("2", 2, "bob", "me", "1"))
+	rm.ProcessMessage(replies(1))
+	rm.ProcessMessage(chat("3", 3, "carol", "unrelated", ""))
+
+	expected := "alice: anyone up for a game? [1 reply]\ncarol: unrelated\n"
+	if got := rm.ChatComponent.ViewRoom(rm.CurrentRoom); got != expected {
+		t.Errorf("Expected replies to stay out of the room.\nexpected=%q\ngot=%q", expected, got)
+	}
+
+	rm.openThread("1")
+	if !rm.threadOpen() {
+		t.Fatalf("Expected the thread to be open")
+	}
+	rm.ProcessMessage(chat("4", 4, "alice", "great", "1"))
+	rm.ProcessMessage(replies(2))
+	rm.handleCommandBody(protocol.CommandMessage{Action: "GetThread", Target: "lobby", Data: []byte(`[
+		{"type":"chat","id":"1","seq":1,"body":{"message":"anyone up for a game?","target":"lobby","username":"alice","replies":2}},
+		{"type":"chat","id":"2","seq":2,"body":{"message":"me","target":"lobby","username":"bob","parent_id":"1"}},
+		{"type":"chat","id":"4","seq":4,"body":{"message":"great","target":"lobby","username":"alice","parent_id":"1"}}
+	]`)})
+	expected = "alice: anyone up for a game? [2 replies]\nbob: me\nalice: great\n"
+	if got := rm.ThreadComponent.ViewRoom(rm.Thread); got != expected {
+		t.Errorf("Unexpected thread.\nexpected=%q\ngot=%q", expected, got)
+	}
+
+	rm.CurrentRoom = rm.conversation("bob")
+	if rm.threadOpen() {
+		t.Errorf("The thread pane should hide in another room")
+	}
+}
+
+func TestMentions(t *testing.T) {
+	rm := NewRootModel(nil, protocol.WelcomeMessage{Username: "alice", Room: "lobby"})
+	rm.ensureRoom("games")
+	rm.ProcessMessage(protocol.Message{Typ: "notification", Body: protocol.NotificationMessage{Room: "games", MessageID: "7", From: "bob", Message: "@alice you in?", Kind: protocol.MentionUser, Mentions: 2}})
+	if got := rm.RoomComponent.View(); !strings.Contains(got, "games @2") {
+		t.Errorf("Expected a mention badge on games, got %q", got)
+	}
+	if len(rm.outgoing) != 0 {
+		t.Errorf("Mentions in another room shouldn't be cleared")
+	}
+
+	_, cmd := rm.Update(SwitchedRoomsMessage{Room: "games"})
+	if cmd == nil {
+		t.Fatalf("Expected switching to games to clear its mentions")
+	}
+	cmd()
+	// marking the room read clears its mentions too
+	if got := string(<-rm.outgoing); !strings.Contains(got, "MarkRead") {
+		t.Errorf("Expected a MarkRead command, got %s", got)
+	}
+	rm.handleCommandBody(protocol.CommandMessage{Action: "ClearMentions", Target: "games"})
+	if got := rm.RoomComponent.View(); strings.Contains(got, "@2") {
+		t.Errorf("Expected the badge to be gone, got %q", got)
+	}
+
+	for text, expected := range map[string]bool{
+		"hey @alice":       true,
+		"@room lunch?":     true,
+		"@alicia hi":       false,
+		"mail me@alice.io": false,
+		"hi alice":         false,
+		"thanks @alice.":   true,
+		"@alice.smith hi":  false,
+		"@alice-bot ping":  false,
+	} {
+		if got := mentionPattern("alice").MatchString(text); got != expected {
+			t.Errorf("mentionPattern(alice) matching %q = %v, expected %v", text, got, expected)
+		}
+	}
+	// the server reads @bob.smith as a mention of bob.smith, so bob isn't highlighted for it
+	rm.setUsername("bob")
+	if rm.ChatComponent.mentions.MatchString("@bob.smith lunch?") || !rm.ThreadComponent.mentions.MatchString("@bob. lunch?") {
+		t.Errorf("Expected only a name ending in full stops to count as a mention of bob")
+	}
+}
+
+func TestUnreadAndReceipts(t *testing.T) {
+	rm := NewRootModel(nil, protocol.WelcomeMessage{Username: "alice", Room: "lobby"})
+	games := rm.ensureRoom("games")
+	chat := func(id string, seq uint64, user, text string) protocol.Message {
+		return protocol.Message{Typ: "chat", ID: id, Seq: seq, Body: protocol.ChatMessage{Message: text, Target: "games", UserName: user}}
+	}
+	rm.ProcessMessage(chat("1", 1, "alice", "anyone around?"))
+	rm.ProcessMessage(chat("2", 2, "bob", "me"))
+	rm.ProcessMessage(chat("3", 3, "carol", "me too"))
+	rm.ProcessMessage(protocol.Message{Typ: "unread", Body: protocol.UnreadMessage{Room: "games", Unread: 2, LastRead: 1}})
+	if rm.RoomComponent.unread["games"] != 2 || len(rm.outgoing) != 0 {
+		t.Fatalf("Expected games to have 2 unread without marking it read")
+	}
+
+	_, cmd := rm.Update(SwitchedRoomsMessage{Room: "games"})
+	cmd()
+	if got := string(<-rm.outgoing); !strings.Contains(got, `"action":"MarkRead"`) || !strings.Contains(got, `"seq":3`) {
+		t.Errorf("Expected games to be marked read up to 3, got %s", got)
+	}
+	rm.ProcessMessage(protocol.Message{Typ: "unread", Body: protocol.UnreadMessage{Room: "games", Unread: 0, LastRead: 3}})
+	if rm.RoomComponent.unread["games"] != 0 || len(rm.outgoing) != 0 {
+		t.Errorf("Expected games to be read")
+	}
+
+	rm.ProcessMessage(protocol.Message{Typ: "read", Body: protocol.ReadReceiptMessage{Room: "games", Username: "bob", Seq: 3}})
+	rm.ProcessMessage(protocol.Message{Typ: "read", Body: protocol.ReadReceiptMessage{Room: "games", Username: "carol", Seq: 2}})
+	expected := "alice: anyone around?\n" + newMessagesDivider + "\nbob: me\n    seen by carol\ncarol: me too\n    seen by bob\n"
+	if got := rm.ChatComponent.ViewRoom(games); got != expected {
+		t.Errorf("Unexpected room.\nexpected=%q\ngot=%q", expected, got)
+	}
+
+	// reading a room you are looking at doesn't leave a divider behind
+	rm.enterRoom(games)
+	if got := rm.ChatComponent.ViewRoom(games); strings.Contains(got, newMessagesDivider) {
+		t.Errorf("Expected no divider once everything was read, got %q", got)
+	}
+}
+
+func TestReconnected(t *testing.T) {
+	rm := NewRootModel(nil, protocol.WelcomeMessage{Username: "alice", Room: "lobby"})
+	rm.ensureRoom("games")
+	rm.ensureRoom("music")
+
+	rm.ProcessMessage(protocol.Message{Typ: "welcome", Body: protocol.WelcomeMessage{Username: "alice", Room: "games", Resumed: true, Rooms: []string{"games", "lobby"}}})
+	if !slices.Equal(rm.RoomComponent.rooms, []string{"games", "lobby"}) {
+		t.Errorf("Expected a resumed session to keep the rooms it got back. got=%v", rm.RoomComponent.rooms)
+	}
+
+	rm.ProcessMessage(protocol.Message{Typ: "welcome", Body: protocol.WelcomeMessage{Username: "alice2", Room: "lobby"}})
+	if !slices.Equal(rm.RoomComponent.rooms, []string{"lobby"}) || rm.username != "alice2" {
+		t.Errorf("Expected a new session to start over in the lobby. got=%v as %s", rm.RoomComponent.rooms, rm.username)
+	}
+	last := rm.CurrentRoom.RenderedMessages[len(rm.CurrentRoom.RenderedMessages)-1]
+	if !strings.Contains(last, "Reconnected as a new session") {
+		t.Errorf("Expected a notice about the new session. got=%q", last)
+	}
+}
+
+func TestCommandsWithoutArguments(t *testing.T) {
+	rm := NewRootModel(nil, protocol.WelcomeMessage{Username: "alice", Room: "lobby"})
+	rm.ensureRoom("games")
+	rm.CurrentRoom = rm.roomsMap["games"]
+
+	for _, input := range []string{"/delete", "/join", "/switch", "/changeUsername", "/switch nowhere"} {
+		if cmd := rm.handleMessage(input); cmd != nil {
+			cmd()
+		}
+	}
+	if len(rm.outgoing) != 0 {
+		t.Errorf("Expected nothing to be sent for commands missing what they act on. got=%s", <-rm.outgoing)
+	}
+
+	rm.handleMessage("/leave")()
+	if got := string(<-rm.outgoing); !strings.Contains(got, `"action":"LeaveRoom"`) || !strings.Contains(got, `"target":"games"`) {
+		t.Errorf("Expected /leave to leave the current room. got=%s", got)
+	}
+}
+
+func TestSwitchToMissingRoom(t *testing.T) {
+	rm := NewRootModel(nil, protocol.WelcomeMessage{Username: "alice", Room: "lobby"})
+	rm.ensureRoom("games")
+
+	// the room can go away between typing /switch and Update getting the message
+	switched := rm.handleMessage("/switch games")()
+	rm.removeRoom("games")
+	model, _ := rm.Update(switched)
+	rm = model.(RootModel)
+	if rm.CurrentRoom.Name != "lobby" {
+		t.Errorf("Expected to stay in the lobby. got=%s", rm.CurrentRoom.Name)
+	}
+	last := rm.CurrentRoom.RenderedMessages[len(rm.CurrentRoom.RenderedMessages)-1]
+	if !strings.Contains(last, "You are not in games") {
+		t.Errorf("Expected a notice about the missing room. got=%q", last)
+	}
+}
@@ -0,0 +1,51 @@
+package tui
+
+import (
+	"testing"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/dylanmccormick/ws-chat/internal/protocol"
+)
+
+func TestReactions(t *testing.T) {
+	room := NewRoom("lobby")
+	room.Add(protocol.Message{ID: "1", Seq: 1, Body: protocol.ChatMessage{Message: "hello", Target: "lobby", UserName: "alice"}})
+	room.Add(protocol.Message{ID: "2", Seq: 2, Body: protocol.ChatMessage{Message: "hi", Target: "lobby", UserName: "bob"}})
+	cc := NewChatComponent()
+	key := func(k tea.KeyType) tea.Cmd {
+		_, cmd := cc.Update(tea.KeyMsg{Type: k}, room)
+		return cmd
+	}
+
+	key(tea.KeyUp)
+	key(tea.KeyUp)
+	if got := cc.Selected(room); got != "1" {
+		t.Errorf("Expected up twice to select the first message. got=%q", got)
+	}
+	cmd := key(tea.KeyCtrlE)
+	if cmd == nil {
+		t.Fatalf("Expected the react key to react to the selected message")
+	}
+	if got := cmd(); got != (ReactMessage{ID: "1", Emoji: defaultReaction}) {
+		t.Errorf("Unexpected react message. got=%+v", got)
+	}
+
+	room.ApplyReaction(protocol.ReactionMessage{ID: "1", Target: "lobby", Emoji: "👍", User: "bob", Added: true, Count: 1}, "alice")
+	room.ApplyReaction(protocol.ReactionMessage{ID: "1", Target: "lobby", Emoji: "👍", User: "alice", Added: true, Count: 2}, "alice")
+	room.ApplyReaction(protocol.ReactionMessage{ID: "1", Target: "lobby", Emoji: "🎉", User: "bob", Added: true, Count: 1}, "alice")
+	expected := "> alice: hello\n    👍 2  🎉 1\nbob: hi\n"
+	if got := cc.ViewRoom(room); got != expected {
+		t.Errorf("Unexpected view.\nexpected=%q\ngot=%q", expected, got)
+	}
+	if !room.Reacted("1", "👍") || room.Reacted("1", "🎉") {
+		t.Errorf("Expected alice to have reacted with 👍 only")
+	}
+
+	room.ApplyReaction(protocol.ReactionMessage{ID: "1", Target: "lobby", Emoji: "🎉", User: "bob", Added: false, Count: 0}, "alice")
+	key(tea.KeyDown)
+	key(tea.KeyDown)
+	expected = "alice: hello\n    👍 2\nbob: hi\n"
+	if got := cc.ViewRoom(room); got != expected {
+		t.Errorf("Expected the selection to clear going down past the newest message.\nexpected=%q\ngot=%q", expected, got)
+	}
+}
@@ -1,12 +1,47 @@
 package tui
 
-import "github.com/dylanmccormick/ws-chat/internal/protocol"
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/dylanmccormick/ws-chat/internal/protocol"
+)
 
 type Room struct {
 	Name             string
 	RawMessages      []protocol.Message
 	RenderedMessages []string
 	Users            []string
+	Topic            string
+	Direct           bool   // a dm conversation. Name is the other user
+	Thread           string // set on a thread pane to the id of the message the thread hangs off. Name is still the room
+
+	Unread   int    // chats from others the server says we haven't read
+	LastRead uint64 // the seq we have read up to
+
+	lastSeq  uint64               // newest seq seen in this room
+	typing   map[string]time.Time // who is typing and when to stop believing it if we don't hear again
+	divider  uint64               // the new messages divider goes after this seq. 0 is no divider
+	receipts map[string]uint64    // how far other users have read, in rooms with read receipts
+
+	markedRead  time.Time // when MarkRead was last sent
+	markReadDue bool      // another MarkRead is scheduled
+}
+
+func NewDirectConversation(peer string) *Room {
+	r := NewRoom(peer)
+	r.Direct = true
+	return r
+}
+
+// NewThread is a thread pane for the replies to parent in the room
+func NewThread(room, parent string) *Room {
+	r := NewRoom(room)
+	r.Thread = parent
+	return r
 }
 
 func NewRoom(name string) *Room {
@@ -17,3 +52,210 @@ func NewRoom(name string) *Room {
 		Users:            []string{},
 	}
 }
+
+// Add appends a live message. When its seq jumps past the last one seen, gap is true and after is the last seq
+// before the jump so the missing messages can be asked for
+func (r *Room) Add(msg protocol.Message) (after uint64, gap bool) {
+	if msg.Seq != 0 {
+		if msg.Seq <= r.lastSeq {
+			// already have it from a History response
+			return 0, false
+		}
+		after, gap = r.lastSeq, r.lastSeq != 0 && msg.Seq > r.lastSeq+1
+		r.lastSeq = msg.Seq
+	}
+	if chat, ok := msg.Body.(protocol.ChatMessage); ok {
+		delete(r.typing, chat.UserName)
+	}
+	r.RawMessages = append(r.RawMessages, msg)
+	r.RenderedMessages = append(r.RenderedMessages, renderMessage(msg))
+	return after, gap
+}
+
+// UpdateChat applies an edited or deleted event to the message with the id, if we have it
+func (r *Room) UpdateChat(id string, change func(*protocol.ChatMessage)) {
+	i := slices.IndexFunc(r.RawMessages, func(m protocol.Message) bool {
+		return m.ID == id
+	})
+	if i < 0 {
+		return
+	}
+	chat, ok := r.RawMessages[i].Body.(protocol.ChatMessage)
+	if !ok {
+		return
+	}
+	change(&chat)
+	r.RawMessages[i].Body = chat
+	r.RenderedMessages[i] = renderMessage(r.RawMessages[i])
+}
+
+// Shows is whether the message belongs in this view of the room. Replies only show in their thread
+func (r *Room) Shows(msg protocol.Message) bool {
+	chat, ok := msg.Body.(protocol.ChatMessage)
+	return !ok || chat.Parent == "" || r.Thread != ""
+}
+
+// chatIDs are the ids of the chat messages on show that can still be reacted to, oldest first
+func (r *Room) chatIDs() []string {
+	ids := []string{}
+	for _, msg := range r.RawMessages {
+		if chat, ok := msg.Body.(protocol.ChatMessage); ok && !chat.Deleted && msg.ID != "" && r.Shows(msg) {
+			ids = append(ids, msg.ID)
+		}
+	}
+	return ids
+}
+
+// ApplyReaction updates a message's reactions from a reaction event. self is our username, to tell which are ours
+func (r *Room) ApplyReaction(event protocol.ReactionMessage, self string) {
+	r.UpdateChat(event.ID, func(chat *protocol.ChatMessage) {
+		reactions := slices.Clone(chat.Reactions)
+		i := slices.IndexFunc(reactions, func(re protocol.Reaction) bool { return re.Emoji == event.Emoji })
+		if i < 0 {
+			reactions = append(reactions, protocol.Reaction{Emoji: event.Emoji})
+			i = len(reactions) - 1
+		}
+		if event.User == self {
+			reactions[i].Mine = event.Added
+		}
+		reactions[i].Count = event.Count
+		if event.Count == 0 {
+			reactions = slices.Delete(reactions, i, i+1)
+		}
+		chat.Reactions = reactions
+	})
+}
+
+// Reacted is whether we have reacted to the message with emoji
+func (r *Room) Reacted(id, emoji string) bool {
+	for _, msg := range r.RawMessages {
+		chat, ok := msg.Body.(protocol.ChatMessage)
+		if !ok || msg.ID != id {
+			continue
+		}
+		for _, re := range chat.Reactions {
+			if re.Emoji == emoji {
+				return re.Mine
+			}
+		}
+	}
+	return false
+}
+
+// LastChatFrom is the newest message user sent to the room that hasn't been deleted
+func (r *Room) LastChatFrom(user string) (protocol.Message, bool) {
+	for _, msg := range slices.Backward(r.RawMessages) {
+		if chat, ok := msg.Body.(protocol.ChatMessage); ok && chat.UserName == user && !chat.Deleted && msg.ID != "" {
+			return msg, true
+		}
+	}
+	return protocol.Message{}, false
+}
+
+// SetTyping records that user started or stopped typing. Anyone who has stopped for good is dropped along the way
+func (r *Room) SetTyping(user string, typing bool, now time.Time) {
+	maps.DeleteFunc(r.typing, func(_ string, until time.Time) bool {
+		return !now.Before(until)
+	})
+	if !typing {
+		delete(r.typing, user)
+		return
+	}
+	if r.typing == nil {
+		r.typing = map[string]time.Time{}
+	}
+	r.typing[user] = now.Add(protocol.TypingTimeout)
+}
+
+// TypingText is the line shown above the input, like "alice is typing…", or "" when nobody is
+func (r *Room) TypingText(now time.Time) string {
+	names := []string{}
+	for user, until := range r.typing {
+		if now.Before(until) {
+			names = append(names, user)
+		}
+	}
+	slices.Sort(names)
+	switch len(names) {
+	case 0:
+		return ""
+	case 1:
+		return fmt.Sprintf("%s is typing…", names[0])
+	case 2:
+		return fmt.Sprintf("%s and %s are typing…", names[0], names[1])
+	default:
+		return "Several people are typing…"
+	}
+}
+
+// SetReceipt records how far user has read
+func (r *Room) SetReceipt(user string, seq uint64) {
+	if r.receipts == nil {
+		r.receipts = map[string]uint64{}
+	}
+	r.receipts[user] = seq
+}
+
+// SeenBy is who has read up to each message, by message id. A receipt goes on the newest message on show that it
+// covers, so someone who read up to a reply is shown on the message before it
+func (r *Room) SeenBy() map[string][]string {
+	seen := map[string][]string{}
+	for user, seq := range r.receipts {
+		for _, msg := range slices.Backward(r.RawMessages) {
+			if msg.Seq != 0 && msg.Seq <= seq && msg.ID != "" && r.Shows(msg) {
+				seen[msg.ID] = append(seen[msg.ID], user)
+				break
+			}
+		}
+	}
+	for _, users := range seen {
+		slices.Sort(users)
+	}
+	return seen
+}
+
+// Notice shows a line from the client itself, like a command response, in the room
+func (r *Room) Notice(text string) {
+	r.Add(protocol.Message{Typ: "announcement", Body: protocol.AnnouncementMessage{Message: text, Target: r.Name}})
+}
+
+// MergeHistory mixes messages from a History response in with the ones already received, in seq order
+func (r *Room) MergeHistory(msgs []protocol.Message) {
+	seen := map[uint64]bool{}
+	merged := []protocol.Message{}
+	for _, msg := range slices.Concat(r.RawMessages, msgs) {
+		if msg.Seq != 0 && seen[msg.Seq] {
+			continue
+		}
+		seen[msg.Seq] = true
+		merged = append(merged, msg)
+		r.lastSeq = max(r.lastSeq, msg.Seq)
+	}
+	slices.SortStableFunc(merged, func(a, b protocol.Message) int {
+		return cmp.Compare(a.Seq, b.Seq)
+	})
+	r.RawMessages = merged
+	r.RenderedMessages = make([]string, 0, len(merged))
+	for _, msg := range merged {
+		r.RenderedMessages = append(r.RenderedMessages, renderMessage(msg))
+	}
+}
+
+// renderMessage prefixes the message with the local time the server got it
+func renderMessage(msg protocol.Message) string {
+	text := ""
+	switch body := msg.Body.(type) {
+	case protocol.ChatMessage:
+		text = renderChat(body)
+	case protocol.AnnouncementMessage:
+		text = renderAnnouncement(body)
+	case protocol.DirectMessage:
+		text = fmt.Sprintf("%s: %s", body.From, body.Message)
+	case protocol.ErrorMessage:
+		text = fmt.Sprintf("! %s", body.Message)
+	}
+	if msg.Time.IsZero() {
+		return text
+	}
+	return fmt.Sprintf("[%s] %s", msg.Time.Local().Format("15:04"), text)
+}
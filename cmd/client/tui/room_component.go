@@ -4,17 +4,37 @@ import (
 	"fmt"
 
 	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
 )
 
 type RoomComponent struct {
-	focused bool
-	rooms   []string
+	focused  bool
+	rooms    []string
+	dms      []string       // users with an open dm conversation
+	mentions map[string]int // unread mentions by room
+	unread   map[string]int // unread messages by room
 }
 
+var unreadStyle = lipgloss.NewStyle().Bold(true)
+
 func (cc RoomComponent) View() string {
 	str := ""
 	for _, room := range cc.rooms {
-		str += fmt.Sprintf("%s\n", room)
+		name := room
+		if cc.unread[room] > 0 {
+			name = unreadStyle.Render(room)
+		}
+		if n := cc.mentions[room]; n > 0 {
+			str += fmt.Sprintf("%s @%d\n", name, n)
+			continue
+		}
+		str += fmt.Sprintf("%s\n", name)
+	}
+	if len(cc.dms) > 0 {
+		str += "\nDirect Messages\n"
+		for _, peer := range cc.dms {
+			str += fmt.Sprintf("@%s\n", peer)
+		}
 	}
 	return str
 }
@@ -29,7 +49,9 @@ func (cc RoomComponent) Init() tea.Cmd {
 
 func NewRoomComponent() *RoomComponent {
 	return &RoomComponent{
-		focused: false,
-		rooms:   []string{"room1", "room2", "lobby"},
+		focused:  false,
+		rooms:    []string{},
+		mentions: map[string]int{},
+		unread:   map[string]int{},
 	}
 }
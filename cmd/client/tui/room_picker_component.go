@@ -0,0 +1,97 @@
+package tui
+
+import (
+	"fmt"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/dylanmccormick/ws-chat/internal/protocol"
+)
+
+// PickedRoomMessage is sent when a room is chosen in the picker
+type PickedRoomMessage struct {
+	Room string
+}
+
+// RoomPickerComponent browses the server's room directory. It takes over the chat pane while it is open
+type RoomPickerComponent struct {
+	open     bool
+	rooms    []protocol.RoomInfo
+	selected int
+}
+
+func NewRoomPickerComponent() *RoomPickerComponent {
+	return &RoomPickerComponent{}
+}
+
+// Open shows the picker with a fresh directory listing
+func (pc *RoomPickerComponent) Open(rooms []protocol.RoomInfo) {
+	pc.open = true
+	pc.rooms = rooms
+	pc.selected = 0
+}
+
+func (pc *RoomPickerComponent) Close() {
+	pc.open = false
+}
+
+func (pc *RoomPickerComponent) IsOpen() bool {
+	return pc.open
+}
+
+// Selected is the room under the cursor, or "" when the directory is empty
+func (pc *RoomPickerComponent) Selected() string {
+	if len(pc.rooms) == 0 {
+		return ""
+	}
+	return pc.rooms[pc.selected].Name
+}
+
+func (pc *RoomPickerComponent) Update(msg tea.Msg) tea.Cmd {
+	key, ok := msg.(tea.KeyMsg)
+	if !ok {
+		return nil
+	}
+	switch key.String() {
+	case "up", "k":
+		pc.selected = max(pc.selected-1, 0)
+	case "down", "j":
+		pc.selected = min(pc.selected+1, max(len(pc.rooms)-1, 0))
+	case "esc", "q":
+		pc.Close()
+	case "enter":
+		room := pc.Selected()
+		pc.Close()
+		if room == "" {
+			return nil
+		}
+		return func() tea.Msg {
+			return PickedRoomMessage{Room: room}
+		}
+	}
+	return nil
+}
+
+func (pc *RoomPickerComponent) View() string {
+	str := "Rooms (up/down to move, enter to join, esc to close)\n\n"
+	if len(pc.rooms) == 0 {
+		return str + "There are no public rooms\n"
+	}
+	for i, room := range pc.rooms {
+		cursor := "  "
+		if i == pc.selected {
+			cursor = "> "
+		}
+		str += fmt.Sprintf("%s#%s  %d members", cursor, room.Name, room.Members)
+		if room.Owner != "" {
+			str += fmt.Sprintf(", owner %s", room.Owner)
+		}
+		if !room.Created.IsZero() {
+			str += fmt.Sprintf(", since %s", room.Created.Local().Format("Jan 2 15:04"))
+		}
+		str += "\n"
+		if room.Topic != "" {
+			str += fmt.Sprintf("    %s\n", room.Topic)
+		}
+	}
+	return str
+}
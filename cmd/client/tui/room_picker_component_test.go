@@ -0,0 +1,44 @@
+package tui_test
+
+import (
+	"testing"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/dylanmccormick/ws-chat/cmd/client/tui"
+	"github.com/dylanmccormick/ws-chat/internal/protocol"
+)
+
+func TestRoomPicker(t *testing.T) {
+	picker := tui.NewRoomPickerComponent()
+	picker.Open([]protocol.RoomInfo{{Name: "games"}, {Name: "lobby"}, {Name: "music"}})
+	key := func(k tea.KeyType) tea.Cmd {
+		return picker.Update(tea.KeyMsg{Type: k})
+	}
+
+	key(tea.KeyUp)
+	if got := picker.Selected(); got != "games" {
+		t.Errorf("Expected the cursor to stop at the top. got=%s", got)
+	}
+	key(tea.KeyDown)
+	key(tea.KeyDown)
+	key(tea.KeyDown)
+	if got := picker.Selected(); got != "music" {
+		t.Errorf("Expected the cursor to stop at the bottom. got=%s", got)
+	}
+
+	cmd := key(tea.KeyEnter)
+	if picker.IsOpen() {
+		t.Errorf("Expected enter to close the picker")
+	}
+	if cmd == nil {
+		t.Fatalf("Expected enter to pick a room")
+	}
+	if msg, ok := cmd().(tui.PickedRoomMessage); !ok || msg.Room != "music" {
+		t.Errorf("Expected music to be picked. got=%#v", msg)
+	}
+
+	picker.Open(nil)
+	if cmd := key(tea.KeyEnter); cmd != nil {
+		t.Errorf("Expected nothing to be picked from an empty directory")
+	}
+}
@@ -0,0 +1,86 @@
+package tui
+
+import (
+	"testing"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/dylanmccormick/ws-chat/internal/protocol"
+)
+
+func TestChatComponentTyping(t *testing.T) {
+	cc := NewChatComponent()
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	cc.now = func() time.Time { return now }
+	press := func(key tea.KeyMsg) *SendTypingMessage {
+		t.Helper()
+		_, cmd := cc.Update(key, NewRoom("lobby"))
+		if cmd == nil {
+			return nil
+		}
+		msg := cmd()
+		if batch, ok := msg.(tea.BatchMsg); ok {
+			for _, c := range batch {
+				if c == nil {
+					continue
+				}
+				if typing, ok := c().(SendTypingMessage); ok {
+					return &typing
+				}
+			}
+			return nil
+		}
+		if typing, ok := msg.(SendTypingMessage); ok {
+			return &typing
+		}
+		return nil
+	}
+	letter := tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{'h'}}
+	backspace := tea.KeyMsg{Type: tea.KeyBackspace}
+
+	if got := press(letter); got == nil || !got.Typing {
+		t.Fatalf("Expected the first key to start typing. got=%+v", got)
+	}
+	now = now.Add(time.Second)
+	if got := press(letter); got != nil {
+		t.Errorf("Expected typing to be throttled. got=%+v", got)
+	}
+	now = now.Add(protocol.TypingInterval)
+	if got := press(letter); got == nil || !got.Typing {
+		t.Errorf("Expected typing to be sent again after the interval. got=%+v", got)
+	}
+	press(backspace)
+	press(backspace)
+	if got := press(backspace); got == nil || got.Typing {
+		t.Errorf("Expected clearing the input to stop typing. got=%+v", got)
+	}
+	if got := press(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{'/'}}); got != nil {
+		t.Errorf("Commands shouldn't count as typing. got=%+v", got)
+	}
+}
+
+func TestTypingText(t *testing.T) {
+	room := NewRoom("lobby")
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	room.SetTyping("bob", true, now)
+	if got := room.TypingText(now); got != "bob is typing…" {
+		t.Errorf("Unexpected typing text. got=%q", got)
+	}
+	room.SetTyping("alice", true, now.Add(time.Second))
+	if got := room.TypingText(now.Add(time.Second)); got != "alice and bob are typing…" {
+		t.Errorf("Unexpected typing text. got=%q", got)
+	}
+	// bob never said they stopped so they time out on their own
+	if got := room.TypingText(now.Add(protocol.TypingTimeout)); got != "alice is typing…" {
+		t.Errorf("Expected bob's indicator to expire. got=%q", got)
+	}
+	room.Add(protocol.Message{Body: protocol.ChatMessage{UserName: "alice", Message: "hi", Target: "lobby"}})
+	if got := room.TypingText(now.Add(time.Second)); got != "bob is typing…" {
+		t.Errorf("Expected a chat to clear the sender's indicator. got=%q", got)
+	}
+	room.SetTyping("bob", false, now.Add(time.Second))
+	if got := room.TypingText(now.Add(time.Second)); got != "" {
+		t.Errorf("Expected no one to be typing. got=%q", got)
+	}
+}
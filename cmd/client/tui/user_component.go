@@ -4,21 +4,58 @@ import (
 	"fmt"
 
 	tea "github.com/charmbracelet/bubbletea"
+	"github.com/dylanmccormick/ws-chat/internal/protocol"
 )
 
 type UserComponent struct {
-	focused bool
-	users   []string
+	focused  bool
+	presence map[string]protocol.PresenceMessage // latest presence by username. Anyone missing is online
 }
 
-func (cc UserComponent) View() string {
+// statusIndicator is the dot shown next to a name
+func statusIndicator(status string) string {
+	switch status {
+	case protocol.PresenceAway:
+		return "◐"
+	case protocol.PresenceOffline:
+		return "○"
+	default:
+		return "●"
+	}
+}
+
+// SetPresence records a presence update
+func (cc *UserComponent) SetPresence(p protocol.PresenceMessage) {
+	cc.presence[p.Username] = p
+}
+
+// Rename moves a user's presence to their new name
+func (cc *UserComponent) Rename(oldUsername, newUsername string) {
+	if p, ok := cc.presence[oldUsername]; ok {
+		p.Username = newUsername
+		cc.presence[newUsername] = p
+		delete(cc.presence, oldUsername)
+	}
+}
+
+// ViewRoom lists the room's members with their presence
+func (cc UserComponent) ViewRoom(room *Room) string {
 	str := ""
-	for _, user := range cc.users {
-		str += fmt.Sprintf("%s\n", user)
+	for _, user := range room.Users {
+		p := cc.presence[user]
+		str += fmt.Sprintf("%s %s\n", statusIndicator(p.Status), user)
+		if p.Text != "" {
+			str += fmt.Sprintf("  %s\n", p.Text)
+		}
 	}
 	return str
 }
 
+func (cc UserComponent) View() string {
+	str := ""
+	return str
+}
+
 func (cc UserComponent) Update(msg tea.Msg) (UserComponent, tea.Cmd) {
 	return cc, nil
 }
@@ -29,7 +66,7 @@ func (cc UserComponent) Init() tea.Cmd {
 
 func NewUserComponent() *UserComponent {
 	return &UserComponent{
-		focused: true,
-		users:   []string{"bozo", "bingo", "alfonz"},
+		focused:  true,
+		presence: map[string]protocol.PresenceMessage{},
 	}
 }
@@ -0,0 +1,31 @@
+package tui
+
+import (
+	"testing"
+
+	"github.com/dylanmccormick/ws-chat/internal/protocol"
+)
+
+func TestUserComponentPresence(t *testing.T) {
+	users := NewUserComponent()
+	room := NewRoom("lobby")
+	if got := users.ViewRoom(room); got != "" {
+		t.Errorf("Expected no users before the server sends any. got=%q", got)
+	}
+	room.Users = []string{"alice", "bob", "carol"}
+	users.SetPresence(protocol.PresenceMessage{Username: "alice", Status: protocol.PresenceAway, Text: "at lunch"})
+	users.SetPresence(protocol.PresenceMessage{Username: "bob", Status: protocol.PresenceOnline})
+	users.SetPresence(protocol.PresenceMessage{Username: "bob", Status: protocol.PresenceOffline})
+
+	expected := "◐ alice\n  at lunch\n○ bob\n● carol\n"
+	if got := users.ViewRoom(room); got != expected {
+		t.Errorf("Unexpected user list.\nexpected=%q\ngot=%q", expected, got)
+	}
+
+	users.Rename("alice", "alicia")
+	room.Users[0] = "alicia"
+	expected = "◐ alicia\n  at lunch\n○ bob\n● carol\n"
+	if got := users.ViewRoom(room); got != expected {
+		t.Errorf("Presence did not follow a rename.\nexpected=%q\ngot=%q", expected, got)
+	}
+}
@@ -1,111 +1,73 @@
+// Package server runs the chat server from pkg/chatserver as a standalone program
 package server
 
 import (
-	"bytes"
 	"context"
+	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
-	"github.com/gorilla/websocket"
+	"github.com/dylanmccormick/ws-chat/pkg/chatserver"
 )
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-}
-
-type User struct {
-	conn        *websocket.Conn
-	username    string
-	currentRoom Room
-	send        chan []byte
-}
+// Time allowed for the reader and writer goroutines to finish once the server starts shutting down
+const shutdownTimeout = 10 * time.Second
 
-type Server struct {
-	Rooms []Room
-	Hub   *Hub
-}
-
-func StartServer() {
-	slog.Info("Starting server")
-	hub := NewHub()
-	s := Server{[]Room{}, hub}
-	go hub.run()
-	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
-		s.ServeWs(w, r)
-	})
-	err := http.ListenAndServe(":8080", nil)
-	if err != nil {
-		slog.Error("ListenAndServe: ", "error", err)
+// StartServer runs the chat server until it gets SIGINT or SIGTERM and then shuts it down gracefully
+func StartServer(cfg chatserver.Config) error {
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("invalid config: %w", err)
 	}
-}
+	slog.Info("Starting server", "addr", cfg.ListenAddr)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-// TODO: This is where context should be created and passed around
-func (s *Server) ServeWs(w http.ResponseWriter, r *http.Request) {
-	slog.Info("upgrading the server")
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		slog.Error("An error occurred upgrading the http connection", "error", err)
-		panic(err)
+	opts := []chatserver.Option{chatserver.WithConfig(cfg)}
+	if cfg.AuditLog != "" {
+		f, err := os.OpenFile(cfg.AuditLog, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			return fmt.Errorf("opening audit log: %w", err)
+		}
+		defer f.Close()
+		opts = append(opts, chatserver.WithAuditLog(f))
 	}
-
-	slog.Info("Creating a new user")
-	user, err := s.createUser(conn)
-	// TODO: This needs to be done differently! I think a userManager or something
-	// Or send a newUser message to the hub and it'll handle user-specific actions!
-
-	slog.Info("Created user: ", "username", user.username)
-
-	go timedWrite(user)
-	// go reader(user, s.Hub.messages)
-	s.Hub.register <- user
-}
-
-func (s *Server) createUser(conn *websocket.Conn) (*User, error) {
-	// We're instead going to create an anonymous user and send them through the registration channel (before they can get messages)
-	u := &User{
-		conn: conn,
-		send: make(chan []byte, 10),
+	s, err := chatserver.New(opts...)
+	if err != nil {
+		return err
 	}
-	return u, nil
-}
+	go s.Run(ctx)
 
-func reader(u *User, highway chan InternalMessage) {
-	slog.Info("Starting reader")
-	t := Translator{}
-	for {
-		_, data, err := u.conn.ReadMessage()
-		if err != nil {
-			slog.Error("Error reading message", "error", err)
-			break
-		}
-		data = bytes.TrimSpace(bytes.ReplaceAll(data, []byte("\n"), []byte(" ")))
-		slog.Info("Got a message", "message", data)
-		message, err := t.BytesToMessage(context.TODO(), data)
-		if err != nil {
-			slog.Error("Error turning data ([]bytes) into Message", "data", string(data), "location", "reader")
-		}
-		message.EnrichWithUser(u)
-		highway <- message
-		slog.Info("Message sent to channel")
+	mux := http.NewServeMux()
+	mux.Handle("/ws", s.Handler())
+	srv := &http.Server{
+		Addr:        cfg.ListenAddr,
+		Handler:     mux,
+		BaseContext: func(net.Listener) context.Context { return ctx },
 	}
-}
 
-func timedWrite(u *User) {
-	ticker := time.NewTicker(1 * time.Second)
-	defer func() {
-		ticker.Stop()
-		u.conn.Close()
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- srv.ListenAndServe()
 	}()
 
-	for {
-		select {
-		case data := <-u.send:
-			slog.Info("Got a message from u.send channel", "user", u.username)
-			WriteToConn(u.conn, data)
-		default:
-			continue
-		}
+	select {
+	case err := <-serverErr:
+		s.Shutdown(context.Background())
+		return fmt.Errorf("listen and serve: %w", err)
+	case <-ctx.Done():
+	}
+	slog.Info("Shutting down server")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	// stops accepting new upgrades. Upgraded connections are hijacked so the hub closes those
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("shutting down http server: %w", err)
 	}
+	return s.Shutdown(shutdownCtx)
 }
@@ -2,11 +2,16 @@ package wschat
 
 import (
 	"fmt"
+	"os"
+	"time"
 
 	"github.com/dylanmccormick/ws-chat/cmd/client"
+	"github.com/dylanmccormick/ws-chat/cmd/client/commands"
 	"github.com/dylanmccormick/ws-chat/cmd/client/tui"
 	"github.com/dylanmccormick/ws-chat/cmd/server"
+	"github.com/dylanmccormick/ws-chat/pkg/chatserver"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 var rootCmd = &cobra.Command{
@@ -24,6 +29,7 @@ func init() {
 	rootCmd.AddCommand(replCmd)
 	rootCmd.AddCommand(startServerCmd)
 	rootCmd.AddCommand(startTui)
+	rootCmd.AddCommand(hashPasswordCmd)
 }
 
 var versionCmd = &cobra.Command{
@@ -41,24 +47,140 @@ var replCmd = &cobra.Command{
 	Long: `A repl for testing the web socket chat without having to launch the whole client.
 	Very basic and does not get real time updates to chat messages.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		client.StartREPL()
+		client.StartREPL(loginFromFlags(cmd))
 	},
 }
 
 var startServerCmd = &cobra.Command{
 	Use:   "start",
 	Short: "a command to start the server",
-	Long:  `Will update these later with some polish`,
-	Run: func(cmd *cobra.Command, args []string) {
-		server.StartServer()
+	Long: `Starts the chat server. Settings are read from the defaults, then the config file, then WSCHAT_* environment
+variables, then flags. Later sources win. The config file can be json, yaml or toml.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg, err := loadServerConfig(cmd)
+		if err != nil {
+			return err
+		}
+		return server.StartServer(cfg)
+	},
+}
+
+func init() {
+	defaults := chatserver.DefaultConfig()
+	flags := startServerCmd.Flags()
+	flags.String("config", "", "path to a json, yaml or toml config file (env: WSCHAT_CONFIG)")
+	flags.String("listen-addr", defaults.ListenAddr, "address the server listens on")
+	flags.String("allowed-origins", "", "comma separated list of origins allowed to connect. * allows all")
+	flags.Int64("max-message-size", defaults.MaxMessageSize, "largest message in bytes a client can send")
+	flags.Int("send-buffer-size", defaults.SendBufferSize, "messages buffered per user before they count as slow")
+	flags.String("default-room", defaults.DefaultRoom, "room every user joins on connect")
+	flags.String("default-room-owner", "", "account that owns the default room and can moderate it")
+	flags.Int("max-rooms", defaults.MaxRooms, "maximum number of rooms. 0 means no limit")
+	flags.Int("max-users-per-room", defaults.MaxUsersPerRoom, "maximum users in a room other than the default room. 0 means no limit")
+	flags.String("auth-mode", defaults.AuthMode, "how users log in: none, password, token or jwt")
+	flags.String("password-file", "", "file of account:hash lines for password auth")
+	flags.String("token-file", "", "file of token:account lines for token auth")
+	flags.String("jwt-secret", "", "HMAC secret used to verify HS256 tokens for jwt auth")
+	flags.String("history-store", defaults.HistoryStore, "where chat history is kept: memory or disk")
+	flags.String("history-dir", "", "directory for the disk history store")
+	flags.Int("history-size", defaults.HistorySize, "messages of history kept per room")
+	flags.String("audit-log", "", "file to append moderation actions to as JSON lines. Empty logs them with the server log")
+	flags.Float64("chat-rate", defaults.ChatRate, "chat and direct messages per second each account can send. 0 means no limit")
+	flags.Int("chat-burst", defaults.ChatBurst, "chat messages an account can send at once before chat-rate applies")
+	flags.Float64("command-rate", defaults.CommandRate, "commands per second each account can send. 0 means no limit")
+	flags.Int("command-burst", defaults.CommandBurst, "commands an account can send at once before command-rate applies")
+	flags.Float64("room-rate", defaults.RoomRate, "chat messages per second across everyone in a room. 0 means no limit")
+	flags.Int("room-burst", defaults.RoomBurst, "chat messages a room can take at once before room-rate applies")
+	flags.Int("abuse-strikes", defaults.AbuseStrikes, "rate limited messages in a minute before abuse-action is taken. 0 never acts")
+	flags.String("abuse-action", defaults.AbuseAction, "what happens to a connection that keeps going over its limits: disconnect or mute")
+	flags.Duration("away-after", time.Duration(defaults.AwayAfter), "idle time before a user shows as away. 0 means never")
+	flags.Duration("idle-timeout", time.Duration(defaults.IdleTimeout), "idle time before a user is disconnected. 0 means never")
+	flags.Duration("resume-grace", time.Duration(defaults.ResumeGrace), "how long a client that dropped can resume its session. 0 means never")
+}
+
+var hashPasswordCmd = &cobra.Command{
+	Use:   "hash-password <account>",
+	Short: "print an account:hash line for a password file",
+	Long:  `Reads a password from stdin and prints a line you can add to the file given to start --password-file.`,
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		password, err := client.ReadPassword(os.Stdin, os.Stderr)
+		if err != nil {
+			return err
+		}
+		hash, err := chatserver.HashPassword(password)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s:%s\n", args[0], hash)
+		return nil
 	},
 }
 
+func init() {
+	for _, cmd := range []*cobra.Command{replCmd, startTui} {
+		cmd.Flags().StringP("username", "u", "", "username to log in with. You will be asked for one if it is empty or taken")
+		cmd.Flags().StringP("password", "p", "", "password for servers using password auth (env: WSCHAT_PASSWORD)")
+		cmd.Flags().String("token", "", "token for servers using token or jwt auth (env: WSCHAT_TOKEN)")
+		cmd.Flags().String("server", commands.DefaultServerURL, "websocket url of the server to connect to (env: WSCHAT_SERVER)")
+	}
+	startTui.Flags().Duration("poll", 0, "also ask the server for your rooms and the room's users this often. The server pushes changes so 0 never polls")
+	startTui.Flags().Bool("bell", false, "ring the terminal bell when someone mentions you")
+}
+
+func loginFromFlags(cmd *cobra.Command) commands.LoginOptions {
+	opts := commands.LoginOptions{
+		Password: os.Getenv("WSCHAT_PASSWORD"),
+		Token:    os.Getenv("WSCHAT_TOKEN"),
+		Server:   os.Getenv("WSCHAT_SERVER"),
+	}
+	opts.Username, _ = cmd.Flags().GetString("username")
+	if cmd.Flags().Changed("password") {
+		opts.Password, _ = cmd.Flags().GetString("password")
+	}
+	if cmd.Flags().Changed("token") {
+		opts.Token, _ = cmd.Flags().GetString("token")
+	}
+	if cmd.Flags().Changed("server") {
+		opts.Server, _ = cmd.Flags().GetString("server")
+	}
+	return opts
+}
+
+func loadServerConfig(cmd *cobra.Command) (chatserver.Config, error) {
+	cfg := chatserver.DefaultConfig()
+	path, _ := cmd.Flags().GetString("config")
+	if path == "" {
+		path = os.Getenv("WSCHAT_CONFIG")
+	}
+	if path != "" {
+		var err error
+		cfg, err = chatserver.LoadConfigFile(path)
+		if err != nil {
+			return cfg, err
+		}
+	}
+	if err := cfg.LoadEnv(); err != nil {
+		return cfg, err
+	}
+
+	var err error
+	cmd.Flags().Visit(func(f *pflag.Flag) {
+		if f.Name == "config" || err != nil {
+			return
+		}
+		err = cfg.Set(f.Name, f.Value.String())
+	})
+	return cfg, err
+}
+
 var startTui = &cobra.Command{
 	Use:   "tui",
 	Short: "a command to start the client tui",
 	Long:  `Will update these later with some polish`,
 	Run: func(cmd *cobra.Command, args []string) {
-		tui.Start()
+		poll, _ := cmd.Flags().GetDuration("poll")
+		bell, _ := cmd.Flags().GetBool("bell")
+		tui.Start(loginFromFlags(cmd), tui.Options{PollEvery: poll, Bell: bell})
 	},
 }
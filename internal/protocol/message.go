@@ -1,18 +1,81 @@
 package protocol
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
 
 // This is the shared message col between the different layers of the application.
 // Both the client and the server rely on this col to create and decode messages.
+// The server fills in ID and Time on everything it sends. Seq is only set on messages that are part of a room's history
+// (chat and announcements). It goes up by one for each of them so a client that sees it jump knows it missed something
 type Message struct {
-	Typ  string `json:"type"`
-	Body any    `json:"-"`
+	Typ  string    `json:"type"`
+	ID   string    `json:"id,omitempty"`
+	Seq  uint64    `json:"seq,omitempty"`
+	Time time.Time `json:"ts,omitzero"`
+	Body any       `json:"-"`
 }
 
 type ChatMessage struct {
-	Message  string `json:"message"`
-	Target   string `json:"target"` // The room for the chat message
-	UserName string `json:"username,omitempty"`
+	Message   string     `json:"message"`
+	Target    string     `json:"target"` // The room for the chat message
+	UserName  string     `json:"username,omitempty"`
+	Edited    time.Time  `json:"edited,omitzero"`   // when it was last edited
+	Deleted   bool       `json:"deleted,omitempty"` // a tombstone. Message is empty
+	Reactions []Reaction `json:"reactions,omitempty"`
+	Parent    string     `json:"parent_id,omitempty"` // set on replies to the id of the message they are in the thread of
+	Replies   int        `json:"replies,omitempty"`   // how many replies a message has, not counting deleted ones
+}
+
+// Reaction is one emoji on a message. Mine is whether the user the message was sent to is one of those who reacted
+type Reaction struct {
+	Emoji string `json:"emoji"`
+	Count int    `json:"count"`
+	Mine  bool   `json:"mine,omitempty"`
+}
+
+// ReactionMessage is sent to the room when someone adds or removes a reaction. Count is how many are left on the
+// message for that emoji. User is the username of who reacted
+type ReactionMessage struct {
+	ID     string `json:"message_id"`
+	Target string `json:"target"`
+	Emoji  string `json:"emoji"`
+	User   string `json:"user"`
+	Added  bool   `json:"added"`
+	Count  int    `json:"count"`
+}
+
+// RepliesMessage is sent to the room when the number of replies to a message changes. ID is the parent's id
+type RepliesMessage struct {
+	ID     string `json:"message_id"`
+	Target string `json:"target"`
+	Count  int    `json:"count"`
+}
+
+// EditedMessage is sent to the room when a chat message is edited. ID is the message's id
+type EditedMessage struct {
+	ID       string    `json:"message_id"`
+	Target   string    `json:"target"`
+	Message  string    `json:"message"`
+	UserName string    `json:"username"` // who wrote the message
+	Edited   time.Time `json:"edited"`
+	By       string    `json:"by"` // who edited it, the author or a moderator
+}
+
+// DeletedMessage is sent to the room when a chat message is deleted. ID is the message's id
+type DeletedMessage struct {
+	ID     string `json:"message_id"`
+	Target string `json:"target"`
+	By     string `json:"by"` // who deleted it, the author or a moderator
+}
+
+// DirectMessage goes to one user instead of a room. The server fills in From
+type DirectMessage struct {
+	Message string `json:"message"`
+	To      string `json:"to"`
+	From    string `json:"from,omitempty"`
 }
 
 type AnnouncementMessage struct {
@@ -21,10 +84,93 @@ type AnnouncementMessage struct {
 	UserName string `json:"username,omitempty"`
 }
 
-type ErrorMessage struct {
-	Message  string `json:"message"`
-	Type     string `json:"type"`
+// TypingMessage says someone started or stopped typing in a room. It is never stored or logged.
+// Clients send it again every TypingInterval while the user keeps typing and forget it after TypingTimeout
+type TypingMessage struct {
+	Target   string `json:"target"` // the room
 	UserName string `json:"username,omitempty"`
+	Typing   bool   `json:"typing"`
+}
+
+const (
+	TypingInterval = 3 * time.Second
+	TypingTimeout  = 6 * time.Second
+)
+
+// NotificationMessage is sent to every session of a user who was mentioned in a room they are in, whatever room they
+// are looking at. Mentions is how many mentions they now have unread in the room
+type NotificationMessage struct {
+	Room      string `json:"room"`
+	MessageID string `json:"message_id"`
+	From      string `json:"from"`
+	Message   string `json:"message"`
+	Kind      string `json:"kind"` // one of the Mention* constants
+	Mentions  int    `json:"mentions"`
+}
+
+const (
+	MentionUser = "user" // @username
+	MentionRoom = "room" // @room, everyone in the room
+)
+
+// UnreadMessage is sent to every session of a user when they join a room, when a chat from someone else arrives in it
+// and when they mark it read. Unread is how many chat messages after LastRead they haven't read
+type UnreadMessage struct {
+	Room     string `json:"room"`
+	Unread   int    `json:"unread"`
+	LastRead uint64 `json:"last_read"`
+}
+
+// ReadReceiptMessage is sent to a room with read receipts turned on when Username has read up to Seq, and to whoever
+// joins it for everyone in it who has read anything
+type ReadReceiptMessage struct {
+	Room     string `json:"room"`
+	Username string `json:"username"`
+	Seq      uint64 `json:"seq"`
+}
+
+// PresenceMessage is sent to everyone who shares a room with Username when they come online, go away, come back or
+// go offline, and when they change their status text
+type PresenceMessage struct {
+	Username string `json:"username"`
+	Status   string `json:"status"`         // one of the Presence* constants
+	Text     string `json:"text,omitempty"` // custom status set with SetStatus
+}
+
+const (
+	PresenceOnline  = "online"
+	PresenceAway    = "away"
+	PresenceOffline = "offline"
+)
+
+// MembershipMessage is sent to everyone in Room when someone joins, leaves, is renamed or is kicked. The user it is
+// about gets it too, except when they leave by disconnecting. OldUsername is only set for renamed
+type MembershipMessage struct {
+	Room        string `json:"room"`
+	Event       string `json:"event"` // one of the Membership* constants
+	Username    string `json:"username"`
+	OldUsername string `json:"old_username,omitempty"`
+}
+
+const (
+	MembershipJoined  = "joined"
+	MembershipLeft    = "left"
+	MembershipRenamed = "renamed"
+	MembershipKicked  = "kicked" // kicked or banned
+)
+
+// StatusRequest is the Data of a SetStatus command. An empty Text clears it
+type StatusRequest struct {
+	Text string `json:"text"`
+}
+
+const MaxStatusLength = 100
+
+type ErrorMessage struct {
+	Message    string `json:"message"`
+	Type       string `json:"type"`
+	UserName   string `json:"username,omitempty"`
+	RetryAfter int64  `json:"retry_after_ms,omitempty"` // for rate_limited errors, how long to wait before sending again
 }
 
 type CommandMessage struct {
@@ -35,9 +181,205 @@ type CommandMessage struct {
 	Data     json.RawMessage `json:"data,omitempty"`
 }
 
+// HistoryRequest is the Data of a History command. After and Before are seqs to page between.
+// 0 means no bound so an empty request gets the newest messages.
+// The History command response Data is a list of the chat and announcement Messages, oldest first
+type HistoryRequest struct {
+	Limit  int    `json:"limit,omitempty"`
+	After  uint64 `json:"after,omitempty"`
+	Before uint64 `json:"before,omitempty"`
+}
+
+const (
+	DefaultHistoryLimit = 50
+	MaxHistoryLimit     = 500
+)
+
+// CreateRoomRequest is the optional Data of a CreateRoom command. Visibility defaults to public.
+// Password is required for password rooms
+type CreateRoomRequest struct {
+	Visibility string `json:"visibility,omitempty"`
+	Password   string `json:"password,omitempty"`
+}
+
+// JoinRoomRequest is the optional Data of a JoinRoom command
+type JoinRoomRequest struct {
+	Password string `json:"password,omitempty"`
+}
+
+// InviteRequest is the Data of an Invite command. The invited user gets an Invite command back where User is who invited them
+type InviteRequest struct {
+	User string `json:"user"`
+}
+
+// ModerationRequest is the Data of Kick, Ban, Unban, Mute, Unmute, Op and Deop commands. The command's Target is the room.
+// Duration is a Go duration like "10m" for Ban and Mute. Empty means until it is lifted
+type ModerationRequest struct {
+	User     string `json:"user"`
+	Duration string `json:"duration,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// RoomInfo is one room in a ListAllRooms response. Owner is the owner's account and is empty for the default room
+type RoomInfo struct {
+	Name       string    `json:"name"`
+	Topic      string    `json:"topic,omitempty"`
+	Members    int       `json:"members"`
+	Created    time.Time `json:"created"`
+	Owner      string    `json:"owner,omitempty"`
+	Visibility string    `json:"visibility"`
+
+	ReadReceipts bool `json:"read_receipts,omitempty"`
+}
+
+// TopicRequest is the Data of a SetTopic command. An empty Topic clears it.
+// Every member of the room gets a SetTopic command back with By set to who changed it
+type TopicRequest struct {
+	Topic string `json:"topic"`
+	By    string `json:"by,omitempty"`
+}
+
+const MaxTopicLength = 200
+
+// MarkReadRequest is the Data of a MarkRead command. The command's Target is the room. Seq is the newest message the
+// user has seen and 0 means everything. Read markers only move forward
+type MarkReadRequest struct {
+	Seq uint64 `json:"seq,omitempty"`
+}
+
+// ReadReceiptsRequest is the Data of a SetReadReceipts command. Every member of the room gets a SetReadReceipts
+// command back with By set to who changed it
+type ReadReceiptsRequest struct {
+	Enabled bool   `json:"enabled"`
+	By      string `json:"by,omitempty"`
+}
+
+// EditMessageRequest is the Data of an EditMessage command. The command's Target is the room
+type EditMessageRequest struct {
+	ID      string `json:"message_id"`
+	Message string `json:"message"`
+}
+
+// DeleteMessageRequest is the Data of a DeleteMessage command. The command's Target is the room
+type DeleteMessageRequest struct {
+	ID string `json:"message_id"`
+}
+
+// ThreadRequest is the Data of a GetThread command. The command's Target is the room.
+// The response Data is a list of Messages, the parent first and then its replies oldest first
+type ThreadRequest struct {
+	ID string `json:"message_id"`
+}
+
+// ReactRequest is the Data of a React command. The command's Target is the room
+type ReactRequest struct {
+	ID     string `json:"message_id"`
+	Emoji  string `json:"emoji"`
+	Remove bool   `json:"remove,omitempty"`
+}
+
+const (
+	MaxEmojiLength = 32 // bytes, enough for the longest emoji sequences
+	MaxReactions   = 20 // different emoji on one message
+)
+
+// HelloMessage is the first thing a client sends after connecting. Password and Token are only needed when
+// the server has auth turned on. A token can also go in the Authorization header of the upgrade request
+type HelloMessage struct {
+	Username string `json:"username"`
+	Password string `json:"password,omitempty"`
+	Token    string `json:"token,omitempty"`
+
+	// Session is the token from an earlier welcome. If the server still has that session the user gets its username
+	// and rooms back, and the messages after LastSeq in each room
+	Session string            `json:"session,omitempty"`
+	LastSeq map[string]uint64 `json:"last_seq,omitempty"`
+}
+
+// WelcomeMessage is the server's reply to an accepted hello. Room is the default room the user was put in.
+// Username is the display name and Account is who the user authenticated as
+type WelcomeMessage struct {
+	Username string `json:"username"`
+	Account  string `json:"account,omitempty"`
+	Room     string `json:"room"`
+	Message  string `json:"message"`
+
+	Session string   `json:"session,omitempty"` // send it in the hello to resume after a disconnect
+	Resumed bool     `json:"resumed,omitempty"`
+	Rooms   []string `json:"rooms,omitempty"` // the rooms a resumed session is back in. Room is the first of them
+}
+
+// Error types sent in ErrorMessage.Type when the server rejects a hello
+const (
+	ErrHandshakeExpected = "handshake_expected"
+	ErrUsernameInvalid   = "username_invalid"
+	ErrUsernameTaken     = "username_taken"
+	ErrHandshakeTimeout  = "handshake_timeout"
+	ErrUnauthorized      = "unauthorized"
+	ErrTooManyAttempts   = "too_many_attempts" // too many failed logins. The connection is closed after this
+)
+
+// Error types sent in ErrorMessage.Type when the server rejects a message after the handshake
+const (
+	ErrRecipientOffline = "recipient_offline"
+	ErrForbidden        = "forbidden" // not allowed to do that in the room
+	ErrBanned           = "banned"
+	ErrMuted            = "muted"
+	ErrRoomPassword     = "room_password"   // the room needs a password and it was missing or wrong
+	ErrInviteRequired   = "invite_required" // the room is invite only
+	ErrRateLimited      = "rate_limited"    // the message was dropped. RetryAfter says when to try again
+)
+
+// Room visibility modes. Only public rooms show up in the directory. Unlisted rooms can be joined by anyone who knows the name
+const (
+	VisibilityPublic   = "public"
+	VisibilityUnlisted = "unlisted"
+	VisibilityPassword = "password"
+	VisibilityInvite   = "invite"
+)
+
+// HandshakeError is why a hello was rejected. Code is one of the Err* constants above
+type HandshakeError struct {
+	Code   string
+	Reason string
+}
+
+func (e *HandshakeError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Reason)
+}
+
+// ErrorMessage turns the error into the message sent to the client
+func (e *HandshakeError) ErrorMessage() ErrorMessage {
+	return ErrorMessage{Message: e.Reason, Type: e.Code}
+}
+
+const MaxUsernameLength = 32
+
+// ValidateUsername checks the rules every username has to follow. 1 to 32 characters of letters, numbers, '_', '-' and '.'
+// The server also checks that nobody else is using it
+func ValidateUsername(name string) error {
+	if len(name) == 0 {
+		return &HandshakeError{Code: ErrUsernameInvalid, Reason: "username can not be empty"}
+	}
+	if len(name) > MaxUsernameLength {
+		return &HandshakeError{Code: ErrUsernameInvalid, Reason: fmt.Sprintf("username can not be longer than %d characters", MaxUsernameLength)}
+	}
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-', r == '.':
+		default:
+			return &HandshakeError{Code: ErrUsernameInvalid, Reason: fmt.Sprintf("username can not contain %q. Use letters, numbers, '_', '-' or '.'", r)}
+		}
+	}
+	return nil
+}
+
 func (m *Message) UnmarshalJSON(data []byte) error {
 	var temp struct {
 		Type string          `json:"type"`
+		ID   string          `json:"id"`
+		Seq  uint64          `json:"seq"`
+		Time time.Time       `json:"ts"`
 		Body json.RawMessage `json:"body"`
 	}
 
@@ -46,6 +388,9 @@ func (m *Message) UnmarshalJSON(data []byte) error {
 	}
 
 	m.Typ = temp.Type
+	m.ID = temp.ID
+	m.Seq = temp.Seq
+	m.Time = temp.Time
 
 	switch temp.Type {
 	case "chat":
@@ -54,12 +399,96 @@ func (m *Message) UnmarshalJSON(data []byte) error {
 			return err
 		}
 		m.Body = chatBody
+	case "dm":
+		var dmBody DirectMessage
+		if err := json.Unmarshal(temp.Body, &dmBody); err != nil {
+			return err
+		}
+		m.Body = dmBody
 	case "command":
 		var commandBody CommandMessage
 		if err := json.Unmarshal(temp.Body, &commandBody); err != nil {
 			return err
 		}
 		m.Body = commandBody
+	case "announcement":
+		var announcementBody AnnouncementMessage
+		if err := json.Unmarshal(temp.Body, &announcementBody); err != nil {
+			return err
+		}
+		m.Body = announcementBody
+	case "hello":
+		var helloBody HelloMessage
+		if err := json.Unmarshal(temp.Body, &helloBody); err != nil {
+			return err
+		}
+		m.Body = helloBody
+	case "welcome":
+		var welcomeBody WelcomeMessage
+		if err := json.Unmarshal(temp.Body, &welcomeBody); err != nil {
+			return err
+		}
+		m.Body = welcomeBody
+	case "edited":
+		var editedBody EditedMessage
+		if err := json.Unmarshal(temp.Body, &editedBody); err != nil {
+			return err
+		}
+		m.Body = editedBody
+	case "deleted":
+		var deletedBody DeletedMessage
+		if err := json.Unmarshal(temp.Body, &deletedBody); err != nil {
+			return err
+		}
+		m.Body = deletedBody
+	case "reaction":
+		var reactionBody ReactionMessage
+		if err := json.Unmarshal(temp.Body, &reactionBody); err != nil {
+			return err
+		}
+		m.Body = reactionBody
+	case "replies":
+		var repliesBody RepliesMessage
+		if err := json.Unmarshal(temp.Body, &repliesBody); err != nil {
+			return err
+		}
+		m.Body = repliesBody
+	case "notification":
+		var notificationBody NotificationMessage
+		if err := json.Unmarshal(temp.Body, &notificationBody); err != nil {
+			return err
+		}
+		m.Body = notificationBody
+	case "unread":
+		var unreadBody UnreadMessage
+		if err := json.Unmarshal(temp.Body, &unreadBody); err != nil {
+			return err
+		}
+		m.Body = unreadBody
+	case "read":
+		var readBody ReadReceiptMessage
+		if err := json.Unmarshal(temp.Body, &readBody); err != nil {
+			return err
+		}
+		m.Body = readBody
+	case "typing":
+		var typingBody TypingMessage
+		if err := json.Unmarshal(temp.Body, &typingBody); err != nil {
+			return err
+		}
+		m.Body = typingBody
+	case "membership":
+		var membershipBody MembershipMessage
+		if err := json.Unmarshal(temp.Body, &membershipBody); err != nil {
+			return err
+		}
+		m.Body = membershipBody
+	case "presence":
+		var presenceBody PresenceMessage
+		if err := json.Unmarshal(temp.Body, &presenceBody); err != nil {
+			return err
+		}
+		m.Body = presenceBody
 	case "error":
 		var errorBody ErrorMessage
 		if err := json.Unmarshal(temp.Body, &errorBody); err != nil {
@@ -74,9 +503,15 @@ func (m *Message) UnmarshalJSON(data []byte) error {
 func (m *Message) MarshalJSON() ([]byte, error) {
 	var temp struct {
 		Type string          `json:"type"`
+		ID   string          `json:"id,omitempty"`
+		Seq  uint64          `json:"seq,omitempty"`
+		Time time.Time       `json:"ts,omitzero"`
 		Body json.RawMessage `json:"body"`
 	}
 	temp.Type = m.Typ
+	temp.ID = m.ID
+	temp.Seq = m.Seq
+	temp.Time = m.Time
 
 	body, err := json.Marshal(m.Body)
 	if err != nil {
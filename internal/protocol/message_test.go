@@ -0,0 +1,131 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandshakeRoundTrip(t *testing.T) {
+	tests := []Message{
+		{Typ: "hello", Body: HelloMessage{Username: "alice"}},
+		{Typ: "welcome", Body: WelcomeMessage{Username: "alice", Room: "lobby", Message: "Welcome to the lobby, alice"}},
+		{Typ: "hello", Body: HelloMessage{Username: "alice", Session: "5f2c", LastSeq: map[string]uint64{"lobby": 12}}},
+		{Typ: "welcome", Body: WelcomeMessage{Username: "alice", Room: "games", Message: "Welcome back, alice", Session: "5f2c", Resumed: true, Rooms: []string{"games", "lobby"}}},
+		{Typ: "error", Body: ErrorMessage{Message: "the username alice is taken", Type: ErrUsernameTaken}},
+	}
+
+	for _, tt := range tests {
+		data, err := tt.MarshalJSON()
+		if err != nil {
+			t.Fatalf("Unable to marshal %s message: %s", tt.Typ, err)
+		}
+		var got Message
+		if err := got.UnmarshalJSON(data); err != nil {
+			t.Fatalf("Unable to unmarshal %s message: %s", tt.Typ, err)
+		}
+		if !reflect.DeepEqual(got, tt) {
+			t.Errorf("Message did not survive a round trip. expected=%#v got=%#v", tt, got)
+		}
+	}
+}
+
+func TestValidateUsername(t *testing.T) {
+	tests := []struct {
+		username string
+		valid    bool
+	}{
+		{"alice", true},
+		{"Bob_the-builder.2", true},
+		{"", false},
+		{strings.Repeat("a", MaxUsernameLength), true},
+		{strings.Repeat("a", MaxUsernameLength+1), false},
+		{"has space", false},
+		{"emoji🙂", false},
+		{"new\nline", false},
+	}
+
+	for _, tt := range tests {
+		err := ValidateUsername(tt.username)
+		if tt.valid && err != nil {
+			t.Errorf("Expected username %q to be valid. got=%s", tt.username, err)
+		}
+		if !tt.valid {
+			var hsErr *HandshakeError
+			if !errors.As(err, &hsErr) || hsErr.Code != ErrUsernameInvalid {
+				t.Errorf("Expected username %q to be rejected with %s. got=%v", tt.username, ErrUsernameInvalid, err)
+			}
+		}
+	}
+}
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	sent := time.Date(2025, 6, 1, 12, 30, 0, 123000000, time.UTC)
+	tests := []Message{
+		{Typ: "chat", ID: "0196f0c1a2b3c4d5e6f708090a0b0c0d", Seq: 42, Time: sent, Body: ChatMessage{Message: "hi", Target: "lobby", UserName: "alice"}},
+		{Typ: "announcement", ID: "0196f0c1a2b3c4d5e6f708090a0b0c0e", Seq: 43, Time: sent, Body: AnnouncementMessage{Message: "User bob has joined the room", Target: "lobby", UserName: "bob"}},
+		{Typ: "error", ID: "0196f0c1a2b3c4d5e6f708090a0b0c0f", Time: sent, Body: ErrorMessage{Message: "nope"}},
+		{Typ: "dm", ID: "0196f0c1a2b3c4d5e6f708090a0b0c10", Time: sent, Body: DirectMessage{Message: "psst", To: "bob", From: "alice"}},
+		{Typ: "presence", ID: "0196f0c1a2b3c4d5e6f708090a0b0c11", Time: sent, Body: PresenceMessage{Username: "alice", Status: PresenceAway, Text: "at lunch"}},
+		{Typ: "error", ID: "0196f0c1a2b3c4d5e6f708090a0b0c12", Time: sent, Body: ErrorMessage{Message: "slow down", Type: ErrRateLimited, RetryAfter: 250}},
+		{Typ: "edited", ID: "0196f0c1a2b3c4d5e6f708090a0b0c13", Time: sent, Body: EditedMessage{ID: "0196f0c1a2b3c4d5e6f708090a0b0c0e", Target: "lobby", Message: "hello", UserName: "alice", Edited: sent, By: "alice"}},
+		{Typ: "deleted", ID: "0196f0c1a2b3c4d5e6f708090a0b0c14", Time: sent, Body: DeletedMessage{ID: "0196f0c1a2b3c4d5e6f708090a0b0c0e", Target: "lobby", By: "carol"}},
+		{Typ: "reaction", ID: "0196f0c1a2b3c4d5e6f708090a0b0c15", Time: sent, Body: ReactionMessage{ID: "0196f0c1a2b3c4d5e6f708090a0b0c0e", Target: "lobby", Emoji: "👍", User: "bob", Added: true, Count: 2}},
+		{Typ: "replies", ID: "0196f0c1a2b3c4d5e6f708090a0b0c16", Time: sent, Body: RepliesMessage{ID: "0196f0c1a2b3c4d5e6f708090a0b0c0e", Target: "lobby", Count: 3}},
+		{Typ: "notification", ID: "0196f0c1a2b3c4d5e6f708090a0b0c16", Time: sent, Body: NotificationMessage{Room: "lobby", MessageID: "0196f0c1a2b3c4d5e6f708090a0b0c0e", From: "bob", Message: "@alice lunch?", Kind: MentionUser, Mentions: 1}},
+		{Typ: "unread", ID: "0196f0c1a2b3c4d5e6f708090a0b0c17", Time: sent, Body: UnreadMessage{Room: "lobby", Unread: 3, LastRead: 7}},
+		{Typ: "read", ID: "0196f0c1a2b3c4d5e6f708090a0b0c18", Time: sent, Body: ReadReceiptMessage{Room: "lobby", Username: "bob", Seq: 10}},
+		// what clients send has none of the server's fields
+		{Typ: "chat", Body: ChatMessage{Message: "hi", Target: "lobby"}},
+		{Typ: "typing", Body: TypingMessage{Target: "lobby", Typing: true}},
+		{Typ: "chat", Body: ChatMessage{Message: "me", Target: "lobby", Parent: "0196f0c1a2b3c4d5e6f708090a0b0c0e"}},
+	}
+
+	for _, tt := range tests {
+		data, err := tt.MarshalJSON()
+		if err != nil {
+			t.Fatalf("Unable to marshal %s message: %s", tt.Typ, err)
+		}
+		var got Message
+		if err := got.UnmarshalJSON(data); err != nil {
+			t.Fatalf("Unable to unmarshal %s message: %s", tt.Typ, err)
+		}
+		if !got.Time.Equal(tt.Time) {
+			t.Errorf("Timestamp did not survive a round trip. expected=%s got=%s", tt.Time, got.Time)
+		}
+		got.Time = tt.Time
+		if !reflect.DeepEqual(got, tt) {
+			t.Errorf("Message did not survive a round trip. expected=%#v got=%#v", tt, got)
+		}
+	}
+
+	data, _ := (&Message{Typ: "chat", Body: ChatMessage{Message: "hi", Target: "lobby"}}).MarshalJSON()
+	var raw map[string]json.RawMessage
+	json.Unmarshal(data, &raw)
+	for _, field := range []string{"id", "seq", "ts"} {
+		if _, ok := raw[field]; ok {
+			t.Errorf("Expected %s to be left out when it is not set. got=%s", field, data)
+		}
+	}
+}
+
+func TestHistoryResponseRoundTrip(t *testing.T) {
+	history := []Message{
+		{Typ: "chat", ID: "a", Seq: 1, Time: time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC), Body: ChatMessage{Message: "one", Target: "lobby", UserName: "alice"}},
+		{Typ: "announcement", ID: "b", Seq: 2, Time: time.Date(2025, 6, 1, 12, 1, 0, 0, time.UTC), Body: AnnouncementMessage{Message: "bye", Target: "lobby"}},
+	}
+	data, err := json.Marshal(history)
+	if err != nil {
+		t.Fatalf("Unable to marshal history: %s", err)
+	}
+	got := []Message{}
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("Unable to unmarshal history: %s", err)
+	}
+	if !reflect.DeepEqual(got, history) {
+		t.Errorf("History did not survive a round trip. expected=%#v got=%#v", history, got)
+	}
+}
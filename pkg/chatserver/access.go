@@ -0,0 +1,64 @@
+package chatserver
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+
+	prot "github.com/dylanmccormick/ws-chat/internal/protocol"
+)
+
+// SetPassword stores a salted hash of the room password. Room passwords only keep casual visitors out
+// so a fast hash is fine and keeps the hub from stalling on argon2
+func (r *Room) SetPassword(password string) error {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	r.passwordSalt = salt
+	r.passwordHash = hashRoomPassword(salt, password)
+	return nil
+}
+
+func hashRoomPassword(salt []byte, password string) []byte {
+	sum := sha256.Sum256(append(salt, password...))
+	return sum[:]
+}
+
+func (r *Room) checkPassword(password string) bool {
+	if len(r.passwordHash) == 0 {
+		return false
+	}
+	return subtle.ConstantTimeCompare(r.passwordHash, hashRoomPassword(r.passwordSalt, password)) == 1
+}
+
+// Invite lets the account into the room whatever its visibility
+func (r *Room) Invite(account string) {
+	if r.Invites == nil {
+		r.Invites = map[string]bool{}
+	}
+	r.Invites[account] = true
+}
+
+// Listed is whether the room shows up in the directory
+func (r *Room) Listed() bool {
+	return r.Visibility == "" || r.Visibility == prot.VisibilityPublic
+}
+
+// checkAccess returns the error code and reason if the account can't join. Owners, moderators and invited accounts
+// always get in. Bans are checked separately because they apply to them too
+func (r *Room) checkAccess(account, password string) (string, error) {
+	if r.RoleOf(account) != RoleMember || r.Invites[account] {
+		return "", nil
+	}
+	switch r.Visibility {
+	case prot.VisibilityPassword:
+		if !r.checkPassword(password) {
+			return prot.ErrRoomPassword, fmt.Errorf("%s needs the right password", r.Name)
+		}
+	case prot.VisibilityInvite:
+		return prot.ErrInviteRequired, fmt.Errorf("%s is invite only", r.Name)
+	}
+	return "", nil
+}
@@ -0,0 +1,113 @@
+package chatserver
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"testing"
+
+	prot "github.com/dylanmccormick/ws-chat/internal/protocol"
+)
+
+func lastErrorCode(msgs []prot.Message) string {
+	for _, m := range slices.Backward(msgs) {
+		if body, ok := m.Body.(prot.ErrorMessage); ok {
+			return body.Type
+		}
+	}
+	return ""
+}
+
+func TestRoomVisibility(t *testing.T) {
+	h, users := newTestHubWithUsers("alice", "bob", "carol")
+	alice, bob, carol := users[0], users[1], users[2]
+	ctx := context.TODO()
+	command := func(u *User, action, target string, data any) {
+		raw, _ := json.Marshal(data)
+		h.handleCommand(ctx, InternalMessage{User: u}, prot.CommandMessage{Action: action, Target: target, Data: raw})
+	}
+
+	command(alice, "CreateRoom", "open", prot.CreateRoomRequest{})
+	command(alice, "CreateRoom", "hidden", prot.CreateRoomRequest{Visibility: prot.VisibilityUnlisted})
+	command(alice, "CreateRoom", "locked", prot.CreateRoomRequest{Visibility: prot.VisibilityPassword, Password: "hunter2"})
+	command(alice, "CreateRoom", "club", prot.CreateRoomRequest{Visibility: prot.VisibilityInvite})
+	command(alice, "CreateRoom", "broken", prot.CreateRoomRequest{Visibility: prot.VisibilityPassword})
+	if _, err := h.roomManager.GetRoom("broken"); err == nil {
+		t.Errorf("A password room was created without a password")
+	}
+	drainTestUser(t, alice)
+
+	tests := []struct {
+		room     string
+		password string
+		code     string
+	}{
+		{"open", "", ""},
+		{"hidden", "", ""},
+		{"locked", "", prot.ErrRoomPassword},
+		{"locked", "wrong", prot.ErrRoomPassword},
+		{"locked", "hunter2", ""},
+		{"club", "", prot.ErrInviteRequired},
+	}
+	for _, tt := range tests {
+		command(bob, "JoinRoom", tt.room, prot.JoinRoomRequest{Password: tt.password})
+		room, _ := h.roomManager.GetRoom(tt.room)
+		code := lastErrorCode(drainTestUser(t, bob))
+		if code != tt.code {
+			t.Errorf("Joining %s with password %q: expected error %q. got=%q", tt.room, tt.password, tt.code, code)
+		}
+		if joined := userInRoom(room, bob); joined != (tt.code == "") {
+			t.Errorf("Joining %s with password %q: expected joined=%v", tt.room, tt.password, tt.code == "")
+		}
+	}
+	h.handleCommand(ctx, InternalMessage{User: carol}, prot.CommandMessage{Action: "JoinRoom", Target: "open", Data: json.RawMessage(`"hunter2"`)})
+	if open, _ := h.roomManager.GetRoom("open"); !hasError(drainTestUser(t, carol)) || userInRoom(open, carol) {
+		t.Errorf("Expected a join request that doesn't parse to be refused")
+	}
+
+	// only members can invite
+	command(carol, "Invite", "club", prot.InviteRequest{User: "bob"})
+	if code := lastErrorCode(drainTestUser(t, carol)); code != prot.ErrForbidden {
+		t.Errorf("Expected a non member invite to be forbidden. got=%q", code)
+	}
+	command(alice, "Invite", "club", prot.InviteRequest{User: "bob"})
+	if msgs := drainTestUser(t, bob); !hasCommandResponse(msgs, "Invite", "club") {
+		t.Errorf("Expected bob to be told about the invite. got=%+v", msgs)
+	}
+	command(bob, "JoinRoom", "club", nil)
+	club, _ := h.roomManager.GetRoom("club")
+	if !userInRoom(club, bob) {
+		t.Errorf("Invited user was not able to join")
+	}
+
+	command(carol, "ListAllRooms", "", nil)
+	msgs := drainTestUser(t, carol)
+	if len(msgs) != 1 {
+		t.Fatalf("Expected a ListAllRooms response. got=%+v", msgs)
+	}
+	rooms := []string{}
+	infos := []prot.RoomInfo{}
+	json.Unmarshal(msgs[0].Body.(prot.CommandMessage).Data, &infos)
+	for _, info := range infos {
+		rooms = append(rooms, info.Name)
+	}
+	if !slices.Equal(rooms, []string{"lobby", "open"}) {
+		t.Errorf("Directory should only list public rooms. got=%v", rooms)
+	}
+
+	// looking at who is in a room follows the same rules as joining it
+	for room, code := range map[string]string{"open": "", "hidden": "", "locked": prot.ErrRoomPassword, "club": prot.ErrInviteRequired} {
+		command(carol, "ListRoomUsers", room, nil)
+		msgs := drainTestUser(t, carol)
+		if got := lastErrorCode(msgs); got != code {
+			t.Errorf("Listing the users of %s: expected error %q. got=%q", room, code, got)
+		}
+		if listed := hasCommandResponse(msgs, "ListRoomUsers", room); listed != (code == "") {
+			t.Errorf("Listing the users of %s: expected a response=%v", room, code == "")
+		}
+	}
+	command(bob, "ListRoomUsers", "club", nil)
+	if msgs := drainTestUser(t, bob); !hasCommandResponse(msgs, "ListRoomUsers", "club") {
+		t.Errorf("Expected a member to see who is in the room. got=%+v", msgs)
+	}
+}
@@ -0,0 +1,306 @@
+package chatserver
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Identity is the account a user authenticated as. It is fixed for the life of the connection.
+// The username on User is only a display name and ChangeUsername never touches the identity
+type Identity struct {
+	Account string
+	Method  string // password, token, jwt or anonymous
+}
+
+// Credentials are everything a client can present. Username, Password and Token come from the hello,
+// Bearer comes from the Authorization header or token query parameter on the /ws upgrade request
+type Credentials struct {
+	Username string
+	Password string
+	Token    string
+	Bearer   string
+}
+
+type Authenticator interface {
+	Authenticate(ctx context.Context, creds Credentials) (Identity, error)
+}
+
+// AccountLister is implemented by authenticators that know every account up front. Nobody else can take one of
+// their names as a username, even while the account is offline
+type AccountLister interface {
+	HasAccount(account string) bool
+}
+
+var ErrUnauthorized = errors.New("invalid credentials")
+
+// anonymousAccount makes up an account for a user who logged in without auth. It can't be a username because
+// usernames can't have a '#', so the next person to pick the same name never gets this one's rooms or roles
+func anonymousAccount(username string) string {
+	var id [4]byte
+	rand.Read(id[:])
+	return username + "#" + hex.EncodeToString(id[:])
+}
+
+// NewAuthenticator builds the authenticator picked by cfg.AuthMode. It returns nil when auth is off
+func NewAuthenticator(cfg Config) (Authenticator, error) {
+	switch cfg.AuthMode {
+	case "", "none":
+		return nil, nil
+	case "password":
+		return LoadPasswordFile(cfg.PasswordFile)
+	case "token":
+		return LoadTokenFile(cfg.TokenFile)
+	case "jwt":
+		return NewJWTAuthenticator([]byte(cfg.JWTSecret)), nil
+	default:
+		return nil, fmt.Errorf("unknown auth mode %q", cfg.AuthMode)
+	}
+}
+
+// bearerToken pulls the token off the upgrade request. Browsers can't set headers on websockets so the query works too
+func bearerToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return r.URL.Query().Get("token")
+}
+
+// PasswordAuthenticator checks passwords against a file of account:hash lines.
+// Hashes can be bcrypt ($2a$...) or argon2id ($argon2id$...). Use HashPassword or `ws-chat hash-password` to make one
+type PasswordAuthenticator struct {
+	hashes map[string]string
+}
+
+func LoadPasswordFile(path string) (*PasswordAuthenticator, error) {
+	lines, err := readAuthFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &PasswordAuthenticator{hashes: lines}, nil
+}
+
+func (a *PasswordAuthenticator) Authenticate(ctx context.Context, creds Credentials) (Identity, error) {
+	hash, ok := a.hashes[creds.Username]
+	if !ok || creds.Password == "" {
+		return Identity{}, ErrUnauthorized
+	}
+	if !checkPassword(hash, creds.Password) {
+		return Identity{}, ErrUnauthorized
+	}
+	return Identity{Account: creds.Username, Method: "password"}, nil
+}
+
+func (a *PasswordAuthenticator) HasAccount(account string) bool {
+	_, ok := a.hashes[account]
+	return ok
+}
+
+// argon2id parameters for new hashes
+const (
+	argonTime    = 1
+	argonMemory  = 64 * 1024
+	argonThreads = 4
+	argonKeyLen  = 32
+)
+
+// HashPassword returns an argon2id hash in the usual $argon2id$v=19$m=,t=,p=$salt$key format
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, argonTime, argonMemory, argonThreads, argonKeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argonMemory, argonTime, argonThreads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func checkPassword(hash, password string) bool {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		return checkArgon2(hash, password)
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+func checkArgon2(hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	// "", "argon2id", "v=19", "m=65536,t=1,p=4", salt, key
+	if len(parts) != 6 {
+		return false
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false
+	}
+	var memory, iterations uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &threads); err != nil {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false
+	}
+	other := argon2.IDKey([]byte(password), salt, iterations, memory, threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1
+}
+
+// TokenAuthenticator accepts a fixed list of tokens from a file of token:account lines
+type TokenAuthenticator struct {
+	tokens map[string]string
+}
+
+func LoadTokenFile(path string) (*TokenAuthenticator, error) {
+	lines, err := readAuthFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewTokenAuthenticator(lines), nil
+}
+
+// NewTokenAuthenticator takes a map of token to account
+func NewTokenAuthenticator(tokens map[string]string) *TokenAuthenticator {
+	return &TokenAuthenticator{tokens: tokens}
+}
+
+func (a *TokenAuthenticator) Authenticate(ctx context.Context, creds Credentials) (Identity, error) {
+	presented := creds.Token
+	if presented == "" {
+		presented = creds.Bearer
+	}
+	if presented == "" {
+		return Identity{}, ErrUnauthorized
+	}
+	// compare against every token so the time taken doesn't leak which one was close
+	account := ""
+	for token, acct := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(presented)) == 1 {
+			account = acct
+		}
+	}
+	if account == "" {
+		return Identity{}, ErrUnauthorized
+	}
+	return Identity{Account: account, Method: "token"}, nil
+}
+
+func (a *TokenAuthenticator) HasAccount(account string) bool {
+	for _, acct := range a.tokens {
+		if acct == account {
+			return true
+		}
+	}
+	return false
+}
+
+// JWTAuthenticator accepts HS256 signed JWTs. The sub claim is the account. exp and nbf are checked when present
+type JWTAuthenticator struct {
+	secret []byte
+	now    func() time.Time
+}
+
+func NewJWTAuthenticator(secret []byte) *JWTAuthenticator {
+	return &JWTAuthenticator{secret: secret, now: time.Now}
+}
+
+type jwtClaims struct {
+	Subject   string `json:"sub"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+	NotBefore int64  `json:"nbf,omitempty"`
+}
+
+func (a *JWTAuthenticator) Authenticate(ctx context.Context, creds Credentials) (Identity, error) {
+	token := creds.Bearer
+	if token == "" {
+		token = creds.Token
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Identity{}, ErrUnauthorized
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil || header.Alg != "HS256" {
+		return Identity{}, ErrUnauthorized
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Identity{}, ErrUnauthorized
+	}
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return Identity{}, ErrUnauthorized
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil || claims.Subject == "" {
+		return Identity{}, ErrUnauthorized
+	}
+	now := a.now().Unix()
+	if claims.ExpiresAt != 0 && now >= claims.ExpiresAt {
+		return Identity{}, ErrUnauthorized
+	}
+	if claims.NotBefore != 0 && now < claims.NotBefore {
+		return Identity{}, ErrUnauthorized
+	}
+	return Identity{Account: claims.Subject, Method: "jwt"}, nil
+}
+
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// readAuthFile reads key:value lines. Blank lines and lines starting with # are skipped
+func readAuthFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening auth file: %w", err)
+	}
+	defer f.Close()
+
+	entries := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok || key == "" || value == "" {
+			return nil, fmt.Errorf("%s:%d: expected key:value", path, lineNumber)
+		}
+		entries[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading auth file: %w", err)
+	}
+	return entries, nil
+}
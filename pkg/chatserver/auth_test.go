@@ -0,0 +1,208 @@
+package chatserver
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	prot "github.com/dylanmccormick/ws-chat/internal/protocol"
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func writeAuthFile(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "auth")
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatalf("Unable to write auth file: %s", err)
+	}
+	return path
+}
+
+func TestPasswordAuthenticator(t *testing.T) {
+	argonHash, err := HashPassword("hunter2")
+	if err != nil {
+		t.Fatalf("Unable to hash password: %s", err)
+	}
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Unable to hash password: %s", err)
+	}
+	path := writeAuthFile(t, "# accounts\nalice:"+argonHash+"\nbob:"+string(bcryptHash)+"\n")
+	auth, err := LoadPasswordFile(path)
+	if err != nil {
+		t.Fatalf("Unable to load password file: %s", err)
+	}
+
+	tests := []struct {
+		username string
+		password string
+		ok       bool
+	}{
+		{"alice", "hunter2", true},
+		{"alice", "hunter3", false},
+		{"bob", "correct horse", true},
+		{"bob", "", false},
+		{"carol", "hunter2", false},
+	}
+	for _, tt := range tests {
+		identity, err := auth.Authenticate(context.TODO(), Credentials{Username: tt.username, Password: tt.password})
+		if tt.ok && (err != nil || identity.Account != tt.username) {
+			t.Errorf("Expected %s to log in. identity=%+v err=%v", tt.username, identity, err)
+		}
+		if !tt.ok && !errors.Is(err, ErrUnauthorized) {
+			t.Errorf("Expected %s with password %q to be rejected. got=%v", tt.username, tt.password, err)
+		}
+	}
+}
+
+func TestTokenAuthenticator(t *testing.T) {
+	auth, err := LoadTokenFile(writeAuthFile(t, "s3cret:alice\n"))
+	if err != nil {
+		t.Fatalf("Unable to load token file: %s", err)
+	}
+	if identity, err := auth.Authenticate(context.TODO(), Credentials{Bearer: "s3cret"}); err != nil || identity.Account != "alice" {
+		t.Errorf("Expected bearer token to log in as alice. identity=%+v err=%v", identity, err)
+	}
+	if identity, err := auth.Authenticate(context.TODO(), Credentials{Token: "s3cret"}); err != nil || identity.Account != "alice" {
+		t.Errorf("Expected hello token to log in as alice. identity=%+v err=%v", identity, err)
+	}
+	for _, token := range []string{"", "s3cre", "wrong"} {
+		if _, err := auth.Authenticate(context.TODO(), Credentials{Bearer: token}); !errors.Is(err, ErrUnauthorized) {
+			t.Errorf("Expected token %q to be rejected. got=%v", token, err)
+		}
+	}
+}
+
+func signTestJWT(secret, header, claims string) string {
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString([]byte(header)) + "." + enc.EncodeToString([]byte(claims))
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + enc.EncodeToString(mac.Sum(nil))
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	auth := NewJWTAuthenticator([]byte("secret"))
+	auth.now = func() time.Time { return time.Unix(1000, 0) }
+	hs256 := `{"alg":"HS256","typ":"JWT"}`
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"valid", signTestJWT("secret", hs256, `{"sub":"alice","exp":2000}`), true},
+		{"no expiry", signTestJWT("secret", hs256, `{"sub":"alice"}`), true},
+		{"expired", signTestJWT("secret", hs256, `{"sub":"alice","exp":1000}`), false},
+		{"not yet valid", signTestJWT("secret", hs256, `{"sub":"alice","nbf":1001}`), false},
+		{"wrong secret", signTestJWT("other", hs256, `{"sub":"alice"}`), false},
+		{"alg none", signTestJWT("secret", `{"alg":"none"}`, `{"sub":"alice"}`), false},
+		{"no subject", signTestJWT("secret", hs256, `{"exp":2000}`), false},
+		{"garbage", "not.a.jwt", false},
+	}
+	for _, tt := range tests {
+		identity, err := auth.Authenticate(context.TODO(), Credentials{Bearer: tt.token})
+		if tt.ok && (err != nil || identity.Account != "alice" || identity.Method != "jwt") {
+			t.Errorf("%s: expected token to be accepted. identity=%+v err=%v", tt.name, identity, err)
+		}
+		if !tt.ok && !errors.Is(err, ErrUnauthorized) {
+			t.Errorf("%s: expected token to be rejected. got=%v", tt.name, err)
+		}
+	}
+}
+
+func TestHandshakeWithAuth(t *testing.T) {
+	s := newServer(DefaultConfig())
+	s.hub.auth = NewTokenAuthenticator(map[string]string{"s3cret": "alice"})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+	url := "ws" + strings.TrimPrefix(ts.URL, "http")
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Unable to connect: %s", err)
+	}
+	defer conn.Close()
+	sendHello(t, conn, "alice")
+	m := readTestMessage(t, conn)
+	if body, ok := m.Body.(prot.ErrorMessage); !ok || body.Type != prot.ErrUnauthorized {
+		t.Errorf("Expected an %s error without a token. got=%#v", prot.ErrUnauthorized, m)
+	}
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer s3cret")
+	authed, _, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		t.Fatalf("Unable to connect: %s", err)
+	}
+	defer authed.Close()
+	// no username so the display name comes from the account
+	sendHello(t, authed, "")
+	m = readTestMessage(t, authed)
+	if body, ok := m.Body.(prot.WelcomeMessage); !ok || body.Username != "alice" || body.Account != "alice" {
+		t.Errorf("Expected a welcome for account alice. got=%#v", m)
+	}
+}
+
+func TestHandshakeClosesAfterFailedLogins(t *testing.T) {
+	s := newServer(DefaultConfig())
+	s.hub.auth = &PasswordAuthenticator{hashes: map[string]string{"alice": ""}}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+	url := "ws" + strings.TrimPrefix(ts.URL, "http")
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Unable to connect: %s", err)
+	}
+	defer conn.Close()
+	for i := range maxAuthFailures {
+		writeTestMessage(t, conn, prot.Message{Typ: "hello", Body: prot.HelloMessage{Username: "alice", Password: "guess"}})
+		want := prot.ErrUnauthorized
+		if i == maxAuthFailures-1 {
+			want = prot.ErrTooManyAttempts
+		}
+		if body, ok := readTestMessage(t, conn).Body.(prot.ErrorMessage); !ok || body.Type != want {
+			t.Fatalf("Attempt %d: expected a %s error. got=%+v", i+1, want, body)
+		}
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseNoStatusReceived) {
+		t.Errorf("Expected the connection to be closed after %d failed logins. got=%v", maxAuthFailures, err)
+	}
+}
+
+func TestLoginLimitPerAddress(t *testing.T) {
+	l, clock := newTestLimiter(DefaultConfig())
+	for i := range loginLimit.Burst {
+		if wait := l.allowLogin("10.0.0.1"); wait != 0 {
+			t.Fatalf("Expected login %d of the burst to be allowed. got wait=%s", i+1, wait)
+		}
+	}
+	if wait := l.allowLogin("10.0.0.1"); wait == 0 {
+		t.Errorf("Expected the address to be limited after %d logins", loginLimit.Burst)
+	}
+	if wait := l.allowLogin("10.0.0.2"); wait != 0 {
+		t.Errorf("Expected other addresses to have their own limit. got wait=%s", wait)
+	}
+	clock.Advance(2 * time.Second)
+	if wait := l.allowLogin("10.0.0.1"); wait != 0 {
+		t.Errorf("Expected a login after waiting. got wait=%s", wait)
+	}
+}
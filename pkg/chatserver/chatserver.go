@@ -0,0 +1,143 @@
+// Package chatserver lets another Go program run ws-chat inside its own http server.
+//
+//	chat, err := chatserver.New(chatserver.WithDefaultRoom("general"))
+//	mux.Handle("/chat", chat.Handler())
+//	go chat.Run(ctx)
+//	...
+//	chat.Shutdown(shutdownCtx)
+package chatserver
+
+import (
+	"fmt"
+	"io"
+)
+
+type options struct {
+	config  Config
+	auth    Authenticator
+	store   MessageStore
+	audit   io.Writer
+	message []MessageHook
+	join    []JoinHook
+	leave   []LeaveHook
+}
+
+type Option func(*options)
+
+// WithConfig replaces the whole config. Options after it still apply on top
+func WithConfig(cfg Config) Option {
+	return func(o *options) {
+		o.config = cfg
+	}
+}
+
+func WithDefaultRoom(name string) Option {
+	return func(o *options) {
+		o.config.DefaultRoom = name
+	}
+}
+
+func WithAllowedOrigins(origins ...string) Option {
+	return func(o *options) {
+		o.config.AllowedOrigins = origins
+	}
+}
+
+func WithMaxMessageSize(size int64) Option {
+	return func(o *options) {
+		o.config.MaxMessageSize = size
+	}
+}
+
+func WithSendBufferSize(size int) Option {
+	return func(o *options) {
+		o.config.SendBufferSize = size
+	}
+}
+
+func WithRoomLimits(maxRooms, maxUsersPerRoom int) Option {
+	return func(o *options) {
+		o.config.MaxRooms = maxRooms
+		o.config.MaxUsersPerRoom = maxUsersPerRoom
+	}
+}
+
+// WithAuthenticator checks every hello before the user is let in. It takes priority over the auth settings in the config
+func WithAuthenticator(auth Authenticator) Option {
+	return func(o *options) {
+		o.auth = auth
+	}
+}
+
+// WithMessageStore keeps history in store instead of the one from the config. The caller closes it after Shutdown
+func WithMessageStore(store MessageStore) Option {
+	return func(o *options) {
+		o.store = store
+	}
+}
+
+// WithAuditLog writes moderation actions to w as JSON lines
+func WithAuditLog(w io.Writer) Option {
+	return func(o *options) {
+		o.audit = w
+	}
+}
+
+// WithMessageHook is called for every chat message after it has been sent to the room
+func WithMessageHook(hook MessageHook) Option {
+	return func(o *options) {
+		o.message = append(o.message, hook)
+	}
+}
+
+// WithJoinHook is called whenever a user joins a room, including the default room when they connect
+func WithJoinHook(hook JoinHook) Option {
+	return func(o *options) {
+		o.join = append(o.join, hook)
+	}
+}
+
+// WithLeaveHook is called for each room a user was in when they disconnect
+func WithLeaveHook(hook LeaveHook) Option {
+	return func(o *options) {
+		o.leave = append(o.leave, hook)
+	}
+}
+
+// New creates a server. It does not handle connections until Run is called.
+// The listen address and audit log file in the config are ignored because the host program owns the http server
+// and its files. Use WithAuditLog for moderation actions
+func New(opts ...Option) (*Server, error) {
+	o := &options{config: DefaultConfig()}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if err := o.config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid chat server config: %w", err)
+	}
+	s := newServer(o.config)
+	auth := o.auth
+	if auth == nil {
+		var err error
+		auth, err = NewAuthenticator(o.config)
+		if err != nil {
+			return nil, fmt.Errorf("setting up auth: %w", err)
+		}
+	}
+	s.hub.auth = auth
+	if o.store != nil {
+		s.hub.store = o.store
+	} else {
+		store, err := NewMessageStore(o.config)
+		if err != nil {
+			return nil, fmt.Errorf("setting up history: %w", err)
+		}
+		s.hub.store = store
+		s.store = store
+	}
+	if o.audit != nil {
+		s.hub.audit = NewAuditLogger(o.audit)
+	}
+	s.hub.hooks = hooks{message: o.message, join: o.join, leave: o.leave}
+	return s, nil
+}
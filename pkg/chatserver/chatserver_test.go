@@ -0,0 +1,112 @@
+package chatserver_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dylanmccormick/ws-chat/pkg/chatserver"
+	"github.com/gorilla/websocket"
+)
+
+type event struct {
+	kind     string
+	room     string
+	username string
+	message  string
+}
+
+func TestEmbeddedServer(t *testing.T) {
+	events := make(chan event, 10)
+	chat, err := chatserver.New(
+		chatserver.WithDefaultRoom("general"),
+		chatserver.WithMessageHook(chatserver.MessageHookFunc(func(ctx context.Context, room, username, message string) {
+			events <- event{"message", room, username, message}
+		})),
+		chatserver.WithJoinHook(chatserver.JoinHookFunc(func(ctx context.Context, room, username string) {
+			events <- event{"join", room, username, ""}
+		})),
+		chatserver.WithLeaveHook(chatserver.LeaveHookFunc(func(ctx context.Context, room, username string) {
+			events <- event{"leave", room, username, ""}
+		})),
+	)
+	if err != nil {
+		t.Fatalf("Unable to create chat server: %s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go chat.Run(ctx)
+
+	// the host app owns the mux and picks the path
+	mux := http.NewServeMux()
+	mux.Handle("/apps/chat", chat.Handler())
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/apps/chat"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Unable to connect: %s", err)
+	}
+	defer conn.Close()
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"hello","body":{"username":"alice"}}`))
+	conn.ReadMessage()
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"chat","body":{"message":"hello","target":"general"}}`))
+
+	expected := []event{
+		{"join", "general", "alice", ""},
+		{"message", "general", "alice", "hello"},
+	}
+	for _, want := range expected {
+		select {
+		case got := <-events:
+			if got != want {
+				t.Errorf("Unexpected hook event. expected=%+v got=%+v", want, got)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Timed out waiting for hook event %+v", want)
+		}
+	}
+
+	conn.Close()
+	select {
+	case got := <-events:
+		want := event{"leave", "general", "alice", ""}
+		if got != want {
+			t.Errorf("Unexpected hook event. expected=%+v got=%+v", want, got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Timed out waiting for leave hook")
+	}
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer shutdownCancel()
+	if err := chat.Shutdown(shutdownCtx); err != nil {
+		t.Errorf("Unable to shut down chat server: %s", err)
+	}
+}
+
+func TestNewRejectsInvalidConfig(t *testing.T) {
+	if _, err := chatserver.New(chatserver.WithSendBufferSize(0)); err == nil {
+		t.Errorf("Expected an error for a zero send buffer")
+	}
+}
+
+func TestShutdownWithoutRun(t *testing.T) {
+	chat, err := chatserver.New()
+	if err != nil {
+		t.Fatalf("Unable to create chat server: %s", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	if err := chat.Shutdown(ctx); err != nil {
+		t.Errorf("Unable to shut down a server that never ran: %s", err)
+	}
+	if waited := time.Since(start); waited > time.Second {
+		t.Errorf("Expected Shutdown to return straight away. waited=%s", waited)
+	}
+}
@@ -0,0 +1,443 @@
+package chatserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	prot "github.com/dylanmccormick/ws-chat/internal/protocol"
+)
+
+func (h *Hub) commandCreateRoom(ctx context.Context, msg InternalMessage, body prot.CommandMessage) {
+	slog.Info("User requested to create room", "user", msg.User.username, "room", body.Target)
+	req := prot.CreateRoomRequest{}
+	if len(body.Data) > 0 {
+		if err := json.Unmarshal(body.Data, &req); err != nil {
+			h.sendError(ctx, msg.User, "Unable to parse create room request")
+			return
+		}
+	}
+	switch req.Visibility {
+	case "", prot.VisibilityPublic, prot.VisibilityUnlisted, prot.VisibilityInvite:
+	case prot.VisibilityPassword:
+		if req.Password == "" {
+			h.sendError(ctx, msg.User, "A password room needs a password")
+			return
+		}
+	default:
+		h.sendError(ctx, msg.User, fmt.Sprintf("Unknown room visibility %q", req.Visibility))
+		return
+	}
+	err := h.roomManager.AddRoom(body.Target)
+	if err != nil {
+		slog.Warn("Was not able to create room", "room", body.Target, "error", err)
+		h.sendError(ctx, msg.User, err.Error())
+		return
+	}
+	rm, err := h.roomManager.GetRoom(body.Target)
+	if err != nil {
+		slog.Error("Was not able to create room", "room", body.Target)
+		return
+	}
+	rm.Owner = msg.User.identity.Account
+	rm.Visibility = req.Visibility
+	if req.Visibility == prot.VisibilityPassword {
+		if err := rm.SetPassword(req.Password); err != nil {
+			slog.Error("Unable to set room password", "room", rm.Name, "error", err)
+		}
+	}
+	if err := h.roomManager.AddUser(rm, msg.User); err != nil {
+		// nobody else can be in it yet so the room goes again rather than being left without its creator
+		slog.Error("Was not able to add the creator to their room", "room", rm.Name, "user", msg.User.username, "error", err)
+		h.roomManager.DeleteRoom(rm.Name)
+		h.sendError(ctx, msg.User, err.Error())
+		return
+	}
+	h.joinedRoom(ctx, rm, msg.User)
+	h.hooks.onJoin(ctx, rm.Name, msg.User.username)
+}
+
+// commandChangeUsername only changes the display name. The account the user authenticated as stays the same
+func (h *Hub) commandChangeUsername(ctx context.Context, msg InternalMessage, body prot.CommandMessage) {
+	slog.Info("User requested to change username", "user", msg.User.username, "new_username", body.Target)
+
+	if err := prot.ValidateUsername(body.Target); err != nil {
+		h.sendError(ctx, msg.User, err.Error())
+		return
+	}
+	if h.nameTaken(body.Target, msg.User.identity, time.Now()) {
+		h.sendError(ctx, msg.User, "This username is taken")
+		return
+	}
+	slog.Info("Getting user from client map")
+	oldUsername := msg.User.username
+	usr := h.clients[oldUsername]
+	slog.Info("retrieved user", "user_is_nil", usr == nil, "username_lookup", oldUsername)
+	slog.Info("Adding new username to client map")
+	h.clients[body.Target] = usr
+	slog.Info("Updating username in user object")
+	usr.username = body.Target
+	slog.Info("Deleting user from client map")
+	// msg.User is the same pointer as usr so its username is already the new one
+	delete(h.clients, oldUsername)
+	for _, rm := range h.roomManager.RoomsFor(usr) {
+		h.sendMembership(ctx, rm, prot.MembershipRenamed, usr, oldUsername)
+	}
+}
+
+func (h *Hub) commandJoinRoom(ctx context.Context, msg InternalMessage, body prot.CommandMessage) {
+	slog.Info("User requested to join room", "user", msg.User.username, "room", body.Target)
+	rm, err := h.roomManager.GetRoom(body.Target)
+	if err != nil {
+		slog.Error("Was not able to join room", "room", body.Target)
+		h.sendError(ctx, msg.User, err.Error())
+		return
+	}
+	if rm.Banned(msg.User.identity.Account, time.Now()) {
+		h.sendErrorCode(ctx, msg.User, prot.ErrBanned, fmt.Sprintf("You are banned from %s", rm.Name))
+		return
+	}
+	req := prot.JoinRoomRequest{}
+	if len(body.Data) > 0 {
+		if err := json.Unmarshal(body.Data, &req); err != nil {
+			h.sendError(ctx, msg.User, "Unable to parse join room request")
+			return
+		}
+	}
+	if code, err := rm.checkAccess(msg.User.identity.Account, req.Password); err != nil {
+		h.sendErrorCode(ctx, msg.User, code, err.Error())
+		return
+	}
+	if userInRoom(rm, msg.User) {
+		slog.Warn("User already in room", "room", rm.Name, "user", msg.User.username)
+		h.sendError(ctx, msg.User, "This user already is in this room")
+		return
+	}
+
+	if err := h.roomManager.AddUser(rm, msg.User); err != nil {
+		slog.Warn("Was not able to join room", "room", rm.Name, "error", err)
+		h.sendError(ctx, msg.User, err.Error())
+		return
+	}
+	h.joinedRoom(ctx, rm, msg.User)
+	h.hooks.onJoin(ctx, rm.Name, msg.User.username)
+	h.announce(ctx, rm, fmt.Sprintf("User %s has joined the room", msg.User.username), msg.User.username)
+	if rm.Topic != "" {
+		h.sendCommandResponse(ctx, msg.User, "SetTopic", rm.Name, prot.TopicRequest{Topic: rm.Topic})
+	}
+}
+
+func (h *Hub) commandListRoomsForUser(ctx context.Context, msg InternalMessage, body prot.CommandMessage) {
+	slog.Info("User requested room information", "user", msg.User.username)
+	rooms := h.roomManager.ListRooms()
+	userRooms := []string{}
+	for _, room := range rooms {
+		r, err := h.roomManager.GetRoom(room)
+		if err != nil {
+			slog.Error("Error trying to get room information", "room", body.Target, "error", err)
+		}
+		for _, user := range r.Users {
+			if user.username == msg.User.username {
+				userRooms = append(userRooms, r.Name)
+			}
+		}
+	}
+	data, err := json.Marshal(userRooms)
+	if err != nil {
+		slog.Error("Unable to create response data", "err", err)
+		return
+	}
+	sendMsg := prot.Message{
+		Typ: "command",
+		Body: prot.CommandMessage{
+			Target:   msg.User.username,
+			Type:     "commandResponse",
+			Action:   "ListMyRooms",
+			Data:     data,
+			UserName: msg.User.username,
+		},
+	}
+	intMsg := InternalMessage{
+		User:    msg.User,
+		Message: sendMsg,
+	}
+	out, err := h.translator.MessageToBytes(ctx, intMsg)
+	if err != nil {
+		slog.Error("Unable to translate message to bytes.", "err", err)
+		return
+	}
+	h.sendTo(ctx, msg.User, out)
+}
+
+func (h *Hub) commandListUsersInRoom(ctx context.Context, msg InternalMessage, body prot.CommandMessage) {
+	slog.Info("User requested user information for room", "user", msg.User.username, "room", body.Target)
+	r, err := h.roomManager.GetRoom(body.Target)
+	if err != nil {
+		slog.Error("Error trying to get user information", "room", body.Target, "error", err)
+		return
+	}
+	// anyone outside the room only gets to look in if they could join it without a password
+	if !userInRoom(r, msg.User) {
+		if r.Banned(msg.User.identity.Account, time.Now()) {
+			h.sendErrorCode(ctx, msg.User, prot.ErrBanned, fmt.Sprintf("You are banned from %s", r.Name))
+			return
+		}
+		if code, err := r.checkAccess(msg.User.identity.Account, ""); err != nil {
+			h.sendErrorCode(ctx, msg.User, code, err.Error())
+			return
+		}
+	}
+	data, err := json.Marshal(roomUsernames(r))
+	if err != nil {
+		slog.Error("Unable to create response data", "err", err)
+	}
+	sendMsg := prot.Message{
+		Typ: "command",
+		Body: prot.CommandMessage{
+			Target:   r.Name,
+			Type:     "commandResponse",
+			Action:   "ListRoomUsers",
+			Data:     data,
+			UserName: msg.User.username,
+		},
+	}
+	intMsg := InternalMessage{
+		User:    msg.User,
+		Message: sendMsg,
+	}
+	out, err := h.translator.MessageToBytes(ctx, intMsg)
+	if err != nil {
+		slog.Error("Unable to translate message to bytes.", "err", err)
+		return
+	}
+	h.sendTo(ctx, msg.User, out)
+}
+
+// commandHistory sends the last messages of a room the user is in. Data can hold a HistoryRequest
+func (h *Hub) commandHistory(ctx context.Context, msg InternalMessage, body prot.CommandMessage) {
+	slog.Info("User requested history", "user", msg.User.username, "room", body.Target)
+	rm, err := h.roomManager.GetRoom(body.Target)
+	if err != nil {
+		h.sendError(ctx, msg.User, err.Error())
+		return
+	}
+	if !userInRoom(rm, msg.User) {
+		h.sendError(ctx, msg.User, "You have to be in a room to see its history")
+		return
+	}
+	req := prot.HistoryRequest{}
+	if len(body.Data) > 0 {
+		if err := json.Unmarshal(body.Data, &req); err != nil {
+			h.sendError(ctx, msg.User, "Unable to parse history request")
+			return
+		}
+	}
+	if req.Limit <= 0 {
+		req.Limit = prot.DefaultHistoryLimit
+	}
+	req.Limit = min(req.Limit, prot.MaxHistoryLimit)
+
+	stored, err := h.store.Range(ctx, rm.Name, RangeQuery{AfterSeq: req.After, BeforeSeq: req.Before, Limit: req.Limit})
+	if err != nil {
+		slog.Error("Unable to read history", "room", rm.Name, "error", err)
+		h.sendError(ctx, msg.User, "Unable to read history")
+		return
+	}
+	messages := make([]prot.Message, 0, len(stored))
+	for _, m := range stored {
+		messages = append(messages, m.Envelope(msg.User.identity.Account))
+	}
+	h.sendCommandResponse(ctx, msg.User, "History", rm.Name, messages)
+}
+
+// sendCommandResponse sends a commandResponse with data marshalled into Data
+func (h *Hub) sendCommandResponse(ctx context.Context, u *User, action, target string, data any) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		slog.Error("Unable to create response data", "err", err)
+		return
+	}
+	sendMsg := InternalMessage{
+		User: u,
+		Message: prot.Message{
+			Typ: "command",
+			Body: prot.CommandMessage{
+				Target:   target,
+				Type:     "commandResponse",
+				Action:   action,
+				Data:     raw,
+				UserName: u.username,
+			},
+		},
+	}
+	out, err := h.translator.MessageToBytes(ctx, sendMsg)
+	if err != nil {
+		slog.Error("Unable to translate message to bytes.", "err", err)
+		return
+	}
+	h.sendTo(ctx, u, out)
+}
+
+// commandLeaveRoom takes the user out of a room. Everyone has to be in at least one room so the last one can't be left
+func (h *Hub) commandLeaveRoom(ctx context.Context, msg InternalMessage, body prot.CommandMessage) {
+	slog.Info("User requested to leave room", "user", msg.User.username, "room", body.Target)
+	rm, err := h.roomManager.GetRoom(body.Target)
+	if err != nil {
+		h.sendError(ctx, msg.User, err.Error())
+		return
+	}
+	if !userInRoom(rm, msg.User) {
+		h.sendError(ctx, msg.User, "You are not in this room")
+		return
+	}
+	if len(h.roomManager.RoomsFor(msg.User)) == 1 {
+		h.sendError(ctx, msg.User, "You have to stay in at least one room")
+		return
+	}
+	h.sendMembership(ctx, rm, prot.MembershipLeft, msg.User, "")
+	h.roomManager.LeaveRoom(rm, msg.User)
+	h.sendCommandResponse(ctx, msg.User, "LeaveRoom", rm.Name, nil)
+	h.announce(ctx, rm, fmt.Sprintf("User %s has left the room", msg.User.username), msg.User.username)
+	h.hooks.onLeave(ctx, rm.Name, msg.User.username)
+}
+
+// commandDeleteRoom lets the owner delete a room. Anyone still in it who isn't in the default room is moved there
+func (h *Hub) commandDeleteRoom(ctx context.Context, msg InternalMessage, body prot.CommandMessage) {
+	slog.Info("User requested to delete room", "user", msg.User.username, "room", body.Target)
+	rm, err := h.roomManager.GetRoom(body.Target)
+	if err != nil {
+		h.sendError(ctx, msg.User, err.Error())
+		return
+	}
+	if rm.Name == h.config.DefaultRoom {
+		h.sendError(ctx, msg.User, "The default room can not be deleted")
+		return
+	}
+	if rm.Owner != msg.User.identity.Account {
+		h.sendError(ctx, msg.User, "Only the owner of a room can delete it")
+		return
+	}
+	h.announce(ctx, rm, fmt.Sprintf("The room %s was deleted by %s", rm.Name, msg.User.username), msg.User.username)
+
+	defaultRoom, err := h.roomManager.GetRoom(h.config.DefaultRoom)
+	if err != nil {
+		slog.Error("DEFAULT ROOM DOES NOT EXIST", "room", h.config.DefaultRoom)
+		return
+	}
+	members := slices.Clone(rm.Users)
+	if err := h.roomManager.DeleteRoom(rm.Name); err != nil {
+		h.sendError(ctx, msg.User, err.Error())
+		return
+	}
+	if err := h.store.Trim(ctx, rm.Name, 0); err != nil {
+		slog.Warn("Unable to remove history for deleted room", "room", rm.Name, "error", err)
+	}
+	h.limiter.ForgetRoom(rm.Name)
+	for account := range h.mentions {
+		h.clearMentions(account, rm.Name)
+	}
+	h.forgetReadMarkers(rm.Name)
+	for _, u := range members {
+		h.sendCommandResponse(ctx, u, "DeleteRoom", rm.Name, nil)
+		h.hooks.onLeave(ctx, rm.Name, u.username)
+		if userInRoom(defaultRoom, u) {
+			continue
+		}
+		h.roomManager.AddUser(defaultRoom, u)
+		h.joinedRoom(ctx, defaultRoom, u)
+		h.hooks.onJoin(ctx, defaultRoom.Name, u.username)
+	}
+}
+
+// commandInvite lets any member of a room invite someone in. It is the only way into an invite only room
+func (h *Hub) commandInvite(ctx context.Context, msg InternalMessage, body prot.CommandMessage) {
+	slog.Info("User requested to invite to room", "user", msg.User.username, "room", body.Target)
+	rm, err := h.roomManager.GetRoom(body.Target)
+	if err != nil {
+		h.sendError(ctx, msg.User, err.Error())
+		return
+	}
+	if !userInRoom(rm, msg.User) {
+		h.sendErrorCode(ctx, msg.User, prot.ErrForbidden, "You have to be in a room to invite people to it")
+		return
+	}
+	var req prot.InviteRequest
+	if err := json.Unmarshal(body.Data, &req); err != nil || req.User == "" {
+		h.sendError(ctx, msg.User, "Invite needs a user")
+		return
+	}
+	// people who are offline can be invited by account
+	account, err := h.subjectAccount(req.User)
+	if err != nil {
+		h.sendError(ctx, msg.User, err.Error())
+		return
+	}
+	invitee, online := h.clients[req.User]
+	rm.Invite(account)
+	h.announce(ctx, rm, fmt.Sprintf("%s invited %s", msg.User.username, req.User), req.User)
+	if online {
+		h.sendCommandResponse(ctx, invitee, "Invite", rm.Name, prot.InviteRequest{User: msg.User.username})
+	}
+}
+
+// commandListAllRooms is the room directory. Unlisted, password and invite only rooms are left out
+func (h *Hub) commandListAllRooms(ctx context.Context, msg InternalMessage, body prot.CommandMessage) {
+	slog.Info("User requested the room directory", "user", msg.User.username)
+	rooms := []prot.RoomInfo{}
+	for _, name := range h.roomManager.ListRooms() {
+		rm, err := h.roomManager.GetRoom(name)
+		if err != nil || !rm.Listed() {
+			continue
+		}
+		visibility := rm.Visibility
+		if visibility == "" {
+			visibility = prot.VisibilityPublic
+		}
+		rooms = append(rooms, prot.RoomInfo{
+			Name:       rm.Name,
+			Topic:      rm.Topic,
+			Members:    len(rm.Users),
+			Created:    rm.Created,
+			Owner:      rm.Owner,
+			Visibility: visibility,
+
+			ReadReceipts: rm.ReadReceipts,
+		})
+	}
+	h.sendCommandResponse(ctx, msg.User, "ListAllRooms", "", rooms)
+}
+
+// commandSetTopic lets the owner and moderators change the topic. Every member is sent the new one
+func (h *Hub) commandSetTopic(ctx context.Context, msg InternalMessage, body prot.CommandMessage) {
+	slog.Info("User requested to set topic", "user", msg.User.username, "room", body.Target)
+	rm, err := h.roomManager.GetRoom(body.Target)
+	if err != nil {
+		h.sendError(ctx, msg.User, err.Error())
+		return
+	}
+	var req prot.TopicRequest
+	if err := json.Unmarshal(body.Data, &req); err != nil {
+		h.sendError(ctx, msg.User, "Unable to parse topic request")
+		return
+	}
+	if len(req.Topic) > prot.MaxTopicLength {
+		h.sendError(ctx, msg.User, fmt.Sprintf("A topic can not be longer than %d characters", prot.MaxTopicLength))
+		return
+	}
+	if !userInRoom(rm, msg.User) || rm.RoleOf(msg.User.identity.Account) == RoleMember {
+		h.sendErrorCode(ctx, msg.User, prot.ErrForbidden, fmt.Sprintf("Only the owner and moderators of %s can set its topic", rm.Name))
+		return
+	}
+	rm.Topic = req.Topic
+	text := fmt.Sprintf("%s set the topic to %q", msg.User.username, req.Topic)
+	if req.Topic == "" {
+		text = fmt.Sprintf("%s cleared the topic", msg.User.username)
+	}
+	h.announce(ctx, rm, text, msg.User.username)
+	for _, u := range slices.Clone(rm.Users) {
+		h.sendCommandResponse(ctx, u, "SetTopic", rm.Name, prot.TopicRequest{Topic: rm.Topic, By: msg.User.username})
+	}
+}
@@ -0,0 +1,312 @@
+package chatserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds everything that can be tuned about the server. It can come from a config file, WSCHAT_* environment
+// variables or flags on the start command. DefaultConfig has the values the server used before any of this was configurable
+type Config struct {
+	ListenAddr       string   `json:"listen_addr" yaml:"listen_addr" toml:"listen_addr"`
+	AllowedOrigins   []string `json:"allowed_origins" yaml:"allowed_origins" toml:"allowed_origins"`    // empty means same origin only, "*" allows everything
+	MaxMessageSize   int64    `json:"max_message_size" yaml:"max_message_size" toml:"max_message_size"` // in bytes
+	SendBufferSize   int      `json:"send_buffer_size" yaml:"send_buffer_size" toml:"send_buffer_size"`
+	DefaultRoom      string   `json:"default_room" yaml:"default_room" toml:"default_room"`
+	DefaultRoomOwner string   `json:"default_room_owner" yaml:"default_room_owner" toml:"default_room_owner"` // account that moderates the default room. Needs auth. Empty means nobody
+	MaxRooms         int      `json:"max_rooms" yaml:"max_rooms" toml:"max_rooms"`                            // 0 means no limit
+	MaxUsersPerRoom  int      `json:"max_users_per_room" yaml:"max_users_per_room" toml:"max_users_per_room"` // 0 means no limit. The default room is never capped
+
+	AuthMode     string `json:"auth_mode" yaml:"auth_mode" toml:"auth_mode"`             // none, password, token or jwt
+	PasswordFile string `json:"password_file" yaml:"password_file" toml:"password_file"` // account:hash lines for password auth
+	TokenFile    string `json:"token_file" yaml:"token_file" toml:"token_file"`          // token:account lines for token auth
+	JWTSecret    string `json:"jwt_secret" yaml:"jwt_secret" toml:"jwt_secret"`          // HMAC secret for jwt auth
+
+	HistoryStore string `json:"history_store" yaml:"history_store" toml:"history_store"` // memory or disk
+	HistoryDir   string `json:"history_dir" yaml:"history_dir" toml:"history_dir"`       // where the disk store keeps its segments
+	HistorySize  int    `json:"history_size" yaml:"history_size" toml:"history_size"`    // messages kept per room. 0 keeps none
+
+	AuditLog string `json:"audit_log" yaml:"audit_log" toml:"audit_log"` // file for moderation actions. Empty logs them with everything else
+
+	// rates are messages per second and 0 turns a limit off. Chat and command limits are per account
+	ChatRate     float64 `json:"chat_rate" yaml:"chat_rate" toml:"chat_rate"`
+	ChatBurst    int     `json:"chat_burst" yaml:"chat_burst" toml:"chat_burst"`
+	CommandRate  float64 `json:"command_rate" yaml:"command_rate" toml:"command_rate"`
+	CommandBurst int     `json:"command_burst" yaml:"command_burst" toml:"command_burst"`
+	RoomRate     float64 `json:"room_rate" yaml:"room_rate" toml:"room_rate"` // chats per second across everyone in a room
+	RoomBurst    int     `json:"room_burst" yaml:"room_burst" toml:"room_burst"`
+	AbuseStrikes int     `json:"abuse_strikes" yaml:"abuse_strikes" toml:"abuse_strikes"` // dropped messages in a minute before AbuseAction. 0 never acts
+	AbuseAction  string  `json:"abuse_action" yaml:"abuse_action" toml:"abuse_action"`    // disconnect or mute
+
+	AwayAfter   Duration `json:"away_after" yaml:"away_after" toml:"away_after"`       // idle time before a user shows as away. 0 never
+	IdleTimeout Duration `json:"idle_timeout" yaml:"idle_timeout" toml:"idle_timeout"` // idle time before a user is disconnected. 0 never
+
+	ResumeGrace Duration `json:"resume_grace" yaml:"resume_grace" toml:"resume_grace"` // how long a dropped session can be resumed. 0 never
+}
+
+// Duration is a time.Duration written as a Go duration string like "5m" in config files
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// ConfigKeys are the names used for flags. The environment variable is WSCHAT_ + the key in upper snake case
+var ConfigKeys = []string{
+	"listen-addr",
+	"allowed-origins",
+	"max-message-size",
+	"send-buffer-size",
+	"default-room",
+	"default-room-owner",
+	"max-rooms",
+	"max-users-per-room",
+	"auth-mode",
+	"password-file",
+	"token-file",
+	"jwt-secret",
+	"history-store",
+	"history-dir",
+	"history-size",
+	"audit-log",
+	"chat-rate",
+	"chat-burst",
+	"command-rate",
+	"command-burst",
+	"room-rate",
+	"room-burst",
+	"abuse-strikes",
+	"abuse-action",
+	"away-after",
+	"idle-timeout",
+	"resume-grace",
+}
+
+func DefaultConfig() Config {
+	return Config{
+		ListenAddr:      ":8080",
+		AllowedOrigins:  []string{},
+		MaxMessageSize:  4096,
+		SendBufferSize:  10,
+		DefaultRoom:     "lobby",
+		MaxRooms:        0,
+		MaxUsersPerRoom: 0,
+		AuthMode:        "none",
+		HistoryStore:    "memory",
+		HistorySize:     1000,
+		ChatRate:        5,
+		ChatBurst:       10,
+		CommandRate:     10,
+		CommandBurst:    20,
+		RoomRate:        20,
+		RoomBurst:       40,
+		AbuseStrikes:    20,
+		AbuseAction:     "disconnect",
+		AwayAfter:       Duration(5 * time.Minute),
+		IdleTimeout:     Duration(time.Hour),
+		ResumeGrace:     Duration(2 * time.Minute),
+	}
+}
+
+// LoadConfigFile reads a json, yaml or toml file on top of the defaults. The format is picked from the extension
+func LoadConfigFile(path string) (Config, error) {
+	cfg := DefaultConfig()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, fmt.Errorf("reading config file: %w", err)
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = json.Unmarshal(data, &cfg)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &cfg)
+	case ".toml":
+		err = toml.Unmarshal(data, &cfg)
+	default:
+		return cfg, fmt.Errorf("unsupported config file type %q", filepath.Ext(path))
+	}
+	if err != nil {
+		return cfg, fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// EnvName is the environment variable for a config key. listen-addr -> WSCHAT_LISTEN_ADDR
+func EnvName(key string) string {
+	return "WSCHAT_" + strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+}
+
+// LoadEnv overrides the config with any WSCHAT_* environment variables that are set
+func (c *Config) LoadEnv() error {
+	for _, key := range ConfigKeys {
+		value, ok := os.LookupEnv(EnvName(key))
+		if !ok {
+			continue
+		}
+		if err := c.Set(key, value); err != nil {
+			return fmt.Errorf("%s: %w", EnvName(key), err)
+		}
+	}
+	return nil
+}
+
+// Set updates a single setting from its string form. Flags and environment variables both go through here
+func (c *Config) Set(key, value string) error {
+	var err error
+	switch key {
+	case "listen-addr":
+		c.ListenAddr = value
+	case "allowed-origins":
+		c.AllowedOrigins = []string{}
+		for origin := range strings.SplitSeq(value, ",") {
+			if origin = strings.TrimSpace(origin); origin != "" {
+				c.AllowedOrigins = append(c.AllowedOrigins, origin)
+			}
+		}
+	case "max-message-size":
+		c.MaxMessageSize, err = strconv.ParseInt(value, 10, 64)
+	case "send-buffer-size":
+		c.SendBufferSize, err = strconv.Atoi(value)
+	case "default-room":
+		c.DefaultRoom = value
+	case "default-room-owner":
+		c.DefaultRoomOwner = value
+	case "max-rooms":
+		c.MaxRooms, err = strconv.Atoi(value)
+	case "max-users-per-room":
+		c.MaxUsersPerRoom, err = strconv.Atoi(value)
+	case "auth-mode":
+		c.AuthMode = value
+	case "password-file":
+		c.PasswordFile = value
+	case "token-file":
+		c.TokenFile = value
+	case "jwt-secret":
+		c.JWTSecret = value
+	case "history-store":
+		c.HistoryStore = value
+	case "history-dir":
+		c.HistoryDir = value
+	case "history-size":
+		c.HistorySize, err = strconv.Atoi(value)
+	case "audit-log":
+		c.AuditLog = value
+	case "chat-rate":
+		c.ChatRate, err = strconv.ParseFloat(value, 64)
+	case "chat-burst":
+		c.ChatBurst, err = strconv.Atoi(value)
+	case "command-rate":
+		c.CommandRate, err = strconv.ParseFloat(value, 64)
+	case "command-burst":
+		c.CommandBurst, err = strconv.Atoi(value)
+	case "room-rate":
+		c.RoomRate, err = strconv.ParseFloat(value, 64)
+	case "room-burst":
+		c.RoomBurst, err = strconv.Atoi(value)
+	case "abuse-strikes":
+		c.AbuseStrikes, err = strconv.Atoi(value)
+	case "abuse-action":
+		c.AbuseAction = value
+	case "away-after":
+		err = c.AwayAfter.UnmarshalText([]byte(value))
+	case "idle-timeout":
+		err = c.IdleTimeout.UnmarshalText([]byte(value))
+	case "resume-grace":
+		err = c.ResumeGrace.UnmarshalText([]byte(value))
+	default:
+		return fmt.Errorf("unknown config key %q", key)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid value %q for %s: %w", value, key, err)
+	}
+	return nil
+}
+
+func (c Config) Validate() error {
+	if c.ListenAddr == "" {
+		return fmt.Errorf("listen address can not be empty")
+	}
+	if c.MaxMessageSize <= 0 {
+		return fmt.Errorf("max message size must be greater than 0")
+	}
+	if c.SendBufferSize <= 0 {
+		return fmt.Errorf("send buffer size must be greater than 0")
+	}
+	if c.DefaultRoom == "" {
+		return fmt.Errorf("default room can not be empty")
+	}
+	if c.MaxRooms < 0 || c.MaxUsersPerRoom < 0 {
+		return fmt.Errorf("room limits can not be negative")
+	}
+	switch c.AuthMode {
+	case "", "none":
+		// without auth every login is given a new account, so there is no account that could own it
+		if c.DefaultRoomOwner != "" {
+			return fmt.Errorf("a default room owner needs auth to be turned on")
+		}
+	case "password":
+		if c.PasswordFile == "" {
+			return fmt.Errorf("password auth needs a password file")
+		}
+	case "token":
+		if c.TokenFile == "" {
+			return fmt.Errorf("token auth needs a token file")
+		}
+	case "jwt":
+		if c.JWTSecret == "" {
+			return fmt.Errorf("jwt auth needs a secret")
+		}
+	default:
+		return fmt.Errorf("unknown auth mode %q", c.AuthMode)
+	}
+	if c.HistorySize < 0 {
+		return fmt.Errorf("history size can not be negative")
+	}
+	switch c.HistoryStore {
+	case "", "memory":
+	case "disk":
+		if c.HistoryDir == "" {
+			return fmt.Errorf("disk history needs a history directory")
+		}
+		if c.HistorySize == 0 {
+			return fmt.Errorf("disk history needs a history size. 0 keeps no history at all")
+		}
+	default:
+		return fmt.Errorf("unknown history store %q", c.HistoryStore)
+	}
+	if c.ChatRate < 0 || c.CommandRate < 0 || c.RoomRate < 0 {
+		return fmt.Errorf("rate limits can not be negative")
+	}
+	if c.ChatBurst < 0 || c.CommandBurst < 0 || c.RoomBurst < 0 || c.AbuseStrikes < 0 {
+		return fmt.Errorf("rate limit bursts and abuse strikes can not be negative")
+	}
+	switch c.AbuseAction {
+	case "", "disconnect", "mute":
+	default:
+		return fmt.Errorf("unknown abuse action %q", c.AbuseAction)
+	}
+	if c.AwayAfter < 0 || c.IdleTimeout < 0 {
+		return fmt.Errorf("idle times can not be negative")
+	}
+	if c.ResumeGrace < 0 {
+		return fmt.Errorf("resume grace can not be negative")
+	}
+	return nil
+}
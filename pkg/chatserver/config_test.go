@@ -0,0 +1,71 @@
+package chatserver
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigFile(t *testing.T) {
+	tests := []struct {
+		filename string
+		contents string
+	}{
+		{"config.json", `{"listen_addr": ":9000", "default_room": "general", "allowed_origins": ["http://a.com"], "max_rooms": 5, "away_after": "90s"}`},
+		{"config.yaml", "listen_addr: \":9000\"\ndefault_room: general\nallowed_origins:\n  - http://a.com\nmax_rooms: 5\naway_after: 90s\n"},
+		{"config.toml", "listen_addr = \":9000\"\ndefault_room = \"general\"\nallowed_origins = [\"http://a.com\"]\nmax_rooms = 5\naway_after = \"90s\"\n"},
+	}
+
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), tt.filename)
+		if err := os.WriteFile(path, []byte(tt.contents), 0o600); err != nil {
+			t.Fatalf("Unable to write config file: %s", err)
+		}
+		cfg, err := LoadConfigFile(path)
+		if err != nil {
+			t.Errorf("Unable to load config file %s: %s", tt.filename, err)
+			continue
+		}
+		if cfg.ListenAddr != ":9000" || cfg.DefaultRoom != "general" || cfg.MaxRooms != 5 {
+			t.Errorf("Config file values were not loaded. file=%s cfg=%+v", tt.filename, cfg)
+		}
+		if cfg.AwayAfter != Duration(90*time.Second) {
+			t.Errorf("Duration was not loaded. file=%s got=%s", tt.filename, time.Duration(cfg.AwayAfter))
+		}
+		if !slices.Equal(cfg.AllowedOrigins, []string{"http://a.com"}) {
+			t.Errorf("Unexpected allowed origins. file=%s got=%v", tt.filename, cfg.AllowedOrigins)
+		}
+		// anything missing from the file keeps its default
+		if cfg.SendBufferSize != DefaultConfig().SendBufferSize {
+			t.Errorf("Missing value did not keep default. file=%s got=%d", tt.filename, cfg.SendBufferSize)
+		}
+	}
+
+	if _, err := LoadConfigFile(filepath.Join(t.TempDir(), "config.ini")); err == nil {
+		t.Errorf("Expected an error for an unsupported config file")
+	}
+}
+
+func TestConfigLoadEnv(t *testing.T) {
+	t.Setenv("WSCHAT_LISTEN_ADDR", ":9999")
+	t.Setenv("WSCHAT_ALLOWED_ORIGINS", "http://a.com, http://b.com")
+	t.Setenv("WSCHAT_MAX_USERS_PER_ROOM", "3")
+
+	cfg := DefaultConfig()
+	if err := cfg.LoadEnv(); err != nil {
+		t.Fatalf("Unable to load env: %s", err)
+	}
+	if cfg.ListenAddr != ":9999" || cfg.MaxUsersPerRoom != 3 {
+		t.Errorf("Env values were not loaded. cfg=%+v", cfg)
+	}
+	if !slices.Equal(cfg.AllowedOrigins, []string{"http://a.com", "http://b.com"}) {
+		t.Errorf("Unexpected allowed origins. got=%v", cfg.AllowedOrigins)
+	}
+
+	t.Setenv("WSCHAT_MAX_ROOMS", "lots")
+	if err := cfg.LoadEnv(); err == nil {
+		t.Errorf("Expected an error for a non numeric max rooms")
+	}
+}
@@ -0,0 +1,158 @@
+package chatserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	prot "github.com/dylanmccormick/ws-chat/internal/protocol"
+)
+
+// Returned from a store update to leave the message alone. errUnchanged means there was nothing to do
+var (
+	errNotAllowed    = errors.New("not allowed")
+	errNotChangeable = errors.New("not changeable")
+	errUnchanged     = errors.New("unchanged")
+
+	errTooManyReactions = errors.New("too many reactions")
+)
+
+// canChange is whether u can edit or delete the message. Authors can change their own messages and the owner and
+// moderators can change anyone's
+func canChange(room *Room, u *User, m StoredMessage) bool {
+	return m.Account == u.identity.Account || room.RoleOf(u.identity.Account) != RoleMember
+}
+
+// memberRoom looks up a room the user is in, telling them if they aren't
+func (h *Hub) memberRoom(ctx context.Context, u *User, name string) (*Room, bool) {
+	room, err := h.roomManager.GetRoom(name)
+	if err != nil {
+		h.sendError(ctx, u, err.Error())
+		return nil, false
+	}
+	if !userInRoom(room, u) {
+		h.sendErrorCode(ctx, u, prot.ErrForbidden, fmt.Sprintf("You are not in %s", room.Name))
+		return nil, false
+	}
+	return room, true
+}
+
+// changeMessage applies change to a chat message in the room, telling the user if it couldn't be done.
+// verb is what they were trying to do for the error, like "edit"
+func (h *Hub) changeMessage(ctx context.Context, u *User, room *Room, id, verb string, change func(*StoredMessage) error) (StoredMessage, bool) {
+	stored, err := h.store.Update(ctx, room.Name, id, func(m *StoredMessage) error {
+		// announcements come from the server and a deleted message has nothing left to change
+		if m.Type != "chat" || m.Deleted {
+			return errNotChangeable
+		}
+		return change(m)
+	})
+	switch {
+	case err == nil:
+		return stored, true
+	case errors.Is(err, errUnchanged):
+	case errors.Is(err, ErrMessageNotFound):
+		h.sendError(ctx, u, fmt.Sprintf("There is no message %s in %s", id, room.Name))
+	case errors.Is(err, errNotAllowed):
+		h.sendErrorCode(ctx, u, prot.ErrForbidden, fmt.Sprintf("You can only %s your own messages", verb))
+	case errors.Is(err, errNotChangeable):
+		h.sendError(ctx, u, fmt.Sprintf("You can not %s that message", verb))
+	case errors.Is(err, errTooManyReactions):
+		h.sendError(ctx, u, fmt.Sprintf("A message can not have more than %d different reactions", prot.MaxReactions))
+	default:
+		slog.Error("Unable to update message", "room", room.Name, "id", id, "error", err)
+		h.sendError(ctx, u, fmt.Sprintf("Unable to %s the message. Please try again", verb))
+	}
+	return StoredMessage{}, false
+}
+
+// commandEditMessage replaces the text of a chat message and tells the room
+func (h *Hub) commandEditMessage(ctx context.Context, msg InternalMessage, body prot.CommandMessage) {
+	slog.Info("User requested to edit a message", "user", msg.User.username, "room", body.Target)
+	var req prot.EditMessageRequest
+	if err := json.Unmarshal(body.Data, &req); err != nil || req.Message == "" {
+		h.sendError(ctx, msg.User, "Unable to parse edit request")
+		return
+	}
+	room, ok := h.memberRoom(ctx, msg.User, body.Target)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	if room.Muted(msg.User.identity.Account, now) {
+		h.sendErrorCode(ctx, msg.User, prot.ErrMuted, fmt.Sprintf("You are muted in %s", room.Name))
+		return
+	}
+	stored, ok := h.changeMessage(ctx, msg.User, room, req.ID, "edit", func(m *StoredMessage) error {
+		if !canChange(room, msg.User, *m) {
+			return errNotAllowed
+		}
+		m.Message = req.Message
+		m.Edited = now
+		return nil
+	})
+	if !ok {
+		return
+	}
+	h.sendRoomEvent(ctx, room, "edited", prot.EditedMessage{
+		ID:       stored.ID,
+		Target:   room.Name,
+		Message:  stored.Message,
+		UserName: stored.Username,
+		Edited:   stored.Edited,
+		By:       msg.User.username,
+	})
+}
+
+// commandDeleteMessage turns a chat message into a tombstone and tells the room. The text isn't kept
+func (h *Hub) commandDeleteMessage(ctx context.Context, msg InternalMessage, body prot.CommandMessage) {
+	slog.Info("User requested to delete a message", "user", msg.User.username, "room", body.Target)
+	var req prot.DeleteMessageRequest
+	if err := json.Unmarshal(body.Data, &req); err != nil {
+		h.sendError(ctx, msg.User, "Unable to parse delete request")
+		return
+	}
+	room, ok := h.memberRoom(ctx, msg.User, body.Target)
+	if !ok {
+		return
+	}
+	stored, ok := h.changeMessage(ctx, msg.User, room, req.ID, "delete", func(m *StoredMessage) error {
+		if !canChange(room, msg.User, *m) {
+			return errNotAllowed
+		}
+		m.Message = ""
+		m.Deleted = true
+		m.Reactions = nil
+		return nil
+	})
+	if !ok {
+		return
+	}
+	if stored.Account != msg.User.identity.Account {
+		h.audit.InfoContext(ctx, "moderation",
+			"action", "DeleteMessage",
+			"room", room.Name,
+			"actor", msg.User.identity.Account,
+			"actor_name", msg.User.username,
+			"subject", stored.Account,
+			"message_id", stored.ID,
+		)
+	}
+	h.sendRoomEvent(ctx, room, "deleted", prot.DeletedMessage{ID: stored.ID, Target: room.Name, By: msg.User.username})
+	if stored.Parent != "" {
+		h.countReply(ctx, room, stored.Parent, -1)
+	}
+}
+
+// sendRoomEvent broadcasts a message that isn't part of the room's history
+func (h *Hub) sendRoomEvent(ctx context.Context, room *Room, typ string, body any) {
+	out, err := h.translator.MessageToBytes(ctx, InternalMessage{Message: prot.Message{Typ: typ, Body: body}})
+	if err != nil {
+		slog.Error("Unable to translate message to bytes.", "err", err)
+		return
+	}
+	h.broadcast(ctx, out, room)
+}
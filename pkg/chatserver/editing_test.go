@@ -0,0 +1,73 @@
+package chatserver
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	prot "github.com/dylanmccormick/ws-chat/internal/protocol"
+)
+
+func TestEditAndDeleteMessage(t *testing.T) {
+	h, users := newTestHubWithUsers("alice", "bob", "carol")
+	alice, bob, carol := users[0], users[1], users[2]
+	ctx := context.TODO()
+	command := func(u *User, action string, data any) {
+		raw, _ := json.Marshal(data)
+		h.handleCommand(ctx, InternalMessage{User: u}, prot.CommandMessage{Action: action, Target: "lobby", Data: raw})
+	}
+	lobby, _ := h.roomManager.GetRoom("lobby")
+	lobby.Moderators = map[string]bool{"carol": true}
+
+	h.handleChat(ctx, InternalMessage{User: alice}, prot.ChatMessage{Message: "helo", Target: "lobby"})
+	msgs := chats(drainTestUser(t, bob))
+	if len(msgs) != 1 || msgs[0].ID == "" {
+		t.Fatalf("Expected a chat with an id. got=%+v", msgs)
+	}
+	id := msgs[0].ID
+	drainTestUser(t, alice)
+	drainTestUser(t, carol)
+
+	command(bob, "EditMessage", prot.EditMessageRequest{ID: id, Message: "bob was here"})
+	if code := lastErrorCode(drainTestUser(t, bob)); code != prot.ErrForbidden {
+		t.Errorf("Expected bob to be forbidden from editing alice's message. got=%q", code)
+	}
+	if msgs := drainTestUser(t, alice); len(msgs) != 0 {
+		t.Errorf("A refused edit shouldn't be broadcast. got=%+v", msgs)
+	}
+
+	command(alice, "EditMessage", prot.EditMessageRequest{ID: id, Message: "hello"})
+	msgs = drainTestUser(t, bob)
+	if len(msgs) != 1 {
+		t.Fatalf("Expected one edited event. got=%+v", msgs)
+	}
+	if body, ok := msgs[0].Body.(prot.EditedMessage); !ok || body.ID != id || body.Message != "hello" || body.By != "alice" || body.Edited.IsZero() {
+		t.Errorf("Unexpected edited event. got=%+v", msgs[0].Body)
+	}
+
+	drainTestUser(t, alice)
+	command(carol, "DeleteMessage", prot.DeleteMessageRequest{ID: id})
+	msgs = drainTestUser(t, alice)
+	if len(msgs) != 1 {
+		t.Fatalf("Expected one deleted event. got=%+v", msgs)
+	}
+	if body, ok := msgs[0].Body.(prot.DeletedMessage); !ok || body.ID != id || body.By != "carol" {
+		t.Errorf("Unexpected deleted event. got=%+v", msgs[0].Body)
+	}
+
+	command(alice, "EditMessage", prot.EditMessageRequest{ID: id, Message: "back again"})
+	if !hasError(drainTestUser(t, alice)) {
+		t.Errorf("Expected a deleted message to stay deleted")
+	}
+
+	command(alice, "History", nil)
+	msgs = drainTestUser(t, alice)
+	var history []prot.Message
+	json.Unmarshal(msgs[0].Body.(prot.CommandMessage).Data, &history)
+	if len(history) != 1 {
+		t.Fatalf("Expected the tombstone in history. got=%+v", history)
+	}
+	if body := history[0].Body.(prot.ChatMessage); !body.Deleted || body.Message != "" || body.Edited.IsZero() {
+		t.Errorf("Unexpected tombstone in history. got=%+v", body)
+	}
+}
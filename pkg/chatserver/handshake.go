@@ -0,0 +1,264 @@
+package chatserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"time"
+
+	prot "github.com/dylanmccormick/ws-chat/internal/protocol"
+)
+
+// How long a new connection has to send an acceptable hello before it gets dropped
+var handshakeTimeout = 10 * time.Second
+
+// maxAuthFailures is how many hellos with bad credentials a connection can send before it is closed
+const maxAuthFailures = 3
+
+// registration is sent to the hub once a hello passes validation. The hub does the uniqueness check
+// because it owns the client map and replies on result
+type registration struct {
+	user     *User
+	username string
+	identity Identity
+	session  string            // token of a session to resume, if any
+	lastSeq  map[string]uint64 // the newest message the client has in each room
+	result   chan error
+}
+
+// handshake reads hello messages until one is accepted or the timeout runs out.
+// Rejections are sent back as typed errors and the client can try again with another name.
+// bearer is the token from the upgrade request, if there was one
+func (h *Hub) handshake(ctx context.Context, u *User, bearer string) {
+	u.conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	failures := 0
+	for {
+		reg, err := h.readHello(ctx, u, bearer)
+		var hsErr *prot.HandshakeError
+		switch {
+		case errors.As(err, &hsErr):
+			slog.Info("Rejected hello", "code", hsErr.Code, "reason", hsErr.Reason)
+			if hsErr.Code == prot.ErrUnauthorized {
+				failures++
+				if failures >= maxAuthFailures {
+					hsErr = &prot.HandshakeError{Code: prot.ErrTooManyAttempts, Reason: "too many failed logins"}
+				}
+			}
+			h.sendHandshakeError(ctx, u, hsErr)
+			if hsErr.Code == prot.ErrTooManyAttempts {
+				slog.Warn("Closing connection after failed logins", "remote", u.conn.RemoteAddr())
+				close(u.send)
+				return
+			}
+			continue
+		case err != nil:
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				h.sendHandshakeError(ctx, u, &prot.HandshakeError{Code: prot.ErrHandshakeTimeout, Reason: "timed out waiting for hello"})
+			}
+			slog.Info("Handshake failed", "error", err)
+			// nothing else has this user yet so closing send here stops the write pump
+			close(u.send)
+			return
+		}
+
+		select {
+		case h.register <- reg:
+		case <-h.closing:
+			close(u.send)
+			return
+		}
+		err = <-reg.result
+		if errors.As(err, &hsErr) {
+			slog.Info("Rejected hello", "code", hsErr.Code, "reason", hsErr.Reason)
+			h.sendHandshakeError(ctx, u, hsErr)
+			continue
+		}
+		// the hub started the reader, which sets its own deadline
+		return
+	}
+}
+
+// readHello reads one frame and returns the registration for it if it is a valid hello.
+// Authentication happens here, off the hub, because password hashing is slow on purpose
+func (h *Hub) readHello(ctx context.Context, u *User, bearer string) (registration, error) {
+	_, data, err := u.conn.ReadMessage()
+	if err != nil {
+		return registration{}, err
+	}
+	var msg prot.Message
+	if err := msg.UnmarshalJSON(data); err != nil {
+		return registration{}, &prot.HandshakeError{Code: prot.ErrHandshakeExpected, Reason: "expected a hello message"}
+	}
+	hello, ok := msg.Body.(prot.HelloMessage)
+	if !ok {
+		return registration{}, &prot.HandshakeError{Code: prot.ErrHandshakeExpected, Reason: "expected a hello message"}
+	}
+
+	username := hello.Username
+	identity := Identity{Method: "anonymous"}
+	if h.auth != nil {
+		if wait := h.limiter.allowLogin(remoteHost(u.conn.RemoteAddr())); wait > 0 {
+			slog.Warn("Too many logins from one address", "remote", u.conn.RemoteAddr())
+			return registration{}, &prot.HandshakeError{
+				Code:   prot.ErrTooManyAttempts,
+				Reason: fmt.Sprintf("too many logins from your address. Try again in %s", wait.Round(time.Second)),
+			}
+		}
+		identity, err = h.auth.Authenticate(ctx, Credentials{
+			Username: hello.Username,
+			Password: hello.Password,
+			Token:    hello.Token,
+			Bearer:   bearer,
+		})
+		if err != nil {
+			slog.Warn("Authentication failed", "username", hello.Username, "error", err)
+			return registration{}, &prot.HandshakeError{Code: prot.ErrUnauthorized, Reason: "invalid credentials"}
+		}
+		// token logins don't have to pick a name, they get their account name
+		if username == "" {
+			username = identity.Account
+		}
+	}
+	if err := prot.ValidateUsername(username); err != nil {
+		return registration{}, err
+	}
+	if h.auth == nil {
+		identity.Account = anonymousAccount(username)
+	}
+	return registration{
+		user:     u,
+		username: username,
+		identity: identity,
+		session:  hello.Session,
+		lastSeq:  hello.LastSeq,
+		result:   make(chan error, 1),
+	}, nil
+}
+
+// sendHandshakeError goes straight to the send channel because the user isn't registered with the hub yet
+func (h *Hub) sendHandshakeError(ctx context.Context, u *User, hsErr *prot.HandshakeError) {
+	msg := InternalMessage{
+		Message: prot.Message{
+			Typ:  "error",
+			Body: hsErr.ErrorMessage(),
+		},
+	}
+	data, err := h.translator.MessageToBytes(ctx, msg)
+	if err != nil {
+		slog.Error("Unable to translate message to bytes.", "err", err)
+		return
+	}
+	select {
+	case u.send <- data:
+	default:
+	}
+}
+
+// nameTaken is whether identity can't use username. It can't if someone is online with it, it is kept for a
+// dropped session, or it is the name of a different account
+func (h *Hub) nameTaken(username string, identity Identity, now time.Time) bool {
+	if _, ok := h.clients[username]; ok || h.reserved(username, identity, now) {
+		return true
+	}
+	if username == identity.Account {
+		return false
+	}
+	if accounts, ok := h.auth.(AccountLister); ok && accounts.HasAccount(username) {
+		return true
+	}
+	for _, u := range h.clients {
+		if u.identity.Account == username {
+			return true
+		}
+	}
+	return false
+}
+
+// registerUser runs on the hub. It claims the username, welcomes the user and puts them in the default room.
+// A user resuming a session gets its username and rooms back instead
+func (h *Hub) registerUser(ctx context.Context, reg registration) {
+	now := time.Now()
+	s := h.resumable(reg, now)
+	if s != nil && s.user != nil {
+		s = h.takeOver(ctx, s)
+	}
+	username := reg.username
+	if s != nil {
+		username = s.username
+	}
+	if s == nil && h.nameTaken(username, reg.identity, now) {
+		reg.result <- &prot.HandshakeError{Code: prot.ErrUsernameTaken, Reason: fmt.Sprintf("the username %s is taken", reg.username)}
+		return
+	}
+	// everyone passes through the default room so a ban there keeps the account off the server
+	account := reg.identity.Account
+	if s != nil {
+		account = s.identity.Account
+	}
+	if lobby, err := h.roomManager.GetRoom(h.config.DefaultRoom); err == nil && lobby.Banned(account, now) {
+		reg.result <- &prot.HandshakeError{Code: prot.ErrBanned, Reason: fmt.Sprintf("you are banned from %s", lobby.Name)}
+		return
+	}
+	u := reg.user
+	u.username = username
+	u.identity = reg.identity
+	slog.Info("Registering User", "user", u.username, "account", u.identity.Account, "auth", u.identity.Method, "resumed", s != nil)
+	h.clients[u.username] = u
+	u.lastActive = now
+
+	rooms := []*Room{}
+	if s != nil {
+		u.identity = s.identity
+		u.statusText = s.status
+		s.user = u
+		u.session = s
+		rooms = h.restoreRooms(u, s, now)
+	} else {
+		s = h.startSession(u)
+	}
+	resumed := len(rooms) > 0
+	if !resumed {
+		rm, err := h.roomManager.GetRoom(h.config.DefaultRoom)
+		if err != nil {
+			slog.Error("DEFAULT ROOM DOES NOT EXIST", "room", h.config.DefaultRoom)
+			os.Exit(1)
+		}
+		h.roomManager.AddUser(rm, u)
+		rooms = append(rooms, rm)
+	}
+	body := prot.WelcomeMessage{
+		Username: u.username,
+		Account:  u.identity.Account,
+		Room:     rooms[0].Name,
+		Message:  fmt.Sprintf("Welcome to the %s, %s", rooms[0].Name, u.username),
+		Session:  s.token,
+	}
+	if resumed {
+		body.Resumed = true
+		body.Message = fmt.Sprintf("Welcome back, %s", u.username)
+		for _, room := range rooms {
+			body.Rooms = append(body.Rooms, room.Name)
+		}
+	}
+	data, err := h.translator.MessageToBytes(ctx, InternalMessage{User: u, Message: prot.Message{Typ: "welcome", Body: body}})
+	if err != nil {
+		slog.Error("Unable to translate message to bytes.", "err", err)
+	}
+	h.sendTo(ctx, u, data)
+	if resumed {
+		h.rejoined(ctx, u, rooms, reg.lastSeq)
+	} else {
+		h.joinedRoom(ctx, rooms[0], u)
+		h.hooks.onJoin(ctx, rooms[0].Name, u.username)
+	}
+	reg.result <- nil
+
+	h.pumps.Go(func() {
+		reader(u, h)
+	})
+	slog.Info("Client connected", "user", u.username, "active_connections", len(h.clients))
+}
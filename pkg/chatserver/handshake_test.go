@@ -0,0 +1,74 @@
+package chatserver
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	prot "github.com/dylanmccormick/ws-chat/internal/protocol"
+	"github.com/gorilla/websocket"
+)
+
+func TestHandshakeRejections(t *testing.T) {
+	_, url := startTestServer(t)
+	alice := dialTestUser(t, url, "alice")
+	defer alice.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Unable to connect: %s", err)
+	}
+	defer conn.Close()
+
+	conn.WriteMessage(websocket.TextMessage, []byte("just a username"))
+	tests := []struct {
+		hello        string
+		expectedCode string
+	}{
+		{"", prot.ErrUsernameInvalid},
+		{strings.Repeat("a", prot.MaxUsernameLength+1), prot.ErrUsernameInvalid},
+		{"bad name", prot.ErrUsernameInvalid},
+		{"alice", prot.ErrUsernameTaken},
+	}
+
+	m := readTestMessage(t, conn)
+	if body, ok := m.Body.(prot.ErrorMessage); !ok || body.Type != prot.ErrHandshakeExpected {
+		t.Errorf("Expected a %s error for a raw text frame. got=%#v", prot.ErrHandshakeExpected, m)
+	}
+	for _, tt := range tests {
+		sendHello(t, conn, tt.hello)
+		m := readTestMessage(t, conn)
+		body, ok := m.Body.(prot.ErrorMessage)
+		if !ok || body.Type != tt.expectedCode {
+			t.Errorf("Unexpected rejection for hello %q. expected=%s got=%#v", tt.hello, tt.expectedCode, m)
+		}
+	}
+
+	// the same connection can try again with a good name
+	sendHello(t, conn, "bob")
+	m = readTestMessage(t, conn)
+	if body, ok := m.Body.(prot.WelcomeMessage); !ok || body.Username != "bob" || body.Room != "lobby" {
+		t.Errorf("Expected a welcome for bob. got=%#v", m)
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	original := handshakeTimeout
+	handshakeTimeout = 100 * time.Millisecond
+	defer func() { handshakeTimeout = original }()
+
+	_, url := startTestServer(t)
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Unable to connect: %s", err)
+	}
+	defer conn.Close()
+
+	m := readTestMessage(t, conn)
+	if body, ok := m.Body.(prot.ErrorMessage); !ok || body.Type != prot.ErrHandshakeTimeout {
+		t.Errorf("Expected a %s error. got=%#v", prot.ErrHandshakeTimeout, m)
+	}
+	if _, _, err := conn.ReadMessage(); err == nil {
+		t.Errorf("Expected the connection to be closed after the handshake timed out")
+	}
+}
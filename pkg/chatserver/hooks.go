@@ -0,0 +1,60 @@
+package chatserver
+
+import "context"
+
+// Hooks let a program embedding the server react to what happens in chat.
+// They are called from the hub goroutine so they must return quickly and must not call back into the server.
+
+type MessageHook interface {
+	OnMessage(ctx context.Context, room, username, message string)
+}
+
+type JoinHook interface {
+	OnJoin(ctx context.Context, room, username string)
+}
+
+type LeaveHook interface {
+	OnLeave(ctx context.Context, room, username string)
+}
+
+type MessageHookFunc func(ctx context.Context, room, username, message string)
+
+func (f MessageHookFunc) OnMessage(ctx context.Context, room, username, message string) {
+	f(ctx, room, username, message)
+}
+
+type JoinHookFunc func(ctx context.Context, room, username string)
+
+func (f JoinHookFunc) OnJoin(ctx context.Context, room, username string) {
+	f(ctx, room, username)
+}
+
+type LeaveHookFunc func(ctx context.Context, room, username string)
+
+func (f LeaveHookFunc) OnLeave(ctx context.Context, room, username string) {
+	f(ctx, room, username)
+}
+
+type hooks struct {
+	message []MessageHook
+	join    []JoinHook
+	leave   []LeaveHook
+}
+
+func (h hooks) onMessage(ctx context.Context, room, username, message string) {
+	for _, hook := range h.message {
+		hook.OnMessage(ctx, room, username, message)
+	}
+}
+
+func (h hooks) onJoin(ctx context.Context, room, username string) {
+	for _, hook := range h.join {
+		hook.OnJoin(ctx, room, username)
+	}
+}
+
+func (h hooks) onLeave(ctx context.Context, room, username string) {
+	for _, hook := range h.leave {
+		hook.OnLeave(ctx, room, username)
+	}
+}
@@ -0,0 +1,432 @@
+package chatserver
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"slices"
+	"sync"
+	"time"
+
+	prot "github.com/dylanmccormick/ws-chat/internal/protocol"
+	"github.com/gorilla/websocket"
+)
+
+// The hub is the central event handler
+type Hub struct {
+	// clients    map[*User]bool
+	clients    map[string]*User
+	register   chan registration
+	unregister chan *User
+
+	messages    chan InternalMessage // all inbound messages for the hub. Will have user messages, commands, and announcements
+	roomManager *RoomManager
+	translator  Translator
+	config      Config
+	hooks       hooks
+	auth        Authenticator // nil when auth is turned off
+	store       MessageStore
+	audit       *slog.Logger                      // moderation actions
+	limiter     *RateLimiter                      // used by the readers, not the hub goroutine
+	mentions    map[string]map[string]int         // unread mentions by account and then room
+	reads       map[string]map[string]*readMarker // read markers by account and then room
+	sessions    map[string]*session               // by token, including suspended ones that can still be resumed
+
+	stop     chan struct{} // closed by Stop to shut the hub down without cancelling the run context
+	stopOnce sync.Once
+	closing  chan struct{}  // closed once the hub has stopped. Pumps select on this so they never block on a dead hub
+	pumps    sync.WaitGroup // reader, writer and registration goroutines
+}
+
+func NewHub(cfg Config) *Hub {
+	return &Hub{
+		clients:     make(map[string]*User),
+		messages:    make(chan InternalMessage, 10),
+		register:    make(chan registration),
+		unregister:  make(chan *User),
+		roomManager: NewRoomManager(cfg),
+		translator:  Translator{},
+		config:      cfg,
+		store:       NewMemoryStore(cfg.HistorySize),
+		mentions:    make(map[string]map[string]int),
+		reads:       make(map[string]map[string]*readMarker),
+		sessions:    make(map[string]*session),
+		audit:       slog.Default().With("log", "audit"),
+		limiter:     NewRateLimiter(cfg),
+		stop:        make(chan struct{}),
+		closing:     make(chan struct{}),
+	}
+}
+
+// This is the event loop. All messages will come through the hub
+func (h *Hub) run(ctx context.Context) {
+	slog.Info("Starting hub")
+	h.roomManager.AddRoom(h.config.DefaultRoom)
+	if lobby, err := h.roomManager.GetRoom(h.config.DefaultRoom); err == nil {
+		lobby.Owner = h.config.DefaultRoomOwner
+	}
+	var idleCheck <-chan time.Time
+	if h.config.AwayAfter > 0 || h.config.IdleTimeout > 0 || h.config.ResumeGrace > 0 {
+		ticker := time.NewTicker(idleCheckInterval)
+		defer ticker.Stop()
+		idleCheck = ticker.C
+	}
+	for {
+		select {
+		case now := <-idleCheck:
+			h.checkIdle(ctx, now)
+			h.expireSessions(now)
+		case reg := <-h.register:
+			h.registerUser(ctx, reg)
+		case client := <-h.unregister:
+			h.unregisterClient(ctx, client)
+		case message := <-h.messages:
+			if !isEphemeral(message.Message) {
+				slog.Info("Received a message", "msg", message)
+			}
+			h.handleMessage(ctx, message)
+		case <-ctx.Done():
+			h.shutdown(ctx)
+			return
+		case <-h.stop:
+			h.shutdown(ctx)
+			return
+		}
+	}
+}
+
+// Stop tells the hub to shut down. Use Wait to know when it is done
+func (h *Hub) Stop() {
+	h.stopOnce.Do(func() {
+		close(h.stop)
+	})
+}
+
+// shutdown lets every room know the server is going away and then releases the pumps.
+// The writers flush what is queued and send a close frame to their client
+func (h *Hub) shutdown(ctx context.Context) {
+	slog.Info("Hub shutting down", "active_connections", len(h.clients))
+	for _, name := range h.roomManager.ListRooms() {
+		room, err := h.roomManager.GetRoom(name)
+		if err != nil {
+			continue
+		}
+		h.announce(ctx, room, "The server is shutting down", "")
+	}
+	close(h.closing)
+}
+
+// Wait blocks until the hub has stopped and every reader and writer has exited or the context expires
+func (h *Hub) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		<-h.closing
+		h.pumps.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		slog.Info("All connections drained")
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("waiting for connections to drain: %w", ctx.Err())
+	}
+}
+
+// signalUnregister is used by the pumps to tell the hub a connection is dead
+func (h *Hub) signalUnregister(u *User) {
+	select {
+	case h.unregister <- u:
+	case <-h.closing:
+	}
+}
+
+func (h *Hub) handleMessage(ctx context.Context, intMsg InternalMessage) {
+	msg := intMsg.Message
+	if !isEphemeral(msg) {
+		slog.Info("Got message with body type", "type", reflect.TypeOf(msg.Body))
+	}
+	if isActivity(msg) {
+		h.touch(ctx, intMsg.User, time.Now())
+	}
+	switch body := msg.Body.(type) {
+	case prot.ChatMessage:
+		h.handleChat(ctx, intMsg, body)
+	case prot.DirectMessage:
+		h.handleDirect(ctx, intMsg, body)
+	case prot.TypingMessage:
+		h.handleTyping(ctx, intMsg, body)
+	case prot.AnnouncementMessage:
+		// announcements are only made by the hub. One from a client would let anyone speak for the server in any room
+		h.sendErrorCode(ctx, intMsg.User, prot.ErrForbidden, "Only the server can send announcements")
+	case prot.ErrorMessage:
+		h.handleError(ctx, intMsg, body)
+	case prot.CommandMessage:
+		slog.Info("Handling command")
+		h.handleCommand(ctx, intMsg, body)
+	case rateLimited:
+		h.handleRateLimited(ctx, intMsg.User, body)
+	}
+}
+
+func (h *Hub) handleChat(ctx context.Context, msg InternalMessage, body prot.ChatMessage) {
+	// TODO: Assert body is of chatMessage type
+	room, err := h.roomManager.GetRoom(body.Target)
+	if err != nil {
+		slog.Error("Unable to resolve target for chat message", "message", msg, "body", body)
+		return
+	}
+	if !userInRoom(room, msg.User) {
+		h.sendErrorCode(ctx, msg.User, prot.ErrForbidden, fmt.Sprintf("You are not in %s", room.Name))
+		return
+	}
+	if room.Muted(msg.User.identity.Account, time.Now()) {
+		h.sendErrorCode(ctx, msg.User, prot.ErrMuted, fmt.Sprintf("You are muted in %s", room.Name))
+		return
+	}
+	if !h.chargeRoom(ctx, msg.User, room) {
+		return
+	}
+	body.UserName = msg.User.username
+	if body.Parent != "" && !h.checkParent(ctx, msg.User, room, body.Parent) {
+		return
+	}
+	// history is written first so anyone who sees the message can also page back to it
+	stored := StoredMessage{Type: "chat", Username: body.UserName, Account: msg.User.identity.Account, Message: body.Message, Parent: body.Parent}
+	stored, err = h.publish(ctx, room, stored)
+	if err != nil {
+		h.sendError(ctx, msg.User, "Your message could not be saved. Please try again")
+		return
+	}
+	if stored.Parent != "" {
+		h.countReply(ctx, room, stored.Parent, 1)
+	}
+	h.countNewMessage(ctx, room, msg.User, stored)
+	h.notifyMentions(ctx, room, msg.User, stored)
+	h.hooks.onMessage(ctx, room.Name, body.UserName, body.Message)
+}
+
+// handleDirect sends a dm to every session of the recipient's account and echoes it to every session of the sender's,
+// including the one it came from so the sender gets the server's id and time
+func (h *Hub) handleDirect(ctx context.Context, msg InternalMessage, body prot.DirectMessage) {
+	recipient, ok := h.clients[body.To]
+	if !ok {
+		h.sendErrorCode(ctx, msg.User, prot.ErrRecipientOffline, fmt.Sprintf("%s is not online", body.To))
+		return
+	}
+	body.From = msg.User.username
+	data, err := h.translator.MessageToBytes(ctx, InternalMessage{Message: prot.Message{Typ: "dm", Body: body}})
+	if err != nil {
+		slog.Error("Unable to convert message to bytes", "message", msg)
+		return
+	}
+	targets := h.sessionsOf(recipient)
+	for _, u := range h.sessionsOf(msg.User) {
+		if !slices.Contains(targets, u) {
+			targets = append(targets, u)
+		}
+	}
+	for _, u := range targets {
+		h.sendTo(ctx, u, data)
+	}
+}
+
+// sessionsOf is every connection logged in as the same account as u. Anonymous users only have their own
+// because anyone can pick the same name once it is free
+func (h *Hub) sessionsOf(u *User) []*User {
+	if u.identity.Method == "anonymous" || u.identity.Account == "" {
+		return []*User{u}
+	}
+	sessions := []*User{}
+	for _, other := range h.clients {
+		if other.identity == u.identity {
+			sessions = append(sessions, other)
+		}
+	}
+	return sessions
+}
+
+// publish stores a message in the room's history, which gives it its seq, and then broadcasts it to the room
+func (h *Hub) publish(ctx context.Context, room *Room, stored StoredMessage) (StoredMessage, error) {
+	stored.Room = room.Name
+	stored, err := h.store.Append(ctx, stored)
+	if err != nil {
+		slog.Error("Unable to store message", "room", room.Name, "error", err)
+		return stored, err
+	}
+	data, err := h.translator.MessageToBytes(ctx, InternalMessage{Message: stored.Envelope("")})
+	if err != nil {
+		slog.Error("Unable to convert message to bytes", "message", stored)
+		return stored, err
+	}
+	h.broadcast(ctx, data, room)
+	return stored, nil
+}
+
+// announce sends an announcement to everyone in the room. username is who it is about, if anyone
+func (h *Hub) announce(ctx context.Context, room *Room, text, username string) {
+	h.publish(ctx, room, StoredMessage{Type: "announcement", Username: username, Message: text})
+}
+
+func (h *Hub) handleError(ctx context.Context, msg InternalMessage, body prot.ErrorMessage) {
+	slog.Warn("Error not yet implemented. This is all you get buddy", "message", body.Message)
+}
+
+func (h *Hub) handleCommand(ctx context.Context, msg InternalMessage, body prot.CommandMessage) {
+	switch body.Action {
+	case "CreateRoom":
+		h.commandCreateRoom(ctx, msg, body)
+	case "JoinRoom":
+		h.commandJoinRoom(ctx, msg, body)
+	case "ListMyRooms":
+		h.commandListRoomsForUser(ctx, msg, body)
+	case "ListRoomUsers":
+		h.commandListUsersInRoom(ctx, msg, body)
+		slog.Info("User requested user information", "user", msg.User.username, "room", body.Target)
+	case "ChangeUsername":
+		h.commandChangeUsername(ctx, msg, body)
+	case "History":
+		h.commandHistory(ctx, msg, body)
+	case "LeaveRoom":
+		h.commandLeaveRoom(ctx, msg, body)
+	case "DeleteRoom":
+		h.commandDeleteRoom(ctx, msg, body)
+	case "Invite":
+		h.commandInvite(ctx, msg, body)
+	case "ListAllRooms":
+		h.commandListAllRooms(ctx, msg, body)
+	case "SetTopic":
+		h.commandSetTopic(ctx, msg, body)
+	case "EditMessage":
+		h.commandEditMessage(ctx, msg, body)
+	case "DeleteMessage":
+		h.commandDeleteMessage(ctx, msg, body)
+	case "React":
+		h.commandReact(ctx, msg, body)
+	case "GetThread":
+		h.commandGetThread(ctx, msg, body)
+	case "ClearMentions":
+		h.commandClearMentions(ctx, msg, body)
+	case "MarkRead":
+		h.commandMarkRead(ctx, msg, body)
+	case "SetReadReceipts":
+		h.commandSetReadReceipts(ctx, msg, body)
+	case "SetStatus":
+		h.commandSetStatus(ctx, msg, body)
+	case "Kick", "Ban", "Unban", "Mute", "Unmute", "Op", "Deop":
+		h.commandModerate(ctx, msg, body)
+
+	default:
+		slog.Warn("Received command with unexpected action", "action", body.Action)
+	}
+}
+
+// maxDroppedFrames is how many frames in a row a slow client can miss before the hub disconnects it
+const maxDroppedFrames = 3
+
+// broadcast never blocks on a client. If a client's send buffer is full the frame is dropped for that client
+// and once it has dropped too many frames it gets disconnected so it can't hold up the rest of the room.
+func (h *Hub) broadcast(ctx context.Context, data []byte, room *Room) {
+	slow := []*User{}
+	for _, u := range room.Users {
+		if !h.trySend(u, data) {
+			slow = append(slow, u)
+		}
+	}
+	// evicting changes room.Users so it can't happen while we're ranging over it
+	for _, u := range slow {
+		h.evictClient(ctx, u, "You were disconnected because you were not reading messages fast enough")
+	}
+}
+
+// sendTo sends data to a single user with the same slow consumer rules as broadcast
+func (h *Hub) sendTo(ctx context.Context, u *User, data []byte) {
+	if !h.trySend(u, data) {
+		h.evictClient(ctx, u, "You were disconnected because you were not reading messages fast enough")
+	}
+}
+
+// trySend returns false when the user has dropped enough frames to be evicted
+func (h *Hub) trySend(u *User, data []byte) bool {
+	if current, ok := h.clients[u.username]; !ok || current != u {
+		// already unregistered, the send channel is closed
+		return true
+	}
+	select {
+	case u.send <- data:
+		// a client that catches up starts over. Only drops in a row mean it can't keep up
+		u.dropped = 0
+		return true
+	default:
+		u.dropped++
+		slog.Warn("Dropped frame for slow client", "user", u.username, "dropped", u.dropped)
+		return u.dropped < maxDroppedFrames
+	}
+}
+
+// sendError sends an ErrorMessage to a single user
+func (h *Hub) sendError(ctx context.Context, u *User, text string) {
+	h.sendErrorCode(ctx, u, "", text)
+}
+
+// sendErrorCode sends an ErrorMessage with one of the protocol's error types so the client can tell what went wrong
+func (h *Hub) sendErrorCode(ctx context.Context, u *User, code, text string) {
+	msg := InternalMessage{
+		User: u,
+		Message: prot.Message{
+			Typ:  "error",
+			Body: prot.ErrorMessage{Message: text, Type: code},
+		},
+	}
+	out, err := h.translator.MessageToBytes(ctx, msg)
+	if err != nil {
+		slog.Error("Unable to translate message to bytes.", "err", err)
+		return
+	}
+	h.sendTo(ctx, u, out)
+}
+
+// evictClient disconnects a user. The reason is sent to the client as an error by the writer before it closes the connection
+func (h *Hub) evictClient(ctx context.Context, u *User, reason string) {
+	if current, ok := h.clients[u.username]; !ok || current != u {
+		return
+	}
+	slog.Warn("Evicting client", "user", u.username, "reason", reason, "dropped", u.dropped)
+	u.closeReason = reason
+	h.unregisterClient(ctx, u)
+}
+
+// unregisterClient removes a disconnected user from the hub and from every room they were in.
+// Both the reader and the writer signal on the unregister channel so this needs to be safe to call twice
+func (h *Hub) unregisterClient(ctx context.Context, u *User) {
+	if current, ok := h.clients[u.username]; !ok || current != u {
+		return
+	}
+	delete(h.clients, u.username)
+	close(u.send)
+	h.broadcastPresence(ctx, u, prot.PresenceMessage{Username: u.username, Status: prot.PresenceOffline})
+
+	rooms := h.roomManager.RemoveUser(u)
+	h.suspendSession(u, rooms, time.Now())
+	for _, room := range rooms {
+		h.sendMembership(ctx, room, prot.MembershipLeft, u, "")
+		h.announce(ctx, room, fmt.Sprintf("User %s has left the room", u.username), u.username)
+		h.hooks.onLeave(ctx, room.Name, u.username)
+	}
+	slog.Info("Client disconnected", "user", u.username, "active_connections", len(h.clients))
+}
+
+func WriteToConn(conn *websocket.Conn, message []byte) error {
+	ws, err := conn.NextWriter(websocket.TextMessage)
+	if err != nil {
+		slog.Error("An error occurred with NextWriter: ", "error", err)
+		return err
+	}
+	ws.Write(message)
+	return ws.Close()
+}
+
+func userInRoom(room *Room, targetUser *User) bool {
+	return slices.Contains(room.Users, targetUser)
+}
@@ -0,0 +1,606 @@
+package chatserver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	prot "github.com/dylanmccormick/ws-chat/internal/protocol"
+	"github.com/gorilla/websocket"
+)
+
+func newTestUser(name string, buffer int) *User {
+	return &User{
+		username: name,
+		send:     make(chan []byte, buffer),
+	}
+}
+
+func TestUnregisterClient(t *testing.T) {
+	h := NewHub(DefaultConfig())
+	h.roomManager.AddRoom("lobby")
+	h.roomManager.AddRoom("general")
+	lobby, _ := h.roomManager.GetRoom("lobby")
+	general, _ := h.roomManager.GetRoom("general")
+
+	leaving := newTestUser("leaving", 10)
+	staying := newTestUser("staying", 10)
+	h.clients[leaving.username] = leaving
+	h.clients[staying.username] = staying
+	lobby.Users = append(lobby.Users, leaving, staying)
+	general.Users = append(general.Users, leaving)
+
+	h.unregisterClient(context.TODO(), leaving)
+
+	if _, ok := h.clients[leaving.username]; ok {
+		t.Errorf("User was not removed from the client map. user=%s", leaving.username)
+	}
+	if slices.Contains(lobby.Users, leaving) || slices.Contains(general.Users, leaving) {
+		t.Errorf("User was not removed from every room. lobby=%v general=%v", lobby.Users, general.Users)
+	}
+	if _, ok := <-leaving.send; ok {
+		t.Errorf("Send channel was not closed for user %s", leaving.username)
+	}
+
+	msgs := drainTestUser(t, staying)
+	if len(msgs) != 3 {
+		t.Fatalf("Remaining user did not receive an offline presence, a membership event and a leave announcement. got=%+v", msgs)
+	}
+	if presence, ok := msgs[0].Body.(prot.PresenceMessage); !ok || presence.Status != prot.PresenceOffline {
+		t.Errorf("Unexpected message for offline presence. got=%+v", msgs[0].Body)
+	}
+	if membership, ok := msgs[1].Body.(prot.MembershipMessage); !ok || membership.Event != prot.MembershipLeft || membership.Room != "lobby" {
+		t.Errorf("Unexpected message for membership event. got=%+v", msgs[1].Body)
+	}
+	if _, ok := msgs[2].Body.(prot.AnnouncementMessage); !ok {
+		t.Errorf("Unexpected message type for leave announcement. expected=%s got=%T", "announcement", msgs[2].Body)
+	}
+
+	// A second signal from the other pump should be a no-op
+	h.unregisterClient(context.TODO(), leaving)
+}
+
+func TestBroadcastEvictsSlowConsumer(t *testing.T) {
+	h := NewHub(DefaultConfig())
+	h.roomManager.AddRoom("lobby")
+	h.roomManager.AddRoom("general")
+	lobby, _ := h.roomManager.GetRoom("lobby")
+	general, _ := h.roomManager.GetRoom("general")
+
+	// stuck never reads so its buffer fills up after the first frame
+	stuck := newTestUser("stuck", 1)
+	reading := newTestUser("reading", 100)
+	other := newTestUser("other", 100)
+	for _, u := range []*User{stuck, reading, other} {
+		h.clients[u.username] = u
+	}
+	lobby.Users = append(lobby.Users, stuck, reading)
+	general.Users = append(general.Users, other)
+
+	for i := 0; i < maxDroppedFrames+1; i++ {
+		h.broadcast(context.TODO(), []byte("lobby message"), lobby)
+		h.broadcast(context.TODO(), []byte("general message"), general)
+	}
+
+	if _, ok := h.clients[stuck.username]; ok {
+		t.Errorf("Slow consumer was not removed from the client map")
+	}
+	if slices.Contains(lobby.Users, stuck) {
+		t.Errorf("Slow consumer was not removed from the room")
+	}
+	if stuck.dropped != maxDroppedFrames {
+		t.Errorf("Unexpected dropped frame count. expected=%d got=%d", maxDroppedFrames, stuck.dropped)
+	}
+	if stuck.closeReason == "" {
+		t.Errorf("Slow consumer was evicted without a reason")
+	}
+	if reading.dropped != 0 || other.dropped != 0 {
+		t.Errorf("Healthy consumers dropped frames. reading=%d other=%d", reading.dropped, other.dropped)
+	}
+	if len(other.send) != maxDroppedFrames+1 {
+		t.Errorf("Other room stopped receiving messages. expected=%d got=%d", maxDroppedFrames+1, len(other.send))
+	}
+	// every lobby message plus stuck going offline, leaving and the announcement that they left
+	if len(reading.send) != maxDroppedFrames+4 {
+		t.Errorf("Reading user in the same room stopped receiving messages. expected=%d got=%d", maxDroppedFrames+4, len(reading.send))
+	}
+
+	// sending to an evicted user must not panic on the closed channel
+	h.broadcast(context.TODO(), []byte("after eviction"), lobby)
+	h.sendTo(context.TODO(), stuck, []byte("after eviction"))
+}
+
+func TestDroppedFramesResetOnCatchUp(t *testing.T) {
+	h := NewHub(DefaultConfig())
+	h.roomManager.AddRoom("lobby")
+	lobby, _ := h.roomManager.GetRoom("lobby")
+	bursty := newTestUser("bursty", 1)
+	h.clients[bursty.username] = bursty
+	lobby.Users = append(lobby.Users, bursty)
+
+	// falls behind now and then over a long session but always catches up in between
+	for range maxDroppedFrames * 3 {
+		h.broadcast(context.TODO(), []byte("fills the buffer"), lobby)
+		h.broadcast(context.TODO(), []byte("dropped"), lobby)
+		<-bursty.send
+	}
+	if _, ok := h.clients[bursty.username]; !ok {
+		t.Errorf("A client that keeps catching up was evicted")
+	}
+	if bursty.dropped != 1 {
+		t.Errorf("Expected only the latest drop to count. got=%d", bursty.dropped)
+	}
+}
+
+// dialTestUser connects a websocket client to the test server and completes the handshake
+func dialTestUser(t *testing.T, url, name string) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Unable to connect user %s: %s", name, err)
+	}
+	sendHello(t, conn, name)
+	m := readTestMessage(t, conn)
+	if _, ok := m.Body.(prot.WelcomeMessage); !ok {
+		t.Fatalf("Expected a welcome message for %s. got=%#v", name, m)
+	}
+	return conn
+}
+
+func sendHello(t *testing.T, conn *websocket.Conn, name string) {
+	t.Helper()
+	hello := prot.Message{Typ: "hello", Body: prot.HelloMessage{Username: name}}
+	data, err := hello.MarshalJSON()
+	if err != nil {
+		t.Fatalf("Unable to marshal hello: %s", err)
+	}
+	conn.WriteMessage(websocket.TextMessage, data)
+}
+
+func readTestMessage(t *testing.T, conn *websocket.Conn) prot.Message {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("Unable to read message: %s", err)
+	}
+	var m prot.Message
+	if err := m.UnmarshalJSON(data); err != nil {
+		t.Fatalf("Unable to unmarshal message %s: %s", data, err)
+	}
+	return m
+}
+
+func startTestServer(t *testing.T) (*Server, string) {
+	t.Helper()
+	s := newServer(DefaultConfig())
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go s.Run(ctx)
+	ts := httptest.NewServer(s.Handler())
+	t.Cleanup(ts.Close)
+	return s, "ws" + strings.TrimPrefix(ts.URL, "http")
+}
+
+func TestHubShutdown(t *testing.T) {
+	s := newServer(DefaultConfig())
+	hub := s.hub
+	ctx, cancel := context.WithCancel(context.Background())
+	go hub.run(ctx)
+	ts := httptest.NewServer(http.HandlerFunc(s.serveWs))
+	defer ts.Close()
+
+	url := "ws" + strings.TrimPrefix(ts.URL, "http")
+	conns := []*websocket.Conn{}
+	for _, name := range []string{"alice", "bob"} {
+		conn := dialTestUser(t, url, name)
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+	// let the hub finish registering everyone
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	for _, conn := range conns {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		announced := false
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+					t.Errorf("Expected a going away close frame. got=%s", err)
+				}
+				break
+			}
+			var m prot.Message
+			if err := m.UnmarshalJSON(data); err == nil {
+				if body, ok := m.Body.(prot.AnnouncementMessage); ok && body.Message == "The server is shutting down" {
+					announced = true
+				}
+			}
+		}
+		if !announced {
+			t.Errorf("Client did not get the shutdown announcement")
+		}
+	}
+
+	waitCtx, waitCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer waitCancel()
+	if err := hub.Wait(waitCtx); err != nil {
+		t.Errorf("Connections did not drain: %s", err)
+	}
+
+	// new upgrades are refused once the hub is closed
+	if _, _, err := websocket.DefaultDialer.Dial(url, nil); err == nil {
+		t.Errorf("Server accepted a connection after shutting down")
+	}
+}
+
+func TestChangeUsernameKeepsIdentity(t *testing.T) {
+	h := NewHub(DefaultConfig())
+	u := newTestUser("alice", 10)
+	u.identity = Identity{Account: "alice", Method: "password"}
+	h.clients[u.username] = u
+
+	msg := InternalMessage{User: u, Message: prot.Message{Typ: "command"}}
+	h.commandChangeUsername(context.TODO(), msg, prot.CommandMessage{Action: "ChangeUsername", Target: "ally"})
+
+	if u.username != "ally" || h.clients["ally"] != u {
+		t.Errorf("Display name was not changed. username=%s", u.username)
+	}
+	if u.identity.Account != "alice" {
+		t.Errorf("Changing the display name changed the account. expected=%s got=%s", "alice", u.identity.Account)
+	}
+}
+
+func TestChangeUsernameToAnotherAccount(t *testing.T) {
+	h, users := newTestHubWithUsers("alice", "bob")
+	alice, bob := users[0], users[1]
+	h.auth = &PasswordAuthenticator{hashes: map[string]string{"alice": "", "bob": "", "carol": ""}}
+	h.config.ResumeGrace = Duration(time.Minute)
+	ctx := context.TODO()
+	rename := func(u *User, name string) {
+		h.commandChangeUsername(ctx, InternalMessage{User: u}, prot.CommandMessage{Action: "ChangeUsername", Target: name})
+	}
+
+	rename(bob, "bobby")
+	// carol is offline but has an account so the name stays theirs
+	rename(alice, "carol")
+	rename(alice, "bob")
+	if alice.username != "alice" {
+		t.Errorf("Expected alice to be kept from other accounts' names. got=%s", alice.username)
+	}
+	rename(bob, "bob")
+	if bob.username != "bob" {
+		t.Errorf("Expected bob to get their own name back. got=%s", bob.username)
+	}
+
+	h.startSession(alice)
+	h.unregisterClient(ctx, alice)
+	h.auth = nil
+	rename(bob, "alice")
+	if bob.username != "bob" {
+		t.Errorf("Expected a dropped session's name to be kept for it. got=%s", bob.username)
+	}
+}
+
+func TestAnonymousAccountsAreUnique(t *testing.T) {
+	// without resuming the name is free again as soon as the first connection drops
+	cfg := DefaultConfig()
+	cfg.ResumeGrace = 0
+	s := newServer(cfg)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+	url := "ws" + strings.TrimPrefix(ts.URL, "http")
+	welcome := func() prot.WelcomeMessage {
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			t.Fatalf("Unable to connect: %s", err)
+		}
+		defer conn.Close()
+		for range 20 {
+			sendHello(t, conn, "alice")
+			if body, ok := readTestMessage(t, conn).Body.(prot.WelcomeMessage); ok {
+				return body
+			}
+			// the hub may not have seen the last connection drop yet
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("alice was never let back in")
+		return prot.WelcomeMessage{}
+	}
+
+	first := welcome()
+	second := welcome()
+	if first.Username != "alice" || second.Username != "alice" {
+		t.Fatalf("Expected both connections to be alice. got=%s and %s", first.Username, second.Username)
+	}
+	if first.Account == "alice" || first.Account == second.Account {
+		t.Errorf("Expected every anonymous login to get its own account. got=%s and %s", first.Account, second.Account)
+	}
+}
+
+func TestHistoryCommand(t *testing.T) {
+	h := NewHub(DefaultConfig())
+	h.roomManager.AddRoom("lobby")
+	rm, _ := h.roomManager.GetRoom("lobby")
+	u := newTestUser("alice", 10)
+	h.clients[u.username] = u
+	h.roomManager.AddUser(rm, u)
+
+	ids := []string{}
+	for i, text := range []string{"one", "two", "three"} {
+		msg := InternalMessage{User: u, Message: prot.Message{Typ: "chat"}}
+		h.handleChat(context.TODO(), msg, prot.ChatMessage{Message: text, Target: "lobby"})
+		var live prot.Message
+		live.UnmarshalJSON(<-u.send)
+		if live.Seq != uint64(i+1) || live.ID == "" || live.Time.IsZero() {
+			t.Errorf("Live message is missing its seq, id or time. got=%+v", live)
+		}
+		ids = append(ids, live.ID)
+	}
+
+	data, _ := json.Marshal(prot.HistoryRequest{Limit: 2})
+	h.commandHistory(context.TODO(), InternalMessage{User: u}, prot.CommandMessage{Action: "History", Target: "lobby", Data: data})
+
+	var m prot.Message
+	if err := m.UnmarshalJSON(<-u.send); err != nil {
+		t.Fatalf("Unable to unmarshal history response: %s", err)
+	}
+	body, ok := m.Body.(prot.CommandMessage)
+	if !ok || body.Action != "History" {
+		t.Fatalf("Expected a History response. got=%#v", m)
+	}
+	history := []prot.Message{}
+	json.Unmarshal(body.Data, &history)
+	if len(history) != 2 || history[0].Seq != 2 || history[1].Seq != 3 {
+		t.Fatalf("Expected the last 2 messages. got=%+v", history)
+	}
+	last, ok := history[1].Body.(prot.ChatMessage)
+	if !ok || last.Message != "three" || last.UserName != "alice" || history[1].ID == "" || history[1].Time.IsZero() {
+		t.Errorf("History message is missing fields. got=%+v", history[1])
+	}
+	if history[1].ID != ids[2] {
+		t.Errorf("History and the live message should have the same id. expected=%s got=%s", ids[2], history[1].ID)
+	}
+}
+
+func TestDirectMessage(t *testing.T) {
+	h := NewHub(DefaultConfig())
+	alice := newTestUser("alice", 10)
+	alice.identity = Identity{Account: "alice", Method: "password"}
+	phone := newTestUser("alice-phone", 10)
+	phone.identity = Identity{Account: "alice", Method: "password"}
+	bob := newTestUser("bob", 10)
+	bob.identity = Identity{Account: "bob", Method: "anonymous"}
+	// anonymous users with the same account name are not the same person
+	other := newTestUser("alice2", 10)
+	other.identity = Identity{Account: "alice", Method: "anonymous"}
+	for _, u := range []*User{alice, phone, bob, other} {
+		h.clients[u.username] = u
+	}
+
+	msg := InternalMessage{User: alice, Message: prot.Message{Typ: "dm"}}
+	h.handleDirect(context.TODO(), msg, prot.DirectMessage{Message: "hey", To: "bob"})
+
+	for _, u := range []*User{alice, phone, bob} {
+		select {
+		case data := <-u.send:
+			var m prot.Message
+			m.UnmarshalJSON(data)
+			body, ok := m.Body.(prot.DirectMessage)
+			if !ok || body.From != "alice" || body.To != "bob" || body.Message != "hey" || m.ID == "" {
+				t.Errorf("Unexpected dm for %s. got=%#v", u.username, m)
+			}
+		default:
+			t.Errorf("Expected %s to get the dm", u.username)
+		}
+	}
+	if len(other.send) != 0 {
+		t.Errorf("An unrelated anonymous user got the dm")
+	}
+
+	h.handleDirect(context.TODO(), msg, prot.DirectMessage{Message: "hey", To: "carol"})
+	var m prot.Message
+	m.UnmarshalJSON(<-alice.send)
+	if body, ok := m.Body.(prot.ErrorMessage); !ok || body.Type != prot.ErrRecipientOffline {
+		t.Errorf("Expected a %s error. got=%#v", prot.ErrRecipientOffline, m)
+	}
+	if len(bob.send) != 0 || len(phone.send) != 0 {
+		t.Errorf("A dm to an offline user should only go back to the sender as an error")
+	}
+}
+
+// drainTestUser reads everything queued for a test user without blocking
+func drainTestUser(t *testing.T, u *User) []prot.Message {
+	t.Helper()
+	msgs := []prot.Message{}
+	for {
+		select {
+		case data := <-u.send:
+			var m prot.Message
+			if err := m.UnmarshalJSON(data); err != nil {
+				t.Fatalf("Unable to unmarshal message %s: %s", data, err)
+			}
+			msgs = append(msgs, m)
+		default:
+			return msgs
+		}
+	}
+}
+
+func hasCommandResponse(msgs []prot.Message, action, target string) bool {
+	return slices.ContainsFunc(msgs, func(m prot.Message) bool {
+		body, ok := m.Body.(prot.CommandMessage)
+		return ok && body.Action == action && body.Target == target
+	})
+}
+
+func hasError(msgs []prot.Message) bool {
+	return slices.ContainsFunc(msgs, func(m prot.Message) bool {
+		_, ok := m.Body.(prot.ErrorMessage)
+		return ok
+	})
+}
+
+func newTestHubWithUsers(names ...string) (*Hub, []*User) {
+	h := NewHub(DefaultConfig())
+	h.roomManager.AddRoom(h.config.DefaultRoom)
+	lobby, _ := h.roomManager.GetRoom(h.config.DefaultRoom)
+	users := []*User{}
+	for _, name := range names {
+		u := newTestUser(name, 20)
+		u.identity = Identity{Account: name, Method: "password"}
+		h.clients[name] = u
+		h.roomManager.AddUser(lobby, u)
+		users = append(users, u)
+	}
+	return h, users
+}
+
+func TestLeaveRoom(t *testing.T) {
+	h, users := newTestHubWithUsers("alice", "bob")
+	alice, bob := users[0], users[1]
+	ctx := context.TODO()
+	command := func(u *User, action, target string) {
+		h.handleCommand(ctx, InternalMessage{User: u}, prot.CommandMessage{Action: action, Target: target})
+	}
+
+	command(alice, "LeaveRoom", "lobby")
+	if msgs := drainTestUser(t, alice); !hasError(msgs) {
+		t.Errorf("Expected an error leaving the only room. got=%+v", msgs)
+	}
+
+	command(alice, "CreateRoom", "games")
+	command(bob, "JoinRoom", "games")
+	drainTestUser(t, alice)
+	drainTestUser(t, bob)
+
+	command(alice, "LeaveRoom", "lobby")
+	lobby, _ := h.roomManager.GetRoom("lobby")
+	if userInRoom(lobby, alice) {
+		t.Errorf("alice is still in the lobby")
+	}
+	if msgs := drainTestUser(t, alice); !hasCommandResponse(msgs, "LeaveRoom", "lobby") {
+		t.Errorf("Expected a LeaveRoom response. got=%+v", msgs)
+	}
+	msgs := drainTestUser(t, bob)
+	if len(msgs) != 2 || msgs[0].Typ != "membership" || msgs[1].Typ != "announcement" {
+		t.Errorf("Expected bob to get a membership event and a leave announcement. got=%+v", msgs)
+	}
+}
+
+func TestDeleteRoom(t *testing.T) {
+	h, users := newTestHubWithUsers("alice", "bob", "carol")
+	alice, bob, carol := users[0], users[1], users[2]
+	ctx := context.TODO()
+	command := func(u *User, action, target string) {
+		h.handleCommand(ctx, InternalMessage{User: u}, prot.CommandMessage{Action: action, Target: target})
+	}
+
+	command(alice, "CreateRoom", "games")
+	command(bob, "JoinRoom", "games")
+	command(carol, "JoinRoom", "games")
+	command(carol, "LeaveRoom", "lobby")
+	for _, u := range users {
+		drainTestUser(t, u)
+	}
+
+	command(bob, "DeleteRoom", "games")
+	if msgs := drainTestUser(t, bob); !hasError(msgs) {
+		t.Errorf("Expected an error when someone other than the owner deletes a room. got=%+v", msgs)
+	}
+	command(alice, "DeleteRoom", "lobby")
+	if msgs := drainTestUser(t, alice); !hasError(msgs) {
+		t.Errorf("Expected an error deleting the default room. got=%+v", msgs)
+	}
+
+	command(alice, "DeleteRoom", "games")
+	if _, err := h.roomManager.GetRoom("games"); err == nil {
+		t.Errorf("Room was not deleted")
+	}
+	for _, u := range users {
+		if msgs := drainTestUser(t, u); !hasCommandResponse(msgs, "DeleteRoom", "games") {
+			t.Errorf("Expected %s to be told the room was deleted. got=%+v", u.username, msgs)
+		}
+	}
+	lobby, _ := h.roomManager.GetRoom("lobby")
+	if !userInRoom(lobby, carol) || len(lobby.Users) != 3 {
+		t.Errorf("Members of the deleted room should all be in the lobby. lobby=%d", len(lobby.Users))
+	}
+}
+
+func TestRoomDirectoryAndTopic(t *testing.T) {
+	h, users := newTestHubWithUsers("alice", "bob", "carol")
+	alice, bob, carol := users[0], users[1], users[2]
+	ctx := context.TODO()
+	command := func(u *User, action, target string, data any) {
+		raw, _ := json.Marshal(data)
+		h.handleCommand(ctx, InternalMessage{User: u}, prot.CommandMessage{Action: action, Target: target, Data: raw})
+	}
+
+	command(alice, "CreateRoom", "games", nil)
+	command(bob, "JoinRoom", "games", nil)
+	drainTestUser(t, alice)
+	drainTestUser(t, bob)
+
+	command(bob, "SetTopic", "games", prot.TopicRequest{Topic: "chess only"})
+	if msgs := drainTestUser(t, bob); !hasError(msgs) {
+		t.Errorf("Expected a member to be refused setting the topic. got=%+v", msgs)
+	}
+	command(alice, "SetTopic", "games", prot.TopicRequest{Topic: "board games"})
+	for _, u := range []*User{alice, bob} {
+		if msgs := drainTestUser(t, u); !hasCommandResponse(msgs, "SetTopic", "games") {
+			t.Errorf("Expected %s to be sent the new topic. got=%+v", u.username, msgs)
+		}
+	}
+	command(carol, "JoinRoom", "games", nil)
+	if msgs := drainTestUser(t, carol); !hasCommandResponse(msgs, "SetTopic", "games") {
+		t.Errorf("Expected carol to be sent the topic on join. got=%+v", msgs)
+	}
+
+	command(carol, "ListAllRooms", "", nil)
+	msgs := drainTestUser(t, carol)
+	if len(msgs) != 1 {
+		t.Fatalf("Expected a ListAllRooms response. got=%+v", msgs)
+	}
+	rooms := []prot.RoomInfo{}
+	json.Unmarshal(msgs[0].Body.(prot.CommandMessage).Data, &rooms)
+	if len(rooms) != 2 {
+		t.Fatalf("Expected the lobby and games. got=%+v", rooms)
+	}
+	games := rooms[0]
+	if games.Name != "games" || games.Topic != "board games" || games.Members != 3 || games.Owner != "alice" ||
+		games.Visibility != prot.VisibilityPublic || games.Created.IsZero() {
+		t.Errorf("Unexpected room info. got=%+v", games)
+	}
+}
+
+func TestClientAnnouncementsRejected(t *testing.T) {
+	h, users := newTestHubWithUsers("alice", "mallory")
+	alice, mallory := users[0], users[1]
+	ctx := context.TODO()
+	h.handleCommand(ctx, InternalMessage{User: alice}, prot.CommandMessage{Action: "CreateRoom", Target: "secret"})
+	drainTestUser(t, alice)
+	drainTestUser(t, mallory)
+
+	forged := prot.AnnouncementMessage{Message: "The server is shutting down", Target: "secret", UserName: "admin"}
+	h.handleMessage(ctx, InternalMessage{User: mallory, Message: prot.Message{Typ: "announcement", Body: forged}})
+	if code := lastErrorCode(drainTestUser(t, mallory)); code != prot.ErrForbidden {
+		t.Errorf("Expected a forbidden error for a client announcement. got=%q", code)
+	}
+	if msgs := drainTestUser(t, alice); len(msgs) != 0 {
+		t.Errorf("Expected nothing to reach the room. got=%+v", msgs)
+	}
+	if stored, _ := h.store.Range(ctx, "secret", RangeQuery{}); len(stored) != 0 {
+		t.Errorf("Expected nothing to be saved to history. got=%+v", stored)
+	}
+}
@@ -0,0 +1,58 @@
+//go:build linux || darwin
+
+package chatserver
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func cpuTime(t *testing.T) time.Duration {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		t.Fatalf("Unable to read cpu usage: %s", err)
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
+
+// With blocking pumps an idle server should sit at close to zero cpu no matter how many users are connected
+func TestIdleCPUWithManyUsers(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping idle cpu test in short mode")
+	}
+	slog.SetLogLoggerLevel(slog.LevelError)
+	defer slog.SetLogLoggerLevel(slog.LevelInfo)
+
+	const users = 500
+	s := newServer(DefaultConfig())
+	hub := s.hub
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go hub.run(ctx)
+	ts := httptest.NewServer(http.HandlerFunc(s.serveWs))
+	defer ts.Close()
+
+	url := "ws" + strings.TrimPrefix(ts.URL, "http")
+	for i := range users {
+		conn := dialTestUser(t, url, fmt.Sprintf("user%d", i))
+		defer conn.Close()
+	}
+	// let the hub finish registering everyone
+	time.Sleep(200 * time.Millisecond)
+
+	wall := time.Second
+	before := cpuTime(t)
+	time.Sleep(wall)
+	used := cpuTime(t) - before
+
+	if used > wall/10 {
+		t.Errorf("Idle server used too much cpu. users=%d wall=%s cpu=%s", users, wall, used)
+	}
+}
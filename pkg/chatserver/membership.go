@@ -0,0 +1,47 @@
+package chatserver
+
+import (
+	"context"
+	"log/slog"
+
+	prot "github.com/dylanmccormick/ws-chat/internal/protocol"
+)
+
+// sendMembership tells everyone in the room that its members changed. For users leaving it has to be called
+// before they are taken out of the room so they hear about it too
+func (h *Hub) sendMembership(ctx context.Context, room *Room, event string, u *User, oldUsername string) {
+	msg := InternalMessage{
+		User: u,
+		Message: prot.Message{
+			Typ: "membership",
+			Body: prot.MembershipMessage{
+				Room:        room.Name,
+				Event:       event,
+				Username:    u.username,
+				OldUsername: oldUsername,
+			},
+		},
+	}
+	out, err := h.translator.MessageToBytes(ctx, msg)
+	if err != nil {
+		slog.Error("Unable to translate message to bytes.", "err", err)
+		return
+	}
+	h.broadcast(ctx, out, room)
+}
+
+// joinedRoom is called once u has been added to the room. The room hears about them and they are sent who is already there
+func (h *Hub) joinedRoom(ctx context.Context, room *Room, u *User) {
+	h.sendMembership(ctx, room, prot.MembershipJoined, u, "")
+	h.sendCommandResponse(ctx, u, "ListRoomUsers", room.Name, roomUsernames(room))
+	h.introduce(ctx, room, u)
+	h.catchUp(ctx, room, u)
+}
+
+func roomUsernames(room *Room) []string {
+	users := []string{}
+	for _, user := range room.Users {
+		users = append(users, user.username)
+	}
+	return users
+}
@@ -0,0 +1,72 @@
+package chatserver
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"testing"
+
+	prot "github.com/dylanmccormick/ws-chat/internal/protocol"
+)
+
+func memberships(msgs []prot.Message) []prot.MembershipMessage {
+	found := []prot.MembershipMessage{}
+	for _, m := range msgs {
+		if membership, ok := m.Body.(prot.MembershipMessage); ok {
+			found = append(found, membership)
+		}
+	}
+	return found
+}
+
+func TestMembershipEvents(t *testing.T) {
+	h, users := newTestHubWithUsers("alice", "bob")
+	alice, bob := users[0], users[1]
+	ctx := context.TODO()
+	command := func(u *User, action, target string, data any) {
+		raw, _ := json.Marshal(data)
+		h.handleCommand(ctx, InternalMessage{User: u}, prot.CommandMessage{Action: action, Target: target, Data: raw})
+	}
+	expect := func(u *User, want ...prot.MembershipMessage) {
+		t.Helper()
+		if got := memberships(drainTestUser(t, u)); !slices.Equal(got, want) {
+			t.Errorf("Unexpected membership events for %s.\nexpected=%+v\ngot=%+v", u.username, want, got)
+		}
+	}
+
+	command(alice, "CreateRoom", "games", nil)
+	expect(alice, prot.MembershipMessage{Room: "games", Event: prot.MembershipJoined, Username: "alice"})
+
+	command(bob, "JoinRoom", "games", nil)
+	joined := prot.MembershipMessage{Room: "games", Event: prot.MembershipJoined, Username: "bob"}
+	expect(alice, joined)
+	msgs := drainTestUser(t, bob)
+	if got := memberships(msgs); !slices.Equal(got, []prot.MembershipMessage{joined}) {
+		t.Errorf("Expected bob to hear about joining. got=%+v", got)
+	}
+	var members []string
+	for _, m := range msgs {
+		if body, ok := m.Body.(prot.CommandMessage); ok && body.Action == "ListRoomUsers" {
+			json.Unmarshal(body.Data, &members)
+		}
+	}
+	if !slices.Equal(members, []string{"alice", "bob"}) {
+		t.Errorf("Expected bob to be sent who is in the room. got=%v", members)
+	}
+
+	command(bob, "ChangeUsername", "robert", nil)
+	renamedLobby := prot.MembershipMessage{Room: "lobby", Event: prot.MembershipRenamed, Username: "robert", OldUsername: "bob"}
+	renamedGames := prot.MembershipMessage{Room: "games", Event: prot.MembershipRenamed, Username: "robert", OldUsername: "bob"}
+	expect(alice, renamedGames, renamedLobby)
+	expect(bob, renamedGames, renamedLobby)
+
+	command(alice, "Kick", "games", prot.ModerationRequest{User: "robert"})
+	kicked := prot.MembershipMessage{Room: "games", Event: prot.MembershipKicked, Username: "robert"}
+	expect(alice, kicked)
+	expect(bob, kicked)
+
+	command(alice, "LeaveRoom", "lobby", nil)
+	left := prot.MembershipMessage{Room: "lobby", Event: prot.MembershipLeft, Username: "alice"}
+	expect(alice, left)
+	expect(bob, left)
+}
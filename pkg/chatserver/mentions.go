@@ -0,0 +1,99 @@
+package chatserver
+
+import (
+	"context"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strings"
+
+	prot "github.com/dylanmccormick/ws-chat/internal/protocol"
+)
+
+// mentionPattern finds @name using the characters usernames are allowed
+var mentionPattern = regexp.MustCompile(`(?:^|[^\w@])@([A-Za-z0-9_.-]+)`)
+
+// parseMentions returns the usernames mentioned in text and whether it mentions the whole room with @room.
+// A full stop right after a name is taken to be the end of the sentence
+func parseMentions(text string) (usernames []string, room bool) {
+	for _, match := range mentionPattern.FindAllStringSubmatch(text, -1) {
+		name := strings.TrimRight(match[1], ".")
+		if name == prot.MentionRoom {
+			room = true
+			continue
+		}
+		if name != "" && !slices.Contains(usernames, name) {
+			usernames = append(usernames, name)
+		}
+	}
+	return usernames, room
+}
+
+// notifyMentions sends a notification to everyone in the room the message mentions, other than whoever wrote it.
+// Only members are notified so a mention can't be used to reach someone outside the room
+func (h *Hub) notifyMentions(ctx context.Context, room *Room, from *User, stored StoredMessage) {
+	usernames, everyone := parseMentions(stored.Message)
+	if len(usernames) == 0 && !everyone {
+		return
+	}
+	notified := map[string]bool{from.identity.Account: true}
+	for _, u := range slices.Clone(room.Users) {
+		kind := ""
+		switch {
+		case slices.Contains(usernames, u.username):
+			kind = prot.MentionUser
+		case everyone:
+			kind = prot.MentionRoom
+		default:
+			continue
+		}
+		// several sessions of one account share a counter and each get the notification once
+		if notified[u.identity.Account] {
+			continue
+		}
+		notified[u.identity.Account] = true
+		count := h.addMention(u.identity.Account, room.Name)
+		notification := prot.NotificationMessage{
+			Room:      room.Name,
+			MessageID: stored.ID,
+			From:      from.username,
+			Message:   stored.Message,
+			Kind:      kind,
+			Mentions:  count,
+		}
+		out, err := h.translator.MessageToBytes(ctx, InternalMessage{User: u, Message: prot.Message{Typ: "notification", Body: notification}})
+		if err != nil {
+			slog.Error("Unable to translate message to bytes.", "err", err)
+			continue
+		}
+		for _, session := range h.sessionsOf(u) {
+			h.sendTo(ctx, session, out)
+		}
+	}
+}
+
+// addMention counts an unread mention and returns how many the account has in the room
+func (h *Hub) addMention(account, room string) int {
+	if h.mentions[account] == nil {
+		h.mentions[account] = map[string]int{}
+	}
+	h.mentions[account][room]++
+	return h.mentions[account][room]
+}
+
+// clearMentions forgets the account's unread mentions in the room
+func (h *Hub) clearMentions(account, room string) {
+	delete(h.mentions[account], room)
+	if len(h.mentions[account]) == 0 {
+		delete(h.mentions, account)
+	}
+}
+
+// commandClearMentions marks the user's mentions in a room as read. Clients send it when the user looks at the room.
+// Every session of the account is told so they can all drop their badge
+func (h *Hub) commandClearMentions(ctx context.Context, msg InternalMessage, body prot.CommandMessage) {
+	h.clearMentions(msg.User.identity.Account, body.Target)
+	for _, session := range h.sessionsOf(msg.User) {
+		h.sendCommandResponse(ctx, session, "ClearMentions", body.Target, nil)
+	}
+}
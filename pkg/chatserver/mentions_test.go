@@ -0,0 +1,76 @@
+package chatserver
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	prot "github.com/dylanmccormick/ws-chat/internal/protocol"
+)
+
+func TestParseMentions(t *testing.T) {
+	tests := []struct {
+		text      string
+		usernames []string
+		room      bool
+	}{
+		{text: "hello", usernames: nil},
+		{text: "@bob are you there?", usernames: []string{"bob"}},
+		{text: "thanks @bob.", usernames: []string{"bob"}},
+		{text: "@alice, @bob and @alice again", usernames: []string{"alice", "bob"}},
+		{text: "@room lunch is here", usernames: nil, room: true},
+		{text: "mail bob@example.com", usernames: nil},
+	}
+	for _, tt := range tests {
+		usernames, room := parseMentions(tt.text)
+		if !slices.Equal(usernames, tt.usernames) || room != tt.room {
+			t.Errorf("parseMentions(%q) = %v, %v. expected %v, %v", tt.text, usernames, room, tt.usernames, tt.room)
+		}
+	}
+}
+
+func notifications(msgs []prot.Message) []prot.NotificationMessage {
+	found := []prot.NotificationMessage{}
+	for _, m := range msgs {
+		if body, ok := m.Body.(prot.NotificationMessage); ok {
+			found = append(found, body)
+		}
+	}
+	return found
+}
+
+func TestMentionNotifications(t *testing.T) {
+	h, users := newTestHubWithUsers("alice", "bob", "carol")
+	alice, bob, carol := users[0], users[1], users[2]
+	ctx := context.TODO()
+	chat := func(u *User, room, text string) {
+		h.handleChat(ctx, InternalMessage{User: u}, prot.ChatMessage{Message: text, Target: room})
+	}
+	h.roomManager.AddRoom("games")
+	games, _ := h.roomManager.GetRoom("games")
+	h.roomManager.AddUser(games, alice)
+
+	chat(alice, "lobby", "@bob hi")
+	chat(alice, "lobby", "@bob @room still there?")
+	chat(alice, "games", "@carol can't hear this")
+	got := notifications(drainTestUser(t, bob))
+	if len(got) != 2 || got[0].Kind != prot.MentionUser || got[0].From != "alice" || got[0].Room != "lobby" || got[1].Mentions != 2 {
+		t.Errorf("Unexpected notifications for bob. got=%+v", got)
+	}
+	got = notifications(drainTestUser(t, carol))
+	if len(got) != 1 || got[0].Kind != prot.MentionRoom || got[0].Mentions != 1 {
+		t.Errorf("Expected carol to only hear about @room. got=%+v", got)
+	}
+	if got := notifications(drainTestUser(t, alice)); len(got) != 0 {
+		t.Errorf("Nobody should be notified about their own message. got=%+v", got)
+	}
+
+	h.handleCommand(ctx, InternalMessage{User: bob}, prot.CommandMessage{Action: "ClearMentions", Target: "lobby"})
+	if !hasCommandResponse(drainTestUser(t, bob), "ClearMentions", "lobby") {
+		t.Errorf("Expected bob to be told the mentions were cleared")
+	}
+	chat(alice, "lobby", "@bob one more")
+	if got := notifications(drainTestUser(t, bob)); len(got) != 1 || got[0].Mentions != 1 {
+		t.Errorf("Expected the count to start again after clearing. got=%+v", got)
+	}
+}
@@ -1,4 +1,4 @@
-package server
+package chatserver
 
 import prot "github.com/dylanmccormick/ws-chat/internal/protocol"
 
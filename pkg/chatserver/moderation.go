@@ -0,0 +1,238 @@
+package chatserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"time"
+
+	prot "github.com/dylanmccormick/ws-chat/internal/protocol"
+)
+
+type Role string
+
+const (
+	RoleOwner     Role = "owner"
+	RoleModerator Role = "moderator"
+	RoleMember    Role = "member"
+)
+
+// RoleOf is the role an account has in the room. Roles are by account so they follow the user across display names
+func (r *Room) RoleOf(account string) Role {
+	switch {
+	case r.Owner != "" && r.Owner == account:
+		return RoleOwner
+	case r.Moderators[account]:
+		return RoleModerator
+	default:
+		return RoleMember
+	}
+}
+
+// Banned reports whether the account is banned right now. Expired bans are cleared as they are found
+func (r *Room) Banned(account string, now time.Time) bool {
+	return activeRestriction(r.Bans, account, now)
+}
+
+// Muted reports whether the account is muted right now. Expired mutes are cleared as they are found
+func (r *Room) Muted(account string, now time.Time) bool {
+	return activeRestriction(r.Mutes, account, now)
+}
+
+// activeRestriction checks a map of account to expiry. A zero expiry never runs out
+func activeRestriction(restrictions map[string]time.Time, account string, now time.Time) bool {
+	until, ok := restrictions[account]
+	if !ok {
+		return false
+	}
+	if !until.IsZero() && !now.Before(until) {
+		delete(restrictions, account)
+		return false
+	}
+	return true
+}
+
+// NewAuditLogger writes one JSON line per moderation action to w
+func NewAuditLogger(w io.Writer) *slog.Logger {
+	return slog.New(slog.NewJSONHandler(w, nil))
+}
+
+// moderation is a parsed moderation command
+type moderation struct {
+	action  string
+	room    *Room
+	actor   *User
+	subject string // account the action is about
+	name    string // display name that was asked for, for announcements
+	until   time.Time
+	reason  string
+}
+
+// commandModerate handles Kick, Ban, Unban, Mute, Unmute, Op and Deop. Target is the room and Data is a ModerationRequest
+func (h *Hub) commandModerate(ctx context.Context, msg InternalMessage, body prot.CommandMessage) {
+	slog.Info("User requested moderation", "user", msg.User.username, "action", body.Action, "room", body.Target)
+	m, err := h.parseModeration(msg.User, body)
+	if err != nil {
+		h.sendErrorCode(ctx, msg.User, prot.ErrForbidden, err.Error())
+		return
+	}
+
+	text := ""
+	switch m.action {
+	case "Kick":
+		if !h.accountInRoom(m.room, m.subject) {
+			h.sendError(ctx, msg.User, fmt.Sprintf("%s is not in this room", m.name))
+			return
+		}
+		text = fmt.Sprintf("%s was kicked by %s", m.name, m.actor.username)
+	case "Ban":
+		if m.room.Bans == nil {
+			m.room.Bans = map[string]time.Time{}
+		}
+		m.room.Bans[m.subject] = m.until
+		text = fmt.Sprintf("%s was banned by %s%s", m.name, m.actor.username, untilText(m.until))
+	case "Unban":
+		delete(m.room.Bans, m.subject)
+		text = fmt.Sprintf("%s was unbanned by %s", m.name, m.actor.username)
+	case "Mute":
+		if m.room.Mutes == nil {
+			m.room.Mutes = map[string]time.Time{}
+		}
+		m.room.Mutes[m.subject] = m.until
+		text = fmt.Sprintf("%s was muted by %s%s", m.name, m.actor.username, untilText(m.until))
+	case "Unmute":
+		delete(m.room.Mutes, m.subject)
+		text = fmt.Sprintf("%s was unmuted by %s", m.name, m.actor.username)
+	case "Op":
+		if m.room.Moderators == nil {
+			m.room.Moderators = map[string]bool{}
+		}
+		m.room.Moderators[m.subject] = true
+		text = fmt.Sprintf("%s was made a moderator by %s", m.name, m.actor.username)
+	case "Deop":
+		delete(m.room.Moderators, m.subject)
+		text = fmt.Sprintf("%s is no longer a moderator", m.name)
+	}
+	if m.reason != "" {
+		text = fmt.Sprintf("%s: %s", text, m.reason)
+	}
+	// announced before anyone is removed so the user who is kicked or banned sees why
+	h.announce(ctx, m.room, text, m.name)
+	if m.action == "Kick" || m.action == "Ban" {
+		h.removeFromRoom(ctx, m.room, m.subject)
+	}
+
+	attrs := []any{
+		"action", m.action,
+		"room", m.room.Name,
+		"actor", m.actor.identity.Account,
+		"actor_name", m.actor.username,
+		"subject", m.subject,
+	}
+	if !m.until.IsZero() {
+		attrs = append(attrs, "until", m.until)
+	}
+	if m.reason != "" {
+		attrs = append(attrs, "reason", m.reason)
+	}
+	h.audit.InfoContext(ctx, "moderation", attrs...)
+}
+
+// parseModeration works out who the command is about and checks the actor is allowed to do it.
+// Owners can do anything to anyone but themselves. Moderators can only act on members and can't hand out roles
+func (h *Hub) parseModeration(actor *User, body prot.CommandMessage) (moderation, error) {
+	room, err := h.roomManager.GetRoom(body.Target)
+	if err != nil {
+		return moderation{}, err
+	}
+	var req prot.ModerationRequest
+	if err := json.Unmarshal(body.Data, &req); err != nil || req.User == "" {
+		return moderation{}, fmt.Errorf("%s needs a user", body.Action)
+	}
+	m := moderation{action: body.Action, room: room, actor: actor, name: req.User, reason: req.Reason}
+	if m.subject, err = h.subjectAccount(req.User); err != nil {
+		return moderation{}, err
+	}
+	if req.Duration != "" {
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil || d <= 0 {
+			return moderation{}, fmt.Errorf("invalid duration %q", req.Duration)
+		}
+		m.until = time.Now().Add(d)
+	}
+
+	actorRole := room.RoleOf(actor.identity.Account)
+	subjectRole := room.RoleOf(m.subject)
+	switch {
+	case m.subject == actor.identity.Account:
+		return moderation{}, fmt.Errorf("you can not %s yourself", body.Action)
+	case actorRole == RoleMember:
+		return moderation{}, fmt.Errorf("you are not a moderator of %s", room.Name)
+	case (m.action == "Op" || m.action == "Deop") && actorRole != RoleOwner:
+		return moderation{}, fmt.Errorf("only the owner of %s can change moderators", room.Name)
+	case subjectRole == RoleOwner || (subjectRole == RoleModerator && actorRole != RoleOwner):
+		return moderation{}, fmt.Errorf("you can not %s a %s", body.Action, subjectRole)
+	}
+	return m, nil
+}
+
+// subjectAccount finds the account a command is about. Someone online is found by username. Bans, invites and role
+// changes can be for someone who is offline, but only by naming an account that can log in again. Without auth every
+// login gets a new account, so offline users can't be named at all
+func (h *Hub) subjectAccount(name string) (string, error) {
+	if u, ok := h.clients[name]; ok {
+		return u.identity.Account, nil
+	}
+	if h.auth == nil {
+		return "", fmt.Errorf("no such user online: %s", name)
+	}
+	if accounts, ok := h.auth.(AccountLister); ok && !accounts.HasAccount(name) {
+		return "", fmt.Errorf("no such user or account: %s", name)
+	}
+	return name, nil
+}
+
+func (h *Hub) accountInRoom(room *Room, account string) bool {
+	for _, u := range room.Users {
+		if u.identity.Account == account {
+			return true
+		}
+	}
+	return false
+}
+
+// removeFromRoom takes every session of the account out of the room. Anyone left with no rooms goes to the default room,
+// or is disconnected if that is the room they were removed from
+func (h *Hub) removeFromRoom(ctx context.Context, room *Room, account string) {
+	for _, u := range slices.Clone(room.Users) {
+		if u.identity.Account != account || !userInRoom(room, u) {
+			continue
+		}
+		h.sendMembership(ctx, room, prot.MembershipKicked, u, "")
+		h.roomManager.LeaveRoom(room, u)
+		h.sendCommandResponse(ctx, u, "LeaveRoom", room.Name, nil)
+		h.hooks.onLeave(ctx, room.Name, u.username)
+		if len(h.roomManager.RoomsFor(u)) > 0 {
+			continue
+		}
+		if room.Name == h.config.DefaultRoom {
+			h.evictClient(ctx, u, fmt.Sprintf("You were removed from %s and are in no other room", room.Name))
+			continue
+		}
+		if defaultRoom, err := h.roomManager.GetRoom(h.config.DefaultRoom); err == nil && defaultRoom != room {
+			h.roomManager.AddUser(defaultRoom, u)
+			h.joinedRoom(ctx, defaultRoom, u)
+			h.hooks.onJoin(ctx, defaultRoom.Name, u.username)
+		}
+	}
+}
+
+func untilText(until time.Time) string {
+	if until.IsZero() {
+		return ""
+	}
+	return fmt.Sprintf(" until %s", until.UTC().Format(time.RFC3339))
+}
@@ -0,0 +1,190 @@
+package chatserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	prot "github.com/dylanmccormick/ws-chat/internal/protocol"
+)
+
+func moderate(h *Hub, actor *User, action, room string, req prot.ModerationRequest) {
+	data, _ := json.Marshal(req)
+	h.handleCommand(context.TODO(), InternalMessage{User: actor}, prot.CommandMessage{Action: action, Target: room, Data: data})
+}
+
+func TestModerationPermissions(t *testing.T) {
+	h, users := newTestHubWithUsers("alice", "bob", "carol")
+	alice, bob, carol := users[0], users[1], users[2]
+	h.handleCommand(context.TODO(), InternalMessage{User: alice}, prot.CommandMessage{Action: "CreateRoom", Target: "games"})
+	room, _ := h.roomManager.GetRoom("games")
+	for _, u := range []*User{bob, carol} {
+		h.roomManager.AddUser(room, u)
+	}
+	drainTestUser(t, alice)
+
+	tests := []struct {
+		actor   *User
+		action  string
+		subject string
+		allowed bool
+	}{
+		{bob, "Kick", "carol", false}, // members can't moderate
+		{bob, "Op", "carol", false},   // or hand out roles
+		{alice, "Op", "bob", true},    // the owner can
+		{bob, "Op", "carol", false},   // moderators can't hand out roles either
+		{bob, "Mute", "alice", false}, // nobody can touch the owner
+		{bob, "Mute", "carol", true},  // moderators can act on members
+		{carol, "Unmute", "bob", false},
+		{alice, "Kick", "alice", false}, // or themselves
+	}
+	for _, tt := range tests {
+		moderate(h, tt.actor, tt.action, "games", prot.ModerationRequest{User: tt.subject})
+		msgs := drainTestUser(t, tt.actor)
+		forbidden := false
+		for _, m := range msgs {
+			if body, ok := m.Body.(prot.ErrorMessage); ok && body.Type == prot.ErrForbidden {
+				forbidden = true
+			}
+		}
+		if forbidden == tt.allowed {
+			t.Errorf("%s %s %s: expected allowed=%v. got=%+v", tt.actor.username, tt.action, tt.subject, tt.allowed, msgs)
+		}
+	}
+	if room.RoleOf("bob") != RoleModerator || room.RoleOf("alice") != RoleOwner || room.RoleOf("carol") != RoleMember {
+		t.Errorf("Unexpected roles. moderators=%v owner=%s", room.Moderators, room.Owner)
+	}
+}
+
+func TestKickBanMute(t *testing.T) {
+	h, users := newTestHubWithUsers("alice", "bob")
+	alice, bob := users[0], users[1]
+	var audit bytes.Buffer
+	h.audit = NewAuditLogger(&audit)
+	ctx := context.TODO()
+	h.handleCommand(ctx, InternalMessage{User: alice}, prot.CommandMessage{Action: "CreateRoom", Target: "games"})
+	h.handleCommand(ctx, InternalMessage{User: bob}, prot.CommandMessage{Action: "JoinRoom", Target: "games"})
+	room, _ := h.roomManager.GetRoom("games")
+	drainTestUser(t, alice)
+	drainTestUser(t, bob)
+
+	moderate(h, alice, "Mute", "games", prot.ModerationRequest{User: "bob", Reason: "spam"})
+	h.handleChat(ctx, InternalMessage{User: bob, Message: prot.Message{Typ: "chat"}}, prot.ChatMessage{Message: "hi", Target: "games"})
+	msgs := drainTestUser(t, bob)
+	if len(msgs) != 2 || msgs[0].Typ != "announcement" {
+		t.Fatalf("Expected the mute announcement and an error. got=%+v", msgs)
+	}
+	if body, ok := msgs[1].Body.(prot.ErrorMessage); !ok || body.Type != prot.ErrMuted {
+		t.Errorf("Expected a %s error. got=%+v", prot.ErrMuted, msgs[1])
+	}
+	if announcement := msgs[0].Body.(prot.AnnouncementMessage); !strings.Contains(announcement.Message, "spam") {
+		t.Errorf("Expected the reason in the announcement. got=%s", announcement.Message)
+	}
+	moderate(h, alice, "Unmute", "games", prot.ModerationRequest{User: "bob"})
+	drainTestUser(t, bob)
+
+	moderate(h, alice, "Kick", "games", prot.ModerationRequest{User: "bob"})
+	if userInRoom(room, bob) {
+		t.Errorf("bob was not kicked")
+	}
+	if msgs := drainTestUser(t, bob); !hasCommandResponse(msgs, "LeaveRoom", "games") {
+		t.Errorf("Expected bob to be told he left the room. got=%+v", msgs)
+	}
+
+	moderate(h, alice, "Ban", "games", prot.ModerationRequest{User: "bob", Duration: "1h"})
+	h.handleCommand(ctx, InternalMessage{User: bob}, prot.CommandMessage{Action: "JoinRoom", Target: "games"})
+	msgs = drainTestUser(t, bob)
+	if len(msgs) == 0 || userInRoom(room, bob) {
+		t.Fatalf("Banned user was able to join")
+	}
+	if body, ok := msgs[len(msgs)-1].Body.(prot.ErrorMessage); !ok || body.Type != prot.ErrBanned {
+		t.Errorf("Expected a %s error. got=%+v", prot.ErrBanned, msgs)
+	}
+	if !room.Banned("bob", time.Now().Add(59*time.Minute)) || room.Banned("bob", time.Now().Add(61*time.Minute)) {
+		t.Errorf("Ban did not expire after an hour")
+	}
+
+	moderate(h, alice, "Ban", "games", prot.ModerationRequest{User: "bob"})
+	moderate(h, alice, "Unban", "games", prot.ModerationRequest{User: "bob"})
+	h.handleCommand(ctx, InternalMessage{User: bob}, prot.CommandMessage{Action: "JoinRoom", Target: "games"})
+	if !userInRoom(room, bob) {
+		t.Errorf("Unbanned user was not able to join")
+	}
+
+	lines := strings.Split(strings.TrimSpace(audit.String()), "\n")
+	if len(lines) != 6 {
+		t.Fatalf("Expected an audit entry per action. got=%d\n%s", len(lines), audit.String())
+	}
+	var entry map[string]any
+	json.Unmarshal([]byte(lines[0]), &entry)
+	if entry["action"] != "Mute" || entry["actor"] != "alice" || entry["subject"] != "bob" || entry["room"] != "games" || entry["reason"] != "spam" {
+		t.Errorf("Unexpected audit entry. got=%v", entry)
+	}
+}
+
+func TestModerateDefaultRoom(t *testing.T) {
+	h, users := newTestHubWithUsers("alice", "bob", "carol")
+	alice, bob, carol := users[0], users[1], users[2]
+	lobby, _ := h.roomManager.GetRoom(h.config.DefaultRoom)
+	// what the hub does with DefaultRoomOwner when it starts. carol is banned once she is offline, which needs accounts
+	lobby.Owner = "alice"
+	h.auth = &PasswordAuthenticator{hashes: map[string]string{"alice": "", "bob": "", "carol": ""}}
+	ctx := context.TODO()
+
+	moderate(h, alice, "Op", "lobby", prot.ModerationRequest{User: "bob"})
+	if lobby.RoleOf("bob") != RoleModerator {
+		t.Fatalf("Expected the owner of the default room to be able to op")
+	}
+
+	// carol has nowhere else to go
+	moderate(h, bob, "Kick", "lobby", prot.ModerationRequest{User: "carol"})
+	if _, ok := h.clients["carol"]; ok || carol.closeReason == "" {
+		t.Errorf("Expected carol to be disconnected when kicked from their only room")
+	}
+
+	moderate(h, bob, "Ban", "lobby", prot.ModerationRequest{User: "carol", Duration: "1h"})
+	reg := registration{user: newTestUser("carol", 10), username: "carol", identity: Identity{Account: "carol", Method: "password"}, result: make(chan error, 1)}
+	h.registerUser(ctx, reg)
+	var hsErr *prot.HandshakeError
+	if err := <-reg.result; !errors.As(err, &hsErr) || hsErr.Code != prot.ErrBanned {
+		t.Errorf("Expected an account banned from the default room to be refused. got=%v", err)
+	}
+}
+
+func TestModerateOfflineUsers(t *testing.T) {
+	h, users := newTestHubWithUsers("alice")
+	alice := users[0]
+	h.handleCommand(context.TODO(), InternalMessage{User: alice}, prot.CommandMessage{Action: "CreateRoom", Target: "games"})
+	room, _ := h.roomManager.GetRoom("games")
+	drainTestUser(t, alice)
+
+	// without auth nobody offline has an account that could ever be banned
+	moderate(h, alice, "Ban", "games", prot.ModerationRequest{User: "bob"})
+	msgs := drainTestUser(t, alice)
+	if len(msgs) != 1 || room.Banned("bob", time.Now()) {
+		t.Fatalf("Expected banning someone offline to fail without auth. got=%+v", msgs)
+	}
+	if body, ok := msgs[0].Body.(prot.ErrorMessage); !ok || !strings.Contains(body.Message, "no such user online") {
+		t.Errorf("Expected a no such user error. got=%+v", msgs)
+	}
+
+	h.auth = &PasswordAuthenticator{hashes: map[string]string{"alice": "", "bob": ""}}
+	moderate(h, alice, "Ban", "games", prot.ModerationRequest{User: "mallory"})
+	if room.Banned("mallory", time.Now()) {
+		t.Errorf("Expected a name that isn't an account to be refused")
+	}
+	moderate(h, alice, "Ban", "games", prot.ModerationRequest{User: "bob"})
+	if !room.Banned("bob", time.Now()) {
+		t.Errorf("Expected an offline account to be banned")
+	}
+
+	cfg := DefaultConfig()
+	cfg.DefaultRoomOwner = "alice"
+	if err := cfg.Validate(); err == nil {
+		t.Errorf("Expected a default room owner without auth to be refused")
+	}
+}
@@ -0,0 +1,128 @@
+package chatserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	prot "github.com/dylanmccormick/ws-chat/internal/protocol"
+)
+
+// idleCheckInterval is how often the hub looks for users who have gone away or idle
+const idleCheckInterval = 10 * time.Second
+
+// passiveCommands are sent by clients on their own, like the tui polling for rooms, so they don't count as activity
+var passiveCommands = map[string]bool{
+	"ListMyRooms":   true,
+	"ListRoomUsers": true,
+	"ListAllRooms":  true,
+	"History":       true,
+	"ClearMentions": true,
+	"MarkRead":      true,
+}
+
+// isActivity is whether the message was something the user did rather than their client
+func isActivity(msg prot.Message) bool {
+	switch body := msg.Body.(type) {
+	case prot.ChatMessage, prot.DirectMessage, prot.TypingMessage:
+		return true
+	case prot.CommandMessage:
+		return !passiveCommands[body.Action]
+	}
+	return false
+}
+
+func (u *User) presence() prot.PresenceMessage {
+	status := prot.PresenceOnline
+	if u.away {
+		status = prot.PresenceAway
+	}
+	return prot.PresenceMessage{Username: u.username, Status: status, Text: u.statusText}
+}
+
+// touch records activity. A user who was away is back
+func (h *Hub) touch(ctx context.Context, u *User, now time.Time) {
+	u.lastActive = now
+	if u.away {
+		u.away = false
+		h.broadcastPresence(ctx, u, u.presence())
+	}
+}
+
+// checkIdle marks users away after AwayAfter and disconnects them after IdleTimeout
+func (h *Hub) checkIdle(ctx context.Context, now time.Time) {
+	awayAfter, idleTimeout := time.Duration(h.config.AwayAfter), time.Duration(h.config.IdleTimeout)
+	for _, u := range h.clients {
+		idle := now.Sub(u.lastActive)
+		switch {
+		case idleTimeout > 0 && idle >= idleTimeout:
+			h.evictClient(ctx, u, fmt.Sprintf("You were disconnected after %s without any activity", idleTimeout))
+		case awayAfter > 0 && idle >= awayAfter && !u.away:
+			u.away = true
+			h.broadcastPresence(ctx, u, u.presence())
+		}
+	}
+}
+
+// roommates is everyone who shares a room with u, and u
+func (h *Hub) roommates(u *User) []*User {
+	seen := map[*User]bool{u: true}
+	users := []*User{u}
+	for _, room := range h.roomManager.RoomsFor(u) {
+		for _, other := range room.Users {
+			if !seen[other] {
+				seen[other] = true
+				users = append(users, other)
+			}
+		}
+	}
+	return users
+}
+
+// broadcastPresence sends u's presence to everyone who can see them in a room
+func (h *Hub) broadcastPresence(ctx context.Context, u *User, presence prot.PresenceMessage) {
+	for _, other := range h.roommates(u) {
+		h.sendPresence(ctx, other, presence)
+	}
+}
+
+func (h *Hub) sendPresence(ctx context.Context, to *User, presence prot.PresenceMessage) {
+	out, err := h.translator.MessageToBytes(ctx, InternalMessage{User: to, Message: prot.Message{Typ: "presence", Body: presence}})
+	if err != nil {
+		slog.Error("Unable to translate message to bytes.", "err", err)
+		return
+	}
+	h.sendTo(ctx, to, out)
+}
+
+// introduce tells the room about a user who just joined it and tells them about anyone in it who isn't
+// plainly online, since clients treat everyone in a room as online until they hear otherwise
+func (h *Hub) introduce(ctx context.Context, room *Room, u *User) {
+	for _, other := range room.Users {
+		if other == u {
+			continue
+		}
+		h.sendPresence(ctx, other, u.presence())
+		if other.away || other.statusText != "" {
+			h.sendPresence(ctx, u, other.presence())
+		}
+	}
+}
+
+// commandSetStatus sets the custom status text shown next to the user's name
+func (h *Hub) commandSetStatus(ctx context.Context, msg InternalMessage, body prot.CommandMessage) {
+	slog.Info("User requested to set status", "user", msg.User.username)
+	var req prot.StatusRequest
+	if err := json.Unmarshal(body.Data, &req); err != nil {
+		h.sendError(ctx, msg.User, "Unable to parse status request")
+		return
+	}
+	if len(req.Text) > prot.MaxStatusLength {
+		h.sendError(ctx, msg.User, fmt.Sprintf("A status can not be longer than %d characters", prot.MaxStatusLength))
+		return
+	}
+	msg.User.statusText = req.Text
+	h.broadcastPresence(ctx, msg.User, msg.User.presence())
+}
@@ -0,0 +1,104 @@
+package chatserver
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	prot "github.com/dylanmccormick/ws-chat/internal/protocol"
+)
+
+// presences returns the presence messages about username in msgs
+func presences(msgs []prot.Message, username string) []prot.PresenceMessage {
+	found := []prot.PresenceMessage{}
+	for _, m := range msgs {
+		if p, ok := m.Body.(prot.PresenceMessage); ok && p.Username == username {
+			found = append(found, p)
+		}
+	}
+	return found
+}
+
+func TestIdlePresence(t *testing.T) {
+	h, users := newTestHubWithUsers("alice", "bob")
+	alice, bob := users[0], users[1]
+	h.config.AwayAfter = Duration(5 * time.Minute)
+	h.config.IdleTimeout = Duration(time.Hour)
+	ctx := context.TODO()
+	start := time.Now()
+	alice.lastActive, bob.lastActive = start, start
+
+	h.checkIdle(ctx, start.Add(time.Minute))
+	if msgs := drainTestUser(t, bob); len(msgs) != 0 {
+		t.Errorf("Expected nothing before anyone is idle. got=%+v", msgs)
+	}
+
+	h.checkIdle(ctx, start.Add(5*time.Minute))
+	got := presences(drainTestUser(t, bob), "alice")
+	if len(got) != 1 || got[0].Status != prot.PresenceAway {
+		t.Errorf("Expected bob to see alice go away. got=%+v", got)
+	}
+	h.checkIdle(ctx, start.Add(6*time.Minute))
+	if got := presences(drainTestUser(t, bob), "alice"); len(got) != 0 {
+		t.Errorf("Expected away to only be sent once. got=%+v", got)
+	}
+
+	// polling doesn't bring anyone back but chatting does
+	h.handleMessage(ctx, InternalMessage{User: alice, Message: prot.Message{Typ: "command", Body: prot.CommandMessage{Action: "ListMyRooms"}}})
+	if alice.away != true {
+		t.Errorf("Expected a passive command to not count as activity")
+	}
+	h.handleMessage(ctx, InternalMessage{User: alice, Message: prot.Message{Typ: "chat", Body: prot.ChatMessage{Message: "back", Target: "lobby"}}})
+	got = presences(drainTestUser(t, bob), "alice")
+	if len(got) != 1 || got[0].Status != prot.PresenceOnline {
+		t.Errorf("Expected bob to see alice come back. got=%+v", got)
+	}
+
+	h.checkIdle(ctx, start.Add(time.Hour))
+	if _, ok := h.clients["bob"]; ok {
+		t.Errorf("Expected bob to be disconnected for being idle")
+	}
+	if bob.closeReason == "" {
+		t.Errorf("Expected bob to be told why they were disconnected")
+	}
+	got = presences(drainTestUser(t, alice), "bob")
+	if len(got) != 2 || got[1].Status != prot.PresenceOffline {
+		t.Errorf("Expected alice to see bob go away then offline. got=%+v", got)
+	}
+}
+
+func TestSetStatus(t *testing.T) {
+	h, users := newTestHubWithUsers("alice", "bob", "carol")
+	alice, bob, carol := users[0], users[1], users[2]
+	ctx := context.TODO()
+	command := func(u *User, action, target string, data any) {
+		raw, _ := json.Marshal(data)
+		h.handleCommand(ctx, InternalMessage{User: u}, prot.CommandMessage{Action: action, Target: target, Data: raw})
+	}
+	command(alice, "CreateRoom", "games", nil)
+	drainTestUser(t, bob)
+
+	command(alice, "SetStatus", "", prot.StatusRequest{Text: "at lunch"})
+	for _, u := range []*User{alice, bob} {
+		got := presences(drainTestUser(t, u), "alice")
+		if len(got) != 1 || got[0].Text != "at lunch" || got[0].Status != prot.PresenceOnline {
+			t.Errorf("Expected %s to see alice's status. got=%+v", u.username, got)
+		}
+	}
+
+	drainTestUser(t, carol)
+	command(carol, "JoinRoom", "games", nil)
+	if got := presences(drainTestUser(t, carol), "alice"); len(got) != 1 || got[0].Text != "at lunch" {
+		t.Errorf("Expected carol to be told alice's status on joining. got=%+v", got)
+	}
+	if got := presences(drainTestUser(t, alice), "carol"); len(got) != 1 {
+		t.Errorf("Expected alice to be told about carol joining. got=%+v", got)
+	}
+
+	command(alice, "SetStatus", "", prot.StatusRequest{Text: strings.Repeat("a", prot.MaxStatusLength+1)})
+	if msgs := drainTestUser(t, alice); !hasError(msgs) {
+		t.Errorf("Expected an error for a status that is too long. got=%+v", msgs)
+	}
+}
@@ -0,0 +1,307 @@
+package chatserver
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	prot "github.com/dylanmccormick/ws-chat/internal/protocol"
+)
+
+// strikeWindow is how long a rate limit strike counts against an account
+const strikeWindow = time.Minute
+
+// autoMuteDuration is how long the abuse action "mute" lasts
+const autoMuteDuration = 5 * time.Minute
+
+// loginLimit is how often one address can try to log in while auth is on, across all of its connections.
+// Checking a password is slow and memory hungry on purpose so guesses have to be too
+var loginLimit = RateLimit{Rate: 0.5, Burst: 10}
+
+// maxLoginAddrs is how many addresses are tracked before the ones that have waited out their limit are dropped
+const maxLoginAddrs = 4096
+
+// RateLimit is a token bucket. Rate is messages per second on average and Burst is how many can come at once.
+// A Rate of 0 turns the limit off
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take spends a token if there is one. Otherwise it returns how long until there will be
+func (b *tokenBucket) take(limit RateLimit, now time.Time) time.Duration {
+	if limit.Rate <= 0 {
+		return 0
+	}
+	burst := float64(max(limit.Burst, 1))
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+}
+
+// RateLimiter checks messages in the reader before they get to the hub so a flood never fills h.messages.
+// Each account has chat and command buckets shared by all of its connections, so opening another one doesn't get
+// more messages through. Every room also has a bucket shared by everyone chatting in it, which the hub charges once
+// it knows the room is real and the sender is in it
+type RateLimiter struct {
+	now     func() time.Time
+	chat    RateLimit
+	command RateLimit
+	room    RateLimit
+	strikes int // rejected messages inside strikeWindow before an account counts as abusive. 0 never does
+
+	mux      sync.Mutex
+	accounts map[string]*accountLimits // used by the readers so guarded by mux
+	logins   map[string]*tokenBucket   // by remote address, used by handshakes so guarded by mux
+
+	rooms map[string]*tokenBucket // only touched on the hub goroutine
+}
+
+func NewRateLimiter(cfg Config) *RateLimiter {
+	return &RateLimiter{
+		now:      time.Now,
+		chat:     RateLimit{Rate: cfg.ChatRate, Burst: cfg.ChatBurst},
+		command:  RateLimit{Rate: cfg.CommandRate, Burst: cfg.CommandBurst},
+		room:     RateLimit{Rate: cfg.RoomRate, Burst: cfg.RoomBurst},
+		strikes:  cfg.AbuseStrikes,
+		accounts: make(map[string]*accountLimits),
+		logins:   make(map[string]*tokenBucket),
+		rooms:    make(map[string]*tokenBucket),
+	}
+}
+
+// accountLimits are the buckets for one account. They last as long as the account has a connection open
+type accountLimits struct {
+	chat       tokenBucket
+	command    tokenBucket
+	background tokenBucket // typing and read markers, which clients send on their own
+	strikes    int
+	lastStrike time.Time
+	quietUntil time.Time // rejections before this have already been reported
+	conns      int
+}
+
+// allowLogin charges a login attempt to the address. It returns how long to wait when there have been too many
+func (l *RateLimiter) allowLogin(addr string) time.Duration {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	now := l.now()
+	if len(l.logins) >= maxLoginAddrs {
+		// a bucket that has had time to refill is the same as a new one
+		refill := time.Duration(float64(loginLimit.Burst) / loginLimit.Rate * float64(time.Second))
+		for other, bucket := range l.logins {
+			if now.Sub(bucket.last) >= refill {
+				delete(l.logins, other)
+			}
+		}
+	}
+	bucket, ok := l.logins[addr]
+	if !ok {
+		bucket = &tokenBucket{}
+		l.logins[addr] = bucket
+	}
+	return bucket.take(loginLimit, now)
+}
+
+// remoteHost is the address without the port, so every connection from one machine shares a login limit
+func remoteHost(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// acquire gets the account's buckets for a reader. Every acquire needs a release when the reader is done
+func (l *RateLimiter) acquire(account string) *accountLimits {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	c, ok := l.accounts[account]
+	if !ok {
+		c = &accountLimits{}
+		l.accounts[account] = c
+	}
+	c.conns++
+	return c
+}
+
+// release drops the account's buckets once its last connection is gone
+func (l *RateLimiter) release(account string) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	c, ok := l.accounts[account]
+	if !ok {
+		return
+	}
+	c.conns--
+	if c.conns <= 0 {
+		delete(l.accounts, account)
+	}
+}
+
+// rateLimited is what the reader sends the hub when it drops a message. It is only sent for the first drop after
+// the user was told to wait, or when they cross the abuse threshold, so a flood turns into a trickle of these
+type rateLimited struct {
+	room       string // set when the message was a chat to a room
+	retryAfter time.Duration
+	abusive    bool
+	roomLimit  bool // the room was over its limit rather than the user
+}
+
+// Allow decides whether the message can go to the hub. When it can't, report is non nil if the hub should hear about it
+func (l *RateLimiter) Allow(c *accountLimits, msg prot.Message) (ok bool, report *rateLimited) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	now := l.now()
+	room := ""
+	var wait time.Duration
+	switch body := msg.Body.(type) {
+	case prot.ChatMessage:
+		room = body.Target
+		wait = c.chat.take(l.chat, now)
+	case prot.DirectMessage:
+		wait = c.chat.take(l.chat, now)
+	default:
+		if isBackground(msg) {
+			// dropped quietly and never a strike. A fast typist shouldn't lose their commands or be taken for a flood
+			return c.background.take(l.command, now) == 0, nil
+		}
+		wait = c.command.take(l.command, now)
+	}
+	if wait == 0 {
+		return true, nil
+	}
+
+	report = &rateLimited{room: room, retryAfter: wait}
+	if l.strikes > 0 {
+		if now.Sub(c.lastStrike) > strikeWindow {
+			c.strikes = 0
+		}
+		c.strikes++
+		c.lastStrike = now
+		if c.strikes >= l.strikes {
+			c.strikes = 0
+			report.abusive = true
+			return false, report
+		}
+	}
+	if now.Before(c.quietUntil) {
+		return false, nil
+	}
+	c.quietUntil = now.Add(wait)
+	return false, report
+}
+
+// isBackground is whether the message is one clients send on their own as the user types and reads. These have a
+// bucket of their own the size of the command limit
+func isBackground(msg prot.Message) bool {
+	switch body := msg.Body.(type) {
+	case prot.TypingMessage:
+		return true
+	case prot.CommandMessage:
+		return body.Action == "MarkRead" || body.Action == "ClearMentions"
+	}
+	return false
+}
+
+// takeRoom charges a chat to the room's shared bucket. Only call it for rooms that exist so the map can't be grown
+// with made up names
+func (l *RateLimiter) takeRoom(room string) time.Duration {
+	bucket, ok := l.rooms[room]
+	if !ok {
+		bucket = &tokenBucket{}
+		l.rooms[room] = bucket
+	}
+	return bucket.take(l.room, l.now())
+}
+
+// ForgetRoom drops the bucket of a deleted room
+func (l *RateLimiter) ForgetRoom(room string) {
+	delete(l.rooms, room)
+}
+
+// chargeRoom takes the chat out of the room's bucket and tells the user when the room is too busy.
+// Like the reader it only reports the first drop until the wait is over. A busy room isn't the fault of whoever
+// happened to hit the limit so it never counts as a strike
+func (h *Hub) chargeRoom(ctx context.Context, u *User, room *Room) bool {
+	wait := h.limiter.takeRoom(room.Name)
+	if wait == 0 {
+		return true
+	}
+	now := h.limiter.now()
+	if now.Before(u.roomQuietUntil) {
+		return false
+	}
+	u.roomQuietUntil = now.Add(wait)
+	h.handleRateLimited(ctx, u, rateLimited{room: room.Name, retryAfter: wait, roomLimit: true})
+	return false
+}
+
+func (r *rateLimited) text() string {
+	wait := r.retryAfter.Round(time.Millisecond)
+	if r.roomLimit {
+		return fmt.Sprintf("%s is busy. Try again in %s", r.room, wait)
+	}
+	return fmt.Sprintf("You are sending messages too fast. Try again in %s", wait)
+}
+
+// handleRateLimited tells the user their message was dropped. When they keep at it the abuse action kicks in.
+// Muting only makes sense for a room so abuse anywhere else always disconnects
+func (h *Hub) handleRateLimited(ctx context.Context, u *User, report rateLimited) {
+	msg := InternalMessage{
+		User: u,
+		Message: prot.Message{
+			Typ: "error",
+			Body: prot.ErrorMessage{
+				Message:    report.text(),
+				Type:       prot.ErrRateLimited,
+				RetryAfter: report.retryAfter.Milliseconds(),
+			},
+		},
+	}
+	out, err := h.translator.MessageToBytes(ctx, msg)
+	if err != nil {
+		slog.Error("Unable to translate message to bytes.", "err", err)
+		return
+	}
+	h.sendTo(ctx, u, out)
+	if !report.abusive {
+		return
+	}
+
+	action := "disconnect"
+	room, err := h.roomManager.GetRoom(report.room)
+	if h.config.AbuseAction == "mute" && err == nil && userInRoom(room, u) {
+		action = "mute"
+	}
+	attrs := []any{"action", "auto-" + action, "actor", "server", "subject", u.identity.Account, "subject_name", u.username}
+	switch action {
+	case "mute":
+		until := h.limiter.now().Add(autoMuteDuration)
+		if room.Mutes == nil {
+			room.Mutes = map[string]time.Time{}
+		}
+		room.Mutes[u.identity.Account] = until
+		h.announce(ctx, room, fmt.Sprintf("%s was muted for flooding%s", u.username, untilText(until)), u.username)
+		attrs = append(attrs, "room", room.Name, "until", until)
+	default:
+		h.evictClient(ctx, u, "You were disconnected for sending messages too fast")
+	}
+	h.audit.InfoContext(ctx, "moderation", attrs...)
+}
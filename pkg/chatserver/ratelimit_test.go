@@ -0,0 +1,253 @@
+package chatserver
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	prot "github.com/dylanmccormick/ws-chat/internal/protocol"
+)
+
+// fakeClock only moves when the test says so
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func newTestLimiter(cfg Config) (*RateLimiter, *fakeClock) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	l := NewRateLimiter(cfg)
+	l.now = clock.Now
+	return l, clock
+}
+
+func chatTo(room string) prot.Message {
+	return prot.Message{Typ: "chat", Body: prot.ChatMessage{Message: "hi", Target: room}}
+}
+
+func TestRateLimiterBucket(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ChatRate, cfg.ChatBurst = 2, 3
+	cfg.RoomRate = 0
+	cfg.AbuseStrikes = 0
+	l, clock := newTestLimiter(cfg)
+	c := l.acquire("alice")
+
+	for i := range 3 {
+		if ok, _ := l.Allow(c, chatTo("lobby")); !ok {
+			t.Fatalf("Expected message %d of the burst to be allowed", i)
+		}
+	}
+	ok, report := l.Allow(c, chatTo("lobby"))
+	if ok || report == nil {
+		t.Fatalf("Expected the message after the burst to be dropped and reported")
+	}
+	if report.retryAfter != 500*time.Millisecond {
+		t.Errorf("Expected to retry after 500ms. got=%s", report.retryAfter)
+	}
+	if ok, report := l.Allow(c, chatTo("lobby")); ok || report != nil {
+		t.Errorf("Expected the next drop to be quiet. ok=%v report=%+v", ok, report)
+	}
+
+	// commands have their own bucket
+	if ok, _ := l.Allow(c, prot.Message{Typ: "command", Body: prot.CommandMessage{Action: "ListMyRooms"}}); !ok {
+		t.Errorf("Expected a command to be allowed while chat is limited")
+	}
+
+	clock.Advance(500 * time.Millisecond)
+	if ok, _ := l.Allow(c, chatTo("lobby")); !ok {
+		t.Errorf("Expected a token after waiting for it")
+	}
+	clock.Advance(time.Hour)
+	for i := range 3 {
+		if ok, _ := l.Allow(c, chatTo("lobby")); !ok {
+			t.Fatalf("Expected the bucket to refill to the burst. message %d was dropped", i)
+		}
+	}
+	if ok, report := l.Allow(c, chatTo("lobby")); ok || report == nil {
+		t.Errorf("Expected the bucket to refill only to the burst. ok=%v report=%+v", ok, report)
+	}
+}
+
+func TestRateLimiterIsPerAccount(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ChatRate, cfg.ChatBurst = 1, 2
+	cfg.AbuseStrikes = 0
+	l, _ := newTestLimiter(cfg)
+	first, second := l.acquire("alice"), l.acquire("alice")
+	bob := l.acquire("bob")
+
+	l.Allow(first, chatTo("lobby"))
+	l.Allow(second, chatTo("lobby"))
+	if ok, _ := l.Allow(second, chatTo("lobby")); ok {
+		t.Errorf("Expected a second connection to share the account's burst")
+	}
+	if ok, _ := l.Allow(bob, chatTo("lobby")); !ok {
+		t.Errorf("Expected other accounts to have their own buckets")
+	}
+
+	l.release("alice")
+	if _, ok := l.accounts["alice"]; !ok {
+		t.Fatalf("Expected the buckets to stay while a connection is open")
+	}
+	l.release("alice")
+	l.release("bob")
+	if len(l.accounts) != 0 {
+		t.Errorf("Expected the buckets to go with the last connection. got=%+v", l.accounts)
+	}
+}
+
+func TestRateLimiterTypingIsQuiet(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.CommandRate, cfg.CommandBurst = 1, 2
+	cfg.AbuseStrikes = 2
+	l, _ := newTestLimiter(cfg)
+	c := l.acquire("alice")
+	typing := prot.Message{Typ: "typing", Body: prot.TypingMessage{Target: "lobby", Typing: true}}
+	markRead := prot.Message{Typ: "command", Body: prot.CommandMessage{Action: "MarkRead", Target: "lobby"}}
+
+	dropped := 0
+	for range 10 {
+		for _, msg := range []prot.Message{typing, markRead} {
+			ok, report := l.Allow(c, msg)
+			if report != nil {
+				t.Fatalf("Expected background messages over the limit to be dropped quietly. got=%+v", report)
+			}
+			if !ok {
+				dropped++
+			}
+		}
+	}
+	if dropped == 0 {
+		t.Errorf("Expected typing and read markers to be limited")
+	}
+	if c.strikes != 0 {
+		t.Errorf("Expected no strikes from background messages. got=%d", c.strikes)
+	}
+	if ok, _ := l.Allow(c, prot.Message{Typ: "command", Body: prot.CommandMessage{Action: "ListMyRooms"}}); !ok {
+		t.Errorf("Expected commands to keep their own budget")
+	}
+}
+
+func TestRateLimiterRoomIsShared(t *testing.T) {
+	h, users := newTestHubWithUsers("alice", "bob")
+	alice, bob := users[0], users[1]
+	cfg := DefaultConfig()
+	cfg.RoomRate, cfg.RoomBurst = 1, 2
+	h.limiter, _ = newTestLimiter(cfg)
+	ctx := context.TODO()
+	chat := func(u *User, room string) []prot.Message {
+		h.handleChat(ctx, InternalMessage{User: u, Message: chatTo(room)}, prot.ChatMessage{Message: "hi", Target: room})
+		return drainTestUser(t, u)
+	}
+	h.handleCommand(ctx, InternalMessage{User: alice}, prot.CommandMessage{Action: "CreateRoom", Target: "games"})
+	drainTestUser(t, alice)
+
+	chat(alice, "lobby")
+	chat(bob, "lobby")
+	if code := lastErrorCode(chat(alice, "lobby")); code != prot.ErrRateLimited {
+		t.Fatalf("Expected the room to be over its limit. got=%q", code)
+	}
+	if code := lastErrorCode(chat(bob, "lobby")); code != prot.ErrRateLimited {
+		t.Errorf("Expected everyone in the room to share its limit. got=%q", code)
+	}
+	if code := lastErrorCode(chat(alice, "lobby")); code != "" {
+		t.Errorf("Expected only the first drop to be reported. got=%q", code)
+	}
+	if code := lastErrorCode(chat(alice, "games")); code != "" {
+		t.Errorf("Expected other rooms to have their own limit. got=%q", code)
+	}
+
+	// rooms that don't exist or that the sender isn't in are never charged
+	chat(bob, "nowhere")
+	chat(bob, "games")
+	if _, ok := h.limiter.rooms["nowhere"]; ok || h.limiter.rooms["games"].tokens != 1 {
+		t.Errorf("Expected only members to be charged to a room. got=%+v", h.limiter.rooms)
+	}
+	h.limiter.ForgetRoom("lobby")
+	if code := lastErrorCode(chat(bob, "lobby")); code != "" {
+		t.Errorf("Expected a forgotten room to start with a full bucket. got=%q", code)
+	}
+}
+
+func TestRateLimiterStrikes(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ChatRate, cfg.ChatBurst = 1, 1
+	cfg.AbuseStrikes = 3
+	l, clock := newTestLimiter(cfg)
+	c := l.acquire("alice")
+
+	l.Allow(c, chatTo("lobby"))
+	l.Allow(c, chatTo("lobby"))
+	l.Allow(c, chatTo("lobby"))
+	// strikes run out after a minute so the count starts again
+	clock.Advance(strikeWindow + time.Second)
+	for i := range 3 {
+		// use the token the wait earned so every message after it is a strike
+		l.Allow(c, chatTo("lobby"))
+		ok, report := l.Allow(c, chatTo("lobby"))
+		if ok {
+			t.Fatalf("Expected strike %d to be dropped", i)
+		}
+		abusive := report != nil && report.abusive
+		if abusive != (i == 2) {
+			t.Errorf("Strike %d: expected abusive=%v. got report=%+v", i, i == 2, report)
+		}
+		clock.Advance(time.Second)
+	}
+}
+
+func TestHandleRateLimited(t *testing.T) {
+	tests := []struct {
+		action    string
+		room      string
+		wantMuted bool
+	}{
+		{action: "mute", room: "lobby", wantMuted: true},
+		{action: "mute", room: "", wantMuted: false},
+		{action: "disconnect", room: "lobby", wantMuted: false},
+	}
+	for _, tt := range tests {
+		h, users := newTestHubWithUsers("alice")
+		alice := users[0]
+		h.config.AbuseAction = tt.action
+		var clock *fakeClock
+		h.limiter, clock = newTestLimiter(h.config)
+		var audit bytes.Buffer
+		h.audit = NewAuditLogger(&audit)
+		ctx := context.TODO()
+
+		h.handleRateLimited(ctx, alice, rateLimited{room: tt.room, retryAfter: time.Second})
+		msgs := drainTestUser(t, alice)
+		if len(msgs) != 1 {
+			t.Fatalf("Expected one error. got=%+v", msgs)
+		}
+		body := msgs[0].Body.(prot.ErrorMessage)
+		if body.Type != prot.ErrRateLimited || body.RetryAfter != 1000 {
+			t.Errorf("Unexpected rate limit error. got=%+v", body)
+		}
+
+		h.handleRateLimited(ctx, alice, rateLimited{room: tt.room, retryAfter: time.Second, abusive: true})
+		lobby, _ := h.roomManager.GetRoom("lobby")
+		if muted := lobby.Muted("alice", clock.now); muted != tt.wantMuted {
+			t.Errorf("%s in %q: expected muted=%v", tt.action, tt.room, tt.wantMuted)
+		}
+		if tt.wantMuted && !lobby.Mutes["alice"].Equal(clock.now.Add(autoMuteDuration)) {
+			t.Errorf("Expected the mute to last %s from the limiter's clock. got=%s", autoMuteDuration, lobby.Mutes["alice"])
+		}
+		if _, connected := h.clients["alice"]; connected != tt.wantMuted {
+			t.Errorf("%s in %q: expected connected=%v", tt.action, tt.room, tt.wantMuted)
+		}
+		if !bytes.Contains(audit.Bytes(), []byte(`"actor":"server"`)) {
+			t.Errorf("%s in %q: expected an audit entry. got=%s", tt.action, tt.room, audit.String())
+		}
+	}
+}
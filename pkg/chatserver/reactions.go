@@ -0,0 +1,85 @@
+package chatserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	prot "github.com/dylanmccormick/ws-chat/internal/protocol"
+)
+
+// react adds or removes account's emoji on the message. It returns errUnchanged if it was already that way.
+// The slices are copied rather than changed in place since the store may still be holding them
+func (m *StoredMessage) react(account, emoji string, remove bool) error {
+	reactions := slices.Clone(m.Reactions)
+	i := slices.IndexFunc(reactions, func(r StoredReaction) bool { return r.Emoji == emoji })
+	reacted := i >= 0 && slices.Contains(reactions[i].Accounts, account)
+	switch {
+	case remove != reacted:
+		return errUnchanged
+	case remove:
+		reactions[i].Accounts = slices.DeleteFunc(slices.Clone(reactions[i].Accounts), func(a string) bool { return a == account })
+		if len(reactions[i].Accounts) == 0 {
+			reactions = slices.Delete(reactions, i, i+1)
+		}
+	case i >= 0:
+		reactions[i].Accounts = append(slices.Clone(reactions[i].Accounts), account)
+	case len(reactions) >= prot.MaxReactions:
+		return errTooManyReactions
+	default:
+		reactions = append(reactions, StoredReaction{Emoji: emoji, Accounts: []string{account}})
+	}
+	m.Reactions = reactions
+	return nil
+}
+
+// reactionCount is how many accounts reacted to the message with emoji
+func (m StoredMessage) reactionCount(emoji string) int {
+	for _, r := range m.Reactions {
+		if r.Emoji == emoji {
+			return len(r.Accounts)
+		}
+	}
+	return 0
+}
+
+// commandReact adds or removes a reaction and sends the room the new count. Reacting again with the same emoji,
+// or removing one that isn't there, does nothing
+func (h *Hub) commandReact(ctx context.Context, msg InternalMessage, body prot.CommandMessage) {
+	slog.Info("User requested to react to a message", "user", msg.User.username, "room", body.Target)
+	var req prot.ReactRequest
+	if err := json.Unmarshal(body.Data, &req); err != nil || req.Emoji == "" {
+		h.sendError(ctx, msg.User, "Unable to parse react request")
+		return
+	}
+	if len(req.Emoji) > prot.MaxEmojiLength {
+		h.sendError(ctx, msg.User, fmt.Sprintf("A reaction can not be longer than %d bytes", prot.MaxEmojiLength))
+		return
+	}
+	room, ok := h.memberRoom(ctx, msg.User, body.Target)
+	if !ok {
+		return
+	}
+	account := msg.User.identity.Account
+	if room.Muted(account, time.Now()) {
+		h.sendErrorCode(ctx, msg.User, prot.ErrMuted, fmt.Sprintf("You are muted in %s", room.Name))
+		return
+	}
+	stored, ok := h.changeMessage(ctx, msg.User, room, req.ID, "react to", func(m *StoredMessage) error {
+		return m.react(account, req.Emoji, req.Remove)
+	})
+	if !ok {
+		return
+	}
+	h.sendRoomEvent(ctx, room, "reaction", prot.ReactionMessage{
+		ID:     stored.ID,
+		Target: room.Name,
+		Emoji:  req.Emoji,
+		User:   msg.User.username,
+		Added:  !req.Remove,
+		Count:  stored.reactionCount(req.Emoji),
+	})
+}
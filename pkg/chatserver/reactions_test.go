@@ -0,0 +1,77 @@
+package chatserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"slices"
+	"testing"
+
+	prot "github.com/dylanmccormick/ws-chat/internal/protocol"
+)
+
+func TestReactions(t *testing.T) {
+	h, users := newTestHubWithUsers("alice", "bob")
+	alice, bob := users[0], users[1]
+	ctx := context.TODO()
+	react := func(u *User, id, emoji string, remove bool) {
+		raw, _ := json.Marshal(prot.ReactRequest{ID: id, Emoji: emoji, Remove: remove})
+		h.handleCommand(ctx, InternalMessage{User: u}, prot.CommandMessage{Action: "React", Target: "lobby", Data: raw})
+	}
+	reactions := func(u *User) []prot.ReactionMessage {
+		found := []prot.ReactionMessage{}
+		for _, m := range drainTestUser(t, u) {
+			if body, ok := m.Body.(prot.ReactionMessage); ok {
+				found = append(found, body)
+			}
+		}
+		return found
+	}
+
+	h.handleChat(ctx, InternalMessage{User: alice}, prot.ChatMessage{Message: "hello", Target: "lobby"})
+	id := drainTestUser(t, bob)[0].ID
+	drainTestUser(t, alice)
+
+	react(bob, id, "👍", false)
+	react(alice, id, "👍", false)
+	react(alice, id, "👍", false)
+	react(alice, id, "🎉", false)
+	want := []prot.ReactionMessage{
+		{ID: id, Target: "lobby", Emoji: "👍", User: "bob", Added: true, Count: 1},
+		{ID: id, Target: "lobby", Emoji: "👍", User: "alice", Added: true, Count: 2},
+		{ID: id, Target: "lobby", Emoji: "🎉", User: "alice", Added: true, Count: 1},
+	}
+	if got := reactions(bob); !slices.Equal(got, want) {
+		t.Errorf("Unexpected reaction events. Reacting twice should do nothing.\nexpected=%+v\ngot=%+v", want, got)
+	}
+
+	drainTestUser(t, alice)
+	react(alice, id, "🎉", true)
+	react(bob, id, "🎉", true)
+	want = []prot.ReactionMessage{{ID: id, Target: "lobby", Emoji: "🎉", User: "alice", Added: false, Count: 0}}
+	if got := reactions(alice); !slices.Equal(got, want) {
+		t.Errorf("Unexpected reaction events after removing.\nexpected=%+v\ngot=%+v", want, got)
+	}
+
+	drainTestUser(t, bob)
+	h.handleCommand(ctx, InternalMessage{User: bob}, prot.CommandMessage{Action: "History", Target: "lobby"})
+	msgs := drainTestUser(t, bob)
+	var history []prot.Message
+	json.Unmarshal(msgs[0].Body.(prot.CommandMessage).Data, &history)
+	chat := history[0].Body.(prot.ChatMessage)
+	if len(chat.Reactions) != 1 || chat.Reactions[0].Emoji != "👍" || chat.Reactions[0].Count != 2 || !chat.Reactions[0].Mine {
+		t.Errorf("Unexpected reactions in history. got=%+v", chat.Reactions)
+	}
+	if raw, _ := json.Marshal(history[0]); bytes.Contains(raw, []byte(`"users"`)) {
+		t.Errorf("Expected accounts to be left out of history. got=%s", raw)
+	}
+
+	h.roomManager.AddRoom("games")
+	games, _ := h.roomManager.GetRoom("games")
+	h.roomManager.AddUser(games, alice)
+	raw, _ := json.Marshal(prot.ReactRequest{ID: id, Emoji: "👍"})
+	h.handleCommand(ctx, InternalMessage{User: alice}, prot.CommandMessage{Action: "React", Target: "games", Data: raw})
+	if !hasError(drainTestUser(t, alice)) {
+		t.Errorf("Expected an error reacting to a message that isn't in the room")
+	}
+}
@@ -0,0 +1,186 @@
+package chatserver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"time"
+
+	prot "github.com/dylanmccormick/ws-chat/internal/protocol"
+)
+
+// session is what the hub remembers about a connection so a client that drops can pick up where it left off.
+// While the connection is up only user is set. When it drops the rest is filled in and it lasts until expires
+type session struct {
+	token    string
+	identity Identity
+	user     *User
+
+	username string
+	rooms    []string
+	status   string
+	left     time.Time // when the connection dropped
+	expires  time.Time
+}
+
+func newSessionToken() string {
+	var token [32]byte
+	rand.Read(token[:])
+	return hex.EncodeToString(token[:])
+}
+
+// startSession gives a newly registered user a session they can resume
+func (h *Hub) startSession(u *User) *session {
+	s := &session{token: newSessionToken(), identity: u.identity, user: u}
+	h.sessions[s.token] = s
+	u.session = s
+	return s
+}
+
+// suspendSession keeps the session of a user who dropped for the grace window. Anyone the server disconnected on
+// purpose can't come back this way
+func (h *Hub) suspendSession(u *User, rooms []*Room, now time.Time) {
+	s := u.session
+	if s == nil {
+		return
+	}
+	if h.config.ResumeGrace <= 0 || u.closeReason != "" {
+		h.endSession(s)
+		return
+	}
+	s.user = nil
+	s.username = u.username
+	s.status = u.statusText
+	s.rooms = s.rooms[:0]
+	for _, room := range rooms {
+		s.rooms = append(s.rooms, room.Name)
+	}
+	s.left = now
+	s.expires = now.Add(time.Duration(h.config.ResumeGrace))
+}
+
+// resumable is the session the hello asked for, if it is still there and belongs to whoever sent it.
+// Anonymous users have nothing but the token to prove who they are. The session can still have a user when the
+// network dropped the old connection and the server hasn't noticed yet, which the caller has to take over
+func (h *Hub) resumable(reg registration, now time.Time) *session {
+	s, ok := h.sessions[reg.session]
+	if !ok || h.config.ResumeGrace <= 0 {
+		return nil
+	}
+	if s.identity.Method != "anonymous" && s.identity != reg.identity {
+		return nil
+	}
+	if s.user != nil {
+		return s
+	}
+	if !now.Before(s.expires) {
+		return nil
+	}
+	if _, taken := h.clients[s.username]; taken {
+		return nil
+	}
+	return s
+}
+
+// takeOver disconnects the old connection of a session that is being resumed. Its rooms and username are kept
+// for the new one the same way as when a connection drops. It returns nil if the session couldn't be kept
+func (h *Hub) takeOver(ctx context.Context, s *session) *session {
+	old := s.user
+	slog.Info("Taking over a session that is still connected", "user", old.username)
+	h.unregisterClient(ctx, old)
+	if current, ok := h.sessions[s.token]; !ok || current.user != nil {
+		return nil
+	}
+	return s
+}
+
+// reserved is whether username belongs to a suspended session of someone else. It is kept for them until the session expires
+func (h *Hub) reserved(username string, identity Identity, now time.Time) bool {
+	for _, s := range h.sessions {
+		if s.user == nil && s.username == username && now.Before(s.expires) {
+			return s.identity.Method == "anonymous" || s.identity != identity
+		}
+	}
+	return false
+}
+
+// expireSessions forgets suspended sessions whose grace window is over
+func (h *Hub) expireSessions(now time.Time) {
+	for _, s := range h.sessions {
+		if s.user == nil && !now.Before(s.expires) {
+			h.endSession(s)
+		}
+	}
+}
+
+// endSession forgets a session for good. An account with no connection or session left is in no rooms, and without
+// auth it is never seen again, so its read markers and mention counts go with it
+func (h *Hub) endSession(s *session) {
+	delete(h.sessions, s.token)
+	account := s.identity.Account
+	for _, u := range h.clients {
+		if u.identity.Account == account {
+			return
+		}
+	}
+	for _, other := range h.sessions {
+		if other.identity.Account == account {
+			return
+		}
+	}
+	delete(h.reads, account)
+	delete(h.mentions, account)
+}
+
+// restoreRooms puts a resuming user back in the rooms they were in that still exist and will still have them
+func (h *Hub) restoreRooms(u *User, s *session, now time.Time) []*Room {
+	rooms := []*Room{}
+	for _, name := range s.rooms {
+		room, err := h.roomManager.GetRoom(name)
+		if err != nil || room.Banned(u.identity.Account, now) {
+			continue
+		}
+		// a room deleted and made again while they were gone is a new room, so they need to be let into it again
+		if _, err := room.checkAccess(u.identity.Account, ""); err != nil && room.Created.After(s.left) {
+			continue
+		}
+		if err := h.roomManager.AddUser(room, u); err != nil {
+			slog.Warn("Unable to restore room", "room", name, "user", u.username, "error", err)
+			continue
+		}
+		rooms = append(rooms, room)
+	}
+	return rooms
+}
+
+// rejoined tells a resumed user's rooms they are back and sends them what they missed in each one.
+// Missed messages come as a History response, oldest first, so a long gap doesn't overflow the send buffer
+func (h *Hub) rejoined(ctx context.Context, u *User, rooms []*Room, lastSeq map[string]uint64) {
+	for _, room := range rooms {
+		h.joinedRoom(ctx, room, u)
+		h.hooks.onJoin(ctx, room.Name, u.username)
+		if room.Topic != "" {
+			h.sendCommandResponse(ctx, u, "SetTopic", room.Name, prot.TopicRequest{Topic: room.Topic})
+		}
+		if after, ok := lastSeq[room.Name]; ok {
+			h.replay(ctx, u, room, after)
+		}
+		h.announce(ctx, room, fmt.Sprintf("User %s is back", u.username), u.username)
+	}
+}
+
+// replay sends the messages in the room after seq, up to a full page of history
+func (h *Hub) replay(ctx context.Context, u *User, room *Room, after uint64) {
+	stored, err := h.store.Range(ctx, room.Name, RangeQuery{AfterSeq: after, Limit: prot.MaxHistoryLimit})
+	if err != nil {
+		slog.Error("Unable to read missed messages", "room", room.Name, "error", err)
+		return
+	}
+	messages := make([]prot.Message, 0, len(stored))
+	for _, m := range stored {
+		messages = append(messages, m.Envelope(u.identity.Account))
+	}
+	h.sendCommandResponse(ctx, u, "History", room.Name, messages)
+}
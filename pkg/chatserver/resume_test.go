@@ -0,0 +1,235 @@
+package chatserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	prot "github.com/dylanmccormick/ws-chat/internal/protocol"
+	"github.com/gorilla/websocket"
+)
+
+func writeTestMessage(t *testing.T, conn *websocket.Conn, msg prot.Message) {
+	t.Helper()
+	data, err := msg.MarshalJSON()
+	if err != nil {
+		t.Fatalf("Unable to marshal %s message: %s", msg.Typ, err)
+	}
+	conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// readTestUntil reads messages until one matches
+func readTestUntil(t *testing.T, conn *websocket.Conn, match func(prot.Message) bool) prot.Message {
+	t.Helper()
+	for {
+		if m := readTestMessage(t, conn); match(m) {
+			return m
+		}
+	}
+}
+
+func TestResumeSession(t *testing.T) {
+	_, url := startTestServer(t)
+	alice, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Unable to connect: %s", err)
+	}
+	sendHello(t, alice, "alice")
+	welcome, _ := readTestMessage(t, alice).Body.(prot.WelcomeMessage)
+	if welcome.Session == "" {
+		t.Fatalf("Expected a session token in the welcome. got=%+v", welcome)
+	}
+	writeTestMessage(t, alice, prot.Message{Typ: "command", Body: prot.CommandMessage{Action: "CreateRoom", Target: "games"}})
+	writeTestMessage(t, alice, prot.Message{Typ: "chat", Body: prot.ChatMessage{Message: "anyone?", Target: "games"}})
+	seen := readTestUntil(t, alice, func(m prot.Message) bool {
+		_, ok := m.Body.(prot.ChatMessage)
+		return ok
+	})
+
+	bob := dialTestUser(t, url, "bob")
+	defer bob.Close()
+	writeTestMessage(t, bob, prot.Message{Typ: "command", Body: prot.CommandMessage{Action: "JoinRoom", Target: "games"}})
+	readTestUntil(t, bob, func(m prot.Message) bool {
+		body, ok := m.Body.(prot.MembershipMessage)
+		return ok && body.Room == "games" && body.Username == "bob"
+	})
+	alice.Close()
+	readTestUntil(t, bob, func(m prot.Message) bool {
+		body, ok := m.Body.(prot.MembershipMessage)
+		return ok && body.Room == "games" && body.Event == prot.MembershipLeft
+	})
+	writeTestMessage(t, bob, prot.Message{Typ: "chat", Body: prot.ChatMessage{Message: "you missed this", Target: "games"}})
+
+	// the name is kept for the session while it can still be resumed
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Unable to connect: %s", err)
+	}
+	defer conn.Close()
+	sendHello(t, conn, "alice")
+	if body, ok := readTestMessage(t, conn).Body.(prot.ErrorMessage); !ok || body.Type != prot.ErrUsernameTaken {
+		t.Errorf("Expected alice to be reserved. got=%+v", body)
+	}
+
+	writeTestMessage(t, conn, prot.Message{Typ: "hello", Body: prot.HelloMessage{
+		Username: "someone",
+		Session:  welcome.Session,
+		LastSeq:  map[string]uint64{"games": seen.Seq},
+	}})
+	resumed, _ := readTestMessage(t, conn).Body.(prot.WelcomeMessage)
+	slices.Sort(resumed.Rooms)
+	if !resumed.Resumed || resumed.Username != "alice" || !slices.Equal(resumed.Rooms, []string{"games", "lobby"}) {
+		t.Fatalf("Expected alice to get their rooms back. got=%+v", resumed)
+	}
+	history := readTestUntil(t, conn, func(m prot.Message) bool {
+		body, ok := m.Body.(prot.CommandMessage)
+		return ok && body.Action == "History" && body.Target == "games"
+	})
+	missed := []prot.Message{}
+	json.Unmarshal(history.Body.(prot.CommandMessage).Data, &missed)
+	if len(missed) == 0 || missed[0].Seq != seen.Seq+1 {
+		t.Fatalf("Expected the messages after %d to be replayed. got=%+v", seen.Seq, missed)
+	}
+	if last, ok := missed[len(missed)-1].Body.(prot.ChatMessage); !ok || last.Message != "you missed this" {
+		t.Errorf("Expected the replay to end with bob's chat. got=%+v", missed[len(missed)-1])
+	}
+}
+
+func TestResumeTakesOverLiveSession(t *testing.T) {
+	_, url := startTestServer(t)
+	old, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Unable to connect: %s", err)
+	}
+	defer old.Close()
+	sendHello(t, old, "alice")
+	welcome, _ := readTestMessage(t, old).Body.(prot.WelcomeMessage)
+	writeTestMessage(t, old, prot.Message{Typ: "command", Body: prot.CommandMessage{Action: "CreateRoom", Target: "games"}})
+	readTestUntil(t, old, func(m prot.Message) bool {
+		body, ok := m.Body.(prot.MembershipMessage)
+		return ok && body.Room == "games"
+	})
+
+	// the old connection is never closed, like one the network dropped without the server hearing about it
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Unable to connect: %s", err)
+	}
+	defer conn.Close()
+	writeTestMessage(t, conn, prot.Message{Typ: "hello", Body: prot.HelloMessage{Username: "alice", Session: welcome.Session}})
+	resumed, ok := readTestMessage(t, conn).Body.(prot.WelcomeMessage)
+	slices.Sort(resumed.Rooms)
+	if !ok || !resumed.Resumed || resumed.Username != "alice" || !slices.Equal(resumed.Rooms, []string{"games", "lobby"}) {
+		t.Fatalf("Expected the session to be taken over with its rooms. got=%+v", resumed)
+	}
+
+	old.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, _, err := old.ReadMessage(); err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				t.Errorf("Expected the old connection to be closed. got=%s", err)
+			}
+			break
+		}
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	h, users := newTestHubWithUsers("alice")
+	alice := users[0]
+	h.config.ResumeGrace = Duration(time.Minute)
+	s := h.startSession(alice)
+	now := time.Now()
+
+	lobby, _ := h.roomManager.GetRoom("lobby")
+	h.suspendSession(alice, []*Room{lobby}, now)
+	if h.reserved("alice", Identity{Account: "alice", Method: "password"}, now) {
+		t.Errorf("The account's own name shouldn't be reserved from it")
+	}
+	if !h.reserved("alice", Identity{Account: "mallory", Method: "password"}, now) {
+		t.Errorf("Expected alice to be reserved from other accounts")
+	}
+	if got := h.resumable(registration{session: s.token, identity: Identity{Account: "mallory", Method: "password"}}, now); got != nil {
+		t.Errorf("Another account shouldn't be able to resume alice's session")
+	}
+
+	h.expireSessions(now.Add(2 * time.Minute))
+	if _, ok := h.sessions[s.token]; ok {
+		t.Errorf("Expected the session to expire")
+	}
+
+	// someone the server disconnected on purpose can't come back
+	s = h.startSession(alice)
+	alice.closeReason = "You were disconnected for sending messages too fast"
+	h.suspendSession(alice, []*Room{lobby}, now)
+	if _, ok := h.sessions[s.token]; ok {
+		t.Errorf("Expected an evicted user's session to be dropped")
+	}
+}
+
+func TestEndedSessionsForgetReads(t *testing.T) {
+	h, users := newTestHubWithUsers("alice", "bob")
+	alice, bob := users[0], users[1]
+	h.config.ResumeGrace = Duration(time.Minute)
+	for _, u := range users {
+		u.identity.Method = "anonymous"
+		h.startSession(u)
+	}
+	ctx := context.TODO()
+	h.handleChat(ctx, InternalMessage{User: bob}, prot.ChatMessage{Message: "hi @alice", Target: "lobby"})
+	if len(h.reads) == 0 || len(h.mentions) == 0 {
+		t.Fatalf("Expected the chat to be tracked. reads=%v mentions=%v", h.reads, h.mentions)
+	}
+
+	h.unregisterClient(ctx, alice)
+	h.unregisterClient(ctx, bob)
+	if _, ok := h.mentions["alice"]; !ok {
+		t.Errorf("Expected the mention to be kept while the session can be resumed")
+	}
+	h.expireSessions(time.Now().Add(2 * time.Minute))
+	if len(h.reads) != 0 || len(h.mentions) != 0 {
+		t.Errorf("Expected nothing left once the sessions expired. reads=%v mentions=%v", h.reads, h.mentions)
+	}
+}
+
+func TestResumeIntoRecreatedRoom(t *testing.T) {
+	h, users := newTestHubWithUsers("alice", "bob")
+	alice, bob := users[0], users[1]
+	h.config.ResumeGrace = Duration(time.Minute)
+	h.roomManager.AddRoom("games")
+	h.roomManager.AddRoom("club")
+	games, _ := h.roomManager.GetRoom("games")
+	games.Visibility = prot.VisibilityPassword
+	games.SetPassword("hunter2")
+	h.roomManager.AddUser(games, bob)
+	club, _ := h.roomManager.GetRoom("club")
+	h.roomManager.AddUser(club, bob)
+	s := h.startSession(bob)
+	lobby, _ := h.roomManager.GetRoom("lobby")
+	left := time.Now()
+	h.suspendSession(bob, []*Room{lobby, games, club}, left)
+
+	// club is deleted and alice makes a new invite only one while bob is gone
+	h.roomManager.DeleteRoom("club")
+	h.roomManager.AddRoom("club")
+	club, _ = h.roomManager.GetRoom("club")
+	club.Owner = alice.identity.Account
+	club.Visibility = prot.VisibilityInvite
+	club.Created = left.Add(time.Second)
+
+	back := newTestUser("bob", 20)
+	back.identity = bob.identity
+	rooms := h.restoreRooms(back, s, left.Add(2*time.Second))
+	names := []string{}
+	for _, room := range rooms {
+		names = append(names, room.Name)
+	}
+	if !slices.Equal(names, []string{"lobby", "games"}) {
+		t.Errorf("Expected bob back in the rooms they were let into and not the new club. got=%v", names)
+	}
+}
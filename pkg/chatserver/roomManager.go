@@ -0,0 +1,141 @@
+package chatserver
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+type Room struct {
+	Name    string
+	Users   []*User
+	Owner   string // account of the user who created the room. The default room's comes from config
+	Topic   string
+	Created time.Time
+
+	ReadReceipts bool // members see how far everyone else has read
+
+	Visibility   string          // one of the protocol Visibility* modes. Empty is public
+	Invites      map[string]bool // accounts that can join whatever the visibility
+	passwordHash []byte
+	passwordSalt []byte
+
+	// moderation state is keyed by account and only touched on the hub goroutine
+	Moderators map[string]bool
+	Bans       map[string]time.Time // zero time means the ban doesn't expire
+	Mutes      map[string]time.Time // zero time means the mute lasts until Unmute
+}
+
+type RoomManager struct {
+	rooms map[string]*Room
+	mux   sync.Mutex
+
+	defaultRoom     string
+	maxRooms        int
+	maxUsersPerRoom int
+}
+
+func NewRoomManager(cfg Config) *RoomManager {
+	return &RoomManager{
+		rooms:           make(map[string]*Room),
+		mux:             sync.Mutex{},
+		defaultRoom:     cfg.DefaultRoom,
+		maxRooms:        cfg.MaxRooms,
+		maxUsersPerRoom: cfg.MaxUsersPerRoom,
+	}
+}
+
+func (r *RoomManager) ListRooms() []string {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	// I don't think these really need to be sorted, but maybe?
+	return slices.Sorted(maps.Keys(r.rooms))
+}
+
+func (r *RoomManager) AddRoom(name string) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if _, ok := r.rooms[name]; ok {
+		return fmt.Errorf("the room %s already exists", name)
+	}
+	if r.maxRooms > 0 && len(r.rooms) >= r.maxRooms {
+		return fmt.Errorf("the server already has the maximum of %d rooms", r.maxRooms)
+	}
+	r.rooms[name] = &Room{Name: name, Users: []*User{}, Created: time.Now()}
+	return nil
+}
+
+func (r *RoomManager) DeleteRoom(name string) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if _, ok := r.rooms[name]; !ok {
+		return fmt.Errorf("the room %s does not exist", name)
+	}
+	delete(r.rooms, name)
+	return nil
+}
+
+func (r *RoomManager) GetRoom(name string) (*Room, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if room, ok := r.rooms[name]; ok {
+		return room, nil
+	}
+	return nil, fmt.Errorf("the room %s does not exist", name)
+}
+
+// AddUser puts the user in the room unless the room is full. Everyone has to fit in the default room so it is never capped
+func (r *RoomManager) AddUser(room *Room, u *User) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if room.Name != r.defaultRoom && r.maxUsersPerRoom > 0 && len(room.Users) >= r.maxUsersPerRoom {
+		return fmt.Errorf("the room %s is full", room.Name)
+	}
+	room.Users = append(room.Users, u)
+	return nil
+}
+
+// LeaveRoom takes the user out of one room. It returns false if they weren't in it
+func (r *RoomManager) LeaveRoom(room *Room, u *User) bool {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if !slices.Contains(room.Users, u) {
+		return false
+	}
+	room.Users = slices.DeleteFunc(room.Users, func(user *User) bool {
+		return user == u
+	})
+	return true
+}
+
+// RoomsFor returns every room the user is in
+func (r *RoomManager) RoomsFor(u *User) []*Room {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	rooms := []*Room{}
+	for _, name := range slices.Sorted(maps.Keys(r.rooms)) {
+		if slices.Contains(r.rooms[name].Users, u) {
+			rooms = append(rooms, r.rooms[name])
+		}
+	}
+	return rooms
+}
+
+// RemoveUser takes the user out of every room and returns the rooms they were removed from
+func (r *RoomManager) RemoveUser(u *User) []*Room {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	removed := []*Room{}
+	for _, room := range r.rooms {
+		if !slices.Contains(room.Users, u) {
+			continue
+		}
+		room.Users = slices.DeleteFunc(room.Users, func(user *User) bool {
+			return user == u
+		})
+		removed = append(removed, room)
+	}
+	return removed
+}
@@ -1,4 +1,4 @@
-package server
+package chatserver
 
 import (
 	"reflect"
@@ -7,7 +7,7 @@ import (
 )
 
 func TestRoomManager(t *testing.T) {
-	rm := NewRoomManager()
+	rm := NewRoomManager(DefaultConfig())
 	if reflect.TypeOf(rm) != reflect.TypeOf(&RoomManager{}) {
 		t.Errorf("Unexpected type for RoomManager. expected=%T, got=%T", &RoomManager{}, rm)
 	}
@@ -48,3 +48,35 @@ func TestRoomManager(t *testing.T) {
 
 	}
 }
+
+func TestRoomManagerLimits(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MaxRooms = 2
+	cfg.MaxUsersPerRoom = 1
+	rm := NewRoomManager(cfg)
+
+	if err := rm.AddRoom(cfg.DefaultRoom); err != nil {
+		t.Fatalf("Unable to add default room: %s", err)
+	}
+	if err := rm.AddRoom("general"); err != nil {
+		t.Fatalf("Unable to add room under the limit: %s", err)
+	}
+	if err := rm.AddRoom("random"); err == nil {
+		t.Errorf("Expected an error adding a room over the limit. maxRooms=%d rooms=%v", cfg.MaxRooms, rm.ListRooms())
+	}
+
+	general, _ := rm.GetRoom("general")
+	if err := rm.AddUser(general, &User{username: "alice"}); err != nil {
+		t.Errorf("Unable to add user to room under the limit: %s", err)
+	}
+	if err := rm.AddUser(general, &User{username: "bob"}); err == nil {
+		t.Errorf("Expected an error adding a user to a full room. users=%d", len(general.Users))
+	}
+
+	lobby, _ := rm.GetRoom(cfg.DefaultRoom)
+	for _, name := range []string{"alice", "bob"} {
+		if err := rm.AddUser(lobby, &User{username: name}); err != nil {
+			t.Errorf("Default room should never be full: %s", err)
+		}
+	}
+}
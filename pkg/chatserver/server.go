@@ -0,0 +1,264 @@
+package chatserver
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	prot "github.com/dylanmccormick/ws-chat/internal/protocol"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Time allowed to write a message to the peer
+	writeWait = 10 * time.Second
+	// Time allowed to read the next pong message from the peer
+	pongWait = 60 * time.Second
+	// Send pings to peer with this period. Must be less than pongWait
+	pingPeriod = (pongWait * 9) / 10
+)
+
+type User struct {
+	conn           *websocket.Conn
+	username       string   // display name. Can change with ChangeUsername
+	identity       Identity // who the user authenticated as. Never changes
+	currentRoom    Room
+	send           chan []byte
+	dropped        int       // frames dropped in a row because send was full
+	roomQuietUntil time.Time // busy room drops before this have already been reported. Only touched on the hub
+	closeReason    string    // set by the hub before it closes send. The writer sends it to the client as an error
+	session        *session
+
+	// presence is only touched on the hub goroutine
+	lastActive time.Time
+	away       bool
+	statusText string
+}
+
+// Server is a chat server that can be mounted on any http server. Create one with New
+type Server struct {
+	hub      *Hub
+	config   Config
+	upgrader websocket.Upgrader
+	store    MessageStore // only set when New opened the store, so Shutdown knows to close it
+	started  atomic.Bool  // set by Run. Shutdown has nothing to wait for without it
+}
+
+func newServer(cfg Config) *Server {
+	return &Server{
+		hub:    NewHub(cfg),
+		config: cfg,
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:  1024,
+			WriteBufferSize: 1024,
+			CheckOrigin:     checkOrigin(cfg.AllowedOrigins),
+		},
+	}
+}
+
+// checkOrigin returns nil when no origins are configured so gorilla falls back to its same origin check
+func checkOrigin(allowed []string) func(r *http.Request) bool {
+	if len(allowed) == 0 {
+		return nil
+	}
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			// not a browser
+			return true
+		}
+		return slices.Contains(allowed, "*") || slices.Contains(allowed, origin)
+	}
+}
+
+// Handler upgrades requests to chat connections. Mount it at any path on your own mux
+func (s *Server) Handler() http.Handler {
+	return http.HandlerFunc(s.serveWs)
+}
+
+// Run blocks until ctx is cancelled or Shutdown is called
+func (s *Server) Run(ctx context.Context) error {
+	s.started.Store(true)
+	s.hub.run(ctx)
+	return nil
+}
+
+// Shutdown announces the shutdown to every room, closes every connection with a going away close frame
+// and waits for them to drain or ctx to expire. It does not shut down the host's http server.
+// If Run was never called there is nothing to drain and it returns straight away
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.hub.Stop()
+	var err error
+	if s.started.Load() {
+		err = s.hub.Wait(ctx)
+	}
+	if s.store != nil {
+		if closeErr := s.store.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+func (s *Server) serveWs(w http.ResponseWriter, r *http.Request) {
+	select {
+	case <-s.hub.closing:
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	default:
+	}
+
+	slog.Info("upgrading the server")
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade already replied to the client with an http error
+		slog.Error("An error occurred upgrading the http connection", "error", err)
+		return
+	}
+
+	slog.Info("Creating a new user")
+	user, err := s.createUser(conn)
+	// TODO: This needs to be done differently! I think a userManager or something
+	// Or send a newUser message to the hub and it'll handle user-specific actions!
+
+	slog.Info("Created user: ", "username", user.username)
+
+	conn.SetReadLimit(s.config.MaxMessageSize)
+	s.hub.pumps.Go(func() {
+		writePump(user, s.hub)
+	})
+	s.hub.pumps.Go(func() {
+		s.hub.handshake(context.WithoutCancel(r.Context()), user, bearerToken(r))
+	})
+}
+
+func (s *Server) createUser(conn *websocket.Conn) (*User, error) {
+	// The user is anonymous until the handshake gives it a username
+	u := &User{
+		conn: conn,
+		send: make(chan []byte, s.config.SendBufferSize),
+	}
+	return u, nil
+}
+
+func reader(u *User, h *Hub) {
+	slog.Info("Starting reader")
+	t := Translator{}
+	limits := h.limiter.acquire(u.identity.Account)
+	defer h.limiter.release(u.identity.Account)
+	defer h.signalUnregister(u)
+	u.conn.SetReadDeadline(time.Now().Add(pongWait))
+	u.conn.SetPongHandler(func(string) error {
+		u.conn.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+	for {
+		_, data, err := u.conn.ReadMessage()
+		if err != nil {
+			slog.Info("Closing reader", "remote", u.conn.RemoteAddr(), "error", err)
+			return
+		}
+		data = bytes.TrimSpace(bytes.ReplaceAll(data, []byte("\n"), []byte(" ")))
+		message, err := t.BytesToMessage(context.TODO(), data)
+		if err != nil {
+			slog.Error("Error turning data ([]bytes) into Message", "data", string(data), "location", "reader")
+		}
+		if !isEphemeral(message.Message) {
+			slog.Info("Got a message", "message", data)
+		}
+		message.EnrichWithUser(u)
+		if ok, report := h.limiter.Allow(limits, message.Message); !ok {
+			if report == nil {
+				continue
+			}
+			message = InternalMessage{User: u, Message: prot.Message{Typ: "error", Body: *report}}
+		}
+		select {
+		case h.messages <- message:
+		case <-h.closing:
+			return
+		}
+		slog.Info("Message sent to channel")
+	}
+}
+
+// writePump is the only goroutine that writes to the connection. It blocks until the hub gives it something
+// to send or it's time to ping the client
+// The pumps log the remote address instead of the username because the hub can change the username at any time
+func writePump(u *User, h *Hub) {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		u.conn.Close()
+	}()
+
+	for {
+		select {
+		case data, ok := <-u.send:
+			u.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				// The hub closed the channel
+				if u.closeReason != "" {
+					writeCloseReason(u)
+				}
+				u.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			slog.Info("Got a message from u.send channel", "remote", u.conn.RemoteAddr())
+			err := WriteToConn(u.conn, data)
+			if err != nil {
+				slog.Info("Closing writer", "remote", u.conn.RemoteAddr(), "error", err)
+				h.signalUnregister(u)
+				return
+			}
+		case <-ticker.C:
+			u.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			err := u.conn.WriteMessage(websocket.PingMessage, nil)
+			if err != nil {
+				slog.Info("Closing writer after failed ping", "remote", u.conn.RemoteAddr(), "error", err)
+				h.signalUnregister(u)
+				return
+			}
+		case <-h.closing:
+			flushAndClose(u)
+			return
+		}
+	}
+}
+
+// flushAndClose writes whatever the hub already queued for the user (like the shutdown announcement)
+// and then tells the client the server is going away
+func flushAndClose(u *User) {
+	for {
+		select {
+		case data, ok := <-u.send:
+			if !ok {
+				u.conn.SetWriteDeadline(time.Now().Add(writeWait))
+				u.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"))
+				return
+			}
+			u.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := WriteToConn(u.conn, data); err != nil {
+				return
+			}
+		default:
+			u.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			u.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"))
+			return
+		}
+	}
+}
+
+func writeCloseReason(u *User) {
+	t := Translator{}
+	data, err := t.MessageToBytes(context.TODO(), CreateErrorMessage(context.TODO(), u.closeReason))
+	if err != nil {
+		slog.Error("Unable to translate message to bytes.", "err", err)
+		return
+	}
+	WriteToConn(u.conn, data)
+}
@@ -0,0 +1,262 @@
+package chatserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	prot "github.com/dylanmccormick/ws-chat/internal/protocol"
+)
+
+// StoredMessage is a chat message or announcement as it is kept in a MessageStore
+type StoredMessage struct {
+	ID        string           `json:"id"`
+	Seq       uint64           `json:"seq"` // per room, starts at 1. Assigned by the store
+	Time      time.Time        `json:"time"`
+	Room      string           `json:"room"`
+	Type      string           `json:"type"` // chat or announcement
+	Username  string           `json:"username,omitempty"`
+	Account   string           `json:"account,omitempty"` // who wrote it, which unlike Username doesn't change. Never sent to clients
+	Message   string           `json:"message"`
+	Edited    time.Time        `json:"edited,omitzero"`
+	Deleted   bool             `json:"deleted,omitempty"`   // Message is cleared when it is deleted
+	Reactions []StoredReaction `json:"reactions,omitempty"` // in the order they were first used
+	Parent    string           `json:"parent,omitempty"`    // the message this is a reply to
+	Replies   int              `json:"replies,omitempty"`
+}
+
+// StoredReaction is one emoji on a message and the accounts that reacted with it, oldest first
+type StoredReaction struct {
+	Emoji    string   `json:"emoji"`
+	Accounts []string `json:"accounts"`
+}
+
+// Envelope is the message clients get, both live and in History responses. account is who it is for, so the reactions
+// they made can be marked as theirs without sending anyone's account
+func (m StoredMessage) Envelope(account string) prot.Message {
+	msg := prot.Message{Typ: m.Type, ID: m.ID, Seq: m.Seq, Time: m.Time}
+	switch m.Type {
+	case "announcement":
+		msg.Body = prot.AnnouncementMessage{Message: m.Message, Target: m.Room, UserName: m.Username}
+	default:
+		chat := prot.ChatMessage{
+			Message:  m.Message,
+			Target:   m.Room,
+			UserName: m.Username,
+			Edited:   m.Edited,
+			Deleted:  m.Deleted,
+			Parent:   m.Parent,
+			Replies:  m.Replies,
+		}
+		for _, r := range m.Reactions {
+			chat.Reactions = append(chat.Reactions, prot.Reaction{Emoji: r.Emoji, Count: len(r.Accounts), Mine: slices.Contains(r.Accounts, account)})
+		}
+		msg.Body = chat
+	}
+	return msg
+}
+
+// fill sets the parts of a new message that the store is responsible for
+func (m *StoredMessage) fill(seq uint64) {
+	m.Seq = seq
+	if m.ID == "" {
+		m.ID = newMessageID()
+	}
+	if m.Time.IsZero() {
+		m.Time = time.Now()
+	}
+	if m.Type == "" {
+		m.Type = "chat"
+	}
+}
+
+// RangeQuery picks messages out of a room. Zero values mean no bound.
+// Results are oldest first. With a Limit only the newest Limit matches are returned
+type RangeQuery struct {
+	AfterSeq  uint64
+	BeforeSeq uint64
+	Since     time.Time
+	Until     time.Time
+	Limit     int
+	Thread    string // only the message with this id and its replies
+}
+
+func (q RangeQuery) matches(m StoredMessage) bool {
+	if q.AfterSeq != 0 && m.Seq <= q.AfterSeq {
+		return false
+	}
+	if q.BeforeSeq != 0 && m.Seq >= q.BeforeSeq {
+		return false
+	}
+	if !q.Since.IsZero() && m.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !m.Time.Before(q.Until) {
+		return false
+	}
+	if q.Thread != "" && m.ID != q.Thread && m.Parent != q.Thread {
+		return false
+	}
+	return true
+}
+
+func (q RangeQuery) limit(msgs []StoredMessage) []StoredMessage {
+	if q.Limit > 0 && len(msgs) > q.Limit {
+		return msgs[len(msgs)-q.Limit:]
+	}
+	return msgs
+}
+
+// ErrMessageNotFound is returned by Get and Update when the message isn't in the room, or has been trimmed
+var ErrMessageNotFound = errors.New("message not found")
+
+// MessageStore keeps chat history. The hub appends every chat message before it is broadcast
+type MessageStore interface {
+	// Append assigns the next Seq for the room, and the ID and time if they are empty, and stores the message
+	Append(ctx context.Context, msg StoredMessage) (StoredMessage, error)
+	Range(ctx context.Context, room string, q RangeQuery) ([]StoredMessage, error)
+	// Get finds a message by ID
+	Get(ctx context.Context, room, id string) (StoredMessage, error)
+	// Update finds the message by ID and lets change make changes to it. If change returns an error nothing is saved
+	// and the error is returned. Seq, ID and Room should be left alone
+	Update(ctx context.Context, room, id string, change func(*StoredMessage) error) (StoredMessage, error)
+	// Trim drops everything but the newest keep messages in the room. Trim(room, 0) forgets the room
+	Trim(ctx context.Context, room string, keep int) error
+	Close() error
+}
+
+// NewMessageStore builds the store picked by cfg.HistoryStore
+func NewMessageStore(cfg Config) (MessageStore, error) {
+	switch cfg.HistoryStore {
+	case "", "memory":
+		return NewMemoryStore(cfg.HistorySize), nil
+	case "disk":
+		return OpenDiskStore(cfg.HistoryDir, cfg.HistorySize)
+	default:
+		return nil, fmt.Errorf("unknown history store %q", cfg.HistoryStore)
+	}
+}
+
+// MemoryStore keeps the newest messages of each room in a ring buffer. Nothing survives a restart
+type MemoryStore struct {
+	mux      sync.Mutex
+	capacity int
+	rooms    map[string]*ring
+}
+
+type ring struct {
+	msgs    []StoredMessage
+	start   int // index of the oldest message
+	count   int
+	lastSeq uint64
+}
+
+func NewMemoryStore(capacity int) *MemoryStore {
+	return &MemoryStore{
+		capacity: capacity,
+		rooms:    make(map[string]*ring),
+	}
+}
+
+func (s *MemoryStore) Append(ctx context.Context, msg StoredMessage) (StoredMessage, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	r, ok := s.rooms[msg.Room]
+	if !ok {
+		r = &ring{msgs: make([]StoredMessage, s.capacity)}
+		s.rooms[msg.Room] = r
+	}
+	r.lastSeq++
+	msg.fill(r.lastSeq)
+	if s.capacity == 0 {
+		return msg, nil
+	}
+	r.msgs[(r.start+r.count)%s.capacity] = msg
+	if r.count < s.capacity {
+		r.count++
+	} else {
+		r.start = (r.start + 1) % s.capacity
+	}
+	return msg, nil
+}
+
+func (s *MemoryStore) Range(ctx context.Context, room string, q RangeQuery) ([]StoredMessage, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	r, ok := s.rooms[room]
+	if !ok {
+		return []StoredMessage{}, nil
+	}
+	msgs := []StoredMessage{}
+	for i := range r.count {
+		m := r.msgs[(r.start+i)%s.capacity]
+		if q.matches(m) {
+			msgs = append(msgs, m)
+		}
+	}
+	return q.limit(msgs), nil
+}
+
+// find is where the message with id is kept in the room, or nil if it isn't there
+func (s *MemoryStore) find(room, id string) *StoredMessage {
+	r, ok := s.rooms[room]
+	if !ok {
+		return nil
+	}
+	for i := range r.count {
+		if m := &r.msgs[(r.start+i)%s.capacity]; m.ID == id {
+			return m
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) Get(ctx context.Context, room, id string) (StoredMessage, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	m := s.find(room, id)
+	if m == nil {
+		return StoredMessage{}, ErrMessageNotFound
+	}
+	return *m, nil
+}
+
+func (s *MemoryStore) Update(ctx context.Context, room, id string, change func(*StoredMessage) error) (StoredMessage, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	m := s.find(room, id)
+	if m == nil {
+		return StoredMessage{}, ErrMessageNotFound
+	}
+	updated := *m
+	if err := change(&updated); err != nil {
+		return *m, err
+	}
+	*m = updated
+	return updated, nil
+}
+
+func (s *MemoryStore) Trim(ctx context.Context, room string, keep int) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	r, ok := s.rooms[room]
+	if !ok {
+		return nil
+	}
+	if keep <= 0 {
+		delete(s.rooms, room)
+		return nil
+	}
+	if r.count > keep {
+		r.start = (r.start + r.count - keep) % s.capacity
+		r.count = keep
+	}
+	return nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,540 @@
+package chatserver
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// segmentSize is how many messages go in a segment file before a new one is started
+var segmentSize = 1000
+
+// DiskStore keeps history in append-only segment files. Each room gets a directory and each segment is a file
+// of JSON lines named after the seq of its first message. Trimming deletes whole segments so a room can hold up to
+// segmentSize more messages than asked for. An update appends the whole message again to the segment it is in and
+// the last line for a seq wins, so a segment is only rewritten once it is mostly old versions of messages.
+// Each segment has an index of where the latest line for every message starts, which lets reads and updates go
+// straight to the lines they need. A segment's index is built the first time it is used
+type DiskStore struct {
+	mux   sync.Mutex
+	dir   string
+	keep  int // messages to keep per room. 0 keeps nothing, the same as a MemoryStore with no capacity
+	rooms map[string]*diskRoom
+}
+
+type diskRoom struct {
+	dir      string
+	segments []*segment // oldest first
+	lastSeq  uint64
+	current  *os.File // the newest segment, open for appending
+}
+
+// segment is one file of a room's history and its index
+type segment struct {
+	first   uint64
+	loaded  bool              // whether the rest is filled in
+	offsets []int64           // where the latest line for each message starts, by seq - first
+	ids     map[string]uint64 // message id to seq
+	size    int64             // bytes in the file
+	lines   int               // lines in the file, old versions of updated messages included
+}
+
+// OpenDiskStore loads the rooms under dir, creating it if needed. keep is the per room retention. With a keep of 0
+// messages are given seqs but never written, and history already in dir is left alone and not read
+func OpenDiskStore(dir string, keep int) (*DiskStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating history directory: %w", err)
+	}
+	s := &DiskStore{
+		dir:   dir,
+		keep:  keep,
+		rooms: make(map[string]*diskRoom),
+	}
+	if keep == 0 {
+		return s, nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading history directory: %w", err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		name, err := base64.RawURLEncoding.DecodeString(entry.Name())
+		if err != nil {
+			slog.Warn("Skipping unknown directory in history store", "dir", entry.Name())
+			continue
+		}
+		room, err := loadDiskRoom(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.rooms[string(name)] = room
+	}
+	return s, nil
+}
+
+func segmentName(firstSeq uint64) string {
+	return fmt.Sprintf("%020d.log", firstSeq)
+}
+
+// loadDiskRoom finds the room's segments. Only the newest one is read, to find the last seq and to append to
+func loadDiskRoom(dir string) (*diskRoom, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading history directory: %w", err)
+	}
+	room := &diskRoom{dir: dir}
+	for _, entry := range entries {
+		first, err := strconv.ParseUint(strings.TrimSuffix(entry.Name(), ".log"), 10, 64)
+		if err != nil || !strings.HasSuffix(entry.Name(), ".log") {
+			continue
+		}
+		room.segments = append(room.segments, &segment{first: first})
+	}
+	slices.SortFunc(room.segments, func(a, b *segment) int {
+		return cmp.Compare(a.first, b.first)
+	})
+	if len(room.segments) == 0 {
+		return room, nil
+	}
+
+	newest := room.segments[len(room.segments)-1]
+	if err := room.load(newest); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(room.path(newest), os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("opening history segment: %w", err)
+	}
+	room.current = f
+	room.lastSeq = newest.first - 1 + uint64(len(newest.offsets))
+	return room, nil
+}
+
+func (room *diskRoom) path(seg *segment) string {
+	return filepath.Join(room.dir, segmentName(seg.first))
+}
+
+// last is the seq of the newest message in the room's i'th segment
+func (room *diskRoom) last(i int) uint64 {
+	if i+1 < len(room.segments) {
+		return room.segments[i+1].first - 1
+	}
+	return room.lastSeq
+}
+
+// load builds the segment's index if it hasn't been yet. A crash in the middle of a write can leave half a line at
+// the end, which is cut off so the next line appended to it starts on a line of its own
+func (room *diskRoom) load(seg *segment) error {
+	if seg.loaded {
+		return nil
+	}
+	f, err := os.OpenFile(room.path(seg), os.O_RDWR, 0o644)
+	if err != nil {
+		return fmt.Errorf("opening history segment: %w", err)
+	}
+	defer f.Close()
+	seg.offsets = []int64{}
+	seg.ids = map[string]uint64{}
+	seg.lines = 0
+	end, err := scanSegment(f, 0, func(offset int64, line []byte) error {
+		var key struct {
+			Seq uint64 `json:"seq"`
+			ID  string `json:"id"`
+		}
+		if err := json.Unmarshal(line, &key); err != nil || key.Seq < seg.first {
+			return fmt.Errorf("corrupt history segment %s at offset %d: %w", segmentName(seg.first), offset, err)
+		}
+		i := int(key.Seq - seg.first)
+		for len(seg.offsets) <= i {
+			seg.offsets = append(seg.offsets, -1)
+		}
+		seg.offsets[i] = offset
+		seg.ids[key.ID] = key.Seq
+		seg.lines++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if info, err := f.Stat(); err == nil && info.Size() > end {
+		if err := f.Truncate(end); err != nil {
+			return fmt.Errorf("repairing history segment: %w", err)
+		}
+	}
+	seg.size = end
+	seg.loaded = true
+	return nil
+}
+
+// scanSegment calls fn with each complete line from r and where it starts, counting from start.
+// It returns the offset just past the last complete line
+func scanSegment(r io.Reader, start int64, fn func(offset int64, line []byte) error) (int64, error) {
+	reader := bufio.NewReader(r)
+	end := start
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return end, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("reading history segment: %w", err)
+		}
+		if err := fn(end, bytes.TrimSpace(line)); err != nil {
+			return 0, err
+		}
+		end += int64(len(line))
+	}
+}
+
+// read returns the latest version of messages from to through in the segment, oldest first.
+// Only the part of the file from the first of them on is read and only their lines are decoded
+func (room *diskRoom) read(seg *segment, from, through uint64) ([]StoredMessage, error) {
+	if err := room.load(seg); err != nil {
+		return nil, err
+	}
+	through = min(through, seg.first+uint64(len(seg.offsets))-1)
+	if len(seg.offsets) == 0 || from > through {
+		return []StoredMessage{}, nil
+	}
+	wanted := make(map[int64]int, through-from+1)
+	start := seg.size
+	for seq := from; seq <= through; seq++ {
+		offset := seg.offsets[seq-seg.first]
+		if offset < 0 {
+			continue
+		}
+		wanted[offset] = int(seq - from)
+		start = min(start, offset)
+	}
+	f, err := os.Open(room.path(seg))
+	if err != nil {
+		return nil, fmt.Errorf("opening history segment: %w", err)
+	}
+	defer f.Close()
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("reading history segment: %w", err)
+	}
+	msgs := make([]StoredMessage, through-from+1)
+	found := make([]bool, len(msgs))
+	_, err = scanSegment(io.LimitReader(f, seg.size-start), start, func(offset int64, line []byte) error {
+		i, ok := wanted[offset]
+		if !ok {
+			return nil
+		}
+		found[i] = true
+		if err := json.Unmarshal(line, &msgs[i]); err != nil {
+			return fmt.Errorf("corrupt history segment %s at offset %d: %w", segmentName(seg.first), offset, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	out := msgs[:0]
+	for i, m := range msgs {
+		if found[i] {
+			out = append(out, m)
+		}
+	}
+	return out, nil
+}
+
+// write appends a line for m to the segment and points the index at it
+func (room *diskRoom) write(seg *segment, m StoredMessage) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	line := append(data, '\n')
+	f := room.current
+	if seg != room.segments[len(room.segments)-1] || f == nil {
+		f, err = os.OpenFile(room.path(seg), os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return fmt.Errorf("opening history segment: %w", err)
+		}
+		defer f.Close()
+	}
+	if _, err := f.Write(line); err != nil {
+		return fmt.Errorf("writing history: %w", err)
+	}
+	i := int(m.Seq - seg.first)
+	if i == len(seg.offsets) {
+		seg.offsets = append(seg.offsets, seg.size)
+	} else {
+		seg.offsets[i] = seg.size
+	}
+	seg.ids[m.ID] = m.Seq
+	seg.size += int64(len(line))
+	seg.lines++
+	return nil
+}
+
+func (s *DiskStore) Append(ctx context.Context, msg StoredMessage) (StoredMessage, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	room, ok := s.rooms[msg.Room]
+	if !ok {
+		room = &diskRoom{dir: filepath.Join(s.dir, base64.RawURLEncoding.EncodeToString([]byte(msg.Room)))}
+		if s.keep > 0 {
+			if err := os.MkdirAll(room.dir, 0o755); err != nil {
+				return msg, fmt.Errorf("creating room history directory: %w", err)
+			}
+		}
+		s.rooms[msg.Room] = room
+	}
+	if s.keep == 0 {
+		msg.fill(room.lastSeq + 1)
+		room.lastSeq = msg.Seq
+		return msg, nil
+	}
+
+	if room.current == nil || len(room.segments[len(room.segments)-1].offsets) >= segmentSize {
+		if err := s.rotate(room); err != nil {
+			return msg, err
+		}
+	}
+
+	msg.fill(room.lastSeq + 1)
+	if err := room.write(room.segments[len(room.segments)-1], msg); err != nil {
+		return msg, err
+	}
+	room.lastSeq = msg.Seq
+	// the message is already safe so a failed cleanup shouldn't fail the append
+	if err := room.trim(s.keep); err != nil {
+		slog.Warn("Unable to trim history", "room", msg.Room, "error", err)
+	}
+	return msg, nil
+}
+
+// rotate closes the newest segment and starts another
+func (s *DiskStore) rotate(room *diskRoom) error {
+	if room.current != nil {
+		room.current.Close()
+		room.current = nil
+	}
+	first := room.lastSeq + 1
+	f, err := os.OpenFile(filepath.Join(room.dir, segmentName(first)), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("creating history segment: %w", err)
+	}
+	room.current = f
+	room.segments = append(room.segments, &segment{first: first, loaded: true, offsets: []int64{}, ids: map[string]uint64{}})
+	return nil
+}
+
+// trim removes every segment whose messages are all older than the newest keep messages
+func (room *diskRoom) trim(keep int) error {
+	for len(room.segments) > 1 {
+		// everything from the second segment on is enough
+		if room.lastSeq-room.segments[1].first+1 < uint64(keep) {
+			break
+		}
+		if err := os.Remove(room.path(room.segments[0])); err != nil {
+			return fmt.Errorf("removing history segment: %w", err)
+		}
+		room.segments = room.segments[1:]
+	}
+	return nil
+}
+
+// Range reads segments from the newest back and stops once it has Limit matches, so asking for the latest
+// messages only reads the end of the history
+func (s *DiskStore) Range(ctx context.Context, room string, q RangeQuery) ([]StoredMessage, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	r, ok := s.rooms[room]
+	if !ok {
+		return []StoredMessage{}, nil
+	}
+	from, through := q.AfterSeq+1, r.lastSeq
+	if q.BeforeSeq != 0 && q.BeforeSeq-1 < through {
+		through = q.BeforeSeq - 1
+	}
+	// collected newest segment first and put in order at the end
+	chunks := [][]StoredMessage{}
+	matched := 0
+	for i := len(r.segments) - 1; i >= 0 && from <= through; i-- {
+		seg := r.segments[i]
+		if seg.first > through {
+			continue
+		}
+		if r.last(i) < from {
+			break
+		}
+		segment, err := r.read(seg, max(from, seg.first), min(through, r.last(i)))
+		if err != nil {
+			return nil, err
+		}
+		chunk := []StoredMessage{}
+		for _, m := range segment {
+			if q.matches(m) {
+				chunk = append(chunk, m)
+			}
+		}
+		chunks = append(chunks, chunk)
+		matched += len(chunk)
+		if q.Limit > 0 && matched >= q.Limit {
+			break
+		}
+	}
+	msgs := make([]StoredMessage, 0, matched)
+	for _, chunk := range slices.Backward(chunks) {
+		msgs = append(msgs, chunk...)
+	}
+	return q.limit(msgs), nil
+}
+
+// find reads the latest version of a message and the segment it is in. Messages looked up by id are nearly always
+// recent ones so it looks from the newest segment back
+func (room *diskRoom) find(id string) (*segment, StoredMessage, error) {
+	for _, seg := range slices.Backward(room.segments) {
+		if err := room.load(seg); err != nil {
+			return nil, StoredMessage{}, err
+		}
+		seq, ok := seg.ids[id]
+		if !ok {
+			continue
+		}
+		found, err := room.read(seg, seq, seq)
+		if err != nil {
+			return nil, StoredMessage{}, err
+		}
+		if len(found) == 0 {
+			break
+		}
+		return seg, found[0], nil
+	}
+	return nil, StoredMessage{}, ErrMessageNotFound
+}
+
+func (s *DiskStore) Get(ctx context.Context, room, id string) (StoredMessage, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	r, ok := s.rooms[room]
+	if !ok {
+		return StoredMessage{}, ErrMessageNotFound
+	}
+	_, m, err := r.find(id)
+	return m, err
+}
+
+func (s *DiskStore) Update(ctx context.Context, room, id string, change func(*StoredMessage) error) (StoredMessage, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	r, ok := s.rooms[room]
+	if !ok {
+		return StoredMessage{}, ErrMessageNotFound
+	}
+	seg, found, err := r.find(id)
+	if err != nil {
+		return StoredMessage{}, err
+	}
+	updated := found
+	if err := change(&updated); err != nil {
+		return found, err
+	}
+	if err := r.write(seg, updated); err != nil {
+		return StoredMessage{}, err
+	}
+	if seg.lines >= 2*len(seg.offsets) {
+		// the message is already safe so a failed compaction shouldn't fail the update
+		if err := r.compact(seg); err != nil {
+			slog.Warn("Unable to compact history segment", "room", room, "error", err)
+		}
+	}
+	return updated, nil
+}
+
+// compact rewrites a segment with only the latest version of each message. The new one is written next to it and
+// renamed over it so a crash leaves one or the other
+func (room *diskRoom) compact(seg *segment) error {
+	msgs, err := room.read(seg, seg.first, seg.first+uint64(len(seg.offsets))-1)
+	if err != nil {
+		return err
+	}
+	path := room.path(seg)
+	var buf bytes.Buffer
+	offsets := make([]int64, 0, len(msgs))
+	for _, m := range msgs {
+		data, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		offsets = append(offsets, int64(buf.Len()))
+		buf.Write(append(data, '\n'))
+	}
+	if err := os.WriteFile(path+".tmp", buf.Bytes(), 0o644); err != nil {
+		return fmt.Errorf("compacting history segment: %w", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("compacting history segment: %w", err)
+	}
+	seg.offsets = offsets
+	seg.size = int64(buf.Len())
+	seg.lines = len(msgs)
+	if seg != room.segments[len(room.segments)-1] {
+		return nil
+	}
+	// the open file for appending still points at the old segment
+	if room.current != nil {
+		room.current.Close()
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		room.current = nil
+		return fmt.Errorf("reopening history segment: %w", err)
+	}
+	room.current = f
+	return nil
+}
+
+func (s *DiskStore) Trim(ctx context.Context, room string, keep int) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	r, ok := s.rooms[room]
+	if !ok {
+		return nil
+	}
+	if keep > 0 {
+		return r.trim(keep)
+	}
+	if r.current != nil {
+		r.current.Close()
+	}
+	delete(s.rooms, room)
+	if err := os.RemoveAll(r.dir); err != nil {
+		return fmt.Errorf("removing room history: %w", err)
+	}
+	return nil
+}
+
+func (s *DiskStore) Close() error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	var err error
+	for _, room := range s.rooms {
+		if room.current != nil {
+			if closeErr := room.current.Close(); closeErr != nil && err == nil {
+				err = closeErr
+			}
+			room.current = nil
+		}
+	}
+	return err
+}
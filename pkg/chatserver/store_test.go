@@ -0,0 +1,316 @@
+package chatserver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func appendTestMessages(t *testing.T, store MessageStore, room string, n int) {
+	t.Helper()
+	for i := range n {
+		_, err := store.Append(context.TODO(), StoredMessage{Room: room, Username: "alice", Message: fmt.Sprintf("message %d", i+1)})
+		if err != nil {
+			t.Fatalf("Unable to append message: %s", err)
+		}
+	}
+}
+
+func TestMessageStores(t *testing.T) {
+	stores := map[string]func(t *testing.T) MessageStore{
+		"memory": func(t *testing.T) MessageStore { return NewMemoryStore(100) },
+		"disk": func(t *testing.T) MessageStore {
+			store, err := OpenDiskStore(t.TempDir(), 100)
+			if err != nil {
+				t.Fatalf("Unable to open disk store: %s", err)
+			}
+			return store
+		},
+	}
+
+	for name, open := range stores {
+		t.Run(name, func(t *testing.T) {
+			store := open(t)
+			defer store.Close()
+			ctx := context.TODO()
+
+			appendTestMessages(t, store, "lobby", 10)
+			appendTestMessages(t, store, "general", 2)
+
+			all, err := store.Range(ctx, "lobby", RangeQuery{})
+			if err != nil {
+				t.Fatalf("Unable to read range: %s", err)
+			}
+			if len(all) != 10 || all[0].Seq != 1 || all[9].Seq != 10 || all[9].Message != "message 10" {
+				t.Errorf("Unexpected messages in room. got=%+v", all)
+			}
+			if all[0].Time.IsZero() {
+				t.Errorf("Store did not set the time")
+			}
+
+			last, _ := store.Range(ctx, "lobby", RangeQuery{Limit: 3})
+			if len(last) != 3 || last[0].Seq != 8 || last[2].Seq != 10 {
+				t.Errorf("Expected the newest 3 messages. got=%+v", last)
+			}
+			page, _ := store.Range(ctx, "lobby", RangeQuery{AfterSeq: 2, BeforeSeq: 6})
+			if len(page) != 3 || page[0].Seq != 3 || page[2].Seq != 5 {
+				t.Errorf("Expected messages 3 to 5. got=%+v", page)
+			}
+			future, _ := store.Range(ctx, "lobby", RangeQuery{Since: time.Now().Add(time.Hour)})
+			if len(future) != 0 {
+				t.Errorf("Expected no messages after the since time. got=%d", len(future))
+			}
+			general, _ := store.Range(ctx, "general", RangeQuery{})
+			if len(general) != 2 || general[0].Seq != 1 {
+				t.Errorf("Each room should have its own seq. got=%+v", general)
+			}
+
+			updated, err := store.Update(ctx, "lobby", all[4].ID, func(m *StoredMessage) error {
+				m.Message = "edited"
+				return nil
+			})
+			if err != nil || updated.Message != "edited" || updated.Seq != 5 {
+				t.Errorf("Unexpected update. got=%+v err=%v", updated, err)
+			}
+			fifth, _ := store.Range(ctx, "lobby", RangeQuery{AfterSeq: 4, BeforeSeq: 6})
+			if len(fifth) != 1 || fifth[0].Message != "edited" {
+				t.Errorf("Expected the update to be saved. got=%+v", fifth)
+			}
+			refused := errors.New("refused")
+			if _, err := store.Update(ctx, "lobby", all[5].ID, func(m *StoredMessage) error {
+				m.Message = "edited"
+				return refused
+			}); !errors.Is(err, refused) {
+				t.Errorf("Expected the change's error back. got=%v", err)
+			}
+			if sixth, _ := store.Range(ctx, "lobby", RangeQuery{AfterSeq: 5, BeforeSeq: 7}); sixth[0].Message != "message 6" {
+				t.Errorf("A refused change shouldn't be saved. got=%+v", sixth)
+			}
+			if _, err := store.Update(ctx, "lobby", "missing", func(*StoredMessage) error { return nil }); !errors.Is(err, ErrMessageNotFound) {
+				t.Errorf("Expected ErrMessageNotFound. got=%v", err)
+			}
+			if got, err := store.Get(ctx, "lobby", all[4].ID); err != nil || got.Message != "edited" || got.Seq != 5 {
+				t.Errorf("Expected to get the updated message. got=%+v err=%v", got, err)
+			}
+			if _, err := store.Get(ctx, "general", all[4].ID); !errors.Is(err, ErrMessageNotFound) {
+				t.Errorf("Expected ErrMessageNotFound from another room. got=%v", err)
+			}
+
+			if err := store.Trim(ctx, "general", 0); err != nil {
+				t.Fatalf("Unable to trim: %s", err)
+			}
+			general, _ = store.Range(ctx, "general", RangeQuery{})
+			if len(general) != 0 {
+				t.Errorf("Expected trimmed room to be empty. got=%d", len(general))
+			}
+		})
+	}
+}
+
+func TestMemoryStoreWrapsAround(t *testing.T) {
+	store := NewMemoryStore(5)
+	appendTestMessages(t, store, "lobby", 12)
+	msgs, _ := store.Range(context.TODO(), "lobby", RangeQuery{})
+	if len(msgs) != 5 || msgs[0].Seq != 8 || msgs[4].Seq != 12 {
+		t.Errorf("Expected the newest 5 messages. got=%+v", msgs)
+	}
+	store.Trim(context.TODO(), "lobby", 2)
+	msgs, _ = store.Range(context.TODO(), "lobby", RangeQuery{})
+	if len(msgs) != 2 || msgs[0].Seq != 11 {
+		t.Errorf("Expected the newest 2 messages after trim. got=%+v", msgs)
+	}
+}
+
+func TestStoresKeepNothing(t *testing.T) {
+	dir := t.TempDir()
+	disk, err := OpenDiskStore(dir, 0)
+	if err != nil {
+		t.Fatalf("Unable to open disk store: %s", err)
+	}
+	stores := map[string]MessageStore{"memory": NewMemoryStore(0), "disk": disk}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			defer store.Close()
+			appendTestMessages(t, store, "lobby", 3)
+			msg, err := store.Append(context.TODO(), StoredMessage{Room: "lobby", Message: "one more"})
+			if err != nil || msg.Seq != 4 {
+				t.Errorf("Messages should still get seqs. got=%+v err=%v", msg, err)
+			}
+			msgs, _ := store.Range(context.TODO(), "lobby", RangeQuery{})
+			if len(msgs) != 0 {
+				t.Errorf("Expected no history with a size of 0. got=%+v", msgs)
+			}
+		})
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("Expected nothing written to disk. got=%d entries", len(entries))
+	}
+
+	cfg := DefaultConfig()
+	cfg.HistoryStore, cfg.HistoryDir, cfg.HistorySize = "disk", dir, 0
+	if err := cfg.Validate(); err == nil {
+		t.Errorf("Expected disk history with a size of 0 to be refused")
+	}
+}
+
+func TestDiskStoreSurvivesRestart(t *testing.T) {
+	old := segmentSize
+	segmentSize = 4
+	defer func() { segmentSize = old }()
+
+	dir := t.TempDir()
+	store, err := OpenDiskStore(dir, 6)
+	if err != nil {
+		t.Fatalf("Unable to open disk store: %s", err)
+	}
+	appendTestMessages(t, store, "lobby", 14)
+	store.Close()
+
+	store, err = OpenDiskStore(dir, 6)
+	if err != nil {
+		t.Fatalf("Unable to reopen disk store: %s", err)
+	}
+	defer store.Close()
+	msg, err := store.Append(context.TODO(), StoredMessage{Room: "lobby", Username: "bob", Message: "after restart"})
+	if err != nil {
+		t.Fatalf("Unable to append after restart: %s", err)
+	}
+	if msg.Seq != 15 {
+		t.Errorf("Seq did not carry on after restart. expected=15 got=%d", msg.Seq)
+	}
+
+	msgs, _ := store.Range(context.TODO(), "lobby", RangeQuery{})
+	// whole segments are dropped so there can be a few more than 6 left, but never fewer
+	if len(msgs) < 6 || len(msgs) > 6+segmentSize || msgs[len(msgs)-1].Seq != 15 {
+		t.Errorf("Unexpected messages after restart. got=%+v", msgs)
+	}
+	entries, _ := os.ReadDir(store.rooms["lobby"].dir)
+	if len(entries) > 3 {
+		t.Errorf("Old segments were not removed. segments=%d", len(entries))
+	}
+}
+
+func TestDiskStoreRepairsTornWrite(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenDiskStore(dir, 100)
+	if err != nil {
+		t.Fatalf("Unable to open disk store: %s", err)
+	}
+	appendTestMessages(t, store, "lobby", 2)
+	// half a line, like a crash in the middle of a write
+	store.rooms["lobby"].current.Write([]byte(`{"seq":3,"mess`))
+	store.Close()
+
+	store, err = OpenDiskStore(dir, 100)
+	if err != nil {
+		t.Fatalf("Unable to reopen disk store: %s", err)
+	}
+	defer store.Close()
+	appendTestMessages(t, store, "lobby", 1)
+	msgs, err := store.Range(context.TODO(), "lobby", RangeQuery{})
+	if err != nil {
+		t.Fatalf("Unable to read after repair: %s", err)
+	}
+	if len(msgs) != 3 || msgs[2].Seq != 3 {
+		t.Errorf("Expected 3 messages after repair. got=%+v", msgs)
+	}
+}
+
+func TestDiskStoreUpdate(t *testing.T) {
+	old := segmentSize
+	segmentSize = 4
+	defer func() { segmentSize = old }()
+
+	dir := t.TempDir()
+	store, err := OpenDiskStore(dir, 100)
+	if err != nil {
+		t.Fatalf("Unable to open disk store: %s", err)
+	}
+	appendTestMessages(t, store, "lobby", 6)
+	msgs, _ := store.Range(context.TODO(), "lobby", RangeQuery{})
+	// one in an old segment and one in the segment that is still being appended to
+	for _, i := range []int{1, 5} {
+		if _, err := store.Update(context.TODO(), "lobby", msgs[i].ID, func(m *StoredMessage) error {
+			m.Deleted = true
+			return nil
+		}); err != nil {
+			t.Fatalf("Unable to update: %s", err)
+		}
+	}
+	appendTestMessages(t, store, "lobby", 1)
+	store.Close()
+
+	store, err = OpenDiskStore(dir, 100)
+	if err != nil {
+		t.Fatalf("Unable to reopen disk store: %s", err)
+	}
+	defer store.Close()
+	msgs, _ = store.Range(context.TODO(), "lobby", RangeQuery{})
+	if len(msgs) != 7 || msgs[6].Seq != 7 {
+		t.Fatalf("Expected appends to carry on after an update. got=%+v", msgs)
+	}
+	for i, m := range msgs {
+		if m.Deleted != (i == 1 || i == 5) {
+			t.Errorf("Unexpected message after restart. got=%+v", m)
+		}
+	}
+}
+
+func TestDiskStoreAppendsUpdates(t *testing.T) {
+	old := segmentSize
+	segmentSize = 4
+	defer func() { segmentSize = old }()
+
+	dir := t.TempDir()
+	store, err := OpenDiskStore(dir, 100)
+	if err != nil {
+		t.Fatalf("Unable to open disk store: %s", err)
+	}
+	appendTestMessages(t, store, "lobby", 6)
+	msgs, _ := store.Range(context.TODO(), "lobby", RangeQuery{})
+	for i := range 20 {
+		if _, err := store.Update(context.TODO(), "lobby", msgs[1].ID, func(m *StoredMessage) error {
+			m.Message = fmt.Sprintf("edit %d", i)
+			return nil
+		}); err != nil {
+			t.Fatalf("Unable to update: %s", err)
+		}
+	}
+	room := store.rooms["lobby"]
+	lines := room.segments[0].lines
+	if _, err := store.Get(context.TODO(), "lobby", msgs[1].ID); err != nil || room.segments[0].lines != lines {
+		t.Errorf("Expected Get to only read. err=%v lines before=%d after=%d", err, lines, room.segments[0].lines)
+	}
+	data, err := os.ReadFile(room.path(room.segments[0]))
+	if err != nil {
+		t.Fatalf("Unable to read segment: %s", err)
+	}
+	if lines := bytes.Count(data, []byte("\n")); lines >= 2*4 {
+		t.Errorf("Expected the segment to be compacted. got=%d lines", lines)
+	}
+	store.Close()
+
+	store, err = OpenDiskStore(dir, 100)
+	if err != nil {
+		t.Fatalf("Unable to reopen disk store: %s", err)
+	}
+	defer store.Close()
+	msgs, _ = store.Range(context.TODO(), "lobby", RangeQuery{})
+	if len(msgs) != 6 || msgs[1].Message != "edit 19" {
+		t.Fatalf("Expected the last edit to win. got=%+v", msgs)
+	}
+
+	// the newest messages come from the newest segment alone
+	room = store.rooms["lobby"]
+	if err := os.Remove(room.path(room.segments[0])); err != nil {
+		t.Fatalf("Unable to remove segment: %s", err)
+	}
+	msgs, err = store.Range(context.TODO(), "lobby", RangeQuery{Limit: 2})
+	if err != nil || len(msgs) != 2 || msgs[0].Seq != 5 || msgs[1].Seq != 6 {
+		t.Fatalf("Expected the last 2 messages. got=%+v err=%v", msgs, err)
+	}
+}
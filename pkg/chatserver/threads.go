@@ -0,0 +1,76 @@
+package chatserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	prot "github.com/dylanmccormick/ws-chat/internal/protocol"
+)
+
+// checkParent makes sure a reply's parent is there before the reply is stored so a reply never points at a message
+// that isn't. Threads are one level deep so a reply can't have replies of its own
+func (h *Hub) checkParent(ctx context.Context, u *User, room *Room, parent string) bool {
+	m, err := h.store.Get(ctx, room.Name, parent)
+	switch {
+	case errors.Is(err, ErrMessageNotFound):
+		h.sendError(ctx, u, fmt.Sprintf("There is no message %s in %s", parent, room.Name))
+	case err != nil:
+		slog.Error("Unable to read message", "room", room.Name, "id", parent, "error", err)
+		h.sendError(ctx, u, "Your message could not be saved. Please try again")
+	case m.Type != "chat" || m.Parent != "":
+		h.sendError(ctx, u, "You can only reply to chat messages that aren't replies themselves")
+	default:
+		return true
+	}
+	return false
+}
+
+// countReply moves the parent's reply count by delta once a reply has been stored or deleted and tells the room
+func (h *Hub) countReply(ctx context.Context, room *Room, parent string, delta int) {
+	stored, err := h.store.Update(ctx, room.Name, parent, func(m *StoredMessage) error {
+		m.Replies = max(m.Replies+delta, 0)
+		return nil
+	})
+	if err != nil {
+		slog.Error("Unable to update reply count", "room", room.Name, "id", parent, "error", err)
+		return
+	}
+	h.sendRoomEvent(ctx, room, "replies", prot.RepliesMessage{ID: stored.ID, Target: room.Name, Count: stored.Replies})
+}
+
+// commandGetThread sends a message and its replies. Asking for a reply gets the whole thread it is in
+func (h *Hub) commandGetThread(ctx context.Context, msg InternalMessage, body prot.CommandMessage) {
+	slog.Info("User requested a thread", "user", msg.User.username, "room", body.Target)
+	var req prot.ThreadRequest
+	if err := json.Unmarshal(body.Data, &req); err != nil || req.ID == "" {
+		h.sendError(ctx, msg.User, "Unable to parse thread request")
+		return
+	}
+	room, ok := h.memberRoom(ctx, msg.User, body.Target)
+	if !ok {
+		return
+	}
+	stored, err := h.store.Range(ctx, room.Name, RangeQuery{Thread: req.ID})
+	if err == nil && len(stored) > 0 && stored[0].ID == req.ID && stored[0].Parent != "" {
+		req.ID = stored[0].Parent
+		stored, err = h.store.Range(ctx, room.Name, RangeQuery{Thread: req.ID})
+	}
+	if err != nil {
+		slog.Error("Unable to read history", "room", room.Name, "error", err)
+		h.sendError(ctx, msg.User, "Unable to read the thread")
+		return
+	}
+	// the parent is always older than its replies so it comes first
+	if len(stored) == 0 || stored[0].ID != req.ID {
+		h.sendError(ctx, msg.User, fmt.Sprintf("There is no message %s in %s", req.ID, room.Name))
+		return
+	}
+	messages := make([]prot.Message, 0, len(stored))
+	for _, m := range stored {
+		messages = append(messages, m.Envelope(msg.User.identity.Account))
+	}
+	h.sendCommandResponse(ctx, msg.User, "GetThread", room.Name, messages)
+}
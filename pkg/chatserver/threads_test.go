@@ -0,0 +1,125 @@
+package chatserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	prot "github.com/dylanmccormick/ws-chat/internal/protocol"
+)
+
+func TestThreads(t *testing.T) {
+	h, users := newTestHubWithUsers("alice", "bob")
+	alice, bob := users[0], users[1]
+	ctx := context.TODO()
+	chat := func(u *User, text, parent string) {
+		h.handleChat(ctx, InternalMessage{User: u}, prot.ChatMessage{Message: text, Target: "lobby", Parent: parent})
+	}
+	getThread := func(u *User, id string) []prot.Message {
+		t.Helper()
+		raw, _ := json.Marshal(prot.ThreadRequest{ID: id})
+		h.handleCommand(ctx, InternalMessage{User: u}, prot.CommandMessage{Action: "GetThread", Target: "lobby", Data: raw})
+		msgs := drainTestUser(t, u)
+		if len(msgs) != 1 {
+			t.Fatalf("Expected one response. got=%+v", msgs)
+		}
+		if body, ok := msgs[0].Body.(prot.CommandMessage); ok && body.Action == "GetThread" {
+			var thread []prot.Message
+			json.Unmarshal(body.Data, &thread)
+			return thread
+		}
+		return nil
+	}
+
+	chat(alice, "anyone up for a game?", "")
+	parent := drainTestUser(t, bob)[0].ID
+	chat(alice, "unrelated", "")
+	chat(bob, "me", parent)
+	chat(alice, "great", parent)
+	msgs := chats(drainTestUser(t, bob))
+	if len(msgs) != 3 {
+		t.Fatalf("Expected replies to still go to the room. got=%+v", msgs)
+	}
+	if body := msgs[1].Body.(prot.ChatMessage); body.Parent != parent {
+		t.Errorf("Expected the reply to point at its parent. got=%+v", body)
+	}
+	drainTestUser(t, alice)
+
+	thread := getThread(alice, parent)
+	if len(thread) != 3 {
+		t.Fatalf("Expected the parent and two replies. got=%+v", thread)
+	}
+	if body := thread[0].Body.(prot.ChatMessage); thread[0].ID != parent || body.Replies != 2 {
+		t.Errorf("Expected the parent first with 2 replies. got=%+v", thread[0])
+	}
+	if body := thread[2].Body.(prot.ChatMessage); body.Message != "great" {
+		t.Errorf("Expected replies oldest first. got=%+v", body)
+	}
+
+	chat(bob, "nested", thread[1].ID)
+	chat(bob, "lost", "missing")
+	msgs = drainTestUser(t, bob)
+	if len(msgs) != 2 || !hasError(msgs[:1]) || !hasError(msgs[1:]) {
+		t.Errorf("Expected errors replying to a reply and to a missing message. got=%+v", msgs)
+	}
+	if msgs := drainTestUser(t, alice); len(msgs) != 0 {
+		t.Errorf("Rejected replies shouldn't reach the room. got=%+v", msgs)
+	}
+	if got := getThread(alice, thread[1].ID); len(got) != 3 || got[0].ID != parent {
+		t.Errorf("Expected asking for a reply to get its whole thread. got=%+v", got)
+	}
+
+	// deleting a reply takes it off the count and the room hears the new one
+	raw, _ := json.Marshal(prot.DeleteMessageRequest{ID: thread[2].ID})
+	h.handleCommand(ctx, InternalMessage{User: alice}, prot.CommandMessage{Action: "DeleteMessage", Target: "lobby", Data: raw})
+	msgs = drainTestUser(t, bob)
+	if len(msgs) != 2 || msgs[1].Typ != "replies" {
+		t.Fatalf("Expected the delete and the new reply count. got=%+v", msgs)
+	}
+	if body := msgs[1].Body.(prot.RepliesMessage); body.ID != parent || body.Count != 1 {
+		t.Errorf("Expected 1 reply left. got=%+v", body)
+	}
+	drainTestUser(t, alice)
+	if got := getThread(alice, parent); got[0].Body.(prot.ChatMessage).Replies != 1 {
+		t.Errorf("Expected the stored count to go down. got=%+v", got[0])
+	}
+}
+
+// failingStore refuses every new message
+type failingStore struct {
+	MessageStore
+}
+
+func (failingStore) Append(ctx context.Context, msg StoredMessage) (StoredMessage, error) {
+	return msg, errors.New("disk full")
+}
+
+func TestReplyCountFollowsStore(t *testing.T) {
+	h, users := newTestHubWithUsers("alice", "bob")
+	alice, bob := users[0], users[1]
+	ctx := context.TODO()
+	h.handleChat(ctx, InternalMessage{User: alice}, prot.ChatMessage{Message: "anyone up for a game?", Target: "lobby"})
+	parent := drainTestUser(t, bob)[0].ID
+	drainTestUser(t, alice)
+
+	h.handleChat(ctx, InternalMessage{User: bob}, prot.ChatMessage{Message: "me", Target: "lobby", Parent: parent})
+	msgs := drainTestUser(t, alice)
+	if len(msgs) < 2 || msgs[0].Typ != "chat" || msgs[1].Typ != "replies" {
+		t.Fatalf("Expected the reply and then its parent's count. got=%+v", msgs)
+	}
+	if body := msgs[1].Body.(prot.RepliesMessage); body.ID != parent || body.Count != 1 {
+		t.Errorf("Expected 1 reply. got=%+v", body)
+	}
+
+	store := h.store
+	h.store = failingStore{store}
+	h.handleChat(ctx, InternalMessage{User: bob}, prot.ChatMessage{Message: "me again", Target: "lobby", Parent: parent})
+	if !hasError(drainTestUser(t, bob)) {
+		t.Errorf("Expected bob to hear the reply wasn't saved")
+	}
+	stored, _ := store.Range(ctx, "lobby", RangeQuery{Thread: parent})
+	if stored[0].Replies != 1 {
+		t.Errorf("A reply that wasn't saved shouldn't count. got=%d", stored[0].Replies)
+	}
+}
@@ -1,9 +1,12 @@
-package server
+package chatserver
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
 	"log/slog"
+	"time"
 
 	prot "github.com/dylanmccormick/ws-chat/internal/protocol"
 )
@@ -24,8 +27,16 @@ func (t *Translator) BytesToMessage(ctx context.Context, data []byte) (InternalM
 	}, nil
 }
 
+// MessageToBytes gives the message an ID and timestamp if it doesn't have them yet. Messages that were stored
+// already have theirs so history and the live message match
 func (t *Translator) MessageToBytes(ctx context.Context, internalMsg InternalMessage) ([]byte, error) {
 	msg := internalMsg.Message
+	if msg.ID == "" {
+		msg.ID = newMessageID()
+	}
+	if msg.Time.IsZero() {
+		msg.Time = time.Now()
+	}
 	// TODO: This might need an internal message Marshal Function
 	data, err := msg.MarshalJSON()
 	if err != nil {
@@ -35,17 +46,22 @@ func (t *Translator) MessageToBytes(ctx context.Context, internalMsg InternalMes
 }
 
 func CreateErrorMessage(ctx context.Context, msg string) InternalMessage {
-	errMsg, err := json.Marshal(prot.ErrorMessage{Message: msg})
-	if err != nil {
-		// if this doesn't work that means I have crafted a bad message... which means the program is bad
-		panic(err)
-	}
 	return InternalMessage{
 		User: &User{}, // TODO: Get user from context
 		Message: prot.Message{
 			Typ:  "error",
-			Body: errMsg,
+			Body: prot.ErrorMessage{Message: msg},
 		},
 	}
 }
 
+// newMessageID is 16 bytes as hex. The first 6 are the time in milliseconds so IDs sort roughly by when they were made,
+// the rest are random
+func newMessageID() string {
+	var id [16]byte
+	var ms [8]byte
+	binary.BigEndian.PutUint64(ms[:], uint64(time.Now().UnixMilli()))
+	copy(id[:6], ms[2:])
+	rand.Read(id[6:])
+	return hex.EncodeToString(id[:])
+}
@@ -1,9 +1,10 @@
-package server
+package chatserver
 
 import (
 	"context"
 	"reflect"
 	"testing"
+	"time"
 
 	prot "github.com/dylanmccormick/ws-chat/internal/protocol"
 )
@@ -41,8 +42,8 @@ func TestMarshalMessage(t *testing.T) {
 		expectedData string
 	}{
 		{
-			InternalMessage{User: &User{}, Message: prot.Message{Typ: "chat", Body: prot.ChatMessage{Message: "test", Target: "lobby"}}},
-			`{"type":"chat","body":{"message":"test","target":"lobby"}}`,
+			InternalMessage{User: &User{}, Message: prot.Message{Typ: "chat", ID: "abc", Seq: 4, Time: time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC), Body: prot.ChatMessage{Message: "test", Target: "lobby"}}},
+			`{"type":"chat","id":"abc","seq":4,"ts":"2025-01-02T03:04:05Z","body":{"message":"test","target":"lobby"}}`,
 		},
 	}
 
@@ -57,3 +58,21 @@ func TestMarshalMessage(t *testing.T) {
 		}
 	}
 }
+
+func TestMessageToBytesStampsMessages(t *testing.T) {
+	translator := Translator{}
+	data, err := translator.MessageToBytes(context.TODO(), CreateErrorMessage(context.TODO(), "oops"))
+	if err != nil {
+		t.Fatalf("error occurred marshalling json: %s", err)
+	}
+	var m prot.Message
+	if err := m.UnmarshalJSON(data); err != nil {
+		t.Fatalf("error occurred unmarshalling json: %s", err)
+	}
+	if len(m.ID) != 32 || m.Time.IsZero() {
+		t.Errorf("Expected the server to set an id and time. got=%+v", m)
+	}
+	if m.Seq != 0 {
+		t.Errorf("Errors are not part of a room so should not have a seq. got=%d", m.Seq)
+	}
+}
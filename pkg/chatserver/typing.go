@@ -0,0 +1,40 @@
+package chatserver
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	prot "github.com/dylanmccormick/ws-chat/internal/protocol"
+)
+
+// isEphemeral messages are passed on and forgotten. They aren't stored and don't go in the server log
+func isEphemeral(msg prot.Message) bool {
+	_, ok := msg.Body.(prot.TypingMessage)
+	return ok
+}
+
+// handleTyping passes a typing event on to everyone else in the room. Anyone who couldn't chat in the room
+// can't look like they are typing in it either, so those are dropped without an error
+func (h *Hub) handleTyping(ctx context.Context, msg InternalMessage, body prot.TypingMessage) {
+	room, err := h.roomManager.GetRoom(body.Target)
+	if err != nil || !userInRoom(room, msg.User) || room.Muted(msg.User.identity.Account, time.Now()) {
+		return
+	}
+	body.UserName = msg.User.username
+	out, err := h.translator.MessageToBytes(ctx, InternalMessage{User: msg.User, Message: prot.Message{Typ: "typing", Body: body}})
+	if err != nil {
+		slog.Error("Unable to translate message to bytes.", "err", err)
+		return
+	}
+	for _, u := range room.Users {
+		if u == msg.User {
+			continue
+		}
+		// a typing event isn't worth counting against a slow client so it is just dropped when they are behind
+		select {
+		case u.send <- out:
+		default:
+		}
+	}
+}
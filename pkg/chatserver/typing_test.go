@@ -0,0 +1,54 @@
+package chatserver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	prot "github.com/dylanmccormick/ws-chat/internal/protocol"
+)
+
+func TestTyping(t *testing.T) {
+	h, users := newTestHubWithUsers("alice", "bob", "carol")
+	alice, bob, carol := users[0], users[1], users[2]
+	ctx := context.TODO()
+	typing := func(u *User, room string) {
+		h.handleMessage(ctx, InternalMessage{User: u, Message: prot.Message{Typ: "typing", Body: prot.TypingMessage{Target: room, Typing: true}}})
+	}
+
+	typing(alice, "lobby")
+	msgs := drainTestUser(t, bob)
+	if len(msgs) != 1 {
+		t.Fatalf("Expected bob to get one typing message. got=%+v", msgs)
+	}
+	if body, ok := msgs[0].Body.(prot.TypingMessage); !ok || body.UserName != "alice" || body.Target != "lobby" || !body.Typing {
+		t.Errorf("Unexpected typing message. got=%+v", msgs[0].Body)
+	}
+	if msgs := drainTestUser(t, alice); len(msgs) != 0 {
+		t.Errorf("Typing shouldn't be echoed back to the sender. got=%+v", msgs)
+	}
+	drainTestUser(t, carol)
+	if messages, _ := h.store.Range(ctx, "lobby", RangeQuery{}); len(messages) != 0 {
+		t.Errorf("Typing shouldn't be stored. got=%+v", messages)
+	}
+
+	// typing in a room you aren't in goes nowhere and doesn't get an error back either
+	h.roomManager.AddRoom("games")
+	games, _ := h.roomManager.GetRoom("games")
+	h.roomManager.AddUser(games, bob)
+	typing(alice, "games")
+	typing(alice, "nowhere")
+	if msgs := drainTestUser(t, bob); len(msgs) != 0 {
+		t.Errorf("Expected typing outside of alice's rooms to be dropped. got=%+v", msgs)
+	}
+	if msgs := drainTestUser(t, alice); len(msgs) != 0 {
+		t.Errorf("Expected no errors for dropped typing. got=%+v", msgs)
+	}
+
+	lobby, _ := h.roomManager.GetRoom("lobby")
+	lobby.Mutes = map[string]time.Time{"carol": {}}
+	typing(carol, "lobby")
+	if msgs := drainTestUser(t, bob); len(msgs) != 0 {
+		t.Errorf("Expected typing from a muted user to be dropped. got=%+v", msgs)
+	}
+}
@@ -0,0 +1,214 @@
+package chatserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+
+	prot "github.com/dylanmccormick/ws-chat/internal/protocol"
+)
+
+// readMarker is how far an account has read in a room and how many chats from others have come in since
+type readMarker struct {
+	seq    uint64
+	unread int
+}
+
+// latestSeq is the seq of the newest message in the room's history, or 0 if it has none
+func (h *Hub) latestSeq(ctx context.Context, room string) (uint64, error) {
+	msgs, err := h.store.Range(ctx, room, RangeQuery{Limit: 1})
+	if err != nil || len(msgs) == 0 {
+		return 0, err
+	}
+	return msgs[0].Seq, nil
+}
+
+// countUnread counts the chats after seq that account didn't write and that are still there to read
+func (h *Hub) countUnread(ctx context.Context, account, room string, seq uint64) (int, error) {
+	msgs, err := h.store.Range(ctx, room, RangeQuery{AfterSeq: seq})
+	if err != nil {
+		return 0, err
+	}
+	unread := 0
+	for _, m := range msgs {
+		if m.Type == "chat" && !m.Deleted && m.Account != account {
+			unread++
+		}
+	}
+	return unread, nil
+}
+
+// catchUp tells a user who just joined a room how much they have missed in it. Someone who has never been in the
+// room starts with everything in it read, since the history they are shown is the first they see of it
+func (h *Hub) catchUp(ctx context.Context, room *Room, u *User) {
+	account := u.identity.Account
+	marker, ok := h.reads[account][room.Name]
+	if !ok {
+		seq, err := h.latestSeq(ctx, room.Name)
+		if err != nil {
+			slog.Error("Unable to find the newest message", "room", room.Name, "error", err)
+			return
+		}
+		marker = h.setReadMarker(account, room.Name, seq)
+	} else {
+		unread, err := h.countUnread(ctx, account, room.Name, marker.seq)
+		if err != nil {
+			slog.Error("Unable to count unread messages", "room", room.Name, "error", err)
+			return
+		}
+		marker.unread = unread
+	}
+	h.sendUnread(ctx, u, room.Name, marker)
+	if !room.ReadReceipts {
+		return
+	}
+	for _, other := range room.Users {
+		if other == u {
+			continue
+		}
+		if theirs, ok := h.reads[other.identity.Account][room.Name]; ok && theirs.seq > 0 {
+			h.sendReadReceipt(ctx, u, room.Name, other.username, theirs.seq)
+		}
+	}
+}
+
+// setReadMarker starts tracking what account has read in the room from seq
+func (h *Hub) setReadMarker(account, room string, seq uint64) *readMarker {
+	if h.reads[account] == nil {
+		h.reads[account] = map[string]*readMarker{}
+	}
+	marker := &readMarker{seq: seq}
+	h.reads[account][room] = marker
+	return marker
+}
+
+// forgetReadMarkers drops every read marker for a deleted room
+func (h *Hub) forgetReadMarkers(room string) {
+	for account, markers := range h.reads {
+		delete(markers, room)
+		if len(markers) == 0 {
+			delete(h.reads, account)
+		}
+	}
+}
+
+// countNewMessage bumps the unread count of everyone in the room other than whoever wrote the message
+func (h *Hub) countNewMessage(ctx context.Context, room *Room, from *User, stored StoredMessage) {
+	counted := map[string]bool{from.identity.Account: true}
+	for _, u := range slices.Clone(room.Users) {
+		account := u.identity.Account
+		if counted[account] {
+			continue
+		}
+		counted[account] = true
+		marker, ok := h.reads[account][room.Name]
+		if !ok {
+			marker = h.setReadMarker(account, room.Name, stored.Seq-1)
+		}
+		marker.unread++
+		h.sendUnread(ctx, u, room.Name, marker)
+	}
+}
+
+// sendUnread tells every session of u's account how much is unread in the room
+func (h *Hub) sendUnread(ctx context.Context, u *User, room string, marker *readMarker) {
+	unread := prot.UnreadMessage{Room: room, Unread: marker.unread, LastRead: marker.seq}
+	out, err := h.translator.MessageToBytes(ctx, InternalMessage{User: u, Message: prot.Message{Typ: "unread", Body: unread}})
+	if err != nil {
+		slog.Error("Unable to translate message to bytes.", "err", err)
+		return
+	}
+	for _, session := range h.sessionsOf(u) {
+		h.sendTo(ctx, session, out)
+	}
+}
+
+func (h *Hub) sendReadReceipt(ctx context.Context, to *User, room, username string, seq uint64) {
+	receipt := prot.ReadReceiptMessage{Room: room, Username: username, Seq: seq}
+	out, err := h.translator.MessageToBytes(ctx, InternalMessage{User: to, Message: prot.Message{Typ: "read", Body: receipt}})
+	if err != nil {
+		slog.Error("Unable to translate message to bytes.", "err", err)
+		return
+	}
+	h.sendTo(ctx, to, out)
+}
+
+// commandMarkRead moves the user's read marker in a room forward. Reading everything also clears their mentions there
+func (h *Hub) commandMarkRead(ctx context.Context, msg InternalMessage, body prot.CommandMessage) {
+	var req prot.MarkReadRequest
+	if len(body.Data) > 0 {
+		if err := json.Unmarshal(body.Data, &req); err != nil {
+			h.sendError(ctx, msg.User, "Unable to parse mark read request")
+			return
+		}
+	}
+	room, ok := h.memberRoom(ctx, msg.User, body.Target)
+	if !ok {
+		return
+	}
+	latest, err := h.latestSeq(ctx, room.Name)
+	if err != nil {
+		slog.Error("Unable to find the newest message", "room", room.Name, "error", err)
+		h.sendError(ctx, msg.User, fmt.Sprintf("Unable to mark %s read", room.Name))
+		return
+	}
+	seq := latest
+	if req.Seq != 0 {
+		seq = min(req.Seq, latest)
+	}
+	account := msg.User.identity.Account
+	marker, ok := h.reads[account][room.Name]
+	if !ok {
+		marker = h.setReadMarker(account, room.Name, 0)
+	}
+	moved := seq > marker.seq
+	if moved {
+		marker.seq = seq
+	}
+	unread, err := h.countUnread(ctx, account, room.Name, marker.seq)
+	if err != nil {
+		slog.Error("Unable to count unread messages", "room", room.Name, "error", err)
+		return
+	}
+	marker.unread = unread
+	h.sendUnread(ctx, msg.User, room.Name, marker)
+	if unread == 0 && h.mentions[account][room.Name] > 0 {
+		h.commandClearMentions(ctx, msg, prot.CommandMessage{Action: "ClearMentions", Target: room.Name})
+	}
+	if moved && room.ReadReceipts {
+		for _, u := range slices.Clone(room.Users) {
+			h.sendReadReceipt(ctx, u, room.Name, msg.User.username, marker.seq)
+		}
+	}
+}
+
+// commandSetReadReceipts turns read receipts on or off for a room. Like the topic only the owner and moderators can
+func (h *Hub) commandSetReadReceipts(ctx context.Context, msg InternalMessage, body prot.CommandMessage) {
+	var req prot.ReadReceiptsRequest
+	if err := json.Unmarshal(body.Data, &req); err != nil {
+		h.sendError(ctx, msg.User, "Unable to parse read receipts request")
+		return
+	}
+	room, ok := h.memberRoom(ctx, msg.User, body.Target)
+	if !ok {
+		return
+	}
+	if room.RoleOf(msg.User.identity.Account) == RoleMember {
+		h.sendErrorCode(ctx, msg.User, prot.ErrForbidden, fmt.Sprintf("Only the owner and moderators of %s can change read receipts", room.Name))
+		return
+	}
+	if room.ReadReceipts == req.Enabled {
+		return
+	}
+	room.ReadReceipts = req.Enabled
+	text := fmt.Sprintf("%s turned read receipts on", msg.User.username)
+	if !req.Enabled {
+		text = fmt.Sprintf("%s turned read receipts off", msg.User.username)
+	}
+	h.announce(ctx, room, text, msg.User.username)
+	for _, u := range slices.Clone(room.Users) {
+		h.sendCommandResponse(ctx, u, "SetReadReceipts", room.Name, prot.ReadReceiptsRequest{Enabled: room.ReadReceipts, By: msg.User.username})
+	}
+}
@@ -0,0 +1,133 @@
+package chatserver
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	prot "github.com/dylanmccormick/ws-chat/internal/protocol"
+)
+
+// chats leaves out everything but the chat messages
+func chats(msgs []prot.Message) []prot.Message {
+	found := []prot.Message{}
+	for _, m := range msgs {
+		if _, ok := m.Body.(prot.ChatMessage); ok {
+			found = append(found, m)
+		}
+	}
+	return found
+}
+
+func lastUnread(t *testing.T, msgs []prot.Message) prot.UnreadMessage {
+	t.Helper()
+	for i := len(msgs) - 1; i >= 0; i-- {
+		if body, ok := msgs[i].Body.(prot.UnreadMessage); ok {
+			return body
+		}
+	}
+	t.Fatalf("Expected an unread message. got=%+v", msgs)
+	return prot.UnreadMessage{}
+}
+
+func receipts(msgs []prot.Message) []prot.ReadReceiptMessage {
+	found := []prot.ReadReceiptMessage{}
+	for _, m := range msgs {
+		if body, ok := m.Body.(prot.ReadReceiptMessage); ok {
+			found = append(found, body)
+		}
+	}
+	return found
+}
+
+func TestUnreadCounts(t *testing.T) {
+	h, users := newTestHubWithUsers("alice", "bob")
+	alice, bob := users[0], users[1]
+	ctx := context.TODO()
+	chat := func(u *User, text string) {
+		h.handleChat(ctx, InternalMessage{User: u}, prot.ChatMessage{Message: text, Target: "lobby"})
+	}
+	markRead := func(u *User, seq uint64) {
+		data, _ := json.Marshal(prot.MarkReadRequest{Seq: seq})
+		h.handleCommand(ctx, InternalMessage{User: u}, prot.CommandMessage{Action: "MarkRead", Target: "lobby", Data: data})
+	}
+
+	chat(alice, "one")
+	chat(alice, "two")
+	chat(bob, "three")
+	if got := lastUnread(t, drainTestUser(t, bob)); got.Unread != 2 || got.LastRead != 0 {
+		t.Errorf("Expected bob to have 2 unread. got=%+v", got)
+	}
+	if got := lastUnread(t, drainTestUser(t, alice)); got.Unread != 1 {
+		t.Errorf("Expected alice's own messages not to count. got=%+v", got)
+	}
+
+	markRead(bob, 1)
+	if got := lastUnread(t, drainTestUser(t, bob)); got.Unread != 1 || got.LastRead != 1 {
+		t.Errorf("Expected bob to have read up to 1. got=%+v", got)
+	}
+	markRead(bob, 0)
+	if got := lastUnread(t, drainTestUser(t, bob)); got.Unread != 0 || got.LastRead != 3 {
+		t.Errorf("Expected bob to have read everything. got=%+v", got)
+	}
+	markRead(bob, 1)
+	if got := lastUnread(t, drainTestUser(t, bob)); got.LastRead != 3 {
+		t.Errorf("Read markers shouldn't go backwards. got=%+v", got)
+	}
+
+	// leaving and coming back picks up where the marker was
+	lobby, _ := h.roomManager.GetRoom("lobby")
+	h.roomManager.LeaveRoom(lobby, bob)
+	chat(alice, "four")
+	h.roomManager.AddUser(lobby, bob)
+	drainTestUser(t, bob)
+	h.joinedRoom(ctx, lobby, bob)
+	if got := lastUnread(t, drainTestUser(t, bob)); got.Unread != 1 || got.LastRead != 3 {
+		t.Errorf("Expected bob to have missed one message. got=%+v", got)
+	}
+}
+
+func TestReadReceipts(t *testing.T) {
+	h, users := newTestHubWithUsers("alice", "bob", "carol")
+	alice, bob, carol := users[0], users[1], users[2]
+	ctx := context.TODO()
+	lobby, _ := h.roomManager.GetRoom("lobby")
+	lobby.Moderators = map[string]bool{"alice": true}
+	setReceipts := func(u *User, enabled bool) {
+		data, _ := json.Marshal(prot.ReadReceiptsRequest{Enabled: enabled})
+		h.handleCommand(ctx, InternalMessage{User: u}, prot.CommandMessage{Action: "SetReadReceipts", Target: "lobby", Data: data})
+	}
+
+	h.handleChat(ctx, InternalMessage{User: alice}, prot.ChatMessage{Message: "hi", Target: "lobby"})
+	h.handleCommand(ctx, InternalMessage{User: bob}, prot.CommandMessage{Action: "MarkRead", Target: "lobby"})
+	if got := receipts(drainTestUser(t, alice)); len(got) != 0 {
+		t.Errorf("Rooms shouldn't send receipts unless they opt in. got=%+v", got)
+	}
+
+	setReceipts(carol, true)
+	if code := lastErrorCode(drainTestUser(t, carol)); code != prot.ErrForbidden {
+		t.Errorf("Expected members to be refused. got=%q", code)
+	}
+	setReceipts(alice, true)
+	if !lobby.ReadReceipts || !hasCommandResponse(drainTestUser(t, bob), "SetReadReceipts", "lobby") {
+		t.Fatalf("Expected read receipts to be turned on")
+	}
+
+	h.handleChat(ctx, InternalMessage{User: alice}, prot.ChatMessage{Message: "still there?", Target: "lobby"})
+	h.handleCommand(ctx, InternalMessage{User: bob}, prot.CommandMessage{Action: "MarkRead", Target: "lobby"})
+	got := receipts(drainTestUser(t, carol))
+	if len(got) != 1 || got[0].Username != "bob" || got[0].Seq != 3 {
+		t.Errorf("Expected a receipt for bob. got=%+v", got)
+	}
+
+	// someone joining is told how far everyone has read
+	dave := newTestUser("dave", 20)
+	dave.identity = Identity{Account: "dave", Method: "password"}
+	h.clients["dave"] = dave
+	h.roomManager.AddUser(lobby, dave)
+	h.joinedRoom(ctx, lobby, dave)
+	got = receipts(drainTestUser(t, dave))
+	if len(got) != 1 || got[0].Username != "bob" {
+		t.Errorf("Expected a receipt for everyone who has read something. got=%+v", got)
+	}
+}